@@ -0,0 +1,992 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+	"github.com/ewindisch/blocker/pkg/plugin"
+	"gopkg.in/yaml.v2"
+)
+
+// command is a subcommand of the blocker binary, e.g. `blocker purge`.  Most
+// talk to the running daemon over its admin socket.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"accept":          {"accept <name>: wait for a volume handed to this host and mount it", runAccept},
+	"batch":           {"batch [-state state] [-tag key:value]... [-all] [-parallelism n] [-json] <unmount|snapshot|verify|resize>: operate on many volumes at once", runBatch},
+	"estimate":        {"estimate [-o key=value]...: estimate what a volume created with the options would cost a month", runEstimate},
+	"export":          {"export [-full] <name>: export a volume's latest snapshot to S3, incrementally", runExport},
+	"events":          {"events [-json]: follow volume lifecycle events", runEvents},
+	"drain":           {"drain [-off]: refuse new mounts (or resume with -off)", runDrain},
+	"features":        {"features [-json]: list the feature flags, and whether each is on", runFeatures},
+	"fstab":           {"fstab [-systemd]: print fstab entries (or systemd mount units) for the mounted volumes", runFstab},
+	"history":         {"history <name>: show the recent operations on a volume", runHistory},
+	"lineage":         {"lineage <name>: show the volumes a volume was restored from, and restored to", runLineage},
+	"luks-restore":    {"luks-restore [-version id] [-confirm volume] <name>: restore an encrypted volume's LUKS header from its backup", runRestoreLUKSHeader},
+	"rotate-key":      {"rotate-key [-kms-key id [-rewrap]] [-confirm volume] <name>: rotate an encrypted volume's LUKS key, or finish rotating it", runRotateLUKSKey},
+	"maintenance":     {"maintenance [-off] [-drain] [-reason text] <name>: refuse mounts of a volume (or accept them again with -off)", runMaintenance},
+	"orphans":         {"orphans [-older-than duration] [-delete] [-json]: list (or delete) unattached volumes blocker created that nothing uses", runOrphans},
+	"prefetch":        {"prefetch <name>: attach a volume ahead of a container that will mount it", runPrefetch},
+	"purge":           {"purge [-older-than duration]: forget never-mounted volumes", runPurge},
+	"release":         {"release <name> <instance-id>: hand a volume off to another host", runRelease},
+	"refresh-copy":    {"refresh-copy <name>: snapshot a volume with replicate-to and replace its copy in the other zone now", runRefreshCopy},
+	"remove":          {"remove [-force] <name>: remove a volume as `docker volume rm` would (-force for pinned volumes)", runRemove},
+	"unmount":         {"unmount [-force] <name>: unmount and detach a volume, whoever is using it (-force for pinned volumes)", runUnmount},
+	"reconcile":       {"reconcile [-run] [-json]: show the latest reconciliation passes' drift, or run one now", runReconcile},
+	"replicate":       {"replicate [-count n] [-prefetch] [-json] <name>: snapshot a volume and register read-only replicas of it", runReplicate},
+	"report":          {"report [-json]: summarize the managed volumes for capacity and cost reviews", runReport},
+	"volumes":         {"volumes [-state state] [-tag key:value]... [-limit n] [-after name] [-json]: list volumes, filtered", runVolumes},
+	"validate-config": {"validate-config [-strict] [-q]: check the configuration file (see -config) and print the effective configuration", runValidateConfig},
+	"verify":          {"verify <name>: restore a volume's latest snapshot and check it", runVerify},
+	"resize":          {"resize <name>: grow a mounted volume's filesystem to fill its (enlarged) volume", runResize},
+	"resume":          {"resume [-force]: re-validate and thaw volumes after hibernation", runResume},
+	"suspend":         {"suspend: freeze mounted volumes before hibernation", runSuspend},
+	"snapshots":       {"snapshots <name>: list a volume's snapshots, newest first", runSnapshots},
+	"snapshot-group":  {"snapshot-group <group>: snapshot a group of volumes at the same instant", runSnapshotGroup},
+}
+
+// runCommand runs the named subcommand, returning the process exit code.
+func runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q.  Commands are:\n", args[0])
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "    %s\n", commands[name].usage)
+		}
+		return 2
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// adminRequest issues a request to the daemon's admin socket, returning the
+// response if it succeeded.
+func adminRequest(method string, path string, query url.Values) (*http.Response, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", plugin.AdminSocketFile)
+			},
+		},
+	}
+	u := url.URL{Scheme: "http", Host: "blocker", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := plugin.SignRequest(req); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e plugin.AdminErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Err == "" {
+			return nil, fmt.Errorf("Admin request failed: %v", resp.Status)
+		}
+		return nil, driver.WithCode(e.Code, errors.New(e.Err))
+	}
+	return resp, nil
+}
+
+// adminCall issues a request to the daemon's admin socket, decoding the JSON
+// reply into out.
+func adminCall(method string, path string, query url.Values, out interface{}) error {
+	resp, err := adminRequest(method, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func runPurge(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	olderThan := flags.Duration("older-than", 0, "only purge registrations older than this")
+	flags.Parse(args)
+
+	var resp plugin.AdminPurgeResponse
+	if err := adminCall("POST", "/purge",
+		url.Values{"older-than": {olderThan.String()}}, &resp); err != nil {
+		return err
+	}
+	for _, name := range resp.Purged {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func runValidateConfig(args []string) error {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	strict := flags.Bool("strict", false, "fail on warnings, too")
+	quiet := flags.Bool("q", false, "don't print the effective configuration")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return errors.New("Usage: blocker validate-config [-strict] [-q]")
+	}
+
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "warning: %v doesn't exist; the defaults apply.\n", configFile)
+	}
+	c, err := driver.LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	warnings := driver.CheckConfig(c)
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", w)
+	}
+	if !*quiet {
+		data, err := yaml.Marshal(c)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(data)
+	}
+	if *strict && len(warnings) > 0 {
+		return fmt.Errorf("%v has %v warning(s).", configFile, len(warnings))
+	}
+	return nil
+}
+
+func runFeatures(args []string) error {
+	flags := flag.NewFlagSet("features", flag.ExitOnError)
+	raw := flags.Bool("json", false, "print the flags as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return errors.New("Usage: blocker features [-json]")
+	}
+
+	type flagState struct {
+		driver.Feature
+		Enabled bool
+	}
+	var states []flagState
+	for _, f := range driver.Features() {
+		states = append(states, flagState{f, driver.FeatureEnabled(f.Name, nil)})
+	}
+	if *raw {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(states)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tENABLED\tDEFAULT\tSCOPE\tDESCRIPTION")
+	for _, s := range states {
+		scope := "daemon"
+		if s.PerVolume {
+			scope = "volume"
+		}
+		description := s.Description
+		if s.Experimental {
+			description = "(experimental) " + description
+		}
+		fmt.Fprintf(w, "%s\t%v\t%v\t%s\t%s\n", s.Name, s.Enabled, s.Default, scope, description)
+	}
+	return w.Flush()
+}
+
+// tagFlags collects repeated flags, like -tag and -o.
+type tagFlags []string
+
+func (t *tagFlags) String() string     { return strings.Join(*t, ",") }
+func (t *tagFlags) Set(s string) error { *t = append(*t, s); return nil }
+
+func runVolumes(args []string) error {
+	flags := flag.NewFlagSet("volumes", flag.ExitOnError)
+	state := flags.String("state", "", "only volumes in this state: registered, prefetched, or mounted")
+	var tags tagFlags
+	flags.Var(&tags, "tag", "only volumes with this EBS tag, as key:value or key (repeatable)")
+	limit := flags.Int("limit", 0, "list at most this many volumes")
+	after := flags.String("after", "", "list the volumes after this name (for the next page)")
+	raw := flags.Bool("json", false, "print the page as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return errors.New("Usage: blocker volumes [-state state] [-tag key:value]... [-limit n] [-after name] [-json]")
+	}
+
+	query := url.Values{"tag": tags}
+	if *state != "" {
+		query.Set("state", *state)
+	}
+	if *limit != 0 {
+		query.Set("limit", fmt.Sprint(*limit))
+	}
+	if *after != "" {
+		query.Set("after", *after)
+	}
+	var page driver.VolumePage
+	if err := adminCall("GET", "/volumes", query, &page); err != nil {
+		return err
+	}
+	if *raw {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(page)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVOLUME\tSTATE\tDEVICE\tMOUNTPOINT\tCREATED")
+	for _, v := range page.Volumes {
+		state := v.State
+		if v.Maintenance != "" {
+			state += " (maintenance)"
+		}
+		if v.Pinned {
+			state += " (pinned)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", v.Name, v.VolumeId, state,
+			v.Device, v.Mountpoint, v.Created.Format(time.RFC3339))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if page.Next != "" {
+		fmt.Printf("\nMore volumes follow; continue with -after %v.\n", page.Next)
+	}
+	return nil
+}
+
+func runSnapshots(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: blocker snapshots <name>")
+	}
+
+	var snapshots []driver.SnapshotInfo
+	if err := adminCall("GET", "/volumes/"+url.PathEscape(args[0])+"/snapshots",
+		nil, &snapshots); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SNAPSHOT\tVOLUME\tSTARTED\tSIZE\tSTATE\tDESCRIPTION")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%dGiB\t%s %s\t%s\n",
+			s.SnapshotId, s.VolumeId, s.StartTime.Format(time.RFC3339),
+			s.SizeGiB, s.State, s.Progress, s.Description)
+	}
+	return w.Flush()
+}
+
+func runReport(args []string) error {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	raw := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+
+	var report driver.Report
+	if err := adminCall("GET", "/report", nil, &report); err != nil {
+		return err
+	}
+	if *raw {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	fmt.Printf("%v volume(s), %v GiB in total; %v unattached, %v GiB.\n\n",
+		report.Volumes, report.TotalGiB, report.Unattached.Volumes, report.Unattached.TotalGiB)
+	var types []string
+	for t := range report.ByType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tVOLUMES\tSIZE")
+	for _, t := range types {
+		fmt.Fprintf(w, "%s\t%d\t%dGiB\n", t, report.ByType[t].Volumes, report.ByType[t].TotalGiB)
+	}
+	w.Flush()
+	fmt.Println()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVOLUME\tTYPE\tSIZE\tSTATE\tINSTANCE\tUSED")
+	for _, v := range report.Details {
+		used := "-"
+		if v.Mountpoint != "" {
+			used = fmt.Sprintf("%.1fGiB (%.0f%%)", v.UsedGiB, v.UsedPercent)
+		}
+		instance := v.InstanceId
+		if instance == "" {
+			instance = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%dGiB\t%s\t%s\t%s\n",
+			v.Name, v.VolumeId, v.Type, v.SizeGiB, v.State, instance, used)
+	}
+	return w.Flush()
+}
+
+func runSnapshotGroup(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: blocker snapshot-group <group>")
+	}
+
+	var snapshots []driver.GroupSnapshot
+	if err := adminCall("POST", "/snapshot-groups/"+url.PathEscape(args[0]),
+		nil, &snapshots); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVOLUME\tSNAPSHOT")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, s.VolumeId, s.SnapshotId)
+	}
+	return w.Flush()
+}
+
+func runHistory(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: blocker history <name>")
+	}
+
+	var history []driver.HistoryEntry
+	if err := adminCall("GET", "/volumes/"+url.PathEscape(args[0])+"/history",
+		nil, &history); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tOPERATION\tTOOK\tMOUNTPOINT\tCALLER\tREQUEST\tERROR")
+	for _, e := range history {
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%s\t%s\t%s\n",
+			e.Time.Format(time.RFC3339), e.Op, e.Duration.Round(time.Millisecond),
+			e.Mountpoint, e.Caller, e.RequestId, e.Err)
+	}
+	return w.Flush()
+}
+
+func runLineage(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: blocker lineage <name>")
+	}
+
+	var lineage driver.Lineage
+	if err := adminCall("GET", "/volumes/"+url.PathEscape(args[0])+"/lineage",
+		nil, &lineage); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RELATION\tVOLUME\tNAME\tFROM SNAPSHOT\tCREATED")
+	row := func(relation string, n driver.LineageNode) {
+		created := "-"
+		if n.Deleted {
+			created = "(deleted)"
+		} else if !n.Created.IsZero() {
+			created = n.Created.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			relation, n.VolumeId, n.Name, n.SnapshotId, created)
+	}
+	for i := len(lineage.Ancestors) - 1; i >= 0; i-- {
+		row(fmt.Sprintf("ancestor %d", i+1), lineage.Ancestors[i])
+	}
+	row("self", lineage.Volume)
+	for _, n := range lineage.Children {
+		row("child", n)
+	}
+	return w.Flush()
+}
+
+func runDrain(args []string) error {
+	flags := flag.NewFlagSet("drain", flag.ExitOnError)
+	off := flags.Bool("off", false, "stop draining and accept new mounts again")
+	flags.Parse(args)
+
+	method := "POST"
+	if *off {
+		method = "DELETE"
+	}
+	var resp plugin.AdminDrainResponse
+	if err := adminCall(method, "/drain", nil, &resp); err != nil {
+		return err
+	}
+	if resp.Draining {
+		fmt.Println("Draining: new mounts are refused.")
+	} else {
+		fmt.Println("Not draining: new mounts are accepted.")
+	}
+	return nil
+}
+
+func runMaintenance(args []string) error {
+	flags := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	off := flags.Bool("off", false, "end maintenance and accept mounts again")
+	drain := flags.Bool("drain", false, "unmount the volume now, whoever is using it")
+	reason := flags.String("reason", "", "why the volume is under maintenance")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: blocker maintenance [-off] [-drain] [-reason text] <name>")
+	}
+	name := flags.Arg(0)
+
+	method := "POST"
+	if *off {
+		method = "DELETE"
+	}
+	query := url.Values{"reason": {*reason}}
+	if *drain {
+		query.Set("drain", "true")
+	}
+	if err := adminCall(method, "/volumes/"+url.PathEscape(name)+"/maintenance",
+		query, nil); err != nil {
+		return err
+	}
+	if *off {
+		fmt.Printf("%v is no longer under maintenance.\n", name)
+	} else {
+		fmt.Printf("%v is under maintenance: mounts are refused.\n", name)
+	}
+	return nil
+}
+
+func runResize(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: blocker resize <name>")
+	}
+
+	if err := adminCall("POST", "/volumes/"+url.PathEscape(args[0])+"/resize",
+		nil, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Grew the filesystem of %v.\n", args[0])
+	return nil
+}
+
+func runRelease(args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: blocker release <name> <instance-id>")
+	}
+
+	if err := adminCall("POST", "/volumes/"+url.PathEscape(args[0])+"/release",
+		url.Values{"to": {args[1]}}, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Released %v to %v.\n", args[0], args[1])
+	return nil
+}
+
+func runAccept(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: blocker accept <name>")
+	}
+
+	var resp plugin.AdminHandoffResponse
+	if err := adminCall("POST", "/volumes/"+url.PathEscape(args[0])+"/accept",
+		nil, &resp); err != nil {
+		return err
+	}
+	fmt.Printf("Mounted %v at %v.\n", args[0], resp.Mountpoint)
+	return nil
+}
+
+func runPrefetch(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: blocker prefetch <name>")
+	}
+
+	var resp plugin.AdminPrefetchResponse
+	if err := adminCall("POST", "/volumes/"+url.PathEscape(args[0])+"/prefetch",
+		nil, &resp); err != nil {
+		return err
+	}
+	fmt.Printf("Attached %v at %v.\n", args[0], resp.Device)
+	return nil
+}
+
+func runReplicate(args []string) error {
+	flags := flag.NewFlagSet("replicate", flag.ExitOnError)
+	count := flags.Int("count", 1, "how many replicas to make")
+	prefetch := flags.Bool("prefetch", false, "attach the replicas now, rather than at their mounts")
+	raw := flags.Bool("json", false, "print the replicas as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: blocker replicate [-count n] [-prefetch] [-json] <name>")
+	}
+
+	query := url.Values{"count": {fmt.Sprint(*count)}}
+	if *prefetch {
+		query.Set("prefetch", "true")
+	}
+	var set driver.ReplicaSet
+	if err := adminCall("POST", "/volumes/"+url.PathEscape(flags.Arg(0))+"/replicas",
+		query, &set); err != nil {
+		return err
+	}
+	if *raw {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(set)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDEVICE\tSTATUS")
+	failed := 0
+	for _, r := range set.Replicas {
+		status := "ready"
+		if r.Error != "" {
+			status = "failed: " + r.Error
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, r.Device, status)
+	}
+	w.Flush()
+	fmt.Printf("\nReplicas of %v (%v) are of snapshot %v; other hosts can mount copies with -o snapshot=%v.\n",
+		set.Source, set.VolumeId, set.SnapshotId, set.SnapshotId)
+	if failed > 0 {
+		return fmt.Errorf("%v replica(s) couldn't be made.", failed)
+	}
+	return nil
+}
+
+func runReconcile(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	run := flags.Bool("run", false, "run a reconciliation pass now")
+	raw := flags.Bool("json", false, "print the reports as JSON")
+	flags.Parse(args)
+
+	var reports []driver.ReconcileReport
+	if *run {
+		var r driver.ReconcileReport
+		if err := adminCall("POST", "/reconcile", nil, &r); err != nil {
+			return err
+		}
+		reports = append(reports, r)
+	} else if err := adminCall("GET", "/reconcile", nil, &reports); err != nil {
+		return err
+	}
+	if *raw {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tPASS\tCHECKED\tADOPTED\tDRIFT\tRESULT")
+	for _, r := range reports {
+		result := "clean"
+		switch {
+		case r.Error != "":
+			result = "failed: " + r.Error
+		case len(r.Drift) > 0 && r.Rebooted:
+			result = "drift (after a restart)"
+		case len(r.Drift) > 0:
+			result = "drift"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n", r.Started.Local().Format(time.RFC3339), r.Pass,
+			r.Checked, len(r.Adopted), len(r.Drift), result)
+	}
+	w.Flush()
+
+	// The drift itself, oldest pass first.
+	var drift []string
+	for i := len(reports) - 1; i >= 0; i-- {
+		for _, found := range reports[i].Drift {
+			line := fmt.Sprintf("%v %v: %v (%v); %v", reports[i].Started.Local().Format(time.RFC3339),
+				found.Name, found.Kind, found.Detail, found.Action)
+			if found.Error != "" {
+				line += " (failed: " + found.Error + ")"
+			}
+			drift = append(drift, line)
+		}
+	}
+	if len(drift) > 0 {
+		fmt.Println()
+		for _, line := range drift {
+			fmt.Println(line)
+		}
+	}
+	return nil
+}
+
+func runFstab(args []string) error {
+	flags := flag.NewFlagSet("fstab", flag.ExitOnError)
+	systemd := flags.Bool("systemd", false, "print systemd mount units instead")
+	flags.Parse(args)
+
+	format := "fstab"
+	if *systemd {
+		format = "systemd"
+	}
+	resp, err := adminRequest("GET", "/fstab", url.Values{"format": {format}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func runEvents(args []string) error {
+	flags := flag.NewFlagSet("events", flag.ExitOnError)
+	raw := flags.Bool("json", false, "print each event as JSON")
+	flags.Parse(args)
+
+	resp, err := adminRequest("GET", "/events", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		data := strings.TrimPrefix(line, "data: ")
+		if *raw {
+			fmt.Println(data)
+			continue
+		}
+		var e driver.VolumeEvent
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return err
+		}
+		fmt.Printf("%s %-9s %s %s %s %s%s\n", e.Time.Format(time.RFC3339), e.Type,
+			e.Name, e.VolumeId, e.Device, e.Mountpoint, e.Err)
+	}
+	return scanner.Err()
+}
+
+func runUnmount(args []string) error {
+	flags := flag.NewFlagSet("unmount", flag.ExitOnError)
+	force := flags.Bool("force", false, "unmount the volume even if it's pinned")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: blocker unmount [-force] <name>")
+	}
+	name := flags.Arg(0)
+
+	query := url.Values{}
+	if *force {
+		query.Set("force", "true")
+	}
+	if err := adminCall("POST", "/volumes/"+url.PathEscape(name)+"/unmount", query, nil); err != nil {
+		return err
+	}
+	fmt.Printf("%v is unmounted and detached.\n", name)
+	return nil
+}
+
+func runRemove(args []string) error {
+	flags := flag.NewFlagSet("remove", flag.ExitOnError)
+	force := flags.Bool("force", false, "remove the volume even if it's pinned")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: blocker remove [-force] <name>")
+	}
+	name := flags.Arg(0)
+
+	query := url.Values{}
+	if *force {
+		query.Set("force", "true")
+	}
+	if err := adminCall("DELETE", "/volumes/"+url.PathEscape(name), query, nil); err != nil {
+		return err
+	}
+	fmt.Printf("%v is removed.\n", name)
+	return nil
+}
+
+func runRefreshCopy(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: blocker refresh-copy <name>")
+	}
+	if err := adminCall("POST", "/volumes/"+url.PathEscape(args[0])+"/copy", nil, nil); err != nil {
+		return err
+	}
+	fmt.Printf("The copy of %v is up to date.\n", args[0])
+	return nil
+}
+
+func runVerify(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: blocker verify <name>")
+	}
+
+	var result driver.VerifyResult
+	if err := adminCall("POST", "/volumes/"+url.PathEscape(args[0])+"/verify",
+		nil, &result); err != nil {
+		return err
+	}
+	fmt.Print(result.Output)
+	if !result.Passed {
+		return fmt.Errorf("Snapshot %v of %v failed verification: %v",
+			result.SnapshotId, result.Volume, result.Err)
+	}
+	fmt.Printf("Snapshot %v of %v (taken %v) passed verification.\n",
+		result.SnapshotId, result.Volume, result.StartTime.Format(time.RFC3339))
+	return nil
+}
+
+func runBatch(args []string) error {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	state := flags.String("state", "", "only volumes in this state: registered, prefetched, or mounted")
+	var tags tagFlags
+	flags.Var(&tags, "tag", "only volumes with this EBS tag, as key:value or key (repeatable)")
+	all := flags.Bool("all", false, "operate on every volume, unfiltered")
+	parallelism := flags.Int("parallelism", 0, "operate on this many volumes at once (default: batch.parallelism)")
+	raw := flags.Bool("json", false, "print the result as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: blocker batch [-state state] [-tag key:value]... [-all] [-parallelism n] [-json] <unmount|snapshot|verify|resize>")
+	}
+	if *state == "" && len(tags) == 0 && !*all {
+		return errors.New("Give -state or -tag to choose the volumes, or -all for every volume.")
+	}
+
+	query := url.Values{"tag": tags}
+	if *state != "" {
+		query.Set("state", *state)
+	}
+	if *parallelism != 0 {
+		query.Set("parallelism", fmt.Sprint(*parallelism))
+	}
+	var result driver.BatchResult
+	if err := adminCall("POST", "/batch/"+url.PathEscape(flags.Arg(0)), query, &result); err != nil {
+		return err
+	}
+	if *raw {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVOLUME\tOUTCOME\tTOOK\tDETAIL")
+	for _, v := range result.Volumes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", v.Name, v.VolumeId, v.Outcome, v.Duration, v.Detail)
+	}
+	w.Flush()
+	fmt.Printf("\n%v: %v succeeded, %v failed, %v skipped.\n",
+		result.Op, result.Succeeded, result.Failed, result.Skipped)
+	if result.Failed > 0 {
+		return fmt.Errorf("%v volume(s) failed.", result.Failed)
+	}
+	return nil
+}
+
+func runOrphans(args []string) error {
+	flags := flag.NewFlagSet("orphans", flag.ExitOnError)
+	olderThan := flags.Duration("older-than", 24*time.Hour, "only volumes created longer ago than this")
+	remove := flags.Bool("delete", false, "delete the volumes, archiving any that may hold data first")
+	raw := flags.Bool("json", false, "print the volumes as JSON")
+	flags.Parse(args)
+
+	method := "GET"
+	if *remove {
+		method = "DELETE"
+	}
+	var orphans []driver.Orphan
+	if err := adminCall(method, "/orphans",
+		url.Values{"older-than": {olderThan.String()}}, &orphans); err != nil {
+		return err
+	}
+	if *raw {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(orphans)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME\tNAME\tKIND\tTYPE\tSIZE\tCREATED\tMONTHLY\tSTATUS")
+	var total float64
+	failed := 0
+	for _, o := range orphans {
+		status := ""
+		if o.Deleted {
+			status = "deleted"
+		} else if o.Error != "" {
+			status = "failed: " + o.Error
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%dGiB\t%s\t$%.2f\t%s\n", o.VolumeId, o.Name, o.Kind, o.Type,
+			o.SizeGiB, o.Created.Local().Format(time.RFC3339), o.MonthlyCost, status)
+		total += o.MonthlyCost
+	}
+	w.Flush()
+	fmt.Printf("\n%v orphaned volume(s), costing $%.2f a month.\n", len(orphans), total)
+	if failed > 0 {
+		return fmt.Errorf("%v volume(s) couldn't be deleted.", failed)
+	}
+	return nil
+}
+
+func runEstimate(args []string) error {
+	flags := flag.NewFlagSet("estimate", flag.ExitOnError)
+	var opts tagFlags
+	flags.Var(&opts, "o", "a volume option, as for docker volume create (may be repeated)")
+	flags.Parse(args)
+	if flags.NArg() != 0 || len(opts) == 0 {
+		return errors.New("Usage: blocker estimate [-o key=value]...")
+	}
+
+	query := url.Values{}
+	for _, o := range opts {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Invalid option %q: expected key=value.", o)
+		}
+		query.Set(kv[0], kv[1])
+	}
+	var e driver.CostEstimate
+	if err := adminCall("GET", "/estimate", query, &e); err != nil {
+		return err
+	}
+	fmt.Printf("%v\n", e)
+	fmt.Printf("  storage $%.2f, IOPS $%.2f, throughput $%.2f\n", e.StorageCost, e.IopsCost, e.ThroughputCost)
+	if e.Ceiling != 0 {
+		verdict := "within"
+		if e.MonthlyCost > e.Ceiling {
+			verdict = "over"
+		}
+		fmt.Printf("  %v the ceiling of $%.2f a month\n", verdict, e.Ceiling)
+	}
+	return nil
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	full := flags.Bool("full", false, "export every block, not just those changed since the last export")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: blocker export [-full] <name>")
+	}
+
+	var query url.Values
+	if *full {
+		query = url.Values{"full": {"true"}}
+	}
+	var result driver.ExportResult
+	if err := adminCall("POST", "/volumes/"+url.PathEscape(flags.Arg(0))+"/export",
+		query, &result); err != nil {
+		return err
+	}
+	kind := "full"
+	if result.BaseSnapshotId != "" {
+		kind = "changes since " + result.BaseSnapshotId
+	}
+	fmt.Printf("Exported snapshot %v of %v (%v) to s3://%v/%v: %v blocks, %v bytes.\n",
+		result.SnapshotId, result.Volume, kind, result.Bucket, result.DataKey,
+		result.Blocks, result.Bytes)
+	return nil
+}
+
+func runRestoreLUKSHeader(args []string) error {
+	flags := flag.NewFlagSet("luks-restore", flag.ExitOnError)
+	version := flags.String("version", "", "restore this S3 object version of the backup, not the latest")
+	confirm := flags.String("confirm", "", "the volume's ID or name, to confirm the restore in strict mode")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: blocker luks-restore [-version id] [-confirm volume] <name>")
+	}
+
+	query := url.Values{}
+	if *version != "" {
+		query.Set("version", *version)
+	}
+	if *confirm != "" {
+		query.Set("confirm", *confirm)
+	}
+	if err := adminCall("POST", "/volumes/"+url.PathEscape(flags.Arg(0))+"/luks-header/restore",
+		query, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Restored the LUKS header of %v.\n", flags.Arg(0))
+	return nil
+}
+
+func runRotateLUKSKey(args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	kmsKey := flags.String("kms-key", "", "re-encrypt the key's Secrets Manager secret under this KMS key")
+	rewrap := flags.Bool("rewrap", false, "only re-encrypt the current key under -kms-key, without rotating it")
+	confirm := flags.String("confirm", "", "the volume's ID or name, to confirm the rotation in strict mode")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: blocker rotate-key [-kms-key id [-rewrap]] [-confirm volume] <name>")
+	}
+
+	query := url.Values{}
+	if *kmsKey != "" {
+		query.Set("kms-key", *kmsKey)
+	}
+	if *rewrap {
+		query.Set("rewrap", "true")
+	}
+	if *confirm != "" {
+		query.Set("confirm", *confirm)
+	}
+	if err := adminCall("POST", "/volumes/"+url.PathEscape(flags.Arg(0))+"/luks-key/rotate",
+		query, nil); err != nil {
+		return err
+	}
+	if *rewrap {
+		fmt.Printf("Re-encrypted the LUKS key of %v under %v.\n", flags.Arg(0), *kmsKey)
+	} else {
+		fmt.Printf("Rotated the LUKS key of %v.\n", flags.Arg(0))
+	}
+	return nil
+}
+
+func runSuspend(args []string) error {
+	var resp plugin.AdminSuspendResponse
+	if err := adminCall("POST", "/suspend", nil, &resp); err != nil {
+		return err
+	}
+	for _, name := range resp.Volumes {
+		fmt.Printf("Froze %v.\n", name)
+	}
+	return nil
+}
+
+func runResume(args []string) error {
+	flags := flag.NewFlagSet("resume", flag.ExitOnError)
+	force := flags.Bool("force", false, "thaw volumes even if their devices have changed")
+	flags.Parse(args)
+
+	var resp plugin.AdminSuspendResponse
+	if err := adminCall("POST", "/resume",
+		url.Values{"force": {fmt.Sprint(*force)}}, &resp); err != nil {
+		return err
+	}
+	for _, name := range resp.Volumes {
+		fmt.Printf("Thawed %v.\n", name)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+	"github.com/ewindisch/blocker/pkg/plugin"
+)
+
+// configFile is the configuration file, from -config.
+var configFile string
+
+func main() {
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	flag.StringVar(&configFile, "config", driver.DefaultConfigFile, "configuration file")
+	var ebsOpts driver.Options
+	flag.BoolVar(&ebsOpts.NoMetadata, "no-metadata",
+		os.Getenv("BLOCKER_NO_METADATA") != "",
+		"don't query the EC2 metadata service; requires -instance-id, -region, and -availability-zone")
+	flag.StringVar(&ebsOpts.InstanceId, "instance-id",
+		os.Getenv("BLOCKER_INSTANCE_ID"), "EC2 instance ID (default: from metadata)")
+	flag.StringVar(&ebsOpts.Region, "region",
+		os.Getenv("BLOCKER_REGION"), "AWS region (default: from metadata)")
+	flag.StringVar(&ebsOpts.AvailabilityZone, "availability-zone",
+		os.Getenv("BLOCKER_AVAILABILITY_ZONE"), "availability zone (default: from metadata)")
+	flag.StringVar(&ebsOpts.Endpoint, "ec2-endpoint",
+		os.Getenv("BLOCKER_EC2_ENDPOINT"), "EC2 API endpoint URL (e.g. for LocalStack)")
+	flag.BoolVar(&ebsOpts.IMDSIPv6, "imds-ipv6",
+		os.Getenv("BLOCKER_IMDS_IPV6") != "",
+		"reach the EC2 metadata service over IPv6")
+	flag.BoolVar(&ebsOpts.DualStack, "dual-stack",
+		os.Getenv("BLOCKER_DUAL_STACK") != "",
+		"use dual-stack (IPv4 and IPv6) AWS API endpoints")
+	flag.BoolVar(&ebsOpts.RecoverState, "recover-state",
+		os.Getenv("BLOCKER_RECOVER_STATE") != "",
+		"start afresh if the state file is corrupt, rather than refusing to start")
+	flag.StringVar(&ebsOpts.AssumeRole, "assume-role",
+		os.Getenv("BLOCKER_ASSUME_ROLE"), "ARN of an IAM role to assume for AWS calls")
+	flag.StringVar(&ebsOpts.CredentialsFile, "credentials-file",
+		os.Getenv("BLOCKER_CREDENTIALS_FILE"),
+		"shared credentials file to read AWS credentials from, re-read when it changes")
+	backend := flag.String("driver", os.Getenv("BLOCKER_DRIVER"),
+		"volume backend: ebs (the default) or gce")
+	project := flag.String("project", os.Getenv("BLOCKER_PROJECT"),
+		"GCE project, with -driver=gce (default: from metadata)")
+	logFormat := flag.String("log-format", os.Getenv("BLOCKER_LOG_FORMAT"),
+		"log format: text (the default) or json")
+	replace := flag.Bool("replace", os.Getenv("BLOCKER_REPLACE") != "",
+		"stop any blocker daemon already running, and take over from it")
+	var statePoll, stateWait, deviceWait, snapshotWait time.Duration
+	flag.DurationVar(&statePoll, "state-poll", envDuration("BLOCKER_STATE_POLL"),
+		"longest interval between polls of EBS while waiting (default: timeouts.state_poll)")
+	flag.DurationVar(&stateWait, "state-wait", envDuration("BLOCKER_STATE_WAIT"),
+		"how long to wait for attaches and detaches (default: timeouts.state_wait)")
+	flag.DurationVar(&deviceWait, "device-wait", envDuration("BLOCKER_DEVICE_WAIT"),
+		"how long to wait for an attached volume's device (default: timeouts.device_wait)")
+	flag.DurationVar(&snapshotWait, "snapshot-wait", envDuration("BLOCKER_SNAPSHOT_WAIT"),
+		"how long to wait for snapshots and copies (default: timeouts.snapshot_wait)")
+	flag.Parse()
+	driver.OverrideTimeouts(driver.TimeoutConfig{
+		StatePoll:    driver.Duration(statePoll),
+		StateWait:    driver.Duration(stateWait),
+		DeviceWait:   driver.Duration(deviceWait),
+		SnapshotWait: driver.Duration(snapshotWait),
+	})
+
+	if err := driver.SetLogFormat(*logFormat); err != nil {
+		driver.LogError("%s\n", err)
+		os.Exit(2)
+	}
+
+	if *showVersion {
+		fmt.Println(driver.CurrentBuildInfo())
+		return
+	}
+
+	c, err := driver.LoadConfig(configFile)
+	if err != nil && flag.Arg(0) == "validate-config" {
+		// It reports the problem itself.
+		os.Exit(runCommand(flag.Args()))
+	} else if err != nil {
+		driver.LogError("Failed to load configuration: %s.\n", err)
+		os.Exit(1)
+	}
+	driver.SetConfig(c)
+
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	driver.Log("blocker: starting up...\n")
+	driver.Log("%v\n", driver.CurrentBuildInfo())
+
+	// Make sure we're the only daemon, before touching any state.
+	if err := driver.LockDaemon(*replace); err != nil {
+		driver.LogError("%s\n", err)
+		os.Exit(1)
+	}
+
+	// Manufacture sockets for communication with Docker, and another for
+	// administrative requests.  Docker's requests wait until we're ready.
+	discovery := driver.GetConfig().Discovery
+	var listeners []net.Listener
+	for _, path := range discovery.Sockets {
+		l, err := plugin.Listen(path, *replace)
+		if err != nil {
+			driver.LogError("Failed to listen on socket %s: %s\n", path, err)
+			os.Exit(1)
+		}
+		defer l.Close()
+		listeners = append(listeners, l)
+	}
+	al, err := plugin.Listen(plugin.AdminSocketFile, *replace)
+	if err != nil {
+		driver.LogError("Failed to listen on socket %s: %s\n", plugin.AdminSocketFile, err)
+		os.Exit(1)
+	}
+	defer al.Close()
+	for _, path := range discovery.SpecFiles {
+		if err := plugin.WriteSpecFile(path, discovery.Sockets[0]); err != nil {
+			driver.LogError("Failed to write plugin spec file %s: %s\n", path, err)
+			os.Exit(1)
+		}
+	}
+
+	d, err := newDriver(*backend, ebsOpts, *project)
+	if err != nil {
+		driver.LogError("Failed to create a %v driver: %s.\n", *backend, err)
+		os.Exit(1)
+	}
+
+	// Make a channel that signals program exit.
+	exit := make(chan bool, len(listeners)+1)
+
+	// Now listen for HTTP calls from Docker.  Once shutdown has begun,
+	// Serve returns ErrServerClosed; it's the signal handler that exits,
+	// after the driver has shut down too.
+	srv := plugin.NewServer(d)
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			err := srv.Serve(l)
+			if err == http.ErrServerClosed {
+				return
+			}
+			driver.LogError("HTTP server error: %s.\n", err)
+			exit <- true
+		}(l)
+	}
+	driver.Log("Ready to go; listening on socket %s...\n",
+		strings.Join(discovery.Sockets, ", "))
+
+	// Serve administrative requests on a separate socket.
+	adminSrv := plugin.NewAdminServer(d)
+	go func() {
+		err := adminSrv.Serve(al)
+		if err != nil && err != http.ErrServerClosed {
+			driver.LogError("Admin HTTP server error: %s.\n", err)
+		}
+	}()
+
+	// Listen to important OS signals, so we trigger exit cleanly.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			// SIGHUP reloads the configuration without disturbing anything
+			// that's mounted.
+			if sig == syscall.SIGHUP {
+				driver.Log("Caught signal %s: reloading configuration.\n", sig)
+				driver.ReloadConfig(configFile)
+				continue
+			}
+
+			driver.Log("Caught signal %s: shutting down.\n", sig)
+			plugin.Shutdown(srv, adminSrv)
+			if s, ok := d.(shutdowner); ok {
+				s.Shutdown(driver.WithRequestId(context.Background(), "shutdown"))
+			}
+			exit <- true
+			return
+		}
+	}()
+
+	// Block until the program exits.
+	<-exit
+}
+
+// envDuration reads a flag's default duration from the environment; unset
+// (or unparseable) is zero.
+func envDuration(name string) time.Duration {
+	d, _ := time.ParseDuration(os.Getenv(name))
+	return d
+}
+
+// shutdowner is implemented by drivers with cleanup to do at exit.
+type shutdowner interface {
+	Shutdown(ctx context.Context)
+}
+
+// newDriver makes the driver for the chosen backend.  For GCE, the instance
+// and availability zone flags give the instance name and zone.
+func newDriver(backend string, ebsOpts driver.Options, project string) (plugin.VolumeDriver, error) {
+	switch backend {
+	case "", "ebs":
+		return driver.NewEbsVolumeDriver(ebsOpts)
+	case "gce":
+		return driver.NewGceVolumeDriver(driver.GceOptions{
+			NoMetadata:   ebsOpts.NoMetadata,
+			Project:      project,
+			Zone:         ebsOpts.AvailabilityZone,
+			Instance:     ebsOpts.InstanceId,
+			RecoverState: ebsOpts.RecoverState,
+		})
+	case "cinder":
+		return nil, errors.New("OpenStack Cinder isn't supported yet.")
+	}
+	return nil, fmt.Errorf("Unknown driver %q; expected ebs or gce.", backend)
+}
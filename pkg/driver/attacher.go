@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Attacher connects volumes to this host as block devices.  EBS is the only
+// backend today (see ebsAttacher), but mount handling goes through this
+// interface alone, so that other backends can be added, and mount handling
+// tested with a fake.
+type Attacher interface {
+	// Attach starts attaching a volume, returning the device name it's
+	// being attached as.  This may not be the name the device ends up with
+	// locally; see ResolveDevice.
+	Attach(ctx context.Context, id string) (string, error)
+	// Detach starts detaching a volume from this host.
+	Detach(ctx context.Context, id string) error
+	// Wait waits until a volume is attached to this host or, if attached is
+	// false, until it's attached nowhere.
+	Wait(ctx context.Context, id string, attached bool) error
+	// ResolveDevice finds the local block device for an attached volume,
+	// given the device name it was attached as.
+	ResolveDevice(ctx context.Context, id string, dev string) (string, error)
+}
+
+// attachVolume attaches a volume to this host, once any detach still under
+// way has finished, returning its local device.
+func (d *EbsVolumeDriver) attachVolume(ctx context.Context, id string) (string, error) {
+	if err := d.attacher.Wait(ctx, id, false); err != nil {
+		return "", err
+	}
+	start := time.Now()
+	dev, err := d.attacher.Attach(ctx, id)
+	if err != nil {
+		return "", d.keyError(ctx, "attached", id, "", err)
+	}
+	// Don't leave the volume attaching (or attached) here if we give up on
+	// it, where the next mount would wait on it in vain; not even if the
+	// request was cancelled.
+	cleanup := context.WithoutCancel(ctx)
+	if err := d.attacher.Wait(ctx, id, true); err != nil {
+		d.detachVolume(cleanup, id)
+		return "", d.keyError(ctx, "attached", id, "", err)
+	}
+
+	// Finally, the attach is complete.
+	LogCtx(ctx, "\tAttached volume %v to %v:%v.\n", id, d.awsInstanceId, dev)
+	local, err := d.attacher.ResolveDevice(ctx, id, dev)
+	if err != nil {
+		d.detachVolume(cleanup, id)
+		return "", err
+	}
+	if local != dev {
+		LogCtx(ctx, "\tLocal device name is %v\n", local)
+	}
+	ObserveDuration(time.Since(start), "blocker_attach_duration_seconds")
+	publishEvent(ctx, VolumeEvent{Type: eventAttached, VolumeId: id, Device: local})
+	return local, nil
+}
+
+// detachVolume starts detaching a volume from this host.  Any LUKS container
+// opened on it, and anything else stacked on it, is removed first.
+func (d *EbsVolumeDriver) detachVolume(ctx context.Context, id string) error {
+	if err := teardownStack(ctx, id); err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := d.attacher.Detach(ctx, id); err != nil {
+		return err
+	}
+	go d.timeDetach(context.WithoutCancel(ctx), id, start)
+
+	LogCtx(ctx, "\tDetached volume %v from %v.\n", id, d.awsInstanceId)
+	publishEvent(ctx, VolumeEvent{Type: eventDetached, VolumeId: id})
+	return nil
+}
+
+// timeDetach watches, quietly, for a detach begun at start to finish, to
+// record how long it took.
+func (d *EbsVolumeDriver) timeDetach(ctx context.Context, id string, start time.Time) {
+	timeouts := GetConfig().Timeouts
+	for time.Since(start) < time.Duration(timeouts.StateWait) {
+		if err := sleep(ctx, time.Duration(timeouts.StatePoll)); err != nil {
+			return
+		}
+		vol, err := d.describeVolume(ctx, id)
+		if err != nil {
+			return
+		}
+		if aws.StringValue(vol.State) != ec2.VolumeStateInUse || len(vol.Attachments) == 0 {
+			ObserveDuration(time.Since(start), "blocker_detach_duration_seconds")
+			return
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package driver
+
+import (
+	"encoding/hex"
+	"syscall"
+)
+
+// currentBootId identifies this boot by when it was, or is "" if that isn't
+// known.
+func currentBootId() string {
+	boottime, err := syscall.Sysctl("kern.boottime")
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString([]byte(boottime))
+}
@@ -0,0 +1,13 @@
+package driver
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// currentBootId is the kernel's random ID for this boot, or "" if it isn't
+// known.
+func currentBootId() string {
+	id, _ := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	return strings.TrimSpace(string(id))
+}
@@ -0,0 +1,1030 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultConfigFile is read at startup and again whenever the daemon receives
+// SIGHUP.  It is optional; without it, built-in defaults are used.
+const DefaultConfigFile = "/etc/blocker/blocker.yaml"
+
+// Config holds the daemon's tunable settings.  Everything in here may change
+// at runtime via a reload, so code should fetch it with GetConfig() at the
+// point of use rather than caching values.
+type Config struct {
+	// LogLevel is one of debug, info, warn, or error.
+	LogLevel string `yaml:"log_level"`
+
+	// Namespace, if set, scopes this daemon's tag lookups and the volumes
+	// and snapshots it creates (via a blocker:namespace tag), so that several
+	// Docker clusters can share one AWS account.
+	Namespace string `yaml:"namespace"`
+
+	// AWS controls how our AWS calls identify themselves.
+	AWS AWSConfig `yaml:"aws"`
+
+	// DefaultOptions are merged beneath the options supplied to each Create.
+	DefaultOptions map[string]string `yaml:"default_options"`
+
+	// Profiles are named sets of options, chosen with the profile option and
+	// merged between the defaults and the options supplied to Create.
+	Profiles map[string]map[string]string `yaml:"profiles"`
+
+	// Classes are named kinds of storage, chosen with the class option, each
+	// with options for any of the backends (ebs or gce), so that the same
+	// class can be asked for whichever driver is in use.  The backend's
+	// options are merged between the defaults and the profile's.
+	Classes map[string]map[string]map[string]string `yaml:"classes"`
+
+	// Features turns feature flags on or off for the whole daemon (see
+	// RegisterFeature); those not listed keep their defaults.
+	Features map[string]bool `yaml:"features"`
+
+	// MetricTags are the keys of EBS tags whose values label each volume's
+	// metrics and log fields, e.g. team and service (see tagLabels).
+	MetricTags []string `yaml:"metric_tags"`
+
+	// ReadOnly mounts every volume read-only, and refuses anything which
+	// would change or delete a volume (see readOnlyMode).
+	ReadOnly bool `yaml:"read_only"`
+
+	// Strict refuses anything which could destroy a volume's data unless
+	// the volume was created with a confirm option naming it (see
+	// strictMode).
+	Strict bool `yaml:"strict"`
+
+	// AutoCreate makes a Mount of an unknown name implicitly Create it with
+	// the default options, like Docker's local driver.
+	AutoCreate bool `yaml:"auto_create"`
+
+	// RegistrationTTL is how long a volume created without options but
+	// never mounted is remembered before being garbage collected.  Zero, the
+	// default, disables collection.
+	RegistrationTTL Duration `yaml:"registration_ttl"`
+
+	// MountRoot is the directory volumes are mounted in.  Changing it only
+	// affects new mounts.
+	MountRoot string `yaml:"mount_root"`
+
+	// StateFile is where what we know of our volumes is kept across
+	// restarts.  "" disables persistence.
+	StateFile string `yaml:"state_file"`
+
+	// ShutdownGrace is how long to keep serving Unmount and Remove (while
+	// refusing new mounts) after being asked to exit.
+	ShutdownGrace Duration `yaml:"shutdown_grace"`
+
+	// ShutdownCleanup controls unmounting everything as the instance shuts
+	// down.
+	ShutdownCleanup ShutdownCleanupConfig `yaml:"shutdown_cleanup"`
+
+	// Batch controls batch admin operations (see Batch).
+	Batch BatchConfig `yaml:"batch"`
+
+	// Snapshots controls the queue every snapshot taken goes through.
+	Snapshots SnapshotsConfig `yaml:"snapshots"`
+
+	// MountRetry controls retrying mounts of devices which aren't ready.
+	MountRetry MountRetryConfig `yaml:"mount_retry"`
+
+	// DeviceReadiness controls how an attached volume's device is found.
+	DeviceReadiness DeviceReadinessConfig `yaml:"device_readiness"`
+
+	// Format controls formatting blank volumes before their first mount.
+	Format FormatConfig `yaml:"format"`
+
+	// Fstab controls the entries kept in /etc/fstab for critical volumes.
+	Fstab FstabConfig `yaml:"fstab"`
+
+	// Workloads are the policies chosen with the workload option, by name
+	// (see defaultWorkloads, which they replace or add to).
+	Workloads map[string]WorkloadPolicy `yaml:"workloads"`
+
+	// Prefetch controls volumes attached ahead of their mounts.
+	Prefetch PrefetchConfig `yaml:"prefetch"`
+
+	// Timeouts controls how long we wait on asynchronous EBS state changes.
+	Timeouts TimeoutConfig `yaml:"timeouts"`
+
+	// SlowEBS slows attaches and detaches down, for testing.
+	SlowEBS SlowEBSConfig `yaml:"slow_ebs"`
+
+	// Reconcile controls the periodic comparison of our state against EC2
+	// and the mount table.
+	Reconcile ReconcileConfig `yaml:"reconcile"`
+
+	// Watchdog controls the quick, local check that mounts are still there.
+	Watchdog WatchdogConfig `yaml:"watchdog"`
+
+	// Devices controls which device names volumes are attached as.
+	Devices DeviceConfig `yaml:"devices"`
+
+	// Verify controls the periodic restore test of volumes' backups.
+	Verify VerifyConfig `yaml:"verify"`
+
+	// Export controls exporting volumes' snapshots to S3.
+	Export ExportConfig `yaml:"export"`
+
+	// LUKSBackup controls backing up the LUKS headers of encrypted-fs
+	// volumes to S3.
+	LUKSBackup LUKSBackupConfig `yaml:"luks_backup"`
+
+	// Saturation controls watching mounted volumes' queue lengths.
+	Saturation SaturationConfig `yaml:"saturation"`
+
+	// CloudWatchLogs controls shipping the operation log to CloudWatch Logs.
+	CloudWatchLogs CloudWatchLogsConfig `yaml:"cloudwatch_logs"`
+
+	// DockerEvents controls following the Docker daemon's events, to
+	// release volumes left mounted by containers which died unseen.
+	DockerEvents DockerEventsConfig `yaml:"docker_events"`
+
+	// Health controls watching AWS Health for EBS issues near us.
+	Health HealthConfig `yaml:"health"`
+
+	// Publish controls publishing a summary of this host's state to AWS.
+	Publish PublishConfig `yaml:"publish"`
+
+	// Grow controls watching for resized volumes, whose filesystems are
+	// then grown to match.
+	Grow GrowConfig `yaml:"grow"`
+
+	// Scrub controls the periodic read-through of mounted volumes.
+	Scrub ScrubConfig `yaml:"scrub"`
+
+	// Trim controls the periodic trim of mounted volumes' unused blocks.
+	Trim TrimConfig `yaml:"trim"`
+
+	// Maintenance controls when heavy background work may run.
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+
+	// Cost controls the cost estimates of new volumes, and their ceiling.
+	Cost CostConfig `yaml:"cost"`
+
+	// Audit controls the access log of volumes with the audit option.
+	Audit AuditConfig `yaml:"audit"`
+
+	// Archive controls the final snapshot of volumes before they're deleted.
+	Archive ArchiveConfig `yaml:"archive"`
+
+	// Replication controls how volumes with the replicate-to option are kept
+	// copied to another availability zone or region.
+	Replication ReplicationConfig `yaml:"replication"`
+
+	// Seed controls where the seed option may fetch volumes' initial
+	// content from.
+	Seed SeedConfig `yaml:"seed"`
+
+	// Encryption controls the KMS key of encrypted volumes, and of those
+	// made from encrypted snapshots.
+	Encryption EncryptionConfig `yaml:"encryption"`
+
+	// Pool controls the warm pools of standby volumes for the pool option.
+	Pool PoolConfig `yaml:"pool"`
+
+	// Lease controls the tag-based lock against other instances using a
+	// volume we have mounted.
+	Lease LeaseConfig `yaml:"lease"`
+
+	// Discovery controls where the plugin is served, and how Docker finds
+	// it.  Changes take effect at the next restart.
+	Discovery DiscoveryConfig `yaml:"discovery"`
+
+	// Auth restricts who may use the plugin and admin sockets.
+	Auth AuthConfig `yaml:"auth"`
+
+	// RateLimits caps plugin requests per operation (create, mount, path,
+	// remove, unmount).  Operations without a limit are unrestricted.
+	RateLimits map[string]RateLimit `yaml:"rate_limits"`
+}
+
+type AWSConfig struct {
+	// UserAgent is appended to the user-agent of every AWS call (after
+	// blocker/<version>), e.g. "acme-scheduler/2.1".
+	UserAgent string `yaml:"user_agent"`
+	// RequestTags are appended to the user-agent as key/value.
+	RequestTags map[string]string `yaml:"request_tags"`
+}
+
+type RateLimit struct {
+	// PerSecond is the sustained rate of requests permitted.
+	PerSecond float64 `yaml:"per_second"`
+	// Burst is how many requests may be made at once.
+	Burst int `yaml:"burst"`
+}
+
+type VerifyConfig struct {
+	// Interval is how often to verify.  Zero disables verification.
+	Interval Duration `yaml:"interval"`
+	// Volumes are the names (or IDs) of the volumes whose latest snapshots
+	// are restored and checked.
+	Volumes []string `yaml:"volumes"`
+	// Command is run (with sh -c) in the root of the restored volume; it
+	// must exit zero for the backup to pass.
+	Command string `yaml:"command"`
+	// Manifest is the path, within the volume, of a sha256sum-style list of
+	// files and digests to check.
+	Manifest string `yaml:"manifest"`
+}
+
+type ExportConfig struct {
+	// Bucket is the S3 bucket exports are written to.  Empty disables
+	// exports.
+	Bucket string `yaml:"bucket"`
+	// Prefix is prepended to the keys of exported objects.
+	Prefix string `yaml:"prefix"`
+	// Region is the bucket's region, if it isn't ours.
+	Region string `yaml:"region"`
+	// KMSKey is the KMS key exports are encrypted with (SSE-KMS).  Exports
+	// of encrypted snapshots are always encrypted, with the snapshot's own
+	// key if this is empty (so it must be set to export them to another
+	// region); others only if it's set.
+	KMSKey string `yaml:"kms_key"`
+}
+
+type LUKSBackupConfig struct {
+	// Bucket is the S3 bucket headers are backed up to.  Empty disables
+	// backups.
+	Bucket string `yaml:"bucket"`
+	// Prefix is prepended to the keys of the backups.
+	Prefix string `yaml:"prefix"`
+	// Region is the bucket's region, if it isn't ours.
+	Region string `yaml:"region"`
+	// KMSKey is the KMS key the backups are encrypted with (SSE-KMS); empty
+	// uses the account's default key for S3.
+	KMSKey string `yaml:"kms_key"`
+}
+
+type SaturationConfig struct {
+	// Interval is how often to check.  Zero disables the checks.
+	Interval Duration `yaml:"interval"`
+	// Window is how long the queue must stay long to count as saturated.
+	Window Duration `yaml:"window"`
+	// QueueLength is the average queue length considered saturated.
+	QueueLength float64 `yaml:"queue_length"`
+	// Remediate raises saturated gp3 volumes' IOPS and throughput (doubling
+	// them each time, at most every six hours) up to MaxIops and
+	// MaxThroughput (in MiB/s).
+	Remediate     bool  `yaml:"remediate"`
+	MaxIops       int64 `yaml:"max_iops"`
+	MaxThroughput int64 `yaml:"max_throughput"`
+}
+
+type CloudWatchLogsConfig struct {
+	// Group, if set, names the log group to ship operations to.  The group
+	// must already exist; each instance writes to a stream named after it.
+	Group string `yaml:"group"`
+}
+
+type DockerEventsConfig struct {
+	// Socket is the Docker daemon's API socket, e.g.
+	// /var/run/docker.sock.  Empty disables following its events.
+	Socket string `yaml:"socket"`
+	// Grace is how long after a container dies to wait for Docker to
+	// unmount its volumes before they're released.
+	Grace Duration `yaml:"grace"`
+}
+
+type HealthConfig struct {
+	// Interval is how often to check AWS Health for open EBS issues in our
+	// region.  Zero disables the checks.
+	Interval Duration `yaml:"interval"`
+}
+
+type PublishConfig struct {
+	// InstanceTag, if set, is the key of an instance tag to keep a compact
+	// summary in.
+	InstanceTag string `yaml:"instance_tag"`
+	// SSMParameter, if set, names an SSM parameter to keep a JSON summary
+	// in.  "{instance}" is replaced with the instance ID.
+	SSMParameter string `yaml:"ssm_parameter"`
+}
+
+type GrowConfig struct {
+	// Interval is how often to check for modifications.  Zero disables it.
+	Interval Duration `yaml:"interval"`
+}
+
+type ScrubConfig struct {
+	// Interval is how often to scrub.  Zero disables scrubbing.
+	Interval Duration `yaml:"interval"`
+	// RateMiB caps how fast block devices are read, in MiB/s.  Zero means
+	// as fast as the (idle priority) I/O allows.
+	RateMiB int `yaml:"rate_mib"`
+}
+
+type TrimConfig struct {
+	// Interval is how often to trim.  Zero disables trimming.
+	Interval Duration `yaml:"interval"`
+}
+
+type MaintenanceConfig struct {
+	// Windows are when scrubs, trims, backup verification, and volume
+	// modifications may run.  Empty lets them run whenever they're due.
+	Windows []MaintenanceWindow `yaml:"windows"`
+	// Timezone is the IANA time zone the windows are given in, e.g.
+	// America/New_York; empty is the host's.
+	Timezone string `yaml:"timezone"`
+}
+
+// MaintenanceWindow is a daily (or weekly) stretch of time.
+type MaintenanceWindow struct {
+	// Days are the days it opens on (sun, mon, ..., sat); empty is every
+	// day.
+	Days []string `yaml:"days"`
+	// Start and End are times of day, HH:MM.  A window ending no later
+	// than it starts runs past midnight.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+}
+
+type CostConfig struct {
+	// Ceiling, if set, is the most (in USD a month) a new volume may be
+	// estimated to cost.
+	Ceiling float64 `yaml:"ceiling"`
+	// Prices override the bundled (us-east-1) prices, by volume type.
+	Prices map[string]VolumePrice `yaml:"prices"`
+}
+
+// VolumePrice is what a volume type costs a month, in USD: per GiB, per
+// provisioned IOPS, and per MiB/s of provisioned throughput.  Zeroes keep the
+// bundled prices.
+type VolumePrice struct {
+	GiB        float64 `yaml:"gib"`
+	Iops       float64 `yaml:"iops"`
+	Throughput float64 `yaml:"throughput"`
+}
+
+type AuditConfig struct {
+	// File, if set, is where access events are appended, as JSON lines;
+	// otherwise they're logged.
+	File string `yaml:"file"`
+	// Rate caps how many events are recorded per second for each volume;
+	// the rest are counted, and reported as suppressed.  Zero means no cap.
+	Rate int `yaml:"rate"`
+}
+
+type ArchiveConfig struct {
+	// Enabled archives every volume before it's deleted.  The archive
+	// volume option overrides it.
+	Enabled bool `yaml:"enabled"`
+	// Region, if set, is the region the final snapshot is copied to (the
+	// snapshot in this region is then deleted).
+	Region string `yaml:"region"`
+	// KMSKey, if set, re-encrypts the copy with this key in Region.
+	KMSKey string `yaml:"kms_key"`
+	// ShareWith lists AWS accounts allowed to create volumes from (and so
+	// copy) the archived snapshot.
+	ShareWith []string `yaml:"share_with"`
+	// Retention is how long archives must be kept, as recorded in their
+	// blocker:retain-until tag.
+	Retention Duration `yaml:"retention"`
+}
+
+type ReplicationConfig struct {
+	// Interval is how often volumes with the replicate-to option are
+	// snapshotted and their copies replaced.  Zero stops replicating.
+	Interval Duration `yaml:"interval"`
+	// KMSKey, if set, encrypts copies made in other regions with this key
+	// there.
+	KMSKey string `yaml:"kms_key"`
+}
+
+type SeedConfig struct {
+	// Dir is the directory seed tarballs must be in.  Empty allows only S3
+	// seeds.
+	Dir string `yaml:"dir"`
+	// Region is the region of the seed buckets, if it isn't ours.
+	Region string `yaml:"region"`
+}
+
+type EncryptionConfig struct {
+	// KMSKey is the KMS key volumes are encrypted with when their kms-key
+	// option names none.  Volumes made from encrypted snapshots are then
+	// re-encrypted to it, rather than keeping their snapshot's key.  Empty
+	// uses the snapshot's key, or else the account's default key for EBS.
+	KMSKey string `yaml:"kms_key"`
+}
+
+type PoolConfig struct {
+	// Interval is how often to top up the pools.  Zero disables refilling
+	// (volumes are then provisioned as they're mounted).
+	Interval Duration `yaml:"interval"`
+	// Classes are the kinds of volume to keep on standby, by the name given
+	// in the pool option.
+	Classes map[string]PoolClass `yaml:"classes"`
+}
+
+type PoolClass struct {
+	// Count is how many standby volumes of the class to keep attached.
+	Count int `yaml:"count"`
+	// Type, Size (in GiB), Iops, and Throughput (in MiB/s) describe the
+	// volumes, as the volume options of the same names do.
+	Type       string `yaml:"type"`
+	Size       int64  `yaml:"size"`
+	Iops       int64  `yaml:"iops"`
+	Throughput int64  `yaml:"throughput"`
+	// FSType is the filesystem standby volumes are formatted with.  The
+	// default is ext4.
+	FSType string `yaml:"fstype"`
+}
+
+func (c PoolClass) spec() volumeSpec {
+	return volumeSpec{Type: c.Type, SizeGiB: c.Size, Iops: c.Iops, Throughput: c.Throughput}
+}
+
+func (c PoolClass) fstype() string {
+	if c.FSType == "" {
+		return DefaultFSType
+	}
+	return c.FSType
+}
+
+type LeaseConfig struct {
+	// Enabled turns on leasing.  Every host sharing volumes should agree.
+	Enabled bool `yaml:"enabled"`
+	// TTL is how long a lease lasts unless renewed.  A host which dies
+	// holds its volumes' leases for up to this long.
+	TTL Duration `yaml:"ttl"`
+}
+
+type DiscoveryConfig struct {
+	// Sockets are the Unix sockets the plugin is served on.  Docker finds
+	// <name>.sock in /run/docker/plugins by itself; a socket anywhere else
+	// needs a spec file pointing at it.
+	Sockets []string `yaml:"sockets"`
+	// SpecFiles are plugin discovery files, written at startup to point at
+	// the first socket: a <name>.spec file holds its URL, and a <name>.json
+	// file a JSON object with the plugin's name and address.
+	SpecFiles []string `yaml:"spec_files"`
+}
+
+type AuthConfig struct {
+	// AllowedUIDs and AllowedGIDs list the peers (checked via SO_PEERCRED)
+	// permitted to use the sockets.  If both are empty, anyone who can open
+	// the socket may use it.
+	AllowedUIDs []uint32 `yaml:"allowed_uids"`
+	AllowedGIDs []uint32 `yaml:"allowed_gids"`
+	// Secret names a shared secret (see ReadSecret).  Admin requests signed
+	// with it (see AuthHeader) are permitted regardless of the peer.
+	Secret string `yaml:"secret"`
+	// SecretFile is a file holding the shared secret, as Secret does with
+	// file:<path>.
+	SecretFile string `yaml:"secret_file"`
+}
+
+// SecretRef names the shared secret, if there is one.
+func (c AuthConfig) SecretRef() string {
+	if c.Secret == "" && c.SecretFile != "" {
+		return "file:" + c.SecretFile
+	}
+	return c.Secret
+}
+
+type DeviceConfig struct {
+	// Letters are the candidate device letters, as ranges like "f-p" joined
+	// with commas.  Device names are /dev/sd<letter>.
+	Letters string `yaml:"letters"`
+	// Exclude lists letters never to use, e.g. those an AMI reserves for
+	// instance-store volumes.
+	Exclude []string `yaml:"exclude"`
+	// ReservedSlots is how many of the instance's attachment slots to leave
+	// free for others (instance-store, other agents).  Attaches which would
+	// eat into them are refused.
+	ReservedSlots int `yaml:"reserved_slots"`
+	// MaxAttachments is how many volumes the instance can have attached,
+	// counting the root volume.  Nitro instances share 28 slots between
+	// volumes and network interfaces, so this should be 28 less the
+	// interfaces in use; see the EC2 documentation for other instances.
+	MaxAttachments int `yaml:"max_attachments"`
+}
+
+type ReconcileConfig struct {
+	// Interval is how often to reconcile.  Zero disables reconciliation.
+	Interval Duration `yaml:"interval"`
+	// Policy is "alert" to only log drift, or "repair" to also fix up our
+	// bookkeeping so that Docker's next Mount starts from a clean slate.
+	Policy string `yaml:"policy"`
+	// CloudTrail looks up who detached or deleted a volume unexpectedly,
+	// for the alert.  This needs cloudtrail:LookupEvents.
+	CloudTrail bool `yaml:"cloudtrail"`
+}
+
+type WatchdogConfig struct {
+	// Interval is how often to check the mount table.  Zero disables it.
+	Interval Duration `yaml:"interval"`
+	// Remount re-attaches and re-mounts a vanished volume at the same path.
+	Remount bool `yaml:"remount"`
+}
+
+type MountRetryConfig struct {
+	// Attempts is how many times to try mounting in all.
+	Attempts int `yaml:"attempts"`
+	// Backoff is the wait before the first retry, doubling each time.
+	Backoff Duration `yaml:"backoff"`
+}
+
+type DeviceReadinessConfig struct {
+	// Strategies are the ways to look for an attached volume's device,
+	// tried in turn until one finds it (see RegisterDeviceStrategy).  Empty
+	// means this platform's default.
+	Strategies []string `yaml:"strategies"`
+	// Platforms replace Strategies on the given platforms (linux or
+	// freebsd), for configuration shared between hosts.
+	Platforms map[string][]string `yaml:"platforms"`
+}
+
+type FstabConfig struct {
+	// Path is the fstab file whose managed block lists the critical
+	// volumes mounted here (see syncFstab).
+	Path string `yaml:"path"`
+}
+
+type FormatConfig struct {
+	// FSType is the filesystem blank volumes are formatted with, unless
+	// they have the fstype option.  "" leaves them unformatted (and their
+	// mounts fail) unless they have the option.
+	FSType string `yaml:"fstype"`
+}
+
+// WorkloadPolicy is how volumes for a workload are formatted and mounted.
+type WorkloadPolicy struct {
+	// FSType is the filesystem, unless the volume has the fstype option.
+	FSType string `yaml:"fstype"`
+	// MkfsFlags are passed to mkfs when formatting a blank volume as
+	// FSType.
+	MkfsFlags []string `yaml:"mkfs_flags"`
+	// MountFlags are the mount flags, unless the volume has the
+	// mount-flags option.
+	MountFlags []string `yaml:"mount_flags"`
+}
+
+type PrefetchConfig struct {
+	// TTL is how long a prefetched volume stays attached waiting to be
+	// mounted before it's detached again.  Zero keeps it indefinitely.
+	TTL Duration `yaml:"ttl"`
+}
+
+type BatchConfig struct {
+	// Parallelism is how many volumes a batch operation works on at once,
+	// unless the request says otherwise.
+	Parallelism int `yaml:"parallelism"`
+}
+
+type SnapshotsConfig struct {
+	// Concurrency is how many CreateSnapshot calls may be under way at
+	// once.
+	Concurrency int `yaml:"concurrency"`
+	// Rate is how many CreateSnapshot calls may start a second.  Zero is
+	// unlimited.
+	Rate int `yaml:"rate"`
+	// Retries is how many times a call EC2 throttles is retried.
+	Retries int `yaml:"retries"`
+	// Jitter is the most scheduled snapshots are delayed by, at random.
+	Jitter Duration `yaml:"jitter"`
+}
+
+type ShutdownCleanupConfig struct {
+	// Parallelism is how many volumes are unmounted and detached at once.
+	Parallelism int `yaml:"parallelism"`
+	// Deadline is how long to spend on the cleanup in all, after which the
+	// volumes still to do are reported and left for EC2.
+	Deadline Duration `yaml:"deadline"`
+}
+
+// SlowEBSConfig adds artificial delays to EBS, so that container health
+// checks and orchestration timeouts can be tried against worst-case storage
+// latency.  It's for testing only.
+type SlowEBSConfig struct {
+	// Attach and Detach are added to attaches and detaches.
+	Attach Duration `yaml:"attach"`
+	Detach Duration `yaml:"detach"`
+	// Device is added to the wait for an attached device to appear.
+	Device Duration `yaml:"device"`
+}
+
+// enabled reports whether any delay is set.
+func (c SlowEBSConfig) enabled() bool {
+	return c.Attach > 0 || c.Detach > 0 || c.Device > 0
+}
+
+type TimeoutConfig struct {
+	// StatePoll is the longest interval between checks of a volume's state
+	// (the first checks come sooner).
+	StatePoll Duration `yaml:"state_poll"`
+	// StateWait is how long to wait in total for a state transition.
+	StateWait Duration `yaml:"state_wait"`
+	// DeviceWait is how long to wait for a device node to show up after
+	// EBS reports the attach complete; udev can lag behind a little.
+	DeviceWait Duration `yaml:"device_wait"`
+	// SnapshotWait is how long to wait for a snapshot (or copy) to finish.
+	SnapshotWait Duration `yaml:"snapshot_wait"`
+	// StuckAttachment is how long an attachment found attaching or
+	// detaching at startup may stay that way before it's forced off.
+	StuckAttachment Duration `yaml:"stuck_attachment"`
+	// Handoff is how long a receiving host waits for a volume to be released.
+	Handoff Duration `yaml:"handoff"`
+}
+
+// Duration is a time.Duration that reads human friendly strings ("5s") from
+// the configuration file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		LogLevel:        "info",
+		DefaultOptions:  map[string]string{},
+		RegistrationTTL: 0,
+		MountRoot:       "/mnt/blocker",
+		StateFile:       "/var/lib/blocker/state.json",
+		Discovery: DiscoveryConfig{
+			Sockets: []string{"/var/run/blocker.sock"},
+		},
+		Reconcile: ReconcileConfig{
+			Interval: Duration(5 * time.Minute),
+			Policy:   "alert",
+		},
+		Devices: DeviceConfig{
+			Letters:        "f-p",
+			MaxAttachments: 28,
+		},
+		Saturation: SaturationConfig{
+			Window:        Duration(15 * time.Minute),
+			QueueLength:   8,
+			MaxIops:       gp3BaseIops,
+			MaxThroughput: gp3BaseThroughput,
+		},
+		Grow: GrowConfig{
+			Interval: Duration(time.Minute),
+		},
+		DockerEvents: DockerEventsConfig{
+			Grace: Duration(30 * time.Second),
+		},
+		Scrub: ScrubConfig{
+			RateMiB: 20,
+		},
+		Audit: AuditConfig{
+			Rate: 100,
+		},
+		Archive: ArchiveConfig{
+			Retention: Duration(90 * 24 * time.Hour),
+		},
+		Replication: ReplicationConfig{
+			Interval: Duration(time.Hour),
+		},
+		Pool: PoolConfig{
+			Interval: Duration(time.Minute),
+		},
+		Lease: LeaseConfig{
+			TTL: Duration(2 * time.Minute),
+		},
+		Watchdog: WatchdogConfig{
+			Interval: Duration(10 * time.Second),
+		},
+		MountRetry: MountRetryConfig{
+			Attempts: 4,
+			Backoff:  Duration(500 * time.Millisecond),
+		},
+		Format: FormatConfig{
+			FSType: DefaultFSType,
+		},
+		Fstab: FstabConfig{
+			Path: "/etc/fstab",
+		},
+		Workloads: defaultWorkloadPolicies(),
+		Prefetch: PrefetchConfig{
+			TTL: Duration(10 * time.Minute),
+		},
+		ShutdownCleanup: ShutdownCleanupConfig{
+			Parallelism: 8,
+			Deadline:    Duration(60 * time.Second),
+		},
+		Batch: BatchConfig{
+			Parallelism: 4,
+		},
+		Snapshots: SnapshotsConfig{
+			Concurrency: 4,
+			Rate:        2,
+			Retries:     5,
+		},
+		Timeouts: TimeoutConfig{
+			StatePoll:       Duration(5 * time.Second),
+			StateWait:       Duration(60 * time.Second),
+			DeviceWait:      Duration(10 * time.Second),
+			SnapshotWait:    Duration(30 * time.Minute),
+			Handoff:         Duration(5 * time.Minute),
+			StuckAttachment: Duration(10 * time.Minute),
+		},
+	}
+}
+
+func (c DiscoveryConfig) validate() error {
+	if len(c.Sockets) == 0 {
+		return fmt.Errorf("The plugin needs at least one socket.")
+	}
+	seen := map[string]bool{}
+	for _, path := range append(c.Sockets, c.SpecFiles...) {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("Plugin socket or spec file %q must be an absolute path.", path)
+		}
+		if seen[filepath.Clean(path)] {
+			return fmt.Errorf("Plugin socket or spec file %v is listed twice.", path)
+		}
+		seen[filepath.Clean(path)] = true
+	}
+	for _, path := range c.SpecFiles {
+		if ext := filepath.Ext(path); ext != ".spec" && ext != ".json" {
+			return fmt.Errorf("Plugin spec file %v must end in .spec or .json.", path)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if err := c.AWS.validate(); err != nil {
+		return err
+	}
+	for name, opts := range c.Profiles {
+		if _, ok := opts["profile"]; ok {
+			return fmt.Errorf("Profile %v can't itself name a profile.", name)
+		}
+	}
+	for name, class := range c.Classes {
+		for backend, opts := range class {
+			if backend != "ebs" && backend != "gce" {
+				return fmt.Errorf("Class %v has options for unknown driver %q; expected ebs or gce.", name, backend)
+			}
+			for _, key := range []string{"class", "profile"} {
+				if _, ok := opts[key]; ok {
+					return fmt.Errorf("Class %v can't itself name a %v.", name, key)
+				}
+			}
+		}
+	}
+	if c.Auth.Secret != "" {
+		if c.Auth.SecretFile != "" {
+			return fmt.Errorf("Only one of auth.secret and auth.secret_file may be set.")
+		}
+		if _, _, err := parseSecretRef(c.Auth.Secret); err != nil {
+			return fmt.Errorf("auth.secret: %v", err)
+		}
+	}
+	if c.Fstab.Path == "" {
+		return fmt.Errorf("fstab.path must be set.")
+	}
+	if c.Seed.Dir != "" && !filepath.IsAbs(c.Seed.Dir) {
+		return fmt.Errorf("seed.dir must be an absolute path.")
+	}
+	for name, p := range c.Workloads {
+		if p.FSType == "" && len(p.MkfsFlags) > 0 {
+			return fmt.Errorf("Workload %v has mkfs_flags but no fstype for them.", name)
+		}
+	}
+	if c.RegistrationTTL < 0 {
+		return fmt.Errorf("The registration TTL must not be negative.")
+	}
+	labels := map[string]string{}
+	for _, key := range c.MetricTags {
+		label := metricLabel(key)
+		if label == "" {
+			return fmt.Errorf("Metric tags can't be empty.")
+		}
+		if reservedLabels[label] {
+			return fmt.Errorf("Metric tag %q would label metrics %v, which is taken.", key, label)
+		}
+		if other, ok := labels[label]; ok {
+			return fmt.Errorf("Metric tags %q and %q would both label metrics %v.", other, key, label)
+		}
+		labels[label] = key
+	}
+	if c.Reconcile.Policy != "alert" && c.Reconcile.Policy != "repair" {
+		return fmt.Errorf("Unknown reconcile policy %q.", c.Reconcile.Policy)
+	}
+	for op, limit := range c.RateLimits {
+		if limit.PerSecond < 0 || limit.Burst < 1 {
+			return fmt.Errorf("Invalid rate limit for %v.", op)
+		}
+	}
+	if c.Verify.Interval > 0 && c.Verify.Command == "" && c.Verify.Manifest == "" {
+		return fmt.Errorf("Backup verification needs a command or a manifest.")
+	}
+	if c.Saturation.Interval > 0 &&
+		(c.Saturation.Window < Duration(2*saturationPeriod*time.Second) ||
+			c.Saturation.QueueLength <= 0) {
+		return fmt.Errorf("Saturation checks need a window of at least %v and a positive queue length.",
+			2*saturationPeriod*time.Second)
+	}
+	if c.DockerEvents.Socket != "" && !filepath.IsAbs(c.DockerEvents.Socket) {
+		return fmt.Errorf("The Docker socket %q must be an absolute path.", c.DockerEvents.Socket)
+	}
+	if c.DockerEvents.Grace < 0 {
+		return fmt.Errorf("The Docker events grace must not be negative.")
+	}
+	for i, w := range c.Maintenance.Windows {
+		if err := w.check(); err != nil {
+			return fmt.Errorf("maintenance.windows[%v]: %v", i, err)
+		}
+	}
+	if c.Maintenance.Timezone != "" {
+		if _, err := time.LoadLocation(c.Maintenance.Timezone); err != nil {
+			return fmt.Errorf("maintenance.timezone: %v", err)
+		}
+	}
+	if c.Scrub.RateMiB < 0 {
+		return fmt.Errorf("The scrub rate must not be negative.")
+	}
+	if c.Cost.Ceiling < 0 {
+		return fmt.Errorf("The cost ceiling must not be negative.")
+	}
+	for t, p := range c.Cost.Prices {
+		if _, ok := volumePrices[t]; !ok {
+			return fmt.Errorf("Unknown volume type %q in cost prices.", t)
+		}
+		if p.GiB < 0 || p.Iops < 0 || p.Throughput < 0 {
+			return fmt.Errorf("Prices for %v must not be negative.", t)
+		}
+	}
+	if c.Audit.Rate < 0 {
+		return fmt.Errorf("The audit rate must not be negative.")
+	}
+	if c.Archive.Retention < 0 {
+		return fmt.Errorf("The archive retention must not be negative.")
+	}
+	if c.Archive.KMSKey != "" && c.Archive.Region == "" {
+		return fmt.Errorf("An archive KMS key needs an archive region to copy to.")
+	}
+	if c.Replication.Interval < 0 {
+		return fmt.Errorf("The replication interval must not be negative.")
+	}
+	for name, class := range c.Pool.Classes {
+		if class.Count < 0 {
+			return fmt.Errorf("The %v pool's count must not be negative.", name)
+		}
+		if err := class.spec().validate(); err != nil {
+			return fmt.Errorf("Invalid %v pool: %v", name, err)
+		}
+	}
+	if c.Lease.Enabled && time.Duration(c.Lease.TTL) < 3*leaseSettle {
+		return fmt.Errorf("The lease TTL must be at least %v.", 3*leaseSettle)
+	}
+	if letters, err := c.Devices.candidates(); err != nil {
+		return err
+	} else if len(letters) == 0 {
+		return fmt.Errorf("No device letters are available.")
+	}
+	if c.Devices.ReservedSlots < 0 || c.Devices.ReservedSlots >= c.Devices.MaxAttachments {
+		return fmt.Errorf("The reserved attachment slots must number from 0 to fewer than max_attachments.")
+	}
+	if c.MountRetry.Attempts < 1 || c.MountRetry.Backoff < 0 {
+		return fmt.Errorf("Mounts need at least one attempt, and a backoff that isn't negative.")
+	}
+	if err := checkDeviceStrategies(c.DeviceReadiness.order()); err != nil {
+		return err
+	}
+	if err := checkFeatures(c.Features); err != nil {
+		return err
+	}
+	if c.Prefetch.TTL < 0 {
+		return fmt.Errorf("The prefetch TTL must not be negative.")
+	}
+	if !filepath.IsAbs(c.MountRoot) || filepath.Clean(c.MountRoot) == "/" {
+		return fmt.Errorf("The mount root must be an absolute path other than /.")
+	}
+	if err := c.Discovery.validate(); err != nil {
+		return err
+	}
+	if c.SlowEBS.Attach < 0 || c.SlowEBS.Detach < 0 || c.SlowEBS.Device < 0 {
+		return fmt.Errorf("The slow_ebs delays must not be negative.")
+	}
+	if c.ShutdownCleanup.Parallelism < 1 || c.ShutdownCleanup.Deadline <= 0 {
+		return fmt.Errorf("Shutdown cleanup needs a parallelism of at least 1 and a positive deadline.")
+	}
+	if c.Batch.Parallelism < 1 {
+		return fmt.Errorf("Batch operations need a parallelism of at least 1.")
+	}
+	if c.Snapshots.Concurrency < 1 {
+		return fmt.Errorf("Snapshots need a concurrency of at least 1.")
+	}
+	if c.Snapshots.Rate < 0 || c.Snapshots.Retries < 0 || c.Snapshots.Jitter < 0 {
+		return fmt.Errorf("The snapshots rate, retries, and jitter must not be negative.")
+	}
+	if c.Timeouts.StatePoll <= 0 || c.Timeouts.StateWait <= 0 || c.Timeouts.DeviceWait <= 0 ||
+		c.Timeouts.SnapshotWait <= 0 || c.Timeouts.Handoff <= 0 ||
+		c.Timeouts.StuckAttachment <= 0 {
+		return fmt.Errorf("Timeouts must be positive.")
+	}
+	return nil
+}
+
+// timeoutOverrides are timeouts given on the command line, which take
+// precedence over the configuration file's (see OverrideTimeouts).
+var timeoutOverrides TimeoutConfig
+
+// OverrideTimeouts makes the non-zero timeouts in t take precedence over the
+// configuration file's, in every configuration loaded from now on (including
+// by ReloadConfig).
+func OverrideTimeouts(t TimeoutConfig) {
+	timeoutOverrides = t
+}
+
+// overrideTimeouts applies any timeouts given on the command line.
+func (c *Config) overrideTimeouts() {
+	o := timeoutOverrides
+	for _, t := range []struct{ to, from *Duration }{
+		{&c.Timeouts.StatePoll, &o.StatePoll},
+		{&c.Timeouts.StateWait, &o.StateWait},
+		{&c.Timeouts.DeviceWait, &o.DeviceWait},
+		{&c.Timeouts.SnapshotWait, &o.SnapshotWait},
+	} {
+		if *t.from != 0 {
+			*t.to = *t.from
+		}
+	}
+}
+
+// LoadConfig reads the configuration file at path, layering it over the
+// defaults (and any timeouts given on the command line over both).  A
+// missing file is not an error.
+func LoadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.overrideTimeouts()
+			if err := c.validate(); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("Parsing %v failed: %v", path, err)
+	}
+	c.overrideTimeouts()
+	if c.DefaultOptions == nil {
+		c.DefaultOptions = map[string]string{}
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid configuration in %v: %v", path, err)
+	}
+	return c, nil
+}
+
+var config atomic.Value
+
+func GetConfig() *Config {
+	return config.Load().(*Config)
+}
+
+// SetConfig installs a new configuration, applying any settings which need
+// to be pushed elsewhere (like the log level).
+func SetConfig(c *Config) {
+	level, _ := parseLogLevel(c.LogLevel)
+	setLogLevel(level)
+	config.Store(c)
+}
+
+// ReloadConfig re-reads the configuration file.  On failure the existing
+// configuration stays in effect.  Mounted volumes are unaffected either way.
+func ReloadConfig(path string) {
+	c, err := LoadConfig(path)
+	if err != nil {
+		LogError("Reloading configuration failed; keeping the old one: %v\n", err)
+		return
+	}
+	SetConfig(c)
+	publishFeatures()
+	Log("Reloaded configuration from %v.\n", path)
+}
+
+func init() {
+	config.Store(defaultConfig())
+}
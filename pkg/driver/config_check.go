@@ -0,0 +1,117 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// `blocker validate-config` checks a configuration file before the daemon is
+// restarted (or reloaded) with it.  Beyond what LoadConfig refuses, it warns
+// of settings which are valid, but won't work as intended here: options no
+// driver takes in default_options, profiles, and classes (which would fail
+// every Create using them); filesystems whose mkfs (or zpool) isn't installed;
+// encrypted-fs without cryptsetup; and files, directories, and sockets which
+// aren't there.
+
+// CheckConfig warns of the problems with a valid configuration which would
+// only show once it's used on this host, sorted.
+func CheckConfig(c *Config) []string {
+	var warnings []string
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	// Options, and what they need installed.
+	anyOptionNames := append(append([]string{}, ebsOptionNames...), gceOptionNames...)
+	fstypes := map[string][]string{}
+	var encrypted []string
+	checkOptions := func(where string, opts map[string]string, known []string) {
+		if err := checkOptionNames(opts, known); err != nil {
+			warn("%v: %v", where, err)
+		}
+		if fs := opts["fstype"]; fs != "" {
+			fstypes[fs] = append(fstypes[fs], where)
+		}
+		if _, ok := opts["encrypted-fs"]; ok {
+			encrypted = append(encrypted, where)
+		}
+		if _, err := parseFeatures(opts["features"]); err != nil {
+			warn("%v: %v", where, err)
+		}
+	}
+	checkOptions("default_options", c.DefaultOptions, anyOptionNames)
+	for name, opts := range c.Profiles {
+		checkOptions("profile "+name, opts, anyOptionNames)
+	}
+	for name, class := range c.Classes {
+		if opts, ok := class["ebs"]; ok {
+			checkOptions("class "+name+" (ebs)", opts, ebsOptionNames)
+		}
+		if opts, ok := class["gce"]; ok {
+			checkOptions("class "+name+" (gce)", opts, gceOptionNames)
+		}
+	}
+	if fs := c.Format.FSType; fs != "" {
+		fstypes[fs] = append(fstypes[fs], "format.fstype")
+	}
+	for name, p := range c.Workloads {
+		if p.FSType != "" {
+			fstypes[p.FSType] = append(fstypes[p.FSType], "workload "+name)
+		}
+	}
+	for fs, users := range fstypes {
+		if _, err := exec.LookPath(formatCommand(fs)); err != nil {
+			sort.Strings(users)
+			warn("Volumes are formatted as %v by %v, but %v isn't installed.", fs, strings.Join(users, ", "), formatCommand(fs))
+		}
+	}
+	// The default strategies pass over those which can't work here.
+	_, platform := c.DeviceReadiness.Platforms[runtime.GOOS]
+	for _, s := range c.DeviceReadiness.order() {
+		if !platform && len(c.DeviceReadiness.Strategies) == 0 {
+			break
+		}
+		if tool, ok := deviceStrategyTools[s]; ok {
+			if _, err := exec.LookPath(tool); err != nil {
+				warn("device_readiness: the %v strategy needs %v, which isn't installed.", s, tool)
+			}
+		}
+	}
+	if len(encrypted) > 0 {
+		if _, err := exec.LookPath("cryptsetup"); err != nil {
+			sort.Strings(encrypted)
+			warn("Volumes are encrypted by %v, but cryptsetup isn't installed.", strings.Join(encrypted, ", "))
+		}
+	}
+
+	// Files and directories.  The state file's is made if need be.
+	dirs := map[string]string{"fstab.path": filepath.Dir(c.Fstab.Path)}
+	if c.Audit.File != "" {
+		dirs["audit.file"] = filepath.Dir(c.Audit.File)
+	}
+	if c.Seed.Dir != "" {
+		dirs["seed.dir"] = c.Seed.Dir
+	}
+	for setting, dir := range dirs {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			warn("%v: directory %v doesn't exist.", setting, dir)
+		}
+	}
+	if ref := c.Auth.SecretRef(); strings.HasPrefix(ref, "file:") {
+		if _, err := os.Stat(strings.TrimPrefix(ref, "file:")); err != nil {
+			warn("auth: %v", err)
+		}
+	}
+	if c.DockerEvents.Socket != "" {
+		if fi, err := os.Stat(c.DockerEvents.Socket); err != nil || fi.Mode()&os.ModeSocket == 0 {
+			warn("docker_events.socket: %v isn't a socket.", c.DockerEvents.Socket)
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
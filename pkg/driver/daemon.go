@@ -0,0 +1,94 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Two daemons on one host would fight over devices and overwrite each other's
+// state, so each holds an exclusive lock on a file beside the state file for
+// as long as it runs, with its PID written in it.  A second daemon refuses to
+// start, unless it's told to replace the first, in which case it asks the
+// first to exit (as systemd would) and waits for it to.
+
+// defaultLockFile is the lock file when there's no state file to put it beside.
+const defaultLockFile = "/var/run/blocker.lock"
+
+// daemonLock is the open lock file, kept for the life of the process (closing
+// it would release the lock).
+var daemonLock *os.File
+
+func lockFile() string {
+	if path := GetConfig().StateFile; path != "" {
+		return path + ".lock"
+	}
+	return defaultLockFile
+}
+
+// LockDaemon takes the daemon lock.  If another daemon holds it, LockDaemon
+// fails, or with replace stops that daemon first.
+func LockDaemon(replace bool) error {
+	path := lockFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := tryLock(f); err == syscall.EWOULDBLOCK {
+		data, _ := ioutil.ReadAll(f)
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		if !replace {
+			f.Close()
+			return fmt.Errorf("Another blocker daemon (pid %v) holds %v; stop it first, or start with -replace to take over from it.",
+				pid, path)
+		}
+		if err := StopDaemon(pid, func() bool { return tryLock(f) != nil }); err != nil {
+			f.Close()
+			return err
+		}
+	} else if err != nil {
+		f.Close()
+		return fmt.Errorf("Locking %v failed: %v", path, err)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		return err
+	}
+	daemonLock = f
+	return nil
+}
+
+func tryLock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// StopDaemon asks the daemon with the given PID to exit, and waits until
+// running reports that it has.  The wait allows for it draining (see
+// Config.ShutdownGrace) and finishing its requests.
+func StopDaemon(pid int, running func() bool) error {
+	if pid <= 0 {
+		return fmt.Errorf("Can't tell which process the other blocker daemon is, to stop it.")
+	}
+	Log("Stopping the blocker daemon with pid %v, to replace it.\n", pid)
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("Stopping blocker daemon %v failed: %v", pid, err)
+	}
+	wait := time.Duration(GetConfig().ShutdownGrace) + 3*time.Minute
+	for deadline := time.Now().Add(wait); running(); time.Sleep(500 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("The blocker daemon with pid %v didn't exit within %v.", pid, wait)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SysBlockDir lists the kernel's block devices, partitions included.
+const SysBlockDir = "/sys/class/block"
+
+// Where an attached volume's device turns up, and how soon, varies with the
+// kernel and hypervisor: udev's by-id links, which embed the volume ID, are
+// the surest guide, but aren't there on every distribution, or in every
+// container.  So devices are looked for by a list of strategies (see
+// DeviceReadinessConfig), tried in turn until one finds the device, and
+// again every second until timeouts.device_wait is up.  A strategy which
+// can't work here (say, its tool isn't installed) is passed over.  Other
+// strategies can be added with RegisterDeviceStrategy.
+
+func init() {
+	DescribeMetric("blocker_devices_found_total",
+		"Attached volumes' devices found, by the strategy which found them.")
+}
+
+// DeviceStrategy looks for the device backing an attached EBS volume, given
+// its ID and the names it may have been given (the one it was attached as
+// and the Xen equivalent, or none where it's only known by ID), returning ""
+// if it isn't there (yet).
+type DeviceStrategy func(id string, names []string) (string, error)
+
+var (
+	deviceStrategiesMu sync.Mutex
+	deviceStrategies   = map[string]DeviceStrategy{
+		"by-id": findInDiskById,
+		"lstat": findByName,
+	}
+)
+
+// RegisterDeviceStrategy makes a way of finding devices available by name
+// (as used in device_readiness.strategies), replacing any registered before.
+func RegisterDeviceStrategy(name string, s DeviceStrategy) {
+	deviceStrategiesMu.Lock()
+	defer deviceStrategiesMu.Unlock()
+	deviceStrategies[name] = s
+}
+
+// UnregisterDeviceStrategy removes a way of finding devices, say one a test
+// registered.
+func UnregisterDeviceStrategy(name string) {
+	deviceStrategiesMu.Lock()
+	defer deviceStrategiesMu.Unlock()
+	delete(deviceStrategies, name)
+}
+
+func deviceStrategy(name string) (DeviceStrategy, bool) {
+	deviceStrategiesMu.Lock()
+	defer deviceStrategiesMu.Unlock()
+	s, ok := deviceStrategies[name]
+	return s, ok
+}
+
+// checkDeviceStrategies makes sure every strategy named is registered.
+func checkDeviceStrategies(names []string) error {
+	for _, name := range names {
+		if _, ok := deviceStrategy(name); !ok {
+			return fmt.Errorf("Unknown device readiness strategy %q.", name)
+		}
+	}
+	return nil
+}
+
+// order is the strategies to try on this platform.
+func (c DeviceReadinessConfig) order() []string {
+	if s, ok := c.Platforms[runtime.GOOS]; ok {
+		return s
+	}
+	if len(c.Strategies) > 0 {
+		return c.Strategies
+	}
+	return defaultDeviceStrategies
+}
+
+// deviceStrategyTools are the commands strategies need installed.
+var deviceStrategyTools = map[string]string{"udev": "udevadm", "nvme": "nvme"}
+
+// nvmeStrategies find devices by their NVMe serial numbers, and are passed
+// over while the nvme feature is off.
+var nvmeStrategies = map[string]bool{"sysfs": true, "nvme": true}
+
+// volumeSerial is the serial number an EBS volume's disk reports: its ID
+// without the hyphen.
+func volumeSerial(id string) string {
+	return strings.Replace(id, "-", "", 1)
+}
+
+// findInDiskById looks for the device backing an EBS volume in DiskByIdDir.
+func findInDiskById(id string, names []string) (string, error) {
+	serial := volumeSerial(id)
+	entries, err := filepath.Glob(filepath.Join(DiskByIdDir, "*"+serial+"*"))
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !wholeDisk(filepath.Base(entry), serial) {
+			continue
+		}
+		return filepath.EvalSymlinks(entry)
+	}
+	return "", nil
+}
+
+// findByName looks for the names the volume may have been given.
+func findByName(id string, names []string) (string, error) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if _, err := os.Lstat(name); err == nil {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// findDevice tries each of the configured strategies in turn for the device
+// backing an attached EBS volume, returning "" if none finds it.
+func findDevice(id string, names []string) string {
+	nvme := FeatureEnabled(featureNVMe, nil)
+	for _, name := range GetConfig().DeviceReadiness.order() {
+		s, ok := deviceStrategy(name)
+		if !ok || (nvmeStrategies[name] && !nvme) {
+			continue
+		}
+		dev, err := s(id, names)
+		if err != nil {
+			LogDebug("\tLooking for %v's device by %v failed: %v\n", id, name, err)
+			continue
+		}
+		if dev != "" {
+			IncCounter("blocker_devices_found_total", "strategy", name)
+			return dev
+		}
+	}
+	return ""
+}
+
+// findDeviceById looks for the device backing an attached EBS volume known
+// only by its ID, returning "" if there isn't one.
+func findDeviceById(id string) (string, error) {
+	return findDevice(id, nil), nil
+}
+
+// resolveDevice works out which local block device an attached EBS volume
+// ended up as, given the name we asked for and its equivalent here (see
+// altDevice).  It gives up if the request is cancelled.
+func resolveDevice(ctx context.Context, id string, dev string, altdev string) (string, error) {
+	deadline := time.Now().Add(time.Duration(GetConfig().Timeouts.DeviceWait))
+	for {
+		if found := findDevice(id, []string{dev, altdev}); found != "" {
+			return found, nil
+		}
+		if time.Now().After(deadline) {
+			return "", errorf(CodeDeviceMissing, "Device %v is missing after attach.", dev)
+		}
+		if err := sleep(ctx, time.Second); err != nil {
+			return "", err
+		}
+	}
+}
+
+// candidates expands the configured letter ranges, less any exclusions, into
+// the list of device letters to try, in order.
+func (c DeviceConfig) candidates() ([]string, error) {
+	excluded := make(map[string]bool)
+	for _, e := range c.Exclude {
+		e = strings.TrimPrefix(strings.TrimPrefix(e, "/dev/"), "sd")
+		if len(e) != 1 || e[0] < 'a' || e[0] > 'z' {
+			return nil, fmt.Errorf("Invalid excluded device letter %q.", e)
+		}
+		excluded[e] = true
+	}
+
+	var letters []string
+	seen := make(map[string]bool)
+	for _, r := range strings.Split(c.Letters, ",") {
+		r = strings.TrimSpace(r)
+		var from, to byte
+		switch {
+		case len(r) == 1:
+			from, to = r[0], r[0]
+		case len(r) == 3 && r[1] == '-':
+			from, to = r[0], r[2]
+		default:
+			return nil, fmt.Errorf("Invalid device letter range %q.", r)
+		}
+		if from < 'a' || to > 'z' || from > to {
+			return nil, fmt.Errorf("Invalid device letter range %q.", r)
+		}
+		for l := from; l <= to; l++ {
+			s := string(l)
+			if !excluded[s] && !seen[s] {
+				letters = append(letters, s)
+				seen[s] = true
+			}
+		}
+	}
+	return letters, nil
+}
@@ -0,0 +1,29 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DiskByIdDir holds GEOM's disk_ident labels for disks.  For EBS volumes on
+// Nitro instances these are the NVMe serial number, which is the volume ID
+// without its hyphen, e.g. DISK-vol0123456789abcdef0.
+const DiskByIdDir = "/dev/diskid"
+
+// defaultDeviceStrategies are tried when none are configured.
+var defaultDeviceStrategies = []string{"by-id", "lstat"}
+
+// wholeDisk reports whether a name in DiskByIdDir embedding serial is the
+// disk's, rather than a partition's (e.g. DISK-vol0123456789abcdef0p1).
+func wholeDisk(name string, serial string) bool {
+	return strings.HasSuffix(name, serial)
+}
+
+// altDevice is the name Xen instances give the disk attached as
+// /dev/sd<letter>: xbd0 for sda, xbd5 for sdf, and so on.
+func altDevice(letter string) string {
+	if len(letter) != 1 || letter[0] < 'a' || letter[0] > 'z' {
+		return ""
+	}
+	return fmt.Sprintf("/dev/xbd%d", letter[0]-'a')
+}
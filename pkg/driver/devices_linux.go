@@ -0,0 +1,107 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DiskByIdDir holds udev's stable names for block devices.  For EBS volumes
+// these embed the volume ID (without its hyphen), e.g.
+// nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0.
+const DiskByIdDir = "/dev/disk/by-id"
+
+// defaultDeviceStrategies are tried when none are configured.  The kernel's
+// own view (sysfs, then nvme-cli) covers hosts without udev's rules for EBS;
+// the names asked for are the last resort, as on Nitro instances they may
+// belong to another disk.
+var defaultDeviceStrategies = []string{"by-id", "sysfs", "nvme", "lstat"}
+
+func init() {
+	RegisterDeviceStrategy("sysfs", findBySysfsSerial)
+	RegisterDeviceStrategy("udev", findAfterUdev)
+	RegisterDeviceStrategy("nvme", findByNvmeList)
+}
+
+// wholeDisk reports whether a name in DiskByIdDir embedding serial is the
+// disk's, rather than a partition's (e.g.
+// nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0-part1).  Newer udevs
+// also link the disk with its NVMe namespace appended (..._1).
+func wholeDisk(name string, serial string) bool {
+	i := strings.Index(name, serial)
+	if i < 0 {
+		return false
+	}
+	rest := name[i+len(serial):]
+	return rest == "" || rest == "_1"
+}
+
+// altDevice is the name Xen instances give the disk attached as
+// /dev/sd<letter>.
+func altDevice(letter string) string {
+	return "/dev/xvd" + letter
+}
+
+// findBySysfsSerial looks for the disk whose serial number, as the kernel
+// reports it, is the volume's.  NVMe disks (so every volume on Nitro
+// instances) have one.
+func findBySysfsSerial(id string, names []string) (string, error) {
+	serial := volumeSerial(id)
+	files, err := filepath.Glob(filepath.Join(SysBlockDir, "*", "device", "serial"))
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil || strings.TrimSpace(string(data)) != serial {
+			continue
+		}
+		// Partitions have no device directory of their own, so this is
+		// the disk.
+		return "/dev/" + filepath.Base(filepath.Dir(filepath.Dir(file))), nil
+	}
+	return "", nil
+}
+
+// findAfterUdev waits for udev to finish handling the kernel's events (like
+// the new disk's), then looks in DiskByIdDir, so that the link is found as
+// soon as it's made.
+func findAfterUdev(id string, names []string) (string, error) {
+	if out, err := exec.Command("udevadm", "settle", "--timeout=1").CombinedOutput(); err != nil {
+		if _, lookErr := exec.LookPath("udevadm"); lookErr != nil {
+			return "", lookErr
+		}
+		LogDebug("\tudevadm settle: %v\n%v", err, string(out))
+	}
+	return findInDiskById(id, names)
+}
+
+// nvmeList is the output of `nvme list -o json`.
+type nvmeList struct {
+	Devices []struct {
+		DevicePath   string
+		SerialNumber string
+	}
+}
+
+// findByNvmeList asks nvme-cli for the NVMe disk whose serial number is the
+// volume's.
+func findByNvmeList(id string, names []string) (string, error) {
+	out, err := exec.Command("nvme", "list", "-o", "json").Output()
+	if err != nil {
+		return "", err
+	}
+	var list nvmeList
+	if err := json.Unmarshal(out, &list); err != nil {
+		return "", err
+	}
+	serial := volumeSerial(id)
+	for _, d := range list.Devices {
+		if strings.TrimSpace(d.SerialNumber) == serial {
+			return d.DevicePath, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,23 @@
+package driver
+
+import "testing"
+
+func TestWholeDisk(t *testing.T) {
+	serial := volumeSerial("vol-0123456789abcdef0")
+	for _, tc := range []struct {
+		name  string
+		whole bool
+	}{
+		{"nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0", true},
+		{"nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0_1", true},
+		{"nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0-part1", false},
+		{"nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0_1-part1", false},
+		// Another volume whose ID starts with this one's.
+		{"nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef01", false},
+		{"nvme-nvme.1d0f-766f6c30313233-416d617a6f6e-00000001", false},
+	} {
+		if got := wholeDisk(tc.name, serial); got != tc.whole {
+			t.Errorf("wholeDisk(%q) = %v, want %v", tc.name, got, tc.whole)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeviceCandidates(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		devices DeviceConfig
+		want    string
+		err     string
+	}{
+		{"default", defaultConfig().Devices, "fghijklmnop", ""},
+		{"custom range", DeviceConfig{Letters: "b-e"}, "bcde", ""},
+		{"several ranges", DeviceConfig{Letters: "x-z, f-h, b"}, "xyzfghb", ""},
+		{"overlapping ranges", DeviceConfig{Letters: "f-j,h-k"}, "fghijk", ""},
+		{"exclusions", DeviceConfig{Letters: "f-p", Exclude: []string{"g", "sdh", "/dev/sdp"}},
+			"fijklmno", ""},
+		{"everything excluded", DeviceConfig{Letters: "f", Exclude: []string{"f"}}, "", ""},
+		{"backwards range", DeviceConfig{Letters: "p-f"}, "", "Invalid device letter range"},
+		{"bad range", DeviceConfig{Letters: "f-"}, "", "Invalid device letter range"},
+		{"upper case", DeviceConfig{Letters: "F-P"}, "", "Invalid device letter range"},
+		{"bad exclusion", DeviceConfig{Letters: "f-p", Exclude: []string{"xvdf"}}, "",
+			"Invalid excluded device letter"},
+	} {
+		letters, err := tc.devices.candidates()
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%v: %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%v: got %v, want an error mentioning %q", tc.name, err, tc.err)
+		case tc.err == "" && strings.Join(letters, "") != tc.want:
+			t.Errorf("%v: candidates() = %q, want %q", tc.name, strings.Join(letters, ""), tc.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Everything stacked on a volume's disk (its LUKS container, and anything
+// else layered on the disk, a partition, or the container, like LVM or
+// dm-integrity) must be gone before the disk is detached.  Otherwise the
+// detach hangs until EC2 gives up, or the kernel is left with a
+// half-assembled stack over a missing disk, which blocks the next attach.
+// So teardownStack removes the stack top down, each device's holders (as
+// listed in sysfs) before the device itself.  Removals are retried, since
+// udev, or a process just closing the device, often holds it for a moment;
+// one which keeps failing stops the detach, naming the layer that's stuck
+// and how many times it's still open.
+
+func init() {
+	DescribeMetric("blocker_teardown_retries_total",
+		"Device-mapper removals retried while tearing down a volume's device stack.")
+}
+
+const (
+	// teardownAttempts is how many times a device-mapper device's removal
+	// is tried.
+	teardownAttempts = 5
+	// teardownBackoff is the wait before the first retry, doubling each
+	// time.
+	teardownBackoff = 200 * time.Millisecond
+)
+
+// blockName is a block device's name in SysBlockDir (e.g. nvme1n1 or dm-3).
+func blockName(dev string) (string, error) {
+	real, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(real), nil
+}
+
+// holders lists the devices stacked directly on a block device or its
+// partitions, by name in SysBlockDir.
+func holders(block string) []string {
+	direct, _ := filepath.Glob(filepath.Join(SysBlockDir, block, "holders", "*"))
+	partitions, _ := filepath.Glob(filepath.Join(SysBlockDir, block, block+"*", "holders", "*"))
+	var names []string
+	for _, path := range append(direct, partitions...) {
+		names = append(names, filepath.Base(path))
+	}
+	return names
+}
+
+// dmName is the device-mapper name of a block device.
+func dmName(block string) (string, error) {
+	name, err := ioutil.ReadFile(filepath.Join(SysBlockDir, block, "dm", "name"))
+	if err != nil {
+		return "", fmt.Errorf("%v is stacked on the volume, but isn't a device-mapper device, "+
+			"so can't be removed.", block)
+	}
+	return strings.TrimSpace(string(name)), nil
+}
+
+// teardownHolders removes everything stacked on a block device, top down.
+func teardownHolders(ctx context.Context, block string) error {
+	for _, holder := range holders(block) {
+		if err := teardownHolders(ctx, holder); err != nil {
+			return err
+		}
+		name, err := dmName(holder)
+		if err != nil {
+			return err
+		}
+		if err := removeDM(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDM removes a device-mapper device, retrying while it's busy.
+func removeDM(ctx context.Context, name string) error {
+	backoff := teardownBackoff
+	for attempt := 1; ; attempt++ {
+		out, err := exec.Command("dmsetup", "remove", "--retry", name).CombinedOutput()
+		if err == nil {
+			LogCtx(ctx, "\tRemoved device-mapper device %v.\n", name)
+			return nil
+		}
+		if _, serr := os.Lstat("/dev/mapper/" + name); os.IsNotExist(serr) {
+			// Gone anyway (say, udev got there first).
+			return nil
+		}
+		if attempt == teardownAttempts {
+			return fmt.Errorf("Removing device-mapper device %v failed (it's open %v time(s)): %v\n%v",
+				name, dmOpenCount(name), err, string(out))
+		}
+		AddCounter(1, "blocker_teardown_retries_total")
+		LogCtxDebug(ctx, "\tRemoving device-mapper device %v failed (will retry): %v\n", name, err)
+		exec.Command("udevadm", "settle").Run()
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// dmOpenCount is how many times a device-mapper device is open, or "an
+// unknown number of" if dmsetup can't say.
+func dmOpenCount(name string) string {
+	out, err := exec.Command("dmsetup", "info", "-c", "--noheadings", "-o", "open", name).Output()
+	if err != nil {
+		return "an unknown number of"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// teardownStack removes everything stacked on an attached volume's disk,
+// ahead of its detach.  Where the disk can't be found by ID, only the LUKS
+// container we open on it (and whatever's on that) is removed.
+func teardownStack(ctx context.Context, id string) error {
+	dev, err := findDeviceById(id)
+	if err != nil {
+		return err
+	}
+	if dev != "" {
+		block, err := blockName(dev)
+		if err != nil {
+			return err
+		}
+		return teardownHolders(ctx, block)
+	}
+	return closeEncrypted(ctx, id)
+}
@@ -0,0 +1,31 @@
+package driver
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// draining is set while the host is being evacuated: new work (Create and
+// Mount) is refused, but Unmount and Remove are still served so containers
+// can be stopped cleanly.  It is set during shutdown, and by operators via
+// `blocker drain`.
+var draining int32
+
+func IsDraining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+func SetDraining(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&draining, v) != v {
+		Events.Publish(VolumeEvent{Time: time.Now(), Type: eventDraining})
+		if on {
+			Log("Draining: refusing new mounts.\n")
+		} else {
+			Log("No longer draining: accepting new mounts.\n")
+		}
+	}
+}
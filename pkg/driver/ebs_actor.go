@@ -0,0 +1,117 @@
+package driver
+
+import (
+	"context"
+	"runtime/debug"
+)
+
+// Each volume's operations run one at a time on a goroutine of its own (the
+// volume's actor), so that an operation which hangs (on a stuck AWS call, say,
+// or a blocked umount) holds up only that volume, rather than every volume
+// the daemon serves.  d.mu is only held briefly, to look at or update shared
+// state, and never across AWS calls or external commands.  The fields of an
+// ebsVolume are changed only by its actor, holding d.mu; the actor may read
+// them at any time, and anyone else while holding d.mu.  After each
+// operation the driver's state is saved (see saveState).
+
+// volumeActor runs the operations on one volume.
+type volumeActor struct {
+	// queue holds the operations waiting to run, in order.  The actor exits
+	// when it finds it empty.  Guarded by d.mu.
+	queue []queuedOp
+}
+
+// queuedOp is an operation waiting for an actor, and where its result goes
+// (if anyone's waiting for it).
+type queuedOp struct {
+	run  func() error
+	done chan<- error
+}
+
+// submit queues op to run on the named volume's actor, starting the actor if
+// it isn't already running.  It never waits for the actor, so background
+// work can queue operations on any number of volumes, busy or not.
+func (d *EbsVolumeDriver) submit(name string, op func()) {
+	d.enqueue(name, queuedOp{run: func() error {
+		op()
+		return nil
+	}})
+}
+
+func (d *EbsVolumeDriver) enqueue(name string, op queuedOp) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	a, ok := d.actors[name]
+	if !ok {
+		a = &volumeActor{}
+		d.actors[name] = a
+		go d.runActor(name, a)
+	}
+	a.queue = append(a.queue, op)
+}
+
+// do runs op on the named volume's actor and waits for its result, which
+// mentions any EBS issue AWS Health reports (see annotateImpairment).
+func (d *EbsVolumeDriver) do(name string, op func() error) error {
+	done := make(chan error, 1)
+	d.enqueue(name, queuedOp{run: op, done: done})
+	return d.annotateImpairment(<-done)
+}
+
+func (d *EbsVolumeDriver) runActor(name string, a *volumeActor) {
+	for {
+		d.mu.Lock()
+		if len(a.queue) == 0 {
+			delete(d.actors, name)
+			d.mu.Unlock()
+			return
+		}
+		op := a.queue[0]
+		a.queue = a.queue[1:]
+		d.mu.Unlock()
+
+		err := d.runOp(name, op.run)
+		if op.done != nil {
+			op.done <- err
+		}
+		d.saveState(context.Background())
+		d.setVolumeGauges()
+	}
+}
+
+// runOp runs an operation, turning a panic into an error (as withRecovery
+// does for requests), so that one bad operation neither takes the daemon
+// down nor leaves its caller waiting forever.
+func (d *EbsVolumeDriver) runOp(name string, op func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			LogError("Panic in an operation on %v: %v\n%s", name, p, debug.Stack())
+			IncCounter("blocker_panics_total", "handler", "actor")
+			err = errorf(CodeInternal, "Internal error: %v", p)
+		}
+	}()
+	return op()
+}
+
+// busy reports whether the named volume has operations queued or running.
+// Background work skips busy volumes rather than queueing up behind them.
+// The caller must hold d.mu.
+func (d *EbsVolumeDriver) busy(name string) bool {
+	_, ok := d.actors[name]
+	return ok
+}
+
+// volume looks up a volume by name.
+func (d *EbsVolumeDriver) volume(name string) (*ebsVolume, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.volumes[name]
+	return v, ok
+}
+
+// update changes shared state (such as a volume's fields) holding d.mu.
+func (d *EbsVolumeDriver) update(f func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f()
+}
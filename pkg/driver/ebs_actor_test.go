@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConfig installs the default configuration, as changed by change, for
+// the rest of a test.  Nothing is saved to a state file.
+func testConfig(t *testing.T, change func(c *Config)) {
+	t.Helper()
+	old := GetConfig()
+	c := defaultConfig()
+	c.StateFile = ""
+	if change != nil {
+		change(c)
+	}
+	SetConfig(c)
+	t.Cleanup(func() { SetConfig(old) })
+}
+
+// newTestDriver makes a driver with just its bookkeeping, for tests which
+// don't reach AWS.
+func newTestDriver(t *testing.T) *EbsVolumeDriver {
+	t.Helper()
+	testConfig(t, nil)
+	return &EbsVolumeDriver{
+		volumes:  make(map[string]*ebsVolume),
+		actors:   make(map[string]*volumeActor),
+		inflight: make(map[string]*inflightOp),
+	}
+}
+
+// waitIdle waits for every actor to finish.
+func waitIdle(t *testing.T, d *EbsVolumeDriver) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		n := len(d.actors)
+		d.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v actor(s) still running", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestActorRunsInOrder(t *testing.T) {
+	d := newTestDriver(t)
+	var mu sync.Mutex
+	var got []int
+	for i := 0; i < 100; i++ {
+		i := i
+		d.submit("vol", func() {
+			mu.Lock()
+			got = append(got, i)
+			mu.Unlock()
+		})
+	}
+	waitIdle(t, d)
+	if len(got) != 100 {
+		t.Fatalf("ran %v operations, want 100", len(got))
+	}
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("operation %v ran as number %v", n, i)
+		}
+	}
+}
+
+func TestActorRunsOneAtATime(t *testing.T) {
+	d := newTestDriver(t)
+	var mu sync.Mutex
+	running, most := 0, 0
+	for i := 0; i < 20; i++ {
+		d.submit("vol", func() {
+			mu.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+	}
+	waitIdle(t, d)
+	if most != 1 {
+		t.Errorf("%v operations ran at once on one volume", most)
+	}
+}
+
+func TestBusyVolumeHoldsUpOnlyItself(t *testing.T) {
+	d := newTestDriver(t)
+	release := make(chan struct{})
+	defer waitIdle(t, d)
+	defer close(release)
+	d.submit("stuck", func() { <-release })
+
+	// More work for the stuck volume is queued, not waited for.
+	queued := make(chan struct{})
+	go func() {
+		d.submit("stuck", func() {})
+		close(queued)
+	}()
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("submit waited for a busy volume")
+	}
+
+	err := d.do("other", func() error { return nil })
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+	d.mu.Lock()
+	busy, other := d.busy("stuck"), d.busy("other")
+	d.mu.Unlock()
+	if !busy {
+		t.Error("a volume with an operation running isn't busy")
+	}
+	if other {
+		t.Error("a volume whose operations are done is still busy")
+	}
+}
+
+func TestDoReturnsResult(t *testing.T) {
+	d := newTestDriver(t)
+	if err := d.do("vol", func() error { return errNameNotFound }); err != errNameNotFound {
+		t.Errorf("do returned %v, want %v", err, errNameNotFound)
+	}
+	waitIdle(t, d)
+}
+
+func TestActorRecoversPanics(t *testing.T) {
+	d := newTestDriver(t)
+	err := d.do("vol", func() error { panic("boom") })
+	if code := ErrorCodeOf(err); code != CodeInternal {
+		t.Errorf("do returned %v, want a %v error", err, CodeInternal)
+	}
+	d.submit("vol", func() { panic("boom") })
+
+	// The volume's actor carries on with the next operation.
+	if err := d.do("vol", func() error { return nil }); err != nil {
+		t.Errorf("do after a panic: %v", err)
+	}
+	waitIdle(t, d)
+}
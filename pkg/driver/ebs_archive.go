@@ -0,0 +1,140 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Before blocker deletes a volume (see deleteIfEphemeral), it can archive
+// it: take a final snapshot, optionally copy it to an archive region and
+// share it with an archive account, and tag it with how long it must be
+// retained.  If any step fails the volume is kept, so nothing is lost.
+
+func init() {
+	DescribeMetric("blocker_archives_total",
+		"Final snapshots taken of volumes before deletion, by outcome.")
+}
+
+// archived reports whether the volume should be archived before deletion,
+// according to its archive option or, failing that, the configuration.
+func (v *ebsVolume) archived() (bool, error) {
+	a, ok := v.opts["archive"]
+	if !ok {
+		return GetConfig().Archive.Enabled, nil
+	}
+	b, err := strconv.ParseBool(a)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for archive: %q.", a)
+	}
+	return b, nil
+}
+
+// archive runs the archival pipeline for a volume about to be deleted.
+func (d *EbsVolumeDriver) archive(ctx context.Context, name string, id string) error {
+	err := d.archiveSnapshot(ctx, name, id)
+	outcome := "archived"
+	if err != nil {
+		outcome = "failed"
+	}
+	IncCounter("blocker_archives_total", "outcome", outcome)
+	return err
+}
+
+func (d *EbsVolumeDriver) archiveSnapshot(ctx context.Context, name string, id string) error {
+	c := GetConfig().Archive
+	tags := ownedTags(
+		newTag("Name", name),
+		newTag(tagVolume, name),
+		newTag(tagArchivedFrom, id),
+		newTag(tagRetainUntil,
+			time.Now().Add(time.Duration(c.Retention)).UTC().Format(time.RFC3339)),
+	)
+
+	LogCtx(ctx, "\tArchiving EBS volume %v before deleting it...\n", id)
+	var out *ec2.Snapshot
+	err := queueSnapshot(ctx, func() (err error) {
+		out, err = d.ec2.CreateSnapshotWithContext(ctx, &ec2.CreateSnapshotInput{
+			VolumeId:    aws.String(id),
+			Description: aws.String("blocker archive of " + name),
+			TagSpecifications: []*ec2.TagSpecification{{
+				ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+				Tags:         tags,
+			}},
+		}, d.awsOpts(ctx)...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	snap := aws.StringValue(out.SnapshotId)
+	if err := d.waitUntilSnapshotCompleted(ctx, d.ec2, snap); err != nil {
+		return err
+	}
+
+	// Copy it to the archive region, and keep only the copy.
+	var svc ec2iface.EC2API = d.ec2
+	if c.Region != "" && c.Region != d.awsRegion {
+		svc = ec2.New(d.session, &aws.Config{Region: aws.String(c.Region)})
+		input := &ec2.CopySnapshotInput{
+			SourceSnapshotId: aws.String(snap),
+			SourceRegion:     aws.String(d.awsRegion),
+			Description:      aws.String("blocker archive of " + name),
+			TagSpecifications: []*ec2.TagSpecification{{
+				ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+				Tags:         tags,
+			}},
+		}
+		if c.KMSKey != "" {
+			input.Encrypted = aws.Bool(true)
+			input.KmsKeyId = aws.String(c.KMSKey)
+		} else if encrypted, _, err := d.snapshotEncryption(ctx, snap); err != nil {
+			return err
+		} else if encrypted {
+			// KMS keys don't leave their region, so the copy can't keep
+			// the snapshot's.
+			input.Encrypted = aws.Bool(true)
+			LogCtxWarn(ctx, "\tArchive %v is re-encrypted with the default EBS key in %v; "+
+				"set archive.kms_key to choose one.\n", snap, c.Region)
+		}
+		out, err := svc.CopySnapshotWithContext(ctx, input, d.awsOpts(ctx)...)
+		if err != nil {
+			return err
+		}
+		copied := aws.StringValue(out.SnapshotId)
+		LogCtx(ctx, "\tCopying archive %v to %v in %v...\n", snap, copied, c.Region)
+		if err := d.waitUntilSnapshotCompleted(ctx, svc, copied); err != nil {
+			return err
+		}
+		if _, err := d.ec2.DeleteSnapshotWithContext(ctx, &ec2.DeleteSnapshotInput{
+			SnapshotId: aws.String(snap),
+		}, d.awsOpts(ctx)...); err != nil {
+			LogCtxWarn(ctx, "\tDeleting local archive snapshot %v failed: %v\n", snap, err)
+		}
+		snap = copied
+	}
+
+	// Let the archive account(s) at it.
+	if len(c.ShareWith) > 0 {
+		var perms []*ec2.CreateVolumePermission
+		for _, account := range c.ShareWith {
+			perms = append(perms, &ec2.CreateVolumePermission{UserId: aws.String(account)})
+		}
+		if _, err := svc.ModifySnapshotAttributeWithContext(ctx, &ec2.ModifySnapshotAttributeInput{
+			SnapshotId:             aws.String(snap),
+			Attribute:              aws.String(ec2.SnapshotAttributeNameCreateVolumePermission),
+			CreateVolumePermission: &ec2.CreateVolumePermissionModifications{Add: perms},
+		}, d.awsOpts(ctx)...); err != nil {
+			return err
+		}
+	}
+
+	LogCtx(ctx, "\tArchived EBS volume %v as %v.\n", id, snap)
+	publishEvent(ctx, VolumeEvent{Type: eventArchived, Name: name, VolumeId: id})
+	return nil
+}
@@ -0,0 +1,241 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ebsAttacher attaches EBS volumes to this instance.
+type ebsAttacher struct {
+	d *EbsVolumeDriver
+	// deviceExists reports whether a device node is present; it's
+	// deviceNodeExists but for tests.
+	deviceExists func(dev string) bool
+}
+
+func deviceNodeExists(dev string) bool {
+	_, err := os.Lstat(dev)
+	return err == nil
+}
+
+// Attach attaches the volume at the first free device.  Until AWS has
+// accepted the attach, nothing stops another attach choosing the same
+// device, so only one of us looks at a time, and the device is claimed for
+// the volume until it's detached.  See
+// http://docs.aws.amazon.com/AWSEC2/latest/UserGuide/device_naming.html
+// for recommended naming scheme (/dev/sd[f-p], which is the default).
+func (a ebsAttacher) Attach(ctx context.Context, id string) (string, error) {
+	d := a.d
+	devices := GetConfig().Devices
+	letters, err := devices.candidates()
+	if err != nil {
+		return "", err
+	}
+	letters = a.preferDevice(ctx, id, letters)
+	d.attachMu.Lock()
+	defer d.attachMu.Unlock()
+	if err := a.checkSlots(ctx, devices); err != nil {
+		return "", err
+	}
+	for _, c := range letters {
+		dev := "/dev/sd" + c
+		altdev := altDevice(c)
+
+		if _, ok := d.reserved[c]; ok {
+			continue
+		}
+		if _, ok := d.claimed[c]; ok {
+			continue
+		}
+
+		if a.deviceExists(dev) || a.deviceExists(altdev) {
+			continue
+		}
+
+		publishEvent(ctx, VolumeEvent{Type: eventAttaching, VolumeId: id, Device: dev})
+		if _, err := d.ec2.AttachVolumeWithContext(ctx, &ec2.AttachVolumeInput{
+			Device:     aws.String(dev),
+			InstanceId: aws.String(d.awsInstanceId),
+			VolumeId:   aws.String(id),
+		}, d.awsOpts(ctx)...); err != nil {
+			if awsErr, ok := err.(awserr.Error); ok &&
+				awsErr.Code() == "InvalidParameterValue" {
+				// If AWS is simply reporting that the device is already in
+				// use, then go ahead and check the next one.
+				continue
+			}
+
+			return "", err
+		}
+		d.claimed[c] = id
+		return dev, nil
+	}
+
+	return "", errorf(CodeNoDevices, "No devices available for attach: /dev/sd[%v] taken.",
+		strings.Join(letters, ""))
+}
+
+// preferDevice puts the device letter a volume asks for in its blocker:device
+// tag (e.g. sdj) first, for tooling or licensing which depends on stable
+// device names.  If it's taken, the volume gets the next free one as usual.
+// Letters outside those we may use are ignored.
+func (a ebsAttacher) preferDevice(ctx context.Context, id string, letters []string) []string {
+	vol, err := a.d.describeVolume(ctx, id)
+	if err != nil {
+		LogCtxWarn(ctx, "\tChecking %v for a preferred device failed: %v\n", id, err)
+		return letters
+	}
+	tag := tagValue(vol.Tags, tagDevice)
+	if tag == "" {
+		return letters
+	}
+	want := deviceLetter(tag)
+	if want == "" {
+		want = deviceLetter("sd" + tag)
+	}
+	for i, l := range letters {
+		if l == want {
+			return append([]string{l}, append(letters[:i:i], letters[i+1:]...)...)
+		}
+	}
+	LogCtxWarn(ctx, "\tIgnoring %v=%v on %v: not one of the device letters in use (%v).\n",
+		tagDevice, tag, id, strings.Join(letters, ""))
+	return letters
+}
+
+// checkSlots refuses an attach which would use one of the attachment slots
+// reserved for others.
+func (a ebsAttacher) checkSlots(ctx context.Context, devices DeviceConfig) error {
+	if devices.ReservedSlots == 0 {
+		return nil
+	}
+	d := a.d
+	out, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{newFilter("attachment.instance-id", d.awsInstanceId)},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return err
+	}
+	if free := devices.MaxAttachments - len(out.Volumes); free <= devices.ReservedSlots {
+		return errorf(CodeNoDevices,
+			"No attachment slots available: %v of %v in use, and the last %v are reserved.",
+			len(out.Volumes), devices.MaxAttachments, devices.ReservedSlots)
+	}
+	return nil
+}
+
+// Detach also gives up the volume's claim on its device letter, whenever
+// the volume is left detached: including when EC2 says it already was, or
+// that it's gone.
+func (a ebsAttacher) Detach(ctx context.Context, id string) error {
+	d := a.d
+	_, err := d.ec2.DetachVolumeWithContext(ctx, &ec2.DetachVolumeInput{
+		InstanceId: aws.String(d.awsInstanceId),
+		VolumeId:   aws.String(id),
+	}, d.awsOpts(ctx)...)
+	if err != nil && !detachedAnyway(err) {
+		return err
+	}
+	d.attachMu.Lock()
+	defer d.attachMu.Unlock()
+	for c, claimant := range d.claimed {
+		if claimant == id {
+			delete(d.claimed, c)
+		}
+	}
+	return err
+}
+
+// detachedAnyway reports whether a failed detach left the volume detached
+// all the same: it wasn't attached, or it, or its attachment, doesn't exist.
+func detachedAnyway(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "IncorrectState", "InvalidVolume.NotFound", "InvalidAttachment.NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// Wait ignores other instances' attachments of Multi-Attach volumes which
+// may be shared (see sharedAttach).
+func (a ebsAttacher) Wait(ctx context.Context, id string, attached bool) error {
+	shared := a.d.sharedAttach(id)
+	if !attached && !shared {
+		return a.d.waitUntilAvailable(ctx, id)
+	}
+	return a.d.waitUntilState(ctx, id, func(volume *ec2.Volume) error {
+		if !shared || !aws.BoolValue(volume.MultiAttachEnabled) {
+			if !attached {
+				if *volume.State == ec2.VolumeStateAvailable {
+					return nil
+				}
+				return fmt.Errorf(
+					"Volume state transition failed: seeking %v, current is %v",
+					ec2.VolumeStateAvailable, *volume.State)
+			}
+			return ourAttachment(volume.Attachments)
+		}
+		var attachments []*ec2.VolumeAttachment
+		for _, at := range volume.Attachments {
+			if aws.StringValue(at.InstanceId) == a.d.awsInstanceId {
+				attachments = append(attachments, at)
+			}
+		}
+		if !attached {
+			if len(attachments) == 0 {
+				return nil
+			}
+			return fmt.Errorf("Volume state transition failed: still %v here",
+				aws.StringValue(attachments[0].State))
+		}
+		return ourAttachment(attachments)
+	})
+}
+
+// ourAttachment checks that a volume's attachments (or those of them which
+// are this instance's) are one, finished, attachment.
+func ourAttachment(attachments []*ec2.VolumeAttachment) error {
+	var attachment *ec2.VolumeAttachment
+	if len(attachments) == 1 {
+		attachment = attachments[0]
+		if *attachment.State == ec2.VolumeAttachmentStateAttached {
+			return nil
+		}
+	}
+	if attachment == nil {
+		return fmt.Errorf(
+			"Volume state transition failed: expected 1 attachment, got %v",
+			len(attachments))
+	}
+	return fmt.Errorf(
+		"Volume state transition failed: seeking %v, current is %v",
+		ec2.VolumeAttachmentStateAttached, *attachment.State)
+}
+
+// sharedAttach reports whether a volume may be attached here alongside other
+// instances, if it's Multi-Attach: whether the multi-attach feature is on for
+// it.
+func (d *EbsVolumeDriver) sharedAttach(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, v := range d.volumes {
+		if v.id == id {
+			return FeatureEnabled(featureMultiAttach, v.opts)
+		}
+	}
+	return false
+}
+
+// ResolveDevice also tries the Xen equivalent of the /dev/sd* name the volume
+// was attached as.
+func (a ebsAttacher) ResolveDevice(ctx context.Context, id string, dev string) (string, error) {
+	return resolveDevice(ctx, id, dev, altDevice(strings.TrimPrefix(dev, "/dev/sd")))
+}
@@ -0,0 +1,164 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// attachEC2 accepts every attach, as EC2 can before it notices that a device
+// is taken, recording the devices asked for.
+type attachEC2 struct {
+	ec2iface.EC2API
+
+	mu sync.Mutex
+	// attached holds the volume attached as each device.
+	attached map[string]string
+	// doubled lists the devices asked for twice.
+	doubled []string
+	// detachErr is what detaches fail with, if anything.
+	detachErr error
+}
+
+func (e *attachEC2) DescribeVolumesWithContext(ctx aws.Context, in *ec2.DescribeVolumesInput,
+	opts ...request.Option) (*ec2.DescribeVolumesOutput, error) {
+	var out ec2.DescribeVolumesOutput
+	for _, id := range in.VolumeIds {
+		out.Volumes = append(out.Volumes, &ec2.Volume{VolumeId: id,
+			State: aws.String(ec2.VolumeStateAvailable)})
+	}
+	return &out, nil
+}
+
+func (e *attachEC2) AttachVolumeWithContext(ctx aws.Context, in *ec2.AttachVolumeInput,
+	opts ...request.Option) (*ec2.VolumeAttachment, error) {
+	// Give another attach time to choose the same device.
+	time.Sleep(time.Millisecond)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	dev := aws.StringValue(in.Device)
+	if _, ok := e.attached[dev]; ok {
+		e.doubled = append(e.doubled, dev)
+	}
+	e.attached[dev] = aws.StringValue(in.VolumeId)
+	return &ec2.VolumeAttachment{Device: in.Device, VolumeId: in.VolumeId}, nil
+}
+
+func (e *attachEC2) DetachVolumeWithContext(ctx aws.Context, in *ec2.DetachVolumeInput,
+	opts ...request.Option) (*ec2.VolumeAttachment, error) {
+	if e.detachErr != nil {
+		return nil, e.detachErr
+	}
+	return &ec2.VolumeAttachment{VolumeId: in.VolumeId}, nil
+}
+
+// testAttacher is an ebsAttacher which sees only the given device nodes,
+// rather than the host's.
+func testAttacher(d *EbsVolumeDriver, present ...string) ebsAttacher {
+	return ebsAttacher{d: d, deviceExists: func(dev string) bool {
+		for _, p := range present {
+			if dev == p {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+func TestAttachChoosesFreeDevices(t *testing.T) {
+	d := newTestDriver(t)
+	sim := &attachEC2{attached: map[string]string{}}
+	d.ec2 = sim
+	d.reserved = map[string]string{"f": "/dev/sda1"}
+	d.claimed = map[string]string{"g": "vol-0000000000000000g"}
+	// Devices left by something else, under either name, are skipped too.
+	a := testAttacher(d, "/dev/sdh", "/dev/xvdi")
+
+	var wg sync.WaitGroup
+	devices := make([]string, 6)
+	errs := make([]error, len(devices))
+	for i := range devices {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			devices[i], errs[i] = a.Attach(context.Background(), fmt.Sprintf("vol-%017d", i))
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for i, dev := range devices {
+		if errs[i] != nil {
+			t.Fatalf("attach %v: %v", i, errs[i])
+		}
+		if dev == "/dev/sdf" || dev == "/dev/sdg" || dev == "/dev/sdh" || dev == "/dev/sdi" {
+			t.Errorf("attach %v chose %v, which is taken", i, dev)
+		}
+		if seen[dev] {
+			t.Errorf("%v was chosen twice", dev)
+		}
+		seen[dev] = true
+	}
+	if len(sim.doubled) > 0 {
+		t.Errorf("EC2 was asked to attach to %v more than once", sim.doubled)
+	}
+	if n := len(d.claimed); n != len(devices)+1 {
+		t.Errorf("%v device(s) claimed, want %v", n, len(devices)+1)
+	}
+
+	// Detaching gives the device back.
+	if err := a.Detach(context.Background(), fmt.Sprintf("vol-%017d", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.claimed[strings.TrimPrefix(devices[0], "/dev/sd")]; ok {
+		t.Errorf("%v is still claimed after its volume was detached", devices[0])
+	}
+}
+
+func TestAttachRunsOutOfDevices(t *testing.T) {
+	d := newTestDriver(t)
+	testConfig(t, func(c *Config) { c.Devices.Letters = "f-g" })
+	d.ec2 = &attachEC2{attached: map[string]string{}}
+	d.reserved = map[string]string{"f": "/dev/sda1"}
+	d.claimed = map[string]string{"g": "vol-0000000000000000g"}
+
+	_, err := testAttacher(d).Attach(context.Background(), "vol-0123456789abcdef0")
+	if code := ErrorCodeOf(err); code != CodeNoDevices {
+		t.Errorf("Attach() = %v, want a %v error", err, CodeNoDevices)
+	}
+}
+
+func TestDetachReleasesDevice(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		released bool
+	}{
+		{"detached", nil, true},
+		{"not attached", awserr.New("IncorrectState", "Volume is in the 'available' state.", nil), true},
+		{"deleted", awserr.New("InvalidVolume.NotFound", "The volume does not exist.", nil), true},
+		{"failed", awserr.New("UnauthorizedOperation", "Not allowed.", nil), false},
+	} {
+		d := newTestDriver(t)
+		d.ec2 = &attachEC2{attached: map[string]string{}, detachErr: tc.err}
+		d.claimed = map[string]string{"f": "vol-0123456789abcdef0"}
+
+		err := testAttacher(d).Detach(context.Background(), "vol-0123456789abcdef0")
+		if err != tc.err {
+			t.Errorf("%v: Detach() = %v, want %v", tc.name, err, tc.err)
+		}
+		if _, claimed := d.claimed["f"]; claimed == tc.released {
+			t.Errorf("%v: /dev/sdf claimed = %v, want %v", tc.name, claimed, !tc.released)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package driver
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Security teams want to know what containers touch on volumes holding
+// regulated data.  A volume created with `-o audit=true` has its accesses
+// logged while it's mounted: which files were opened, and which were
+// modified (written and closed), by what process in which container.
+// audit-paths narrows the log to files matching any of a comma-separated
+// list of glob patterns, matched against both the path and the file name
+// (e.g. `audit-paths=*.csv,/data/secret/*`).
+//
+// Events come from fanotify, watching the volume's whole filesystem so that
+// containers' bind mounts of it are covered too.  Paths are as the opening
+// process sees them.  They're logged, or appended to audit.file as JSON
+// lines, at no more than audit.rate per second per volume; the excess is
+// counted and reported as suppressed.  The daemon's own accesses aren't
+// logged.
+
+func init() {
+	DescribeMetric("blocker_audit_events_total",
+		"File accesses recorded by the audit option, by event (open or modify).")
+	DescribeMetric("blocker_audit_suppressed_total",
+		"File accesses not recorded by the audit option, because of its rate limit or a full queue.")
+}
+
+// fanotify's ABI, from <linux/fanotify.h>.
+const (
+	fanCloexec        = 0x1
+	fanNonblock       = 0x2
+	fanClassNotif     = 0x0
+	fanMarkAdd        = 0x1
+	fanMarkFilesystem = 0x100
+	fanModify         = 0x2
+	fanCloseWrite     = 0x8
+	fanOpen           = 0x20
+	fanQOverflow      = 0x4000
+	fanMetadataLen    = 24
+)
+
+// AccessEvent is a file access recorded by the audit option.
+type AccessEvent struct {
+	Time      time.Time
+	Volume    string
+	VolumeId  string
+	Event     string
+	Path      string
+	Pid       int
+	Command   string `json:",omitempty"`
+	Container string `json:",omitempty"`
+}
+
+// audited reports whether the volume's accesses are to be logged, according
+// to its audit option, and the patterns of its audit-paths option.
+func (v *ebsVolume) audited() (bool, []string, error) {
+	a, ok := v.opts["audit"]
+	if !ok {
+		return false, nil, nil
+	}
+	on, err := strconv.ParseBool(a)
+	if err != nil {
+		return false, nil, fmt.Errorf("Invalid value for audit: %q.", a)
+	}
+	var patterns []string
+	if p := v.opts["audit-paths"]; p != "" {
+		for _, pattern := range strings.Split(p, ",") {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return false, nil, fmt.Errorf("Invalid audit-paths pattern %q: %v", pattern, err)
+			}
+			patterns = append(patterns, pattern)
+		}
+	}
+	return on, patterns, nil
+}
+
+// auditor watches a mounted volume's filesystem for accesses.
+type auditor struct {
+	name     string
+	id       string
+	patterns []string
+	f        *os.File
+	limit    *rateLimiter
+}
+
+// startAudit starts logging accesses to a mounted volume, if it has the audit
+// option.  Failing to doesn't fail the mount, but is logged as an error.
+func (d *EbsVolumeDriver) startAudit(ctx context.Context, name string, v *ebsVolume) {
+	on, patterns, _ := v.audited()
+	if !on || v.audit != nil || v.mountpoint == "" {
+		return
+	}
+	a := &auditor{name: name, id: v.id, patterns: patterns,
+		limit: newRateLimiter(GetConfig().Audit.Rate)}
+	if err := a.watch(v.mountpoint); err != nil {
+		LogCtxError(ctx, "Auditing accesses to %v failed: %v\n", name, err)
+		return
+	}
+	go a.read(withVolumeFields(context.WithoutCancel(ctx), v, "volume", name))
+	d.update(func() { v.audit = a })
+	LogCtx(ctx, "\tAuditing accesses to %v.\n", name)
+}
+
+// stopAudit stops logging accesses to a volume, ahead of its unmount.
+func (d *EbsVolumeDriver) stopAudit(v *ebsVolume) {
+	if v.audit == nil {
+		return
+	}
+	v.audit.f.Close()
+	d.update(func() { v.audit = nil })
+}
+
+// read records the auditor's events until its fanotify fd is closed.
+func (a *auditor) read(ctx context.Context) {
+	self := os.Getpid()
+	buf := make([]byte, 64*fanMetadataLen)
+	for {
+		n, err := a.f.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+fanMetadataLen <= n; {
+			length := int(binary.LittleEndian.Uint32(buf[off:]))
+			mask := binary.LittleEndian.Uint64(buf[off+8:])
+			fd := int32(binary.LittleEndian.Uint32(buf[off+16:]))
+			pid := int(int32(binary.LittleEndian.Uint32(buf[off+20:])))
+			if length < fanMetadataLen {
+				break
+			}
+			off += length
+
+			if mask&fanQOverflow != 0 {
+				LogCtxWarn(ctx, "Audit events for %v were lost: the fanotify queue overflowed.\n", a.name)
+				AddCounter(1, "blocker_audit_suppressed_total")
+			}
+			if fd < 0 {
+				continue
+			}
+			path, _ := os.Readlink("/proc/self/fd/" + strconv.Itoa(int(fd)))
+			syscall.Close(int(fd))
+			if pid == self || !a.matches(path) {
+				continue
+			}
+			if mask&fanOpen != 0 {
+				a.record(ctx, "open", path, pid)
+			}
+			if mask&fanCloseWrite != 0 {
+				a.record(ctx, "modify", path, pid)
+			}
+		}
+	}
+}
+
+// matches reports whether a path is among those audited.
+func (a *auditor) matches(path string) bool {
+	if len(a.patterns) == 0 {
+		return true
+	}
+	for _, pattern := range a.patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *auditor) record(ctx context.Context, event string, path string, pid int) {
+	allowed, suppressed := a.limit.allow(time.Now())
+	if suppressed > 0 {
+		LogCtxWarn(ctx, "Suppressed %v audit events for %v.\n", suppressed, a.name)
+	}
+	if !allowed {
+		AddCounter(1, "blocker_audit_suppressed_total")
+		return
+	}
+	IncCounter("blocker_audit_events_total", "event", event)
+
+	e := AccessEvent{
+		Time:      time.Now().UTC(),
+		Volume:    a.name,
+		VolumeId:  a.id,
+		Event:     event,
+		Path:      path,
+		Pid:       pid,
+		Command:   processCommand(pid),
+		Container: processContainer(pid),
+	}
+	if file := GetConfig().Audit.File; file != "" {
+		if err := appendAuditEvent(file, e); err != nil {
+			LogCtxError(ctx, "Writing to the audit file %v failed: %v\n", file, err)
+		}
+		return
+	}
+	LogCtx(WithLogFields(ctx, "event", event, "path", path, "pid", strconv.Itoa(pid),
+		"container", e.Container), "audit: %v %v by %v (pid %v, container %v)\n",
+		event, path, e.Command, pid, e.Container)
+}
+
+// auditFile is the file audit events are appended to, kept open.
+var auditFile struct {
+	sync.Mutex
+	path string
+	f    *os.File
+}
+
+func appendAuditEvent(path string, e AccessEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	auditFile.Lock()
+	defer auditFile.Unlock()
+	if auditFile.path != path {
+		if auditFile.f != nil {
+			auditFile.f.Close()
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			auditFile.path, auditFile.f = "", nil
+			return err
+		}
+		auditFile.path, auditFile.f = path, f
+	}
+	_, err = auditFile.f.Write(append(data, '\n'))
+	return err
+}
+
+// processCommand is the name of a process's command, if it's still running.
+func processCommand(pid int) string {
+	comm, _ := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/comm")
+	return strings.TrimSpace(string(comm))
+}
+
+// containerId matches the IDs of Docker containers in cgroup paths.
+var containerId = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// processContainer is the ID of the container a process runs in, as found in
+// its cgroup, or "" if it's on the host (or gone).
+func processContainer(pid int) string {
+	cgroup, _ := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	return containerId.FindString(string(cgroup))
+}
+
+// rateLimiter is a token bucket, allowing rate events a second on average,
+// and as many at once.
+type rateLimiter struct {
+	rate       float64
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate)}
+}
+
+// allow reports whether an event may go ahead and, the first time one may
+// after some were refused, how many were.
+func (l *rateLimiter) allow(now time.Time) (bool, int) {
+	if l.rate == 0 {
+		return true, 0
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		l.suppressed++
+		return false, 0
+	}
+	l.tokens--
+	suppressed := l.suppressed
+	l.suppressed = 0
+	return true, suppressed
+}
@@ -0,0 +1,6 @@
+package driver
+
+// watch fails: only Linux has fanotify.
+func (a *auditor) watch(mnt string) error {
+	return errorf(CodeNotSupported, "Auditing needs fanotify, which only Linux has.")
+}
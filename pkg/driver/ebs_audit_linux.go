@@ -0,0 +1,34 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// watch marks the filesystem mounted at mnt for fanotify.
+func (a *auditor) watch(mnt string) error {
+	fd, _, errno := syscall.Syscall(syscall.SYS_FANOTIFY_INIT,
+		fanClassNotif|fanCloexec|fanNonblock, syscall.O_RDONLY|syscall.O_LARGEFILE|syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		return fmt.Errorf("fanotify_init failed: %v", errno)
+	}
+	path, err := syscall.BytePtrFromString(mnt)
+	if err != nil {
+		syscall.Close(int(fd))
+		return err
+	}
+	// mnt is absolute, so the directory fd is ignored.
+	dirfd := -1
+	_, _, errno = syscall.Syscall6(syscall.SYS_FANOTIFY_MARK, fd, fanMarkAdd|fanMarkFilesystem,
+		fanOpen|fanCloseWrite, uintptr(dirfd), uintptr(unsafe.Pointer(path)), 0)
+	if errno != 0 {
+		syscall.Close(int(fd))
+		return fmt.Errorf("fanotify_mark %v failed: %v", mnt, errno)
+	}
+	// Being non-blocking, the fd goes through the runtime's poller, so
+	// closing it stops read.
+	a.f = os.NewFile(fd, "fanotify:"+mnt)
+	return nil
+}
@@ -0,0 +1,206 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Maintenance windows often touch many volumes at once: unmount everything
+// tagged env:staging, say, or snapshot every mounted volume before an
+// upgrade.  Batch runs one operation over the volumes matching a filter (as
+// for Volumes), a few at a time (batch.parallelism, unless overridden), and
+// reports how each went.  One volume failing doesn't stop the rest.
+
+func init() {
+	DescribeMetric("blocker_batch_operations_total",
+		"Volumes operated on by batch admin operations, by operation and outcome.")
+}
+
+// batchOps are the operations Batch can run, each on one volume, from within
+// the volume's actor where the operation isn't already.  An operation
+// returns a detail to report on success, or errSkipped to skip the volume.
+var batchOps = map[string]func(d *EbsVolumeDriver, ctx context.Context, name string) (string, error){
+	"unmount":  (*EbsVolumeDriver).batchUnmount,
+	"snapshot": (*EbsVolumeDriver).batchSnapshot,
+	"verify":   (*EbsVolumeDriver).batchVerify,
+	"resize": func(d *EbsVolumeDriver, ctx context.Context, name string) (string, error) {
+		return "", d.Resize(ctx, name)
+	},
+}
+
+// batchSkip is returned by batch operations which don't apply to a volume.
+type batchSkip struct {
+	reason string
+}
+
+func (s batchSkip) Error() string { return s.reason }
+
+// BatchResult reports how a batch operation went.
+type BatchResult struct {
+	Op        string
+	Succeeded int
+	Failed    int
+	Skipped   int
+	Volumes   []BatchVolume
+}
+
+// BatchVolume reports how a batch operation went for one volume.
+type BatchVolume struct {
+	Name     string
+	VolumeId string `json:",omitempty"`
+	// Outcome is succeeded, failed, or skipped.
+	Outcome  string
+	Detail   string `json:",omitempty"`
+	Duration time.Duration
+}
+
+// Batch runs an operation (unmount, snapshot, verify, or resize) on every
+// volume matching the filter, at most parallelism at a time (or
+// batch.parallelism, if it's zero).  The filter's After and Limit are
+// ignored.
+func (d *EbsVolumeDriver) Batch(
+	ctx context.Context, op string, f VolumeFilter, parallelism int) (BatchResult, error) {
+	run, ok := batchOps[op]
+	if !ok {
+		var names []string
+		for name := range batchOps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return BatchResult{}, errorf(CodeInvalidOption, "Unknown batch operation %q; expected one of %v.",
+			op, strings.Join(names, ", "))
+	}
+	if parallelism < 0 {
+		return BatchResult{}, errorf(CodeInvalidOption, "The parallelism must not be negative.")
+	} else if parallelism == 0 {
+		parallelism = GetConfig().Batch.Parallelism
+	}
+	f.After, f.Limit = "", 0
+	page, err := d.Volumes(ctx, f)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	LogCtx(ctx, "Batch %v of %v volume(s), %v at a time.\n", op, len(page.Volumes), parallelism)
+
+	result := BatchResult{Op: op, Volumes: make([]BatchVolume, len(page.Volumes))}
+	var (
+		wg    sync.WaitGroup
+		slots = make(chan struct{}, parallelism)
+	)
+	for i, s := range page.Volumes {
+		i, s := i, s
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			start := time.Now()
+			detail, err := run(d, ctx, s.Name)
+			bv := BatchVolume{Name: s.Name, VolumeId: s.VolumeId, Outcome: "succeeded", Detail: detail,
+				Duration: time.Since(start).Round(time.Millisecond)}
+			if skip, ok := err.(batchSkip); ok {
+				bv.Outcome, bv.Detail = "skipped", skip.reason
+			} else if err != nil {
+				bv.Outcome, bv.Detail = "failed", err.Error()
+				LogCtxError(ctx, "Batch %v of %v failed: %v\n", op, s.Name, err)
+			}
+			IncCounter("blocker_batch_operations_total", "op", op, "outcome", bv.Outcome)
+			result.Volumes[i] = bv
+		}()
+	}
+	wg.Wait()
+
+	for _, bv := range result.Volumes {
+		switch bv.Outcome {
+		case "succeeded":
+			result.Succeeded++
+		case "failed":
+			result.Failed++
+		case "skipped":
+			result.Skipped++
+		}
+	}
+	LogCtx(ctx, "Batch %v done: %v succeeded, %v failed, %v skipped.\n",
+		op, result.Succeeded, result.Failed, result.Skipped)
+	return result, nil
+}
+
+// batchUnmount unmounts and detaches a volume, unless containers are still
+// using it.
+func (d *EbsVolumeDriver) batchUnmount(ctx context.Context, name string) (string, error) {
+	var detail string
+	err := d.do(name, func() (err error) {
+		v, exists := d.volume(name)
+		if !exists {
+			return errNameNotFound
+		}
+		if v.mountpoint == "" {
+			return batchSkip{"not mounted"}
+		}
+		if n := v.userCount(); n > 0 {
+			return batchSkip{fmt.Sprintf("in use by %v mount(s)", n)}
+		}
+		if pinned, _ := v.pinned(); pinned {
+			return batchSkip{"pinned"}
+		}
+		defer d.record(ctx, name, "batch-unmount", time.Now(), &err)
+		detail = "unmounted from " + v.mountpoint
+		return d.doUnmount(ctx, name)
+	})
+	return detail, err
+}
+
+// batchSnapshot starts a snapshot of a volume, without waiting for it to
+// complete.  Batch snapshots are scheduled ones, and jittered.
+func (d *EbsVolumeDriver) batchSnapshot(ctx context.Context, name string) (string, error) {
+	if err := snapshotJitter(ctx); err != nil {
+		return "", err
+	}
+	var snap string
+	err := d.do(name, func() (err error) {
+		v, exists := d.volume(name)
+		if !exists {
+			return errNameNotFound
+		}
+		if v.id == "" || v.temporary {
+			return batchSkip{"no EBS volume of its own to snapshot"}
+		}
+		defer d.record(ctx, name, "batch-snapshot", time.Now(), &err)
+		var out *ec2.Snapshot
+		err = queueSnapshot(ctx, func() (err error) {
+			out, err = d.ec2.CreateSnapshotWithContext(ctx, &ec2.CreateSnapshotInput{
+				VolumeId:    aws.String(v.id),
+				Description: aws.String("blocker batch snapshot of " + name),
+				TagSpecifications: []*ec2.TagSpecification{{
+					ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+					Tags:         ownedTags(newTag("Name", name), newTag(tagVolume, name)),
+				}},
+			}, d.awsOpts(ctx)...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		snap = aws.StringValue(out.SnapshotId)
+		LogCtx(ctx, "\tSnapshotting EBS volume %v as %v.\n", v.id, snap)
+		return nil
+	})
+	return snap, err
+}
+
+// batchVerify verifies a volume's latest snapshot.
+func (d *EbsVolumeDriver) batchVerify(ctx context.Context, name string) (string, error) {
+	r := d.Verify(ctx, name)
+	if !r.Passed {
+		return r.SnapshotId, fmt.Errorf("%v", r.Err)
+	}
+	return r.SnapshotId, nil
+}
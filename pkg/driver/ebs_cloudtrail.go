@@ -0,0 +1,65 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+)
+
+// When reconciliation finds a volume detached or deleted from under us, the
+// first question on-call asks is "who did that?"  With reconcile.cloudtrail
+// enabled, the alert answers it from CloudTrail's event history.
+
+// cloudTrailLookback is how far back to look for the responsible event.
+const cloudTrailLookback = 24 * time.Hour
+
+// cloudTrailEvent is the part of a CloudTrail record we report.
+type cloudTrailEvent struct {
+	UserIdentity struct {
+		Arn string `json:"arn"`
+	} `json:"userIdentity"`
+	SourceIPAddress string `json:"sourceIPAddress"`
+	UserAgent       string `json:"userAgent"`
+}
+
+// responsibleFor describes the most recent CloudTrail event which detached or
+// deleted a volume: what it was, when, and who (and what) made it.
+func (d *EbsVolumeDriver) responsibleFor(ctx context.Context, id string) (string, error) {
+	out, err := d.cloudtrail.LookupEventsWithContext(ctx, &cloudtrail.LookupEventsInput{
+		LookupAttributes: []*cloudtrail.LookupAttribute{{
+			AttributeKey:   aws.String(cloudtrail.LookupAttributeKeyResourceName),
+			AttributeValue: aws.String(id),
+		}},
+		StartTime:  aws.Time(time.Now().Add(-cloudTrailLookback)),
+		EndTime:    aws.Time(time.Now()),
+		MaxResults: aws.Int64(50),
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return "", err
+	}
+
+	// Events come newest first.
+	for _, e := range out.Events {
+		switch aws.StringValue(e.EventName) {
+		case "DetachVolume", "DeleteVolume":
+		default:
+			continue
+		}
+		who := aws.StringValue(e.Username)
+		var record cloudTrailEvent
+		if err := json.Unmarshal([]byte(aws.StringValue(e.CloudTrailEvent)), &record); err == nil {
+			if record.UserIdentity.Arn != "" {
+				who = record.UserIdentity.Arn
+			}
+			who = fmt.Sprintf("%v from %v (%v)", who, record.SourceIPAddress, record.UserAgent)
+		}
+		return fmt.Sprintf("%v by %v at %v", aws.StringValue(e.EventName), who,
+			aws.TimeValue(e.EventTime).Format(time.RFC3339)), nil
+	}
+	// CloudTrail can take several minutes to deliver events.
+	return "", fmt.Errorf("No DetachVolume or DeleteVolume event for %v is in CloudTrail yet.", id)
+}
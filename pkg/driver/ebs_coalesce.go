@@ -0,0 +1,75 @@
+package driver
+
+import (
+	"context"
+)
+
+// Docker can send the same request twice, say a Mount it retries because the
+// first is taking a while to attach.  Rather than queue the duplicate behind
+// the original (or race it), the duplicate joins the original and gets the
+// same result.  Requests are the same if they're the same operation on the
+// same volume for the same caller (Docker's ID for the container mount).
+
+func init() {
+	DescribeMetric("blocker_coalesced_requests_total",
+		"Duplicate requests which joined an identical one already in flight, by operation.")
+}
+
+// inflightOp is a request under way, which duplicates can wait on.
+type inflightOp struct {
+	done   chan struct{}
+	result string
+	err    error
+	// waiters counts the requests still waiting on the result; when the
+	// last of them is cancelled, so is the operation.  Guarded by d.mu.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// coalesce runs op, unless an identical request is already running, in
+// which case it waits for that one's result instead.  op is given a context
+// which is cancelled only once every request waiting on it has been, so the
+// original giving up (as Docker does when it retries) doesn't fail the
+// duplicate.
+func (d *EbsVolumeDriver) coalesce(ctx context.Context, opName string, name string,
+	op func(ctx context.Context) (string, error)) (string, error) {
+	key := opName + "\x00" + name + "\x00" + Caller(ctx)
+	d.mu.Lock()
+	if c, ok := d.inflight[key]; ok {
+		c.waiters++
+		d.mu.Unlock()
+		LogCtx(ctx, "\tJoining the %v of %v already under way.\n", opName, name)
+		IncCounter("blocker_coalesced_requests_total", "op", opName)
+		select {
+		case <-c.done:
+			return c.result, c.err
+		case <-ctx.Done():
+			d.leave(c)
+			return "", ctx.Err()
+		}
+	}
+	opCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	c := &inflightOp{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	d.inflight[key] = c
+	d.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() { d.leave(c) })
+	c.result, c.err = op(opCtx)
+	stop()
+	cancel()
+	d.mu.Lock()
+	delete(d.inflight, key)
+	d.mu.Unlock()
+	close(c.done)
+	return c.result, c.err
+}
+
+// leave stops a request waiting on c, cancelling c if it was the last.
+func (d *EbsVolumeDriver) leave(c *inflightOp) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c.waiters--
+	if c.waiters == 0 {
+		c.cancel()
+	}
+}
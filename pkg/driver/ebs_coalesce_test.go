@@ -0,0 +1,103 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// startCoalesced starts a mount of vol through coalesce, whose op (if it runs
+// this request's) reports its context on ctxs and waits for release.
+func startCoalesced(d *EbsVolumeDriver, ctx context.Context, ctxs chan<- context.Context,
+	release <-chan struct{}) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		_, err := d.coalesce(ctx, "mount", "vol", func(ctx context.Context) (string, error) {
+			ctxs <- ctx
+			<-release
+			return "/mnt/blocker/vol", ctx.Err()
+		})
+		errs <- err
+	}()
+	return errs
+}
+
+// joined waits for n requests to be waiting on the mount of vol.
+func joined(t *testing.T, d *EbsVolumeDriver, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		c := d.inflight["mount\x00vol\x00"]
+		waiters := 0
+		if c != nil {
+			waiters = c.waiters
+		}
+		d.mu.Unlock()
+		if waiters == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v request(s) waiting, want %v", waiters, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalesceSurvivesOriginalCancelled(t *testing.T) {
+	d := newTestDriver(t)
+	ctxs := make(chan context.Context, 2)
+	release := make(chan struct{})
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := startCoalesced(d, first, ctxs, release)
+	opCtx := <-ctxs
+	second := startCoalesced(d, context.Background(), ctxs, release)
+	joined(t, d, 2)
+
+	// Docker gives up on the original and retries.
+	cancelFirst()
+	joined(t, d, 1)
+	if opCtx.Err() != nil {
+		t.Fatal("the operation was cancelled with a request still waiting on it")
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("the duplicate failed: %v", err)
+	}
+	<-firstErr
+	select {
+	case <-ctxs:
+		t.Error("the duplicate ran the operation again")
+	default:
+	}
+}
+
+func TestCoalesceCancelledWhenAllGiveUp(t *testing.T) {
+	d := newTestDriver(t)
+	ctxs := make(chan context.Context, 2)
+	release := make(chan struct{})
+	defer close(release)
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := startCoalesced(d, first, ctxs, release)
+	opCtx := <-ctxs
+	second, cancelSecond := context.WithCancel(context.Background())
+	secondErr := startCoalesced(d, second, ctxs, release)
+	joined(t, d, 2)
+
+	cancelSecond()
+	if err := <-secondErr; err != context.Canceled {
+		t.Errorf("the cancelled duplicate returned %v", err)
+	}
+	cancelFirst()
+	select {
+	case <-opCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the operation wasn't cancelled once nobody was waiting on it")
+	}
+	release <- struct{}{}
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("the original returned %v", err)
+	}
+}
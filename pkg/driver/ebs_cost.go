@@ -0,0 +1,207 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Before a volume is provisioned, its monthly cost is estimated from its
+// type, size, IOPS, and throughput, and logged.  The prices are a bundled
+// table of us-east-1's on-demand prices, which cost.prices can override for
+// other regions or negotiated rates.  If cost.ceiling is set, or the volume
+// has a max-monthly-cost option (which can only lower the ceiling), volumes
+// estimated to cost more are refused.  `blocker estimate -o ...` estimates a
+// volume's cost without creating it.
+
+// iopsTier prices the provisioned IOPS up to upTo (or beyond, if zero).
+type iopsTier struct {
+	upTo  int64
+	price float64
+}
+
+// volumePricing is what a volume type costs a month.
+type volumePricing struct {
+	gib float64
+	// iops prices provisioned IOPS beyond freeIops, in tiers.
+	iops     []iopsTier
+	freeIops int64
+	// throughput prices each MiB/s beyond freeThroughput.
+	throughput     float64
+	freeThroughput int64
+}
+
+// volumePrices are the bundled prices, in USD a month.
+var volumePrices = map[string]volumePricing{
+	ec2.VolumeTypeGp2: {gib: 0.10},
+	ec2.VolumeTypeGp3: {gib: 0.08, iops: []iopsTier{{0, 0.005}}, freeIops: gp3BaseIops,
+		throughput: 0.04, freeThroughput: gp3BaseThroughput},
+	ec2.VolumeTypeIo1:      {gib: 0.125, iops: []iopsTier{{0, 0.065}}},
+	ec2.VolumeTypeIo2:      {gib: 0.125, iops: []iopsTier{{32000, 0.065}, {64000, 0.0455}, {0, 0.032}}},
+	ec2.VolumeTypeSt1:      {gib: 0.045},
+	ec2.VolumeTypeSc1:      {gib: 0.015},
+	ec2.VolumeTypeStandard: {gib: 0.05},
+}
+
+// CostEstimate is what a volume is expected to cost a month.
+type CostEstimate struct {
+	Type           string
+	SizeGiB        int64
+	Iops           int64 `json:",omitempty"`
+	Throughput     int64 `json:",omitempty"`
+	StorageCost    float64
+	IopsCost       float64
+	ThroughputCost float64
+	MonthlyCost    float64
+	// Ceiling is the most the volume may cost, or zero if there's no
+	// limit.
+	Ceiling float64 `json:",omitempty"`
+}
+
+func (e CostEstimate) String() string {
+	s := fmt.Sprintf("%v, %v GiB", e.Type, e.SizeGiB)
+	if e.Iops != 0 {
+		s += fmt.Sprintf(", %v IOPS", e.Iops)
+	}
+	if e.Throughput != 0 {
+		s += fmt.Sprintf(", %v MiB/s", e.Throughput)
+	}
+	return fmt.Sprintf("%v: $%.2f a month", s, e.MonthlyCost)
+}
+
+// pricing is what a volume type costs, with any configured overrides.
+func pricing(volumeType string) (volumePricing, error) {
+	p, ok := volumePrices[volumeType]
+	if !ok {
+		return p, fmt.Errorf("No prices are known for %v volumes.", volumeType)
+	}
+	if o, ok := GetConfig().Cost.Prices[volumeType]; ok {
+		if o.GiB != 0 {
+			p.gib = o.GiB
+		}
+		if o.Iops != 0 {
+			p.iops = []iopsTier{{0, o.Iops}}
+		}
+		if o.Throughput != 0 {
+			p.throughput = o.Throughput
+		}
+	}
+	return p, nil
+}
+
+// estimateCost estimates what a volume of the given spec costs a month.
+func estimateCost(s volumeSpec) (CostEstimate, error) {
+	e := CostEstimate{Type: s.Type, SizeGiB: s.SizeGiB, Iops: s.Iops, Throughput: s.Throughput}
+	if e.Type == "" {
+		// EBS's default.
+		e.Type = ec2.VolumeTypeGp2
+	}
+	p, err := pricing(e.Type)
+	if err != nil {
+		return e, err
+	}
+	e.StorageCost = float64(e.SizeGiB) * p.gib
+
+	iops := e.Iops
+	if iops == 0 {
+		iops = p.freeIops
+	}
+	var below int64
+	for _, t := range p.iops {
+		top := iops
+		if t.upTo != 0 && t.upTo < top {
+			top = t.upTo
+		}
+		if from := max(below, p.freeIops); top > from {
+			e.IopsCost += float64(top-from) * t.price
+		}
+		if t.upTo == 0 || t.upTo >= iops {
+			break
+		}
+		below = t.upTo
+	}
+	if e.Throughput > p.freeThroughput {
+		e.ThroughputCost = float64(e.Throughput-p.freeThroughput) * p.throughput
+	}
+	e.MonthlyCost = e.StorageCost + e.IopsCost + e.ThroughputCost
+	return e, nil
+}
+
+// costCeiling is the most a volume may cost a month, according to the
+// configuration and its max-monthly-cost option, or zero if there's no limit.
+func (v *ebsVolume) costCeiling() (float64, error) {
+	ceiling := GetConfig().Cost.Ceiling
+	s, ok := v.opts["max-monthly-cost"]
+	if !ok {
+		return ceiling, nil
+	}
+	limit, err := strconv.ParseFloat(s, 64)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("Invalid value for max-monthly-cost: %q; expected an amount in USD, e.g. 250.", s)
+	}
+	if ceiling == 0 || limit < ceiling {
+		ceiling = limit
+	}
+	return ceiling, nil
+}
+
+// estimateVolume estimates what a new volume with the given options costs a
+// month.  A volume restored from a snapshot without a size is as large as the
+// snapshot.
+func (d *EbsVolumeDriver) estimateVolume(ctx context.Context, v *ebsVolume) (CostEstimate, error) {
+	spec, err := parseVolumeSpec(v.opts)
+	if err != nil {
+		return CostEstimate{}, WithCode(CodeInvalidOption, err)
+	}
+	if snap := v.opts["restore"]; spec.SizeGiB == 0 && snap != "" {
+		out, err := d.ec2.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(snap)},
+		}, d.awsOpts(ctx)...)
+		if err != nil {
+			return CostEstimate{}, err
+		}
+		if len(out.Snapshots) != 1 {
+			return CostEstimate{}, errorf(CodeNotFound, "No snapshot %v was found.", snap)
+		}
+		spec.SizeGiB = aws.Int64Value(out.Snapshots[0].VolumeSize)
+	}
+	e, err := estimateCost(spec)
+	if err != nil {
+		return e, WithCode(CodeInvalidOption, err)
+	}
+	if e.Ceiling, err = v.costCeiling(); err != nil {
+		return e, WithCode(CodeInvalidOption, err)
+	}
+	return e, nil
+}
+
+// checkCost estimates a new volume's cost, refusing it if that's over its
+// ceiling.
+func (d *EbsVolumeDriver) checkCost(ctx context.Context, name string, v *ebsVolume) error {
+	e, err := d.estimateVolume(ctx, v)
+	if err != nil {
+		return err
+	}
+	if e.Ceiling != 0 && e.MonthlyCost > e.Ceiling {
+		return errorf(CodeOverBudget, "Volume %v (%v) would cost more than the ceiling of $%.2f a month.",
+			name, e, e.Ceiling)
+	}
+	LogCtx(ctx, "\tEstimated cost of %v: %v.\n", name, e)
+	return nil
+}
+
+// Estimate estimates what a volume created with the given options would cost
+// a month, without creating it.
+func (d *EbsVolumeDriver) Estimate(ctx context.Context, opts map[string]string) (CostEstimate, error) {
+	merged, err := volumeOptions("ebs", nil, opts)
+	if err != nil {
+		return CostEstimate{}, WithCode(CodeInvalidOption, err)
+	}
+	if err := checkOptionNames(merged, ebsOptionNames); err != nil {
+		return CostEstimate{}, WithCode(CodeInvalidOption, err)
+	}
+	return d.estimateVolume(ctx, &ebsVolume{opts: merged})
+}
@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEstimateCost(t *testing.T) {
+	testConfig(t, nil)
+	for _, tc := range []struct {
+		spec volumeSpec
+		// storage, iops, and throughput are the expected monthly costs of
+		// each, in USD.
+		storage, iops, throughput float64
+	}{
+		// EBS's default type is gp2.
+		{volumeSpec{SizeGiB: 100}, 10, 0, 0},
+		{volumeSpec{Type: "gp2", SizeGiB: 100}, 10, 0, 0},
+		// gp3's baseline 3000 IOPS and 125 MiB/s are free...
+		{volumeSpec{Type: "gp3", SizeGiB: 100}, 8, 0, 0},
+		{volumeSpec{Type: "gp3", SizeGiB: 100, Iops: 3000, Throughput: 125}, 8, 0, 0},
+		// ...and only what's above them is paid for.
+		{volumeSpec{Type: "gp3", SizeGiB: 100, Iops: 6000, Throughput: 250}, 8, 15, 5},
+		{volumeSpec{Type: "io1", SizeGiB: 100, Iops: 5000}, 12.5, 325, 0},
+		// io2's IOPS are cheaper beyond 32,000, and again beyond 64,000.
+		{volumeSpec{Type: "io2", SizeGiB: 100, Iops: 32000}, 12.5, 2080, 0},
+		{volumeSpec{Type: "io2", SizeGiB: 500, Iops: 40000}, 62.5, 2080 + 364, 0},
+		{volumeSpec{Type: "io2", SizeGiB: 100, Iops: 70000}, 12.5, 2080 + 1456 + 192, 0},
+		{volumeSpec{Type: "st1", SizeGiB: 1000}, 45, 0, 0},
+		{volumeSpec{Type: "sc1", SizeGiB: 1000}, 15, 0, 0},
+		{volumeSpec{Type: "standard", SizeGiB: 10}, 0.5, 0, 0},
+	} {
+		e, err := estimateCost(tc.spec)
+		if err != nil {
+			t.Errorf("%+v: %v", tc.spec, err)
+			continue
+		}
+		if !near(e.StorageCost, tc.storage) || !near(e.IopsCost, tc.iops) ||
+			!near(e.ThroughputCost, tc.throughput) ||
+			!near(e.MonthlyCost, tc.storage+tc.iops+tc.throughput) {
+			t.Errorf("%+v: got %+v, want storage %v, IOPS %v, and throughput %v",
+				tc.spec, e, tc.storage, tc.iops, tc.throughput)
+		}
+	}
+
+	if _, err := estimateCost(volumeSpec{Type: "gp9", SizeGiB: 100}); err == nil {
+		t.Error("estimated the cost of an unknown volume type")
+	}
+}
+
+// near reports whether two amounts in USD are the same, to a hundredth of a
+// cent.
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 0.0001
+}
@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Credentials ordinarily come from the SDK's default chain: the environment,
+// the shared credentials file, the ECS and EKS (IRSA) container credential
+// endpoints, and finally the instance profile via IMDS.  Run in a container
+// on an instance whose IMDS hop limit is 1, the last of these can't be
+// reached, which shows up as AWS calls failing (often only once the first
+// credentials expire).  We check credentials at startup and watch for these
+// failures, explaining what's wrong, and Options.CredentialsFile provides a
+// fallback which is re-read whenever it changes.
+
+func init() {
+	DescribeMetric("blocker_credential_errors_total",
+		"AWS calls which failed because no credentials could be found.")
+}
+
+// credentialErrorCodes are the SDK's codes for failing to find credentials.
+var credentialErrorCodes = map[string]bool{
+	"NoCredentialProviders": true,
+	"EC2RoleRequestError":   true,
+	"SharedCredsLoad":       true,
+}
+
+// credentialHint explains the likely causes of missing credentials.
+const credentialHint = "If blocker runs in a container, the instance's metadata " +
+	"hop limit may be too low for it to reach the instance profile's credentials " +
+	"(raise it with `aws ec2 modify-instance-metadata-options " +
+	"--http-put-response-hop-limit 2`), or supply credentials with " +
+	"-credentials-file, the AWS_* environment variables, or an ECS/EKS role."
+
+// fileProvider reads credentials from a shared credentials file, reading it
+// again whenever it's modified, so that credentials written (and rotated) by
+// something else are picked up.
+type fileProvider struct {
+	path     string
+	mu       sync.Mutex
+	modified time.Time
+}
+
+func (p *fileProvider) Retrieve() (credentials.Value, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if fi, err := os.Stat(p.path); err == nil {
+		p.modified = fi.ModTime()
+	}
+	shared := &credentials.SharedCredentialsProvider{Filename: p.path}
+	v, err := shared.Retrieve()
+	v.ProviderName = "CredentialsFile"
+	return v, err
+}
+
+func (p *fileProvider) IsExpired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fi, err := os.Stat(p.path)
+	return err != nil || !fi.ModTime().Equal(p.modified)
+}
+
+// credentialErrorMu guards lastCredentialError, which limits how often the
+// diagnostic is logged.
+var (
+	credentialErrorMu   sync.Mutex
+	lastCredentialError time.Time
+)
+
+// watchCredentials makes every client created from the session explain
+// failures to find credentials.
+func watchCredentials(sess *session.Session) {
+	sess.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "blocker.Credentials",
+		Fn: func(r *request.Request) {
+			aerr, ok := r.Error.(awserr.Error)
+			if !ok || !credentialErrorCodes[aerr.Code()] {
+				return
+			}
+			IncCounter("blocker_credential_errors_total")
+			credentialErrorMu.Lock()
+			defer credentialErrorMu.Unlock()
+			if time.Since(lastCredentialError) < 5*time.Minute {
+				return
+			}
+			lastCredentialError = time.Now()
+			LogError("No AWS credentials available: %v\n\t%v\n", aerr.Message(), credentialHint)
+		},
+	})
+}
+
+// checkCredentials logs where credentials are coming from, or why there
+// aren't any.  It doesn't fail, since credentials may yet turn up (say, once
+// a sidecar writes the credentials file).
+func checkCredentials(sess *session.Session) {
+	v, err := sess.Config.Credentials.Get()
+	if err != nil {
+		LogError("Finding AWS credentials failed: %v\n\t%v\n", err, credentialHint)
+		return
+	}
+	Log("\tCredentials       : %v\n", v.ProviderName)
+}
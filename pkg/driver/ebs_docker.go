@@ -0,0 +1,230 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// When dockerd crashes (or is killed) its containers die without it ever
+// sending the Unmounts for their volumes, and when it comes back it has
+// forgotten them: their volumes stay mounted here, counted as in use, and
+// can't be mounted anywhere else.  With docker_events.socket set, blocker
+// follows the Docker daemon's events.  A little while (docker_events.grace)
+// after a container dies, and whenever it (re)connects to Docker, it asks
+// Docker which containers are still running, and releases (unmounts and
+// detaches) any mounted volume whose users none of them are.  Only volumes
+// Docker has mounted through blocker are considered; a volume mounted some
+// other way, with no users, is left alone.
+
+func init() {
+	DescribeMetric("blocker_docker_releases_total",
+		"Volumes released because no container Docker runs was using them any more, by outcome (released, pinned, or failed).")
+}
+
+// dockerRetry is how long to wait before reconnecting to the Docker daemon.
+const dockerRetry = 30 * time.Second
+
+// dockerLiveStates are the states of containers which may have volumes
+// mounted.  Created containers haven't yet, but may be starting.
+var dockerLiveStates = map[string]bool{"created": true, "running": true, "paused": true, "restarting": true}
+
+// dockerEvent is an event from the Docker daemon's /events.
+type dockerEvent struct {
+	Type   string
+	Action string
+	Actor  struct {
+		ID string
+	}
+}
+
+// dockerContainer is a container from the Docker daemon's /containers/json.
+type dockerContainer struct {
+	Id     string
+	State  string
+	Mounts []struct {
+		Type string
+		Name string
+	}
+}
+
+// dockerClient talks to the Docker daemon on its socket.
+func dockerClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// dockerGet makes a GET request of the Docker daemon.  The caller closes the
+// response's body.
+func dockerGet(ctx context.Context, client *http.Client, path string, query url.Values) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "docker", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Docker request %v failed: %v", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// dockerEventsLoop follows the Docker daemon's events, if configured,
+// reconnecting whenever it loses them.
+func (d *EbsVolumeDriver) dockerEventsLoop(ctx context.Context) {
+	for {
+		c := GetConfig().DockerEvents
+		if c.Socket == "" {
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+		if err := d.followDocker(ctx, c); err != nil {
+			LogCtxWarn(ctx, "Following Docker's events on %v failed (will retry): %v\n", c.Socket, err)
+		}
+		if sleep(ctx, dockerRetry) != nil {
+			return
+		}
+	}
+}
+
+// followDocker follows the Docker daemon's container deaths until the
+// connection is lost or the configuration changes, releasing the volumes
+// they leave behind.
+func (d *EbsVolumeDriver) followDocker(ctx context.Context, c DockerEventsConfig) error {
+	client := dockerClient(c.Socket)
+	filters, _ := json.Marshal(map[string][]string{"type": {"container"}, "event": {"die"}})
+	resp, err := dockerGet(ctx, client, "/events", url.Values{"filters": {string(filters)}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	LogCtx(ctx, "Following Docker's events on %v.\n", c.Socket)
+
+	// Containers may have died while we weren't listening.
+	d.releaseUnused(ctx, client)
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e dockerEvent
+		if err := dec.Decode(&e); err != nil {
+			return err
+		}
+		if GetConfig().DockerEvents != c {
+			LogCtx(ctx, "Docker events configuration changed; reconnecting.\n")
+			return nil
+		}
+		LogCtxDebug(ctx, "Docker container %v died; checking its volumes in %v.\n",
+			e.Actor.ID, time.Duration(c.Grace))
+		// Docker normally unmounts the container's volumes after it
+		// dies; give it the chance to.
+		time.AfterFunc(time.Duration(c.Grace), func() { d.releaseUnused(ctx, client) })
+	}
+}
+
+// releaseUnused releases the mounted volumes which have users, but which no
+// container Docker is running has mounted.
+func (d *EbsVolumeDriver) releaseUnused(ctx context.Context, client *http.Client) {
+	// Note who the volumes' users are before asking Docker, so that a
+	// volume mounted again meanwhile isn't mistaken for an unused one.
+	users := map[string]map[string]int{}
+	d.mu.Lock()
+	for name, v := range d.volumes {
+		if v.mountpoint != "" && v.userCount() > 0 {
+			users[name] = copyUsers(v.users)
+		}
+	}
+	d.mu.Unlock()
+	if len(users) == 0 {
+		return
+	}
+
+	resp, err := dockerGet(ctx, client, "/containers/json", url.Values{"all": {"1"}})
+	if err != nil {
+		LogCtxWarn(ctx, "Listing Docker's containers failed: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		LogCtxWarn(ctx, "Listing Docker's containers failed: %v\n", err)
+		return
+	}
+	for _, c := range containers {
+		if !dockerLiveStates[c.State] {
+			continue
+		}
+		for _, m := range c.Mounts {
+			if m.Type == "volume" {
+				delete(users, m.Name)
+			}
+		}
+	}
+
+	for name, seen := range users {
+		name, seen := name, seen
+		d.submit(name, func() { d.releaseUnusedVolume(ctx, name, seen) })
+	}
+}
+
+// releaseUnusedVolume unmounts and detaches a volume no container is using,
+// provided its users are still those seen and it isn't pinned.  Its users are
+// only forgotten once it's unmounted, so a volume which fails to unmount is
+// still counted as in use.
+func (d *EbsVolumeDriver) releaseUnusedVolume(ctx context.Context, name string, seen map[string]int) {
+	v, exists := d.volume(name)
+	if !exists || v.mountpoint == "" || !sameUsers(v.users, seen) {
+		return
+	}
+	if err := v.checkPinned(ctx, name, "unmount"); err != nil {
+		LogCtxWarn(ctx, "Volume %v has %v mount(s) Docker never unmounted, but no container is using it; "+
+			"leaving it mounted, since it's pinned.\n", name, v.userCount())
+		IncCounter("blocker_docker_releases_total", d.volumeLabels(name, "outcome", "pinned")...)
+		return
+	}
+	LogCtxWarn(ctx, "Volume %v has %v mount(s) Docker never unmounted, but no container is using it; "+
+		"releasing it.\n", name, v.userCount())
+	var err error
+	defer d.record(ctx, name, "docker-release", time.Now(), &err)
+	if err = d.doUnmount(ctx, name); err != nil {
+		LogCtxError(ctx, "Releasing %v failed: %v\n", name, err)
+		IncCounter("blocker_docker_releases_total", d.volumeLabels(name, "outcome", "failed")...)
+		return
+	}
+	IncCounter("blocker_docker_releases_total", d.volumeLabels(name, "outcome", "released")...)
+}
+
+func copyUsers(users map[string]int) map[string]int {
+	c := make(map[string]int, len(users))
+	for caller, n := range users {
+		c[caller] = n
+	}
+	return c
+}
+
+func sameUsers(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for caller, n := range a {
+		if b[caller] != n {
+			return false
+		}
+	}
+	return true
+}
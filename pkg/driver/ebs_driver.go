@@ -0,0 +1,1139 @@
+// Package driver implements blocker's EBS volume driver, along with the
+// configuration, logging, metrics, and events it shares with the plugin server.
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ebs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/health"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/satori/go.uuid"
+)
+
+type EbsVolumeDriver struct {
+	// session makes clients for other regions (see archive).
+	session             *session.Session
+	ec2                 ec2iface.EC2API
+	ssm                 *ssm.SSM
+	cloudwatch          *cloudwatch.CloudWatch
+	cloudtrail          *cloudtrail.CloudTrail
+	logs                *cloudwatchlogs.CloudWatchLogs
+	secrets             *secretsmanager.SecretsManager
+	ebs                 *ebs.EBS
+	health              *health.Health
+	kms                 kmsiface.KMSAPI
+	ec2meta             *ec2metadata.EC2Metadata
+	awsInstanceId       string
+	awsRegion           string
+	awsAvailabilityZone string
+
+	// attacher attaches volumes to this instance.
+	attacher Attacher
+
+	// attachMu serializes choosing a device letter and attaching to it, so
+	// concurrent attaches (on different volumes' actors) can't pick the same
+	// one.  It also guards reserved and claimed.
+	attachMu sync.Mutex
+
+	// rootMu guards rootId, the instance's root volume, which is looked up
+	// once rootKnown (see rootVolume).
+	rootMu    sync.Mutex
+	rootId    string
+	rootKnown bool
+
+	// reserved holds device letters in use by the root device or by other
+	// attachments which existed at startup; we never attach to these.
+	reserved map[string]string
+
+	// claimed holds the device letters our own attachments are using, with
+	// the volume ID, from when EC2 accepts the attach until we detach it.
+	// The device node can take a while to appear, and until it does nothing
+	// else says the letter's taken.
+	claimed map[string]string
+
+	// mu guards volumes (and the other maps below).  Background work (like
+	// garbage collection) runs alongside Docker's requests, so everything
+	// must hold it, but only briefly: see ebs_actor.go.
+	mu      sync.Mutex
+	volumes map[string]*ebsVolume
+
+	// actors runs each volume's operations, by name, while it has any.
+	actors map[string]*volumeActor
+
+	// inflight holds the Docker requests under way, for duplicates to join
+	// (see coalesce).
+	inflight map[string]*inflightOp
+
+	// remediated records when we last raised a volume's performance, by
+	// EBS volume ID (see remediate).
+	remediated map[string]time.Time
+
+	// frozen holds the volumes frozen by Suspend, until they're thawed.
+	frozen map[string]*frozenVolume
+
+	// pool holds the standby volumes ready to be taken, by class.
+	pool map[string][]standbyVolume
+
+	// grown records, by EBS volume ID, the start of the latest resize whose
+	// filesystem growth we've handled.
+	grown map[string]time.Time
+
+	// shipped queues operations to be shipped to CloudWatch Logs.
+	shipped chan shippedOperation
+
+	// impairments holds the open AWS Health issues affecting EBS here (see
+	// healthLoop).
+	impairments []healthEvent
+
+	// reconciled holds the latest reconciliation passes' reports, oldest
+	// first, and driftingPasses counts the consecutive ones which found
+	// drift (see recordReconcile).
+	reconciled     []ReconcileReport
+	driftingPasses int
+
+	// stop cancels the context of the background loops, and loops waits for
+	// them to return (see Close).
+	stop  context.CancelFunc
+	loops sync.WaitGroup
+}
+
+// ebsVolume is the driver's record of a volume Docker has told us about.
+type ebsVolume struct {
+	// id is the EBS volume ID.  Usually this is the name itself, but volumes
+	// provisioned on demand don't have one until they're first mounted.
+	id string
+	// mountpoint is where the volume is mounted, or "" if it isn't.
+	mountpoint string
+	// device is the local block device while the volume is attached.
+	device string
+	// opts are the options supplied at Create, layered over the defaults
+	// (and, once mounted, over any the volume carries in its tags).
+	opts map[string]string
+	// requested are the options exactly as supplied at Create.
+	requested map[string]string
+	// created is when Docker first told us about the volume.
+	created time.Time
+	// everMounted records whether the volume has been mounted since.
+	everMounted bool
+	// ephemeral means the volume is tagged for deletion on removal (and at
+	// instance shutdown).  It's only known once the volume has been mounted.
+	ephemeral bool
+	// pinnedTag means the volume is tagged as pinned (see pinned).  Like
+	// ephemeral, it's only known once the volume has been mounted.
+	pinnedTag bool
+	// temporary means we provisioned the EBS volume for this mount only (from
+	// a snapshot), and must delete it again once unmounted.
+	temporary bool
+	// provisioned means we made the EBS volume at Create (given a size, or a
+	// snapshot to restore), so it's ours to keep track of.
+	provisioned bool
+	// prefetched is when the volume was attached ahead of its mount (see
+	// Prefetch), or zero if it wasn't (or has since been mounted).
+	prefetched time.Time
+	// history holds the most recent operations on the volume (see record).
+	history []HistoryEntry
+	// users counts the Docker mounts of the volume, by Docker's mount ID
+	// (see addUser).
+	users mountUsers
+	// maintenance is why the volume is under maintenance, or "" if it isn't
+	// (see SetMaintenance).
+	maintenance string
+	// expires is when the volume's ttl runs out, while it's mounted with
+	// one (see ttlLoop).
+	expires time.Time
+	// audit logs accesses to the volume while it's mounted with the audit
+	// option (see startAudit).
+	audit *auditor
+	// labels are the labels from the volume's tags for its metrics and log
+	// fields, as of its last attach (see tagLabels).
+	labels map[string]string
+	// scope are the volume's scope labels for schedulers, as of its last
+	// attach or listing (see scopeLabels).
+	scope map[string]string
+}
+
+// readOnly reports whether the volume should be mounted read-only.  Volumes
+// mounted from snapshots always are, since their contents are thrown away,
+// as is every volume in read-only mode.
+func (v *ebsVolume) readOnly() (bool, error) {
+	if _, ok := v.opts["snapshot"]; ok {
+		return true, nil
+	}
+	if readOnlyMode() {
+		return true, nil
+	}
+	ro, ok := v.opts["ro"]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(ro)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for ro: %q.", ro)
+	}
+	return b, nil
+}
+
+// Options controls how the driver discovers where it's running.
+// Ordinarily everything comes from the EC2 instance metadata service (IMDS),
+// but any of it may be supplied explicitly, and IMDS may be skipped entirely
+// (e.g. for CI against LocalStack, or where IMDS is firewalled off).
+type Options struct {
+	NoMetadata       bool
+	InstanceId       string
+	Region           string
+	AvailabilityZone string
+	Endpoint         string
+
+	// IMDSIPv6 reaches the metadata service over IPv6, and DualStack uses
+	// the dual-stack EC2 endpoints; both are needed on IPv6-only subnets.
+	// If IPv4 metadata is unreachable, both are turned on automatically.
+	IMDSIPv6  bool
+	DualStack bool
+
+	// CredentialsFile, if set, is a shared credentials file to take AWS
+	// credentials from (instead of the SDK's default chain), re-read
+	// whenever it changes.
+	CredentialsFile string
+
+	// AssumeRole, if set, is the ARN of an IAM role to assume for every AWS
+	// call, using the credentials we'd otherwise have used.
+	AssumeRole string
+
+	// RecoverState starts afresh if the state file is corrupt (or from a
+	// newer version), rather than refusing to start.
+	RecoverState bool
+
+	// Attacher, if set, attaches volumes in place of EBS (say, a fake in
+	// tests).
+	Attacher Attacher
+
+	// EC2, if set, is called in place of the EC2 API (say, a simulation of
+	// it; see the ec2sim package).
+	EC2 ec2iface.EC2API
+	// KMS, likewise, is called in place of the KMS API, to find out why a
+	// volume's key can't be used.
+	KMS kmsiface.KMSAPI
+}
+
+// newSession makes an AWS session according to the IPv6 settings.
+func newSession(opts Options) (*session.Session, error) {
+	var sessOpts session.Options
+	if opts.IMDSIPv6 {
+		sessOpts.EC2IMDSEndpointMode = endpoints.EC2IMDSEndpointModeStateIPv6
+	}
+	if opts.DualStack {
+		sessOpts.Config.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+	if opts.CredentialsFile != "" {
+		sessOpts.Config.Credentials = credentials.NewCredentials(
+			&fileProvider{path: opts.CredentialsFile})
+	}
+	sess, err := session.NewSessionWithOptions(sessOpts)
+	if err != nil {
+		return nil, err
+	}
+	stampUserAgent(sess)
+	watchCredentials(sess)
+	watchAwsCalls(sess)
+	return sess, nil
+}
+
+func NewEbsVolumeDriver(opts Options) (*EbsVolumeDriver, error) {
+	d := &EbsVolumeDriver{
+		awsInstanceId:       opts.InstanceId,
+		awsRegion:           opts.Region,
+		awsAvailabilityZone: opts.AvailabilityZone,
+		volumes:             make(map[string]*ebsVolume),
+		actors:              make(map[string]*volumeActor),
+		claimed:             make(map[string]string),
+		inflight:            make(map[string]*inflightOp),
+		grown:               make(map[string]time.Time),
+		frozen:              make(map[string]*frozenVolume),
+		remediated:          make(map[string]time.Time),
+		pool:                make(map[string][]standbyVolume),
+		shipped:             make(chan shippedOperation, logShipBuffer),
+		attacher:            opts.Attacher,
+	}
+	if d.attacher == nil {
+		d.attacher = ebsAttacher{d: d, deviceExists: deviceNodeExists}
+	}
+	d.attacher = slowAttacher{d.attacher}
+
+	ec2sess, err := newSession(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch AWS information, validating along the way.  Explicitly supplied
+	// values take precedence over whatever the metadata service says.
+	if opts.NoMetadata {
+		// The region isn't guessed from the zone: Local and Wavelength
+		// Zones (us-west-2-lax-1a, say) aren't the region plus a letter.
+		if d.awsInstanceId == "" || d.awsRegion == "" || d.awsAvailabilityZone == "" {
+			return nil, errors.New(
+				"An instance ID, region, and availability zone are required when " +
+					"metadata auto-detection is disabled.")
+		}
+	} else {
+		d.ec2meta = ec2metadata.New(ec2sess)
+		if !d.ec2meta.Available() && !opts.IMDSIPv6 {
+			// We may be on an IPv6-only subnet, where the IPv4 metadata
+			// endpoint (and the IPv4-only regional endpoints) are unreachable.
+			opts.IMDSIPv6 = true
+			opts.DualStack = true
+			if ec2sess, err = newSession(opts); err != nil {
+				return nil, err
+			}
+			d.ec2meta = ec2metadata.New(ec2sess)
+			if d.ec2meta.Available() {
+				Log("IPv4 metadata is unavailable; using IPv6 and dual-stack endpoints.\n")
+			}
+		}
+		if !d.ec2meta.Available() {
+			return nil, errors.New("Not running on an EC2 instance (or, in a container, " +
+				"the instance's metadata hop limit is too low to reach IMDS; see -no-metadata).")
+		}
+		if d.awsInstanceId == "" {
+			if d.awsInstanceId, err = d.ec2meta.GetMetadata("instance-id"); err != nil {
+				return nil, err
+			}
+		}
+		if d.awsRegion == "" {
+			if d.awsRegion, err = d.ec2meta.Region(); err != nil {
+				return nil, err
+			}
+		}
+		if d.awsAvailabilityZone == "" {
+			if d.awsAvailabilityZone, err =
+				d.ec2meta.GetMetadata("placement/availability-zone"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if opts.AssumeRole != "" {
+		base := ec2sess.Copy(&aws.Config{Region: aws.String(d.awsRegion)})
+		ec2sess = ec2sess.Copy(&aws.Config{Credentials: stscreds.NewCredentials(base, opts.AssumeRole,
+			func(p *stscreds.AssumeRoleProvider) {
+				p.RoleSessionName = "blocker-" + d.awsInstanceId
+			})})
+	}
+
+	ec2config := &aws.Config{Region: aws.String(d.awsRegion)}
+	if opts.Endpoint != "" {
+		ec2config.Endpoint = aws.String(opts.Endpoint)
+	}
+	d.session = ec2sess
+	d.ec2 = opts.EC2
+	if d.ec2 == nil {
+		d.ec2 = ec2.New(ec2sess, ec2config)
+	}
+	d.ssm = ssm.New(ec2sess, &aws.Config{Region: aws.String(d.awsRegion)})
+	d.cloudwatch = cloudwatch.New(ec2sess, &aws.Config{Region: aws.String(d.awsRegion)})
+	d.cloudtrail = cloudtrail.New(ec2sess, &aws.Config{Region: aws.String(d.awsRegion)})
+	d.logs = cloudwatchlogs.New(ec2sess, &aws.Config{Region: aws.String(d.awsRegion)})
+	d.secrets = secretsmanager.New(ec2sess, &aws.Config{Region: aws.String(d.awsRegion)})
+	d.ebs = ebs.New(ec2sess, &aws.Config{Region: aws.String(d.awsRegion)})
+	// Fetch AWS secrets with our own session, rather than the default one.
+	RegisterSecretProvider("secretsmanager", SecretProviderFunc(func(ctx context.Context, id string) ([]byte, error) {
+		return secretsManagerSecret(ctx, d.secrets, id, d.awsOpts(ctx)...)
+	}))
+	RegisterSecretProvider("ssm", SecretProviderFunc(func(ctx context.Context, name string) ([]byte, error) {
+		return ssmSecret(ctx, d.ssm, name, d.awsOpts(ctx)...)
+	}))
+	// AWS Health is served from us-east-1 only, whatever region it's asked about.
+	d.health = health.New(ec2sess, &aws.Config{Region: aws.String("us-east-1")})
+	d.kms = opts.KMS
+	if d.kms == nil {
+		d.kms = kms.New(ec2sess, &aws.Config{Region: aws.String(d.awsRegion)})
+	}
+
+	// Print some diagnostic information and then return the driver.
+	if opts.NoMetadata {
+		Log("Using supplied EC2 information:\n")
+	} else {
+		Log("Auto-detected EC2 information:\n")
+	}
+	Log("\tInstanceId        : %v\n", d.awsInstanceId)
+	SetLogFields("instance_id", d.awsInstanceId)
+	Log("\tRegion            : %v\n", d.awsRegion)
+	Log("\tAvailability Zone : %v\n", d.awsAvailabilityZone)
+	if opts.Endpoint != "" {
+		Log("\tEC2 Endpoint      : %v\n", opts.Endpoint)
+	}
+	if opts.EC2 != nil {
+		Log("\tEC2               : %T\n", opts.EC2)
+	}
+	if opts.AssumeRole != "" {
+		Log("\tAssumed Role      : %v\n", opts.AssumeRole)
+	}
+	if opts.EC2 == nil {
+		checkCredentials(ec2sess)
+	}
+	if GetConfig().SlowEBS.enabled() {
+		LogWarn("EBS is being slowed down for testing (see slow_ebs); don't do this in production.\n")
+	}
+	for _, f := range Features() {
+		if f.Experimental && FeatureEnabled(f.Name, nil) {
+			LogWarn("The experimental %v feature is on.\n", f.Name)
+		}
+	}
+	startup := WithRequestId(context.Background(), "startup")
+	d.reserved = d.findReservedDevices(startup)
+	if err := d.restoreState(startup, opts.RecoverState); err != nil {
+		return nil, err
+	}
+	d.setVolumeGauges()
+	publishFeatures()
+	background, stop := context.WithCancel(context.Background())
+	d.stop = stop
+	d.loop(background, "startup", d.repairStuckAttachments)
+	d.loop(background, "gc", d.gcLoop)
+	d.loop(background, "ttl", d.ttlLoop)
+	d.loop(background, "reconcile", d.reconcileLoop)
+	d.loop(background, "watchdog", d.watchdogLoop)
+	d.loop(background, "lease", d.leaseLoop)
+	d.loop(background, "verify", d.verifyLoop)
+	d.loop(background, "replication", d.replicationLoop)
+	d.loop(background, "scrub", d.scrubLoop)
+	d.loop(background, "trim", d.trimLoop)
+	d.loop(background, "grow", d.growLoop)
+	d.loop(background, "publish", d.publishLoop)
+	d.loop(background, "saturation", d.saturationLoop)
+	d.loop(background, "pool", d.poolLoop)
+	d.loop(background, "logs", d.logShipLoop)
+	d.loop(background, "health", d.healthLoop)
+	d.loop(background, "docker", d.dockerEventsLoop)
+	return d, nil
+}
+
+// loop runs one of the driver's background loops, under the given request
+// ID, until Close.
+func (d *EbsVolumeDriver) loop(ctx context.Context, id string, run func(ctx context.Context)) {
+	d.loops.Add(1)
+	go func() {
+		defer d.loops.Done()
+		run(WithRequestId(ctx, id))
+	}()
+}
+
+// Close stops the driver's background loops, waiting for them to finish
+// what they're doing.  Docker's requests are still served.
+func (d *EbsVolumeDriver) Close() {
+	if d.stop != nil {
+		d.stop()
+	}
+	d.loops.Wait()
+}
+
+// awsOpts tags EC2 calls made on behalf of a request with its ID (in the
+// user-agent), so they can be correlated with our logs in CloudTrail.
+func (d *EbsVolumeDriver) awsOpts(ctx context.Context) []request.Option {
+	if id := RequestId(ctx); id != "" {
+		return []request.Option{request.WithAppendUserAgent("blocker-request/" + id)}
+	}
+	return nil
+}
+
+func (d *EbsVolumeDriver) Create(ctx context.Context, name string, opts map[string]string) (err error) {
+	defer publishError(ctx, name, &err)
+	return d.do(name, func() (err error) {
+		defer d.record(ctx, name, "create", time.Now(), &err)
+		return d.create(ctx, name, opts)
+	})
+}
+
+func (d *EbsVolumeDriver) create(ctx context.Context, name string, opts map[string]string) error {
+	v, exists := d.volume(name)
+	if exists && v.mountpoint != "" {
+		// Docker re-announces volumes it already knows about, notably when
+		// dockerd restarts with live-restore enabled and containers kept
+		// running.  Leave the mounted volume exactly as it is.
+		LogCtx(ctx, "\tVolume %v already mounted at %v; keeping it.\n",
+			name, v.mountpoint)
+		return nil
+	}
+
+	// Layer the requested options over the profile and class they name, if
+	// any, and the configured defaults.
+	merged, err := volumeOptions("ebs", nil, opts)
+	if err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if err := checkOptionNames(merged, ebsOptionNames); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+
+	if snap, ok := merged["restore"]; ok {
+		for _, other := range []string{"snapshot", "from", "pool"} {
+			if _, ok := merged[other]; ok {
+				return errorf(CodeInvalidOption, "Only one of restore and %v may be given.", other)
+			}
+		}
+		if !strings.HasPrefix(snap, "snap-") {
+			return errorf(CodeInvalidOption, "Invalid snapshot ID %q.", snap)
+		}
+	}
+
+	// A point-in-time request is just a snapshot mount once we've found the
+	// right snapshot.
+	if from, ok := merged["from"]; ok {
+		if _, ok := merged["snapshot"]; ok {
+			return WithCode(CodeInvalidOption,
+				errors.New("Only one of from and snapshot may be given."))
+		}
+		snap, err := d.findSnapshotAt(ctx, from)
+		if err != nil {
+			return err
+		}
+		merged["snapshot"] = snap
+	}
+
+	v = &ebsVolume{opts: merged, requested: opts, created: time.Now()}
+	provision := false
+	if class, ok := merged["pool"]; ok {
+		// A new volume is taken from the pool at mount time.
+		if _, ok := merged["snapshot"]; ok {
+			return WithCode(CodeInvalidOption,
+				errors.New("Only one of pool and snapshot may be given."))
+		}
+		if _, ok := GetConfig().Pool.Classes[class]; !ok {
+			return errorf(CodeInvalidOption, "Unknown pool class %q.", class)
+		}
+		// Unless it was made earlier (say, before the daemon restarted).
+		id, err := d.resolveVolumeId(ctx, name)
+		if err != nil {
+			return err
+		}
+		v.id = id
+	} else if snap, ok := merged["snapshot"]; ok {
+		// The volume is provisioned from the snapshot at mount time.
+		if !strings.HasPrefix(snap, "snap-") {
+			return errorf(CodeInvalidOption, "Invalid snapshot ID %q.", snap)
+		}
+	} else {
+		// Otherwise the name is either a volume ID or a volume's Name tag.
+		id, err := d.resolveVolumeId(ctx, name)
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			// Given a size or a snapshot to restore, we make the volume
+			// (once the options check out).
+			_, sized := merged["size"]
+			_, restored := merged["restore"]
+			if !sized && !restored {
+				return errorf(CodeNotFound, "No EBS volume is named %v.", name)
+			}
+			provision = true
+		}
+		if err := d.refuseRoot(ctx, id); err != nil {
+			return err
+		}
+		v.id = id
+	}
+	if _, err := v.readOnly(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := v.mountOptions(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := v.repairable(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := v.fsckPolicy(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := v.archived(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := v.snapshotOnRemove(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if ttl, err := v.ttl(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	} else if pinned, err := v.pinned(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	} else if pinned && ttl > 0 {
+		return errorf(CodeInvalidOption, "Pinned volumes can't have a ttl.")
+	}
+	if _, _, err := v.audited(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := v.costCeiling(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if critical, err := v.critical(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	} else if encrypted, _ := v.encryptedFS(); critical && encrypted {
+		// Mounting at boot would need the LUKS key, which only blocker
+		// can get.
+		return errorf(CodeInvalidOption, "Encrypted filesystems can't be critical volumes.")
+	}
+	if force, err := v.forced(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	} else if force && v.id != "" {
+		// Refuse now, rather than at the mount.
+		if err := v.confirmed(name, "forcibly detaching "+v.id); err != nil {
+			return err
+		}
+	}
+	if _, err := parseFeatures(merged["features"]); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if spec, err := parseVolumeSpec(merged); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	} else if spec.MultiAttach && !FeatureEnabled(featureMultiAttach, merged) {
+		return errorf(CodeInvalidOption, "Multi-Attach is experimental, and the %v feature is off; "+
+			"turn it on with features=%v (or under features in the configuration).",
+			featureMultiAttach, featureMultiAttach)
+	}
+	if _, err := v.encrypted(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := v.tuning(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := v.encryptedFS(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := v.seed(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := parseVolumeTags(merged["tags"]); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if zone, err := v.replicateTo(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	} else if zone != "" && zone == d.awsAvailabilityZone {
+		return errorf(CodeInvalidOption, "The volume is already in %v; replicate-to must name another zone.", zone)
+	}
+
+	if provision || merged["pool"] != "" {
+		if readOnlyMode() {
+			return errReadOnly("creating volume " + name)
+		}
+	}
+	if provision {
+		if err := d.checkCost(ctx, name, v); err != nil {
+			return err
+		}
+		id, err := d.provisionVolume(ctx, name, v)
+		if err != nil {
+			return err
+		}
+		v.id = id
+		v.provisioned = true
+	}
+
+	d.update(func() { d.volumes[name] = v })
+	publishEvent(ctx, VolumeEvent{Type: eventCreated, Name: name, VolumeId: v.id})
+	return nil
+}
+
+func (d *EbsVolumeDriver) Mount(ctx context.Context, name string) (string, error) {
+	return d.coalesce(ctx, "mount", name, func(ctx context.Context) (mnt string, err error) {
+		defer publishError(ctx, name, &err)
+		err = d.do(name, func() (err error) {
+			defer d.record(ctx, name, "mount", time.Now(), &err)
+			mnt, err = d.mount(ctx, name)
+			return err
+		})
+		return mnt, err
+	})
+}
+
+func (d *EbsVolumeDriver) mount(ctx context.Context, name string) (string, error) {
+	v, exists := d.volume(name)
+	if !exists {
+		if !GetConfig().AutoCreate {
+			return "", errNameNotFound
+		}
+
+		// Users who never run `docker volume create` get the defaults.
+		LogCtx(ctx, "\tAuto-creating volume %v.\n", name)
+		if err := d.create(ctx, name, nil); err != nil {
+			return "", err
+		}
+		v, _ = d.volume(name)
+	}
+	if err := v.checkMaintenance(name); err != nil {
+		return "", err
+	}
+
+	// Another container may already be using the volume, or Docker may be
+	// retrying a Mount it thinks failed (e.g. after a daemon hiccup); either
+	// way, just hand back where it's mounted.
+	caller := Caller(ctx)
+	if v.mountpoint != "" {
+		d.update(func() { v.addUser(caller) })
+		LogCtx(ctx, "\tVolume %v already mounted at %v; now in use by %v mount(s).\n",
+			name, v.mountpoint, v.userCount())
+		return v.mountpoint, nil
+	}
+
+	mnt, err := d.doMount(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	d.update(func() { v.addUser(caller) })
+	return mnt, nil
+}
+
+func (d *EbsVolumeDriver) Path(ctx context.Context, name string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[name]
+	if !exists {
+		return "", errNameNotFound
+	}
+
+	if v.mountpoint == "" {
+		return "", WithCode(CodeNotMounted, errors.New("Volume not mounted."))
+	}
+
+	return v.mountpoint, nil
+}
+
+func (d *EbsVolumeDriver) Remove(ctx context.Context, name string) error {
+	_, err := d.coalesce(ctx, "remove", name, func(ctx context.Context) (_ string, err error) {
+		defer publishError(ctx, name, &err)
+		return "", d.do(name, func() error {
+			return d.remove(ctx, name)
+		})
+	})
+	return err
+}
+
+func (d *EbsVolumeDriver) remove(ctx context.Context, name string) error {
+	v, exists := d.volume(name)
+	if !exists {
+		return errNameNotFound
+	}
+	if err := v.checkPinned(ctx, name, "remove"); err != nil {
+		return err
+	}
+
+	// If the volume is still mounted (or attached), unmount it before
+	// removing it.
+	if v.mountpoint != "" {
+		err := d.doUnmount(ctx, name)
+		if err != nil {
+			return err
+		}
+	} else if !v.prefetched.IsZero() {
+		if err := d.detachPrefetched(ctx, v); err != nil {
+			return err
+		}
+	}
+	if err := d.snapshotIfRequested(ctx, name, v); err != nil {
+		return err
+	}
+	if err := d.deleteIfEphemeral(ctx, name, v); err != nil {
+		return err
+	}
+
+	d.update(func() { delete(d.volumes, name) })
+	return nil
+}
+
+func (d *EbsVolumeDriver) Unmount(ctx context.Context, name string) error {
+	_, err := d.coalesce(ctx, "unmount", name, func(ctx context.Context) (_ string, err error) {
+		defer publishError(ctx, name, &err)
+		return "", d.do(name, func() (err error) {
+			defer d.record(ctx, name, "unmount", time.Now(), &err)
+			return d.unmount(ctx, name)
+		})
+	})
+	return err
+}
+
+func (d *EbsVolumeDriver) unmount(ctx context.Context, name string) error {
+	v, exists := d.volume(name)
+	if !exists {
+		return errNameNotFound
+	}
+
+	// Ignore requests to unmount volumes that aren't actually mounted.
+	if v.mountpoint == "" {
+		return nil
+	}
+
+	// Leave the volume mounted while other containers are using it.
+	var left int
+	d.update(func() { left = v.dropUser(Caller(ctx)) })
+	if left > 0 {
+		LogCtx(ctx, "\tVolume %v is still in use by %v mount(s); leaving it mounted.\n",
+			name, left)
+		return nil
+	}
+	if err := v.checkPinned(ctx, name, "unmount"); err != nil {
+		return err
+	}
+	return d.doUnmount(ctx, name)
+}
+
+// mountRoot is where volumes are mounted.
+func mountRoot() string {
+	return GetConfig().MountRoot
+}
+
+func (d *EbsVolumeDriver) doMount(ctx context.Context, name string) (string, error) {
+	// Auto-generate a random mountpoint.
+	mnt := mountRoot() + "/" + uuid.NewV4().String()
+	if err := d.mountAt(ctx, name, mnt); err != nil {
+		return "", err
+	}
+	return mnt, nil
+}
+
+// mountAt attaches the volume (unless it was prefetched) and mounts it at
+// the given mountpoint.
+func (d *EbsVolumeDriver) mountAt(ctx context.Context, name string, mnt string) error {
+	// Ensure the directory /mnt/blocker/<m> exists.
+	if err := os.MkdirAll(mnt, os.ModeDir|0700); err != nil {
+		return err
+	}
+	if stat, err := os.Stat(mnt); err != nil || !stat.IsDir() {
+		return fmt.Errorf("Mountpoint %v is not a directory: %v", mnt, err)
+	}
+
+	v, _ := d.volume(name)
+	prefetched := !v.prefetched.IsZero()
+	dev := v.device
+	if !prefetched {
+		var err error
+		if dev, err = d.attach(ctx, name, v); err != nil {
+			return err
+		}
+	}
+	ctx = withVolumeFields(ctx, v, "device", dev)
+
+	ro, _ := v.readOnly()
+	mo, _ := v.mountOptions()
+	dev, err := d.openEncrypted(ctx, name, v, dev, ro, mo)
+	if err == nil {
+		err = formatIfBlank(ctx, dev, ro, mo, func() error {
+			return v.confirmed(name, "formatting "+v.id)
+		})
+	}
+	if err == nil {
+		err = fsckIfWanted(ctx, v, dev, ro, mo)
+	}
+	if err == nil {
+		err = d.mountRepairing(ctx, v, dev, mnt, ro, mo)
+		if err == nil && !ro {
+			if err = d.seedIfEmpty(ctx, v, mnt, mo); err != nil {
+				unmount(mnt, mo.FSType)
+			}
+		}
+	}
+	if err != nil {
+		// Make sure to detach the instance before quitting (ignoring errors),
+		// even if the request was cancelled.
+		cleanup := context.WithoutCancel(ctx)
+		d.detachVolume(cleanup, v.id)
+		d.releaseLease(cleanup, v.id)
+		d.cleanupTemporary(cleanup, v)
+		if prefetched {
+			d.update(func() {
+				v.device = ""
+				v.prefetched = time.Time{}
+			})
+		}
+		return err
+	}
+
+	// And finally record it.
+	var expires time.Time
+	if ttl, _ := v.ttl(); ttl > 0 {
+		expires = time.Now().Add(ttl)
+		LogCtx(ctx, "\tVolume %v will be unmounted after %v, at %v.\n",
+			name, ttl, expires.Format(time.RFC3339))
+	}
+	d.update(func() {
+		v.mountpoint = mnt
+		v.device = dev
+		v.everMounted = true
+		v.prefetched = time.Time{}
+		v.expires = expires
+	})
+	publishEvent(ctx, VolumeEvent{Type: eventMounted,
+		Name: name, VolumeId: v.id, Device: dev, Mountpoint: mnt})
+	d.startAudit(ctx, name, v)
+	if critical, _ := v.critical(); critical {
+		d.syncFstab(ctx)
+	}
+	if !ro && !v.temporary {
+		d.growIfEnlarged(ctx, name, v)
+	}
+	return nil
+}
+
+// attach readies the volume's EBS volume (making it first if need be),
+// leases it, and attaches it, returning its local device.
+func (d *EbsVolumeDriver) attach(ctx context.Context, name string, v *ebsVolume) (string, error) {
+	// Volumes mounted from a snapshot need an EBS volume to be made first,
+	// and new pooled volumes come ready attached.
+	var dev string
+	if class, ok := v.opts["pool"]; ok && v.id == "" {
+		sb, err := d.takeStandby(ctx, name, class)
+		if err != nil {
+			return "", err
+		}
+		d.update(func() {
+			v.id = sb.id
+			v.ephemeral = true
+		})
+		dev = sb.device
+	} else if v.id == "" {
+		id, err := d.createVolumeFromSnapshot(ctx, name, v.opts)
+		if err != nil {
+			return "", err
+		}
+		d.update(func() {
+			v.id = id
+			v.temporary = true
+		})
+	}
+
+	ctx = withVolumeFields(ctx, v)
+
+	// Don't take a volume that's being handed between hosts, unless it's
+	// being handed to us, nor the instance's root volume.
+	if !v.temporary && dev == "" {
+		if err := d.refuseRoot(ctx, v.id); err != nil {
+			return "", err
+		}
+		if err := d.awaitHandoff(ctx, v.id); err != nil {
+			return "", err
+		}
+		if err := d.applyTags(ctx, v); err != nil {
+			return "", err
+		}
+	}
+	// Failures from here on are tidied up even if the request was
+	// cancelled.
+	cleanup := context.WithoutCancel(ctx)
+	if err := d.acquireLease(ctx, v.id); err != nil {
+		d.cleanupTemporary(cleanup, v)
+		return "", err
+	}
+
+	// Attach the EBS device to the current EC2 instance, first taking it
+	// from a dead one if need be.
+	if force, _ := v.forced(); force && dev == "" && !v.temporary {
+		if readOnlyMode() {
+			d.releaseLease(cleanup, v.id)
+			return "", errReadOnly("forcibly detaching " + v.id)
+		}
+		if err := v.confirmed(name, "forcibly detaching "+v.id); err != nil {
+			d.releaseLease(cleanup, v.id)
+			return "", err
+		}
+		if err := d.forceDetachElsewhere(ctx, v.id); err != nil {
+			d.releaseLease(cleanup, v.id)
+			return "", err
+		}
+	}
+	if dev == "" {
+		var err error
+		if dev, err = d.attachVolume(ctx, v.id); err != nil {
+			d.releaseLease(cleanup, v.id)
+			d.cleanupTemporary(cleanup, v)
+			return "", err
+		}
+	}
+
+	if v.ephemeral {
+		if err := d.setDeleteOnTermination(ctx, v.id); err != nil {
+			LogCtxWarn(ctx, "\tMarking %v delete-on-termination failed: %v\n", v.id, err)
+		}
+	}
+	tuneDevice(ctx, v, dev)
+	return dev, nil
+}
+
+func init() {
+	DescribeMetric("blocker_mount_retries_total",
+		"Mounts retried because the device wasn't ready yet.")
+}
+
+// mountDevice mounts an attached device at the given mountpoint.  Retries
+// stop if the request is cancelled.
+func (d *EbsVolumeDriver) mountDevice(ctx context.Context, dev string, mnt string, ro bool, mo mountOptions) error {
+	// Refuse to stack mounts or to double-mount the device.  Filesystems
+	// which unmount themselves aren't in the mount table, and look after
+	// that themselves (see Unmounter).
+	fs := filesystemFor(mountFSType(dev, mo.FSType))
+	if _, ok := fs.(Unmounter); !ok {
+		if err := checkMountTarget(dev, mnt); err != nil {
+			return err
+		}
+	}
+
+	// Now go ahead and mount the EBS device to the desired mountpoint.
+	flags := mo.Flags
+	if ro {
+		flags = append([]string{"ro"}, flags...)
+	}
+
+	// A freshly attached device can take a moment to become usable, so
+	// retry (with backoff) while mount says it isn't there.  Anything else,
+	// like a bad superblock, won't get better by waiting.
+	retry := GetConfig().MountRetry
+	backoff := time.Duration(retry.Backoff)
+	for attempt := 1; ; attempt++ {
+		out, err := fs.Mount(dev, mnt, flags)
+		if err == nil {
+			break
+		}
+		if badSuperblock(out) {
+			return diagnoseSuperblock(dev, out)
+		}
+		if attempt >= retry.Attempts || !deviceNotReady(out) {
+			return fmt.Errorf("Mounting device %v to %v failed: %v\n%v",
+				dev, mnt, err, out)
+		}
+		LogCtx(ctx, "\tDevice %v isn't ready yet; retrying the mount in %v.\n", dev, backoff)
+		IncCounter("blocker_mount_retries_total")
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+	if !ro {
+		if err := mo.chown(mnt); err != nil {
+			exec.Command("umount", mnt).Run()
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *EbsVolumeDriver) waitUntilState(
+	ctx context.Context, id string, check func(*ec2.Volume) error) error {
+	// Most volume operations are asynchronous, and we often need to wait until
+	// state transitions finish before proceeding to the mount.  Most finish
+	// within seconds, so we poll quickly at first, backing off to the
+	// configured interval, and give up if the request is abandoned.
+	timeouts := GetConfig().Timeouts
+	deadline := time.Now().Add(time.Duration(timeouts.StateWait))
+	poll := time.Second
+	for {
+		volumes, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(id)},
+		}, d.awsOpts(ctx)...)
+		if err != nil {
+			return err
+		}
+
+		if len(volumes.Volumes) != 1 {
+			return errorf(CodeNotFound, "Volume %v not found.", id)
+		}
+
+		// Check to see if the volume reached the intended state; if yes, return.
+		err = check(volumes.Volumes[0])
+		if err == nil {
+			return nil
+		}
+		if aws.StringValue(volumes.Volumes[0].State) == ec2.VolumeStateError {
+			// It never will.
+			return fmt.Errorf("Volume %v failed: its state is %v.", id, ec2.VolumeStateError)
+		}
+		if time.Now().After(deadline) {
+			return WithCode(CodeAttachTimeout, err)
+		}
+
+		LogCtx(ctx, "\tWaiting for volume %v: %v\n", id, err)
+		if poll > time.Duration(timeouts.StatePoll) {
+			poll = time.Duration(timeouts.StatePoll)
+		}
+		if err := sleep(ctx, poll); err != nil {
+			return err
+		}
+		poll *= 2
+	}
+}
+
+func (d *EbsVolumeDriver) waitUntilAvailable(ctx context.Context, id string) error {
+	return d.waitUntilState(ctx, id, func(volume *ec2.Volume) error {
+		if *volume.State == ec2.VolumeStateAvailable {
+			return nil
+		}
+		return fmt.Errorf(
+			"Volume state transition failed: seeking %v, current is %v",
+			ec2.VolumeStateAvailable, *volume.State)
+	})
+}
+
+func (d *EbsVolumeDriver) doUnmount(ctx context.Context, name string) error {
+	v, _ := d.volume(name)
+	mnt := v.mountpoint
+	// An unmount, once begun, is seen through even if the request is
+	// cancelled: stopping halfway would leave the volume recorded as mounted
+	// when it isn't, or still attached.
+	ctx = withVolumeFields(context.WithoutCancel(ctx), v, "device", v.device)
+
+	// First unmount the device.
+	d.stopAudit(v)
+	mo, _ := v.mountOptions()
+	if err := unmount(mnt, mo.FSType); err != nil {
+		d.startAudit(ctx, name, v)
+		return err
+	}
+	publishEvent(ctx, VolumeEvent{Type: eventUnmounted,
+		Name: name, VolumeId: v.id, Mountpoint: mnt})
+	if critical, _ := v.critical(); critical {
+		d.syncFstab(ctx)
+	}
+
+	// Remove the mountpoint from the filesystem.
+	if err := os.Remove(mnt); err != nil {
+		return err
+	}
+
+	// Detach the EBS volume from this AWS instance.
+	if err := d.detachVolume(ctx, v.id); err != nil {
+		return err
+	}
+	if err := d.releaseLease(ctx, v.id); err != nil {
+		LogCtxWarn(ctx, "\tReleasing lease on %v failed: %v\n", v.id, err)
+	}
+	if err := d.cleanupTemporary(ctx, v); err != nil {
+		return err
+	}
+
+	// Finally clear out the slot and return.
+	d.update(func() {
+		v.mountpoint = ""
+		v.device = ""
+		v.users = nil
+	})
+	return nil
+}
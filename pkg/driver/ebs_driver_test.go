@@ -0,0 +1,33 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCloseStopsLoops(t *testing.T) {
+	d := newTestDriver(t)
+	background, stop := context.WithCancel(context.Background())
+	d.stop = stop
+	d.loop(background, "gc", d.gcLoop)
+	d.loop(background, "ttl", d.ttlLoop)
+	d.loop(background, "reconcile", d.reconcileLoop)
+	d.loop(background, "watchdog", d.watchdogLoop)
+	d.loop(background, "grow", d.growLoop)
+	d.loop(background, "logs", d.logShipLoop)
+	d.loop(background, "docker", d.dockerEventsLoop)
+
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't stop the background loops")
+	}
+	// Closing again does no harm.
+	d.Close()
+}
@@ -0,0 +1,68 @@
+package driver
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Encryption follows the data.  EBS keeps snapshots of encrypted volumes,
+// and volumes made from encrypted snapshots, encrypted, but with whichever
+// key the request names (or else the account's default one), and the EBS
+// direct APIs hand back plaintext.  So wherever blocker makes a volume from
+// a snapshot it names the key explicitly: the volume's kms-key option if it
+// has one, else encryption.kms_key if that's set (re-encrypting everything
+// to one key), else the snapshot's own.  New encrypted volumes use the same
+// key, bar the snapshot's.  A volume made from an encrypted snapshot which
+// asks not to be encrypted is refused rather than quietly encrypted, and
+// exports of encrypted snapshots (see Export) are themselves encrypted.
+
+// volumeKey is the KMS key to encrypt a volume with: its kms-key option, or
+// else the configured one, or else "" for the default.
+func volumeKey(opts map[string]string) string {
+	if key := opts["kms-key"]; key != "" {
+		return key
+	}
+	return GetConfig().Encryption.KMSKey
+}
+
+// snapshotEncryption looks up whether a snapshot is encrypted, and with what
+// key.
+func (d *EbsVolumeDriver) snapshotEncryption(ctx context.Context, snap string) (bool, string, error) {
+	out, err := d.ec2.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{aws.String(snap)},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return false, "", err
+	}
+	if len(out.Snapshots) != 1 {
+		return false, "", errorf(CodeNotFound, "Snapshot %v not found.", snap)
+	}
+	s := out.Snapshots[0]
+	return aws.BoolValue(s.Encrypted), aws.StringValue(s.KmsKeyId), nil
+}
+
+// inheritEncryption encrypts a volume being made from a snapshot as the
+// snapshot is (see volumeKey), refusing one whose encrypted option says it
+// mustn't be.  Volumes from unencrypted snapshots are left as asked for.
+func (d *EbsVolumeDriver) inheritEncryption(ctx context.Context, snap string, opts map[string]string,
+	input *ec2.CreateVolumeInput) error {
+	encrypted, key, err := d.snapshotEncryption(ctx, snap)
+	if err != nil || !encrypted {
+		return err
+	}
+	if e, ok := opts["encrypted"]; ok {
+		if b, err := strconv.ParseBool(e); err == nil && !b {
+			return errorf(CodeInvalidOption, "Snapshot %v is encrypted, so volumes made from it "+
+				"must be too; drop encrypted=false.", snap)
+		}
+	}
+	if k := volumeKey(opts); k != "" {
+		key = k
+	}
+	input.Encrypted = aws.Bool(true)
+	input.KmsKeyId = aws.String(key)
+	return nil
+}
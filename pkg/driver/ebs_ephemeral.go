@@ -0,0 +1,207 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Volumes tagged blocker:ephemeral=true are scratch space: they're deleted
+// when Docker removes them, or when the instance shuts down, much like EC2's
+// DeleteOnTermination for volumes launched with an instance.
+
+// isEphemeral reports whether an EBS volume is tagged as ephemeral.
+func isEphemeral(vol *ec2.Volume) bool {
+	return tagValue(vol.Tags, tagEphemeral) == "true"
+}
+
+// setDeleteOnTermination marks our attachment of an ephemeral volume so that
+// EC2 deletes it if the instance is terminated without us getting a say.
+func (d *EbsVolumeDriver) setDeleteOnTermination(ctx context.Context, id string) error {
+	vol, err := d.describeVolume(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, a := range vol.Attachments {
+		if aws.StringValue(a.InstanceId) != d.awsInstanceId {
+			continue
+		}
+		_, err := d.ec2.ModifyInstanceAttributeWithContext(ctx, &ec2.ModifyInstanceAttributeInput{
+			InstanceId: aws.String(d.awsInstanceId),
+			BlockDeviceMappings: []*ec2.InstanceBlockDeviceMappingSpecification{{
+				DeviceName: a.Device,
+				Ebs: &ec2.EbsInstanceBlockDeviceSpecification{
+					VolumeId:            aws.String(id),
+					DeleteOnTermination: aws.Bool(true),
+				},
+			}},
+		}, d.awsOpts(ctx)...)
+		return err
+	}
+	return nil
+}
+
+// deleteIfEphemeral deletes an unmounted volume if it's tagged as ephemeral,
+// archiving it first if so configured.
+func (d *EbsVolumeDriver) deleteIfEphemeral(ctx context.Context, name string, v *ebsVolume) error {
+	if v.id == "" || v.temporary {
+		return nil
+	}
+	vol, err := d.describeVolume(ctx, v.id)
+	if err != nil {
+		// Don't let a volume that's vanished (say) block its removal.
+		LogCtxWarn(ctx, "\tChecking whether %v is ephemeral failed: %v\n", v.id, err)
+		return nil
+	}
+	if !isEphemeral(vol) {
+		return nil
+	}
+	if err := v.checkPinned(ctx, name, "delete"); err != nil {
+		LogCtxWarn(ctx, "\tKeeping ephemeral EBS volume %v: %v\n", v.id, err)
+		return nil
+	}
+
+	if readOnlyMode() {
+		LogCtx(ctx, "\tKeeping ephemeral EBS volume %v: this host is in read-only mode.\n", v.id)
+		return nil
+	}
+	if err := v.confirmed(name, "deleting "+v.id); err != nil {
+		// Docker can't change a volume's options, so failing the removal
+		// would leave it stuck; keep the EBS volume instead.
+		LogCtxWarn(ctx, "\tKeeping ephemeral EBS volume %v: %v\n", v.id, err)
+		return nil
+	}
+	LogCtx(ctx, "\tDeleting ephemeral EBS volume %v.\n", v.id)
+	if err := d.waitUntilAvailable(ctx, v.id); err != nil {
+		return err
+	}
+	if archive, _ := v.archived(); archive {
+		if err := d.archive(ctx, name, v.id); err != nil {
+			return fmt.Errorf("Archiving %v failed, so it was kept: %v", v.id, err)
+		}
+	}
+	if err := d.deleteVolume(ctx, v.id); err != nil {
+		return err
+	}
+	d.update(func() { v.id = "" })
+	return nil
+}
+
+// systemShuttingDown reports whether the whole machine (rather than just
+// blocker) is going down, according to systemd.
+func systemShuttingDown() bool {
+	out, _ := exec.Command("systemctl", "is-system-running").Output()
+	return strings.TrimSpace(string(out)) == "stopping"
+}
+
+// Shutdown is called as the daemon exits.  The background loops are stopped
+// (see Close), and if the instance itself is shutting down, every volume but
+// the critical ones (see ebs_fstab.go) is unmounted and detached (so that
+// other instances can take them straight away) and ephemeral volumes are
+// deleted; otherwise (say, blocker is merely being restarted) everything is
+// left as it is.  Volumes are cleaned up a few at a time, and what isn't done
+// by the deadline is reported and left to EC2, rather than have systemd kill
+// us midway through.
+func (d *EbsVolumeDriver) Shutdown(ctx context.Context) {
+	d.Close()
+	if !systemShuttingDown() {
+		return
+	}
+	cfg := GetConfig().ShutdownCleanup
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Deadline))
+	defer cancel()
+
+	d.mu.Lock()
+	pending := map[string]bool{}
+	for name := range d.volumes {
+		pending[name] = true
+	}
+	d.mu.Unlock()
+	LogCtx(ctx, "Cleaning up %v volume(s), %v at a time.\n", len(pending), cfg.Parallelism)
+
+	// Each volume is cleaned up by its actor, so one that hangs only holds
+	// up its own slot.
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		slots = make(chan struct{}, cfg.Parallelism)
+	)
+	for name := range pending {
+		name := name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+			d.do(name, func() error {
+				d.shutdownVolume(ctx, name)
+				return nil
+			})
+			mu.Lock()
+			delete(pending, name)
+			mu.Unlock()
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		LogCtx(ctx, "Cleaned up all volumes.\n")
+	case <-ctx.Done():
+		mu.Lock()
+		var stragglers []string
+		for name := range pending {
+			stragglers = append(stragglers, name)
+		}
+		mu.Unlock()
+		sort.Strings(stragglers)
+		LogCtxError(ctx, "Cleanup missed its %v deadline; %v volume(s) weren't cleaned up: %v\n",
+			time.Duration(cfg.Deadline), len(stragglers), strings.Join(stragglers, ", "))
+	}
+}
+
+// shutdownVolume unmounts and detaches a volume, deleting it if it's
+// ephemeral.
+func (d *EbsVolumeDriver) shutdownVolume(ctx context.Context, name string) {
+	v, exists := d.volume(name)
+	if !exists || v.id == "" {
+		return
+	}
+	// Critical volumes are left attached, with their fstab entries, to be
+	// mounted at boot.
+	if critical, _ := v.critical(); critical && v.mountpoint != "" {
+		LogCtx(ctx, "\tLeaving critical volume %v mounted, to be mounted again at boot.\n", name)
+		return
+	}
+	if v.mountpoint != "" {
+		LogCtx(ctx, "\tUnmounting %v.\n", name)
+		if err := d.doUnmount(ctx, name); err != nil {
+			LogCtxError(ctx, "Unmounting %v failed: %v\n", name, err)
+			return
+		}
+	} else if !v.prefetched.IsZero() {
+		LogCtx(ctx, "\tDetaching prefetched volume %v.\n", name)
+		if err := d.detachPrefetched(ctx, v); err != nil {
+			LogCtxError(ctx, "Detaching prefetched volume %v failed: %v\n", name, err)
+			return
+		}
+	}
+	if err := d.deleteIfEphemeral(ctx, name, v); err != nil {
+		LogCtxError(ctx, "Deleting ephemeral volume %v failed: %v\n", name, err)
+	}
+}
@@ -0,0 +1,20 @@
+package driver
+
+import (
+	"context"
+	"testing"
+)
+
+func TestShutdownLeavesCriticalVolumes(t *testing.T) {
+	d := newTestDriver(t)
+	d.volumes["data"] = &ebsVolume{
+		id:         "vol-0123456789abcdef0",
+		opts:       map[string]string{"critical": "true"},
+		mountpoint: "/mnt/blocker/data",
+		device:     "/dev/xvdf",
+	}
+	d.shutdownVolume(context.Background(), "data")
+	if v := d.volumes["data"]; v.mountpoint == "" || v.device == "" {
+		t.Errorf("critical volume was unmounted at shutdown: %+v", v)
+	}
+}
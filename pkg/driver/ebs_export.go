@@ -0,0 +1,351 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ebs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Some users need backups outside the EBS snapshot system: in another
+// account's bucket, say, or somewhere EBS can't reach.  Export reads a
+// volume's latest snapshot through the EBS direct APIs and streams its blocks
+// to S3 (see ExportConfig).  The first export of a volume sends every block;
+// later ones send only the blocks changed since the last snapshot exported to
+// the same place, which is remembered in its blocker:exported-to tag.
+//
+// Each export is two objects under <prefix><volume-id>/: <snapshot-id>.blocks,
+// the blocks' data one after another, and <snapshot-id>.json, an
+// ExportManifest saying which blocks they are.  To restore, write a full
+// export's blocks to a blank device at index*BlockSize, then each incremental
+// export's in turn (following BaseSnapshotId), zeroing the blocks marked Zero.
+
+func init() {
+	DescribeMetric("blocker_exports_total",
+		"Snapshot exports to S3, by kind (full or incremental) and result.")
+	DescribeMetric("blocker_export_bytes_total",
+		"Bytes of snapshot blocks exported to S3.")
+}
+
+// exportFormat is the version of the export layout, recorded in manifests.
+const exportFormat = 1
+
+// ExportManifest describes an exported snapshot.
+type ExportManifest struct {
+	Format         int
+	VolumeId       string
+	SnapshotId     string
+	BaseSnapshotId string `json:",omitempty"`
+	VolumeSizeGiB  int64
+	BlockSize      int64
+	Created        time.Time
+	// Blocks are the blocks in the .blocks object, in order.  Zero blocks
+	// have no data there; they were written in the base snapshot, but
+	// aren't in this one.
+	Blocks []ExportBlock
+}
+
+type ExportBlock struct {
+	Index    int64
+	Checksum string `json:",omitempty"`
+	Zero     bool   `json:",omitempty"`
+}
+
+// ExportResult reports what an export sent, and where.
+type ExportResult struct {
+	Volume         string
+	VolumeId       string
+	SnapshotId     string
+	BaseSnapshotId string `json:",omitempty"`
+	Bucket         string
+	DataKey        string
+	ManifestKey    string
+	Blocks         int
+	Bytes          int64
+}
+
+// exportDestination is where exports go, as recorded in blocker:exported-to.
+func exportDestination(c ExportConfig) string {
+	return "s3://" + c.Bucket + "/" + c.Prefix
+}
+
+// Export exports the latest snapshot of the named volume to S3: only what
+// has changed since its last export, unless full is set.
+func (d *EbsVolumeDriver) Export(ctx context.Context, name string, full bool) (ExportResult, error) {
+	result := ExportResult{Volume: name}
+	kind := "incremental"
+	err := d.export(ctx, name, full, &result)
+	if result.BaseSnapshotId == "" {
+		kind = "full"
+	}
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+		LogCtxError(ctx, "Exporting %v (%v) failed: %v\n", name, result.SnapshotId, err)
+	} else {
+		LogCtx(ctx, "Exported %v (%v) to s3://%v/%v: %v blocks, %v bytes.\n",
+			name, result.SnapshotId, result.Bucket, result.DataKey, result.Blocks, result.Bytes)
+	}
+	IncCounter("blocker_exports_total", "kind", kind, "result", outcome)
+	return result, err
+}
+
+func (d *EbsVolumeDriver) export(ctx context.Context, name string, full bool, result *ExportResult) error {
+	c := GetConfig().Export
+	if c.Bucket == "" {
+		return errors.New("No export bucket is configured.")
+	}
+	id, err := d.resolveVolumeId(ctx, name)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return errorf(CodeNotFound, "No EBS volume is named %v.", name)
+	}
+	snap, err := d.latestSnapshot(ctx, id)
+	if err != nil {
+		return err
+	}
+	dest := exportDestination(c)
+	result.VolumeId = id
+	result.SnapshotId = aws.StringValue(snap.SnapshotId)
+	if tagValue(snap.Tags, tagExportedTo) == dest {
+		return fmt.Errorf("Snapshot %v of %v was already exported to %v; there's nothing new to export.",
+			result.SnapshotId, name, dest)
+	}
+	// The direct APIs return plaintext, so exports of encrypted snapshots
+	// are encrypted in S3 (with the snapshot's key, unless another's set).
+	sseKey := c.KMSKey
+	sse := sseKey != "" || aws.BoolValue(snap.Encrypted)
+	if sseKey == "" && sse {
+		if c.Region != "" && c.Region != d.awsRegion {
+			return errorf(CodeInvalidOption, "Snapshot %v of %v is encrypted, and its key can't be "+
+				"used in %v; set export.kms_key to a key there.", result.SnapshotId, name, c.Region)
+		}
+		sseKey = aws.StringValue(snap.KmsKeyId)
+	}
+	if !full {
+		base, err := d.lastExport(ctx, id, dest)
+		if err != nil {
+			return err
+		}
+		result.BaseSnapshotId = base
+	}
+
+	prefix := c.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	key := prefix + id + "/" + result.SnapshotId
+	result.Bucket = c.Bucket
+	result.DataKey = key + ".blocks"
+	result.ManifestKey = key + ".json"
+
+	uploader := s3manager.NewUploaderWithClient(d.s3Client(c.Region))
+	encrypt := func(input *s3manager.UploadInput) {
+		if sse {
+			input.ServerSideEncryption = aws.String("aws:kms")
+			if sseKey != "" {
+				input.SSEKMSKeyId = aws.String(sseKey)
+			}
+		}
+	}
+
+	manifest := ExportManifest{
+		Format:         exportFormat,
+		VolumeId:       id,
+		SnapshotId:     result.SnapshotId,
+		BaseSnapshotId: result.BaseSnapshotId,
+		VolumeSizeGiB:  aws.Int64Value(snap.VolumeSize),
+		Created:        time.Now().UTC(),
+	}
+	if manifest.BaseSnapshotId != "" {
+		LogCtx(ctx, "\tExporting the blocks of %v changed since %v.\n",
+			result.SnapshotId, manifest.BaseSnapshotId)
+	} else {
+		LogCtx(ctx, "\tExporting every block of %v.\n", result.SnapshotId)
+	}
+
+	// The blocks are streamed to the upload as they're read, rather than
+	// staged on disk.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(d.readBlocks(ctx, &manifest, pw))
+	}()
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(result.DataKey),
+		Body:   pr,
+	}
+	encrypt(input)
+	_, err = uploader.UploadWithContext(ctx, input)
+	pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("Uploading %v failed: %v", result.DataKey, err)
+	}
+	for _, b := range manifest.Blocks {
+		if !b.Zero {
+			result.Blocks++
+		}
+	}
+	result.Bytes = int64(result.Blocks) * manifest.BlockSize
+	AddCounter(float64(result.Bytes), "blocker_export_bytes_total")
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	input = &s3manager.UploadInput{
+		Bucket:      aws.String(c.Bucket),
+		Key:         aws.String(result.ManifestKey),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}
+	encrypt(input)
+	if _, err := uploader.UploadWithContext(ctx, input); err != nil {
+		return fmt.Errorf("Uploading %v failed: %v", result.ManifestKey, err)
+	}
+
+	// Only now is the export complete, and a base for the next.
+	_, err = d.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(result.SnapshotId)},
+		Tags:      []*ec2.Tag{newTag(tagExportedTo, dest)},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return fmt.Errorf("Tagging %v as exported failed (the next export will be larger): %v",
+			result.SnapshotId, err)
+	}
+	return nil
+}
+
+// s3Client makes an S3 client for a bucket in the given region, or in ours if
+// it's "".
+func (d *EbsVolumeDriver) s3Client(region string) *s3.S3 {
+	if region == "" {
+		region = d.awsRegion
+	}
+	return s3.New(d.session, &aws.Config{Region: aws.String(region)})
+}
+
+// lastExport finds the newest snapshot of an EBS volume exported to the given
+// destination, or "" if there is none.
+func (d *EbsVolumeDriver) lastExport(ctx context.Context, id string, dest string) (string, error) {
+	snapshots, err := d.ec2.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		Filters: []*ec2.Filter{
+			newFilter("volume-id", id),
+			newFilter("status", ec2.SnapshotStateCompleted),
+			newFilter("tag:"+tagExportedTo, dest),
+		},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return "", err
+	}
+
+	var latest *ec2.Snapshot
+	for _, snap := range snapshots.Snapshots {
+		if latest == nil ||
+			aws.TimeValue(snap.StartTime).After(aws.TimeValue(latest.StartTime)) {
+			latest = snap
+		}
+	}
+	if latest == nil {
+		return "", nil
+	}
+	return aws.StringValue(latest.SnapshotId), nil
+}
+
+// readBlocks writes the blocks to export to w, adding them to the manifest:
+// those which differ from the base snapshot, or all of them if there isn't
+// one.  Blocks are listed a page at a time, since their tokens expire.
+func (d *EbsVolumeDriver) readBlocks(ctx context.Context, m *ExportManifest, w io.Writer) error {
+	var next *string
+	for {
+		var blocks []ExportBlock
+		var tokens []*string
+		if m.BaseSnapshotId != "" {
+			out, err := d.ebs.ListChangedBlocksWithContext(ctx, &ebs.ListChangedBlocksInput{
+				FirstSnapshotId:  aws.String(m.BaseSnapshotId),
+				SecondSnapshotId: aws.String(m.SnapshotId),
+				NextToken:        next,
+			}, d.awsOpts(ctx)...)
+			if err != nil {
+				return err
+			}
+			m.BlockSize = aws.Int64Value(out.BlockSize)
+			for _, b := range out.ChangedBlocks {
+				blocks = append(blocks, ExportBlock{
+					Index: aws.Int64Value(b.BlockIndex),
+					Zero:  b.SecondBlockToken == nil,
+				})
+				tokens = append(tokens, b.SecondBlockToken)
+			}
+			next = out.NextToken
+		} else {
+			out, err := d.ebs.ListSnapshotBlocksWithContext(ctx, &ebs.ListSnapshotBlocksInput{
+				SnapshotId: aws.String(m.SnapshotId),
+				NextToken:  next,
+			}, d.awsOpts(ctx)...)
+			if err != nil {
+				return err
+			}
+			m.BlockSize = aws.Int64Value(out.BlockSize)
+			for _, b := range out.Blocks {
+				blocks = append(blocks, ExportBlock{Index: aws.Int64Value(b.BlockIndex)})
+				tokens = append(tokens, b.BlockToken)
+			}
+			next = out.NextToken
+		}
+
+		for i, b := range blocks {
+			if !b.Zero {
+				sum, err := d.copyBlock(ctx, m.SnapshotId, b.Index, tokens[i], w)
+				if err != nil {
+					return err
+				}
+				b.Checksum = sum
+			}
+			m.Blocks = append(m.Blocks, b)
+		}
+		if aws.StringValue(next) == "" {
+			return nil
+		}
+	}
+}
+
+// copyBlock writes a snapshot block to w, checking it against the checksum
+// EBS gives for it, and returns the checksum.
+func (d *EbsVolumeDriver) copyBlock(
+	ctx context.Context, snapshot string, index int64, token *string, w io.Writer) (string, error) {
+	out, err := d.ebs.GetSnapshotBlockWithContext(ctx, &ebs.GetSnapshotBlockInput{
+		SnapshotId: aws.String(snapshot),
+		BlockIndex: aws.Int64(index),
+		BlockToken: token,
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return "", fmt.Errorf("Reading block %v of %v failed: %v", index, snapshot, err)
+	}
+	defer out.BlockData.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), out.BlockData); err != nil {
+		return "", err
+	}
+	sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if want := aws.StringValue(out.Checksum); want != "" && want != sum {
+		return "", fmt.Errorf("Block %v of %v is corrupt: its checksum is %v, not %v.",
+			index, snapshot, sum, want)
+	}
+	return sum, nil
+}
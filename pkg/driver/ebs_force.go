@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// A volume left attached to an instance which died uncleanly can't be
+// attached anywhere else until EC2 lets go of it, which may be never.  With
+// the force option, a mount takes it anyway: the volume is forcibly detached
+// from the other instance first.  As a guard rail, this is only done if
+// that instance is gone, stopped, or on its way there; forcing a volume away
+// from a running instance risks corrupting it, so that's left to a human.
+
+func init() {
+	DescribeMetric("blocker_forced_detaches_total",
+		"Volumes forcibly detached from dead instances by mounts with the force option, by outcome.")
+}
+
+// forced reports whether the volume may be forcibly detached from a dead
+// instance, according to its force option.
+func (v *ebsVolume) forced() (bool, error) {
+	f, ok := v.opts["force"]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(f)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for force: %q.", f)
+	}
+	return b, nil
+}
+
+// instanceState finds the state of an instance, or "" if it no longer exists.
+func (d *EbsVolumeDriver) instanceState(ctx context.Context, instance string) (string, error) {
+	out, err := d.ec2.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instance)},
+	}, d.awsOpts(ctx)...)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidInstanceID.NotFound" {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	for _, r := range out.Reservations {
+		for _, inst := range r.Instances {
+			if inst.State != nil {
+				return aws.StringValue(inst.State.Name), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// forceDetachElsewhere forcibly detaches a volume from any dead instance it's
+// attached to, so that we can attach it.
+func (d *EbsVolumeDriver) forceDetachElsewhere(ctx context.Context, id string) error {
+	vol, err := d.describeVolume(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, a := range vol.Attachments {
+		instance := aws.StringValue(a.InstanceId)
+		if instance == d.awsInstanceId {
+			continue
+		}
+		state, err := d.instanceState(ctx, instance)
+		if err != nil {
+			return err
+		}
+		switch state {
+		case "", ec2.InstanceStateNameTerminated, ec2.InstanceStateNameShuttingDown,
+			ec2.InstanceStateNameStopped, ec2.InstanceStateNameStopping:
+		default:
+			return errorf(CodeAlreadyMounted,
+				"Volume %v is attached to %v, which is %v; refusing to force it off a "+
+					"live instance.  Stop the instance (or detach the volume) first.",
+				id, instance, state)
+		}
+
+		if state == "" {
+			state = "gone"
+		}
+		LogCtxWarn(ctx, "\tForcibly detaching %v from %v instance %v (it was %v).\n",
+			id, state, instance, aws.StringValue(a.State))
+		_, err = d.ec2.DetachVolumeWithContext(ctx, &ec2.DetachVolumeInput{
+			InstanceId: aws.String(instance),
+			VolumeId:   aws.String(id),
+			Force:      aws.Bool(true),
+		}, d.awsOpts(ctx)...)
+		if err == nil {
+			err = d.waitUntilAvailable(ctx, id)
+		}
+		outcome := "detached"
+		if err != nil {
+			outcome = "failed"
+		}
+		IncCounter("blocker_forced_detaches_total", "outcome", outcome)
+		if err != nil {
+			return fmt.Errorf("Forcibly detaching %v from %v failed: %v", id, instance, err)
+		}
+		publishEvent(ctx, VolumeEvent{Type: eventDetached, VolumeId: id})
+	}
+	return nil
+}
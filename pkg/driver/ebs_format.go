@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+)
+
+// A new EBS volume is blank, and mount makes nothing of it.  Rather than fail
+// the mount, we format blank volumes first, with the volume's fstype option
+// (or its workload's) or else the configured default (see FormatConfig).  Since formatting
+// destroys whatever was there, a device only counts as blank if blkid (or on
+// FreeBSD, fstyp) finds no signature of any kind on it and its first MiB reads
+// as zeros, so a volume holding data which they don't recognize is never
+// formatted.
+
+// blankCheckSize is how much of a device must read as zeros for it to be
+// considered blank.
+const blankCheckSize = 1 << 20
+
+// blankDevice reports whether a device holds nothing at all.
+func blankDevice(dev string) (bool, error) {
+	if hasSignature(dev) {
+		return false, nil
+	}
+
+	f, err := os.Open(dev)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, blankCheckSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return bytes.Count(buf[:n], []byte{0}) == n, nil
+}
+
+// formatIfBlank formats a volume's device before its first mount, if it's
+// blank.  Read-only mounts are left alone.  confirm, if given, is asked
+// whether formatting may go ahead (see strictMode).
+func formatIfBlank(ctx context.Context, dev string, ro bool, mo mountOptions, confirm func() error) error {
+	fstype := mo.FSType
+	if fstype == "" {
+		fstype = GetConfig().Format.FSType
+	}
+	if ro || fstype == "" {
+		return nil
+	}
+	blank, err := blankDevice(dev)
+	if err != nil || !blank {
+		return err
+	}
+	if confirm != nil {
+		if err := confirm(); err != nil {
+			return err
+		}
+	}
+
+	LogCtx(ctx, "\tDevice %v is blank; formatting it as %v.\n", dev, fstype)
+	return formatFilesystem(ctx, fstype, dev, mo.MkfsFlags)
+}
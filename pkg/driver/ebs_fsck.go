@@ -0,0 +1,75 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+)
+
+// A filesystem left dirty by a crash or a forced detach may fail to mount, or
+// mount and hand its damage on to the container.  The fsck option checks it
+// first: auto checks filesystems which might need it (ext filesystems not
+// cleanly unmounted or due a check; XFS and btrfs check themselves as they're
+// mounted), and force checks whatever the filesystem says.  What can safely
+// be repaired unattended is; otherwise the mount fails with a
+// CorruptFilesystem error, rather than mounting damaged data.
+
+func init() {
+	DescribeMetric("blocker_fsck_total",
+		"Filesystem checks before mounting, by outcome: clean, repaired, corrupt, or failed.")
+}
+
+const (
+	fsckAuto  = "auto"
+	fsckForce = "force"
+	fsckNever = "never"
+)
+
+// fsckPolicy reads the volume's fsck option, which defaults to never.
+func (v *ebsVolume) fsckPolicy() (string, error) {
+	switch p := v.opts["fsck"]; p {
+	case "", fsckNever:
+		return fsckNever, nil
+	case fsckAuto, fsckForce:
+		return p, nil
+	default:
+		return "", fmt.Errorf("Invalid value for fsck: %q (use auto, force, or never).", p)
+	}
+}
+
+// fsckIfWanted checks a device's filesystem before it's mounted, according to
+// the volume's fsck option.  Read-only mounts are never checked, since
+// checking may mean repairing.
+func fsckIfWanted(ctx context.Context, v *ebsVolume, dev string, ro bool, mo mountOptions) error {
+	policy, _ := v.fsckPolicy()
+	if policy == fsckNever || ro {
+		return nil
+	}
+	// Without an fstype option, mount works out the filesystem for itself,
+	// so we must too.
+	fstype := mo.FSType
+	if fstype == "" {
+		fstype = probeFSType(dev)
+	}
+	fs, ok := filesystemFor(fstype).(Fscker)
+	if !ok {
+		LogCtxWarn(ctx, "\tNot checking %v: can't check %q filesystems.\n", dev, fstype)
+		return nil
+	}
+
+	LogCtx(ctx, "\tChecking the filesystem on %v (fsck=%v).\n", dev, policy)
+	repaired, err := fs.Fsck(ctx, dev, policy == fsckForce)
+	switch {
+	case ErrorCodeOf(err) == CodeCorrupt:
+		IncCounter("blocker_fsck_total", "outcome", "corrupt")
+		return err
+	case err != nil:
+		IncCounter("blocker_fsck_total", "outcome", "failed")
+		return err
+	case repaired:
+		IncCounter("blocker_fsck_total", "outcome", "repaired")
+		LogCtx(ctx, "\tRepaired the filesystem on %v.\n", dev)
+	default:
+		IncCounter("blocker_fsck_total", "outcome", "clean")
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// If blocker (or Docker) can't be brought up, say during disaster recovery,
+// an operator may need to get at the data on its volumes by hand.  Fstab
+// renders the current mounts as /etc/fstab lines or systemd mount units,
+// naming filesystems by UUID, since device names needn't survive a move to
+// another host.  The output is commented with each volume's name and EBS ID
+// so that the volumes can be attached first.
+//
+// Some volumes are too important to wait for that: a host's critical data
+// should come back after a reboot even if Docker or blocker doesn't.  While a
+// volume created with `-o critical=true` is mounted, it has an entry in a
+// block of /etc/fstab (fstab.path) that blocker manages, naming it by UUID and
+// marked nofail so that the boot carries on without it.  EBS volumes stay
+// attached across reboots, so systemd mounts it where it was, and blocker
+// adopts the mount as it restores its state.  The entry is removed when the
+// volume is unmounted.  Lines outside the block are left alone.
+
+// Fstab renders the volumes mounted here as fstab entries or, if systemd is
+// set, as systemd mount units.
+func (d *EbsVolumeDriver) Fstab(ctx context.Context, systemd bool) (string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return "", err
+	}
+
+	type entry struct {
+		name, id, device, mountpoint string
+	}
+	var entries []entry
+	d.mu.Lock()
+	for name, v := range d.volumes {
+		if v.mountpoint != "" {
+			entries = append(entries, entry{name, v.id, v.device, v.mountpoint})
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# blocker volumes mounted on %v, as of %v.\n",
+		d.awsInstanceId, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "# Attach each EBS volume to the host before mounting it.\n")
+	for _, e := range entries {
+		m := findMountpoint(mounts, e.mountpoint)
+		if m == nil {
+			LogCtxError(ctx, "Volume %v isn't mounted at %v; leaving it out.\n", e.name, e.mountpoint)
+			continue
+		}
+		what, options := fstabSource(e.device), m.Options+",nofail"
+
+		fmt.Fprintf(&b, "\n# %v (%v), attached as %v.\n", e.name, e.id, e.device)
+		if !systemd {
+			fmt.Fprintf(&b, "%v %v %v %v 0 2\n", what, e.mountpoint, m.FSType, options)
+			continue
+		}
+		if strings.HasPrefix(what, "UUID=") {
+			what = "/dev/disk/by-uuid/" + strings.TrimPrefix(what, "UUID=")
+		}
+		fmt.Fprintf(&b, "# Save as /etc/systemd/system/%v\n", mountUnitName(e.mountpoint))
+		fmt.Fprintf(&b, "[Unit]\nDescription=blocker volume %v (%v)\n\n", e.name, e.id)
+		fmt.Fprintf(&b, "[Mount]\nWhat=%v\nWhere=%v\nType=%v\nOptions=%v\n\n",
+			what, e.mountpoint, m.FSType, options)
+		fmt.Fprintf(&b, "[Install]\nWantedBy=multi-user.target\n")
+	}
+	return b.String(), nil
+}
+
+// fstabSource names a device's filesystem by UUID, if it has one.
+func fstabSource(dev string) string {
+	if uuid := filesystemUUID(dev); uuid != "" {
+		return "UUID=" + uuid
+	}
+	return dev
+}
+
+// filesystemUUID returns the UUID of the filesystem on a device, or "" if
+// it can't be found.
+func filesystemUUID(dev string) string {
+	out, _ := exec.Command("blkid", "-o", "value", "-s", "UUID", dev).Output()
+	return strings.TrimSpace(string(out))
+}
+
+// mountUnitName returns the name systemd requires of the mount unit for a
+// path, as systemd-escape --path --suffix=mount would.
+func mountUnitName(path string) string {
+	var b strings.Builder
+	for i, c := range []byte(strings.Trim(path, "/")) {
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '_', c == ':', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String() + ".mount"
+}
+
+// Markers around the entries blocker manages in /etc/fstab.
+const (
+	fstabBegin = "# BEGIN blocker managed volumes; edits here will be lost."
+	fstabEnd   = "# END blocker managed volumes"
+)
+
+// fstabMu serializes rewrites of /etc/fstab.
+var fstabMu sync.Mutex
+
+// critical reports whether the volume should be mounted at boot, according
+// to its critical option.
+func (v *ebsVolume) critical() (bool, error) {
+	c, ok := v.opts["critical"]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(c)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for critical: %q.", c)
+	}
+	return b, nil
+}
+
+// syncFstab rewrites the block of /etc/fstab blocker manages to hold the
+// critical volumes mounted here.  Failing to is logged, but fails nothing.
+func (d *EbsVolumeDriver) syncFstab(ctx context.Context) {
+	mounts, err := readMounts()
+	if err != nil {
+		LogCtxError(ctx, "Reading the mount table failed; not updating fstab: %v\n", err)
+		return
+	}
+
+	type entry struct {
+		name, id, device, mountpoint string
+	}
+	var entries []entry
+	d.mu.Lock()
+	for name, v := range d.volumes {
+		if critical, _ := v.critical(); critical && v.mountpoint != "" && !v.temporary {
+			entries = append(entries, entry{name, v.id, v.device, v.mountpoint})
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	var lines []string
+	for _, e := range entries {
+		m := findMountpoint(mounts, e.mountpoint)
+		if m == nil {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("# %v (%v)", e.name, e.id),
+			fmt.Sprintf("%v %v %v %v,nofail,x-systemd.device-timeout=10s 0 2",
+				fstabSource(e.device), e.mountpoint, m.FSType, m.Options))
+	}
+	if err := writeFstabBlock(GetConfig().Fstab.Path, lines); err != nil {
+		LogCtxError(ctx, "Updating fstab failed: %v\n", err)
+	}
+}
+
+// writeFstabBlock replaces the managed block of an fstab with the given
+// lines, adding it at the end if it isn't there (and removing it if there
+// are no lines).  The file is replaced atomically, and only if it changes.
+func writeFstabBlock(path string, lines []string) error {
+	fstabMu.Lock()
+	defer fstabMu.Unlock()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(lines) == 0 && !strings.Contains(string(data), fstabBegin) {
+		return nil
+	}
+	var kept []string
+	inBlock := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		switch strings.TrimSuffix(line, "\n") {
+		case fstabBegin:
+			inBlock = true
+		case fstabEnd:
+			inBlock = false
+		default:
+			if !inBlock && line != "" {
+				kept = append(kept, strings.TrimSuffix(line, "\n"))
+			}
+		}
+	}
+	if len(lines) > 0 {
+		kept = append(kept, fstabBegin)
+		kept = append(kept, lines...)
+		kept = append(kept, fstabEnd)
+	}
+	updated := ""
+	if len(kept) > 0 {
+		updated = strings.Join(kept, "\n") + "\n"
+	}
+	if updated == string(data) {
+		return nil
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".fstab.blocker")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(updated); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
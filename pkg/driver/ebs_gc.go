@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"context"
+	"time"
+)
+
+// gcInterval is how often we look for stale registrations.
+const gcInterval = time.Minute
+
+// gcLoop periodically forgets volumes which were created but never mounted
+// within the configured TTL.  Docker doesn't always clean these up, so
+// without this they would accumulate forever.
+func (d *EbsVolumeDriver) gcLoop(ctx context.Context) {
+	for sleep(ctx, gcInterval) == nil {
+		ttl := time.Duration(GetConfig().RegistrationTTL)
+		if ttl <= 0 {
+			continue
+		}
+		if purged := d.Purge(ttl); len(purged) > 0 {
+			LogCtx(ctx, "Purged %v stale registration(s): %v\n", len(purged), purged)
+		}
+	}
+}
+
+// Purge forgets every volume that was registered more than olderThan ago and
+// has never been mounted, returning the names removed.  Volumes with
+// operations under way are left for next time.  Those created with options
+// are kept until Docker removes them, since the options couldn't be got back;
+// so are those we made EBS volumes for at Create, since forgetting them would
+// leave the EBS volumes behind, paid for and unknown to Docker.
+func (d *EbsVolumeDriver) Purge(olderThan time.Duration) []string {
+	purged := d.purge(olderThan)
+	if len(purged) > 0 {
+		d.saveState(context.Background())
+	}
+	return purged
+}
+
+func (d *EbsVolumeDriver) purge(olderThan time.Duration) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	purged := []string{}
+	cutoff := time.Now().Add(-olderThan)
+	for name, v := range d.volumes {
+		if v.everMounted || v.mountpoint != "" || !v.prefetched.IsZero() ||
+			v.provisioned || len(v.requested) > 0 || v.created.After(cutoff) || d.busy(name) {
+			continue
+		}
+		delete(d.volumes, name)
+		purged = append(purged, name)
+	}
+	return purged
+}
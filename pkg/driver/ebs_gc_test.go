@@ -0,0 +1,45 @@
+package driver
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPurge(t *testing.T) {
+	d := newTestDriver(t)
+	old := time.Now().Add(-48 * time.Hour)
+	d.volumes = map[string]*ebsVolume{
+		"stale":       {created: old},
+		"recent":      {created: time.Now()},
+		"used":        {created: old, everMounted: true},
+		"mounted":     {created: old, mountpoint: "/mnt/blocker/mounted"},
+		"prefetched":  {created: old, prefetched: time.Now()},
+		"provisioned": {id: "vol-0123456789abcdef0", created: old, provisioned: true},
+		"options":     {created: old, requested: map[string]string{"fstype": "xfs"}},
+		"busy":        {created: old},
+	}
+	release := make(chan struct{})
+	d.submit("busy", func() { <-release })
+	// Let the busy volume's actor finish (saving state) before the next
+	// test changes the configuration.
+	defer waitIdle(t, d)
+	defer close(release)
+
+	purged := d.Purge(24 * time.Hour)
+	if want := []string{"stale"}; !reflect.DeepEqual(purged, want) {
+		t.Errorf("Purge() = %v, want %v", purged, want)
+	}
+	var left []string
+	d.mu.Lock()
+	for name := range d.volumes {
+		left = append(left, name)
+	}
+	d.mu.Unlock()
+	sort.Strings(left)
+	want := []string{"busy", "mounted", "options", "prefetched", "provisioned", "recent", "used"}
+	if !reflect.DeepEqual(left, want) {
+		t.Errorf("left %v, want %v", left, want)
+	}
+}
@@ -0,0 +1,184 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// growLoop watches for Elastic Volumes modifications (made in the console,
+// say) which enlarge mounted volumes, and grows their filesystems to match
+// once the new size is available, so nobody needs to log into the host.
+func (d *EbsVolumeDriver) growLoop(ctx context.Context) {
+	for {
+		interval := time.Duration(GetConfig().Grow.Interval)
+		if interval <= 0 || readOnlyMode() {
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+		if sleep(ctx, interval) != nil {
+			return
+		}
+
+		if err := d.growModified(ctx); err != nil {
+			LogCtxError(ctx, "Checking for volume modifications failed: %v\n", err)
+		}
+	}
+}
+
+// growModified grows the filesystems of volumes enlarged since they were last
+// grown.  Busy volumes are left until the next pass.
+func (d *EbsVolumeDriver) growModified(ctx context.Context) error {
+	d.mu.Lock()
+	names := make(map[string]string)
+	grown := make(map[string]time.Time)
+	var ids []string
+	for name, v := range d.volumes {
+		if v.mountpoint != "" && !v.temporary && !d.busy(name) {
+			names[v.id] = name
+			grown[v.id] = d.grown[v.id]
+			ids = append(ids, v.id)
+		}
+	}
+	d.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	mods, err := d.enlargements(ctx, ids...)
+	if err != nil {
+		return err
+	}
+	for id, mod := range mods {
+		if !aws.TimeValue(mod.StartTime).After(grown[id]) {
+			continue
+		}
+
+		// The filesystem is grown by the volume's actor, so it can't be
+		// unmounted from under us.
+		name, id, mod := names[id], id, mod
+		d.submit(name, func() { d.growVolume(ctx, name, id, mod) })
+	}
+	return nil
+}
+
+// enlargements finds the latest modification enlarging each of the given
+// volumes, by volume ID.  The new size is usable as soon as a modification
+// starts optimizing.
+func (d *EbsVolumeDriver) enlargements(
+	ctx context.Context, ids ...string) (map[string]*ec2.VolumeModification, error) {
+	mods, err := d.ec2.DescribeVolumesModificationsWithContext(ctx,
+		&ec2.DescribeVolumesModificationsInput{
+			Filters: []*ec2.Filter{
+				newFilter("volume-id", ids...),
+				newFilter("modification-state",
+					ec2.VolumeModificationStateOptimizing,
+					ec2.VolumeModificationStateCompleted),
+			},
+		}, d.awsOpts(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[string]*ec2.VolumeModification)
+	for _, mod := range mods.VolumesModifications {
+		id := aws.StringValue(mod.VolumeId)
+		if aws.Int64Value(mod.TargetSize) <= aws.Int64Value(mod.OriginalSize) {
+			continue
+		}
+		if prev, ok := latest[id]; !ok ||
+			aws.TimeValue(mod.StartTime).After(aws.TimeValue(prev.StartTime)) {
+			latest[id] = mod
+		}
+	}
+	return latest, nil
+}
+
+// growIfEnlarged grows the filesystem of a volume just mounted, if it was
+// enlarged while it wasn't mounted (and so wasn't watched).  This runs on the
+// volume's actor.  Growing a filesystem that already fills its device does
+// nothing, so after a restart (when we've forgotten what we've grown) the
+// latest enlargement is simply applied again.
+func (d *EbsVolumeDriver) growIfEnlarged(ctx context.Context, name string, v *ebsVolume) {
+	mods, err := d.enlargements(ctx, v.id)
+	if err != nil {
+		LogCtxWarn(ctx, "\tChecking %v for modifications failed: %v\n", v.id, err)
+		return
+	}
+	if mod, ok := mods[v.id]; ok {
+		d.growVolume(ctx, name, v.id, mod)
+	}
+}
+
+// Resize grows the filesystem of a mounted volume to fill its device, for
+// when it's been enlarged and the operator would rather not wait for
+// growLoop to notice.
+func (d *EbsVolumeDriver) Resize(ctx context.Context, name string) error {
+	return d.do(name, func() (err error) {
+		defer d.record(ctx, name, "resize", time.Now(), &err)
+		v, exists := d.volume(name)
+		if !exists {
+			return errNameNotFound
+		}
+		if v.mountpoint == "" {
+			return errorf(CodeNotMounted, "Volume %v is not mounted here.", name)
+		}
+		if readOnlyMode() {
+			return errReadOnly("resizing " + name)
+		}
+		LogCtx(ctx, "\tGrowing the filesystem of %v to fill %v.\n", name, v.device)
+		if err := growFilesystem(v.device, v.mountpoint); err != nil {
+			return err
+		}
+		publishEvent(ctx, VolumeEvent{Type: eventResized, Name: name, VolumeId: v.id,
+			Device: v.device, Mountpoint: v.mountpoint})
+		return nil
+	})
+}
+
+// growVolume grows the filesystem of a mounted volume after a modification,
+// if it's still mounted and nobody has got there first.
+func (d *EbsVolumeDriver) growVolume(ctx context.Context, name string, id string, mod *ec2.VolumeModification) {
+	started := aws.TimeValue(mod.StartTime)
+	d.mu.Lock()
+	v, exists := d.volumes[name]
+	stale := !exists || v.id != id || v.mountpoint == "" || !started.After(d.grown[id])
+	d.mu.Unlock()
+	if stale {
+		return
+	}
+
+	LogCtx(ctx, "Volume %v (%v) was resized from %vGiB to %vGiB; growing its filesystem.\n",
+		name, id, aws.Int64Value(mod.OriginalSize), aws.Int64Value(mod.TargetSize))
+	if err := growFilesystem(v.device, v.mountpoint); err != nil {
+		LogCtxError(ctx, "Growing the filesystem of %v failed: %v\n", name, err)
+		publishEvent(ctx, VolumeEvent{Type: eventError, Name: name, VolumeId: id,
+			Err: err.Error()})
+		return
+	}
+	d.update(func() { d.grown[id] = started })
+	publishEvent(ctx, VolumeEvent{Type: eventResized, Name: name, VolumeId: id,
+		Device: v.device, Mountpoint: v.mountpoint})
+}
+
+// growFilesystem grows a mounted filesystem to fill its (enlarged) device.
+func growFilesystem(dev string, mnt string) error {
+	mounts, err := readMounts()
+	if err != nil {
+		return err
+	}
+	m := findMountpoint(mounts, mnt)
+	if m == nil {
+		return fmt.Errorf("%v is not mounted.", mnt)
+	}
+
+	if err := resizeEncrypted(dev); err != nil {
+		return err
+	}
+	return filesystemFor(m.FSType).Grow(dev, mnt)
+}
@@ -0,0 +1,147 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// A handoff moves a volume from one host to another for a blue/green style
+// cutover.  The releasing daemon tags the volume (see tagHandoff) as
+// "releasing" to the receiving instance, unmounts and detaches it, and then
+// marks it "released".  The receiving daemon waits for that before attaching,
+// and clears the tags once it has the volume.  Meanwhile mounts by any other
+// instance are refused, so nothing can grab the volume mid-cutover.
+const (
+	handoffReleasing = "releasing"
+	handoffReleased  = "released"
+)
+
+// Release unmounts and detaches a volume so that the given instance can take
+// it over.
+func (d *EbsVolumeDriver) Release(ctx context.Context, name string, to string) error {
+	return d.do(name, func() (err error) {
+		defer d.record(ctx, name, "release", time.Now(), &err)
+		return d.release(ctx, name, to)
+	})
+}
+
+func (d *EbsVolumeDriver) release(ctx context.Context, name string, to string) error {
+	v, exists := d.volume(name)
+	if !exists {
+		return errNameNotFound
+	}
+	if v.id == "" || v.temporary {
+		return errors.New("Snapshot mounts can't be handed off.")
+	}
+	if to == "" || to == d.awsInstanceId {
+		return errors.New("A different instance to hand off to is required.")
+	}
+
+	if err := d.setHandoff(ctx, v.id, handoffReleasing, to); err != nil {
+		return err
+	}
+	LogCtx(ctx, "\tReleasing volume %v (%v) to %v.\n", name, v.id, to)
+	if v.mountpoint != "" {
+		if err := d.doUnmount(ctx, name); err != nil {
+			// Back out, so the volume isn't left looking like it's on its way
+			// elsewhere.
+			d.clearHandoff(ctx, v.id)
+			return err
+		}
+	}
+	if err := d.waitUntilAvailable(ctx, v.id); err != nil {
+		return err
+	}
+	if err := d.setHandoff(ctx, v.id, handoffReleased, to); err != nil {
+		return err
+	}
+	LogCtx(ctx, "\tReleased volume %v (%v) to %v.\n", name, v.id, to)
+	return nil
+}
+
+// Accept waits for a volume being handed to this instance to be released,
+// then attaches and mounts it, so that Docker's eventual Mount finds it ready.
+func (d *EbsVolumeDriver) Accept(ctx context.Context, name string) (mnt string, err error) {
+	err = d.do(name, func() (err error) {
+		defer d.record(ctx, name, "accept", time.Now(), &err)
+		mnt, err = d.accept(ctx, name)
+		return err
+	})
+	return mnt, err
+}
+
+func (d *EbsVolumeDriver) accept(ctx context.Context, name string) (string, error) {
+	v, exists := d.volume(name)
+	if !exists {
+		if err := d.create(ctx, name, nil); err != nil {
+			return "", err
+		}
+		v, _ = d.volume(name)
+	}
+	if err := v.checkMaintenance(name); err != nil {
+		return "", err
+	}
+	if v.mountpoint != "" {
+		return v.mountpoint, nil
+	}
+	return d.doMount(ctx, name)
+}
+
+func (d *EbsVolumeDriver) setHandoff(ctx context.Context, id string, state string, to string) error {
+	_, err := d.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      []*ec2.Tag{newTag(tagHandoff, state), newTag(tagHandoffTo, to)},
+	}, d.awsOpts(ctx)...)
+	return err
+}
+
+func (d *EbsVolumeDriver) clearHandoff(ctx context.Context, id string) error {
+	_, err := d.ec2.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      []*ec2.Tag{{Key: aws.String(tagHandoff)}, {Key: aws.String(tagHandoffTo)}},
+	}, d.awsOpts(ctx)...)
+	return err
+}
+
+// awaitHandoff is called before attaching a volume.  If the volume is being
+// handed off to another instance, the mount is refused; if it's being handed
+// to us, we wait for the other side to release it and then claim it.
+func (d *EbsVolumeDriver) awaitHandoff(ctx context.Context, id string) error {
+	timeouts := GetConfig().Timeouts
+	deadline := time.Now().Add(time.Duration(timeouts.Handoff))
+	for {
+		volumes, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(id)},
+		}, d.awsOpts(ctx)...)
+		if err != nil {
+			return err
+		}
+		if len(volumes.Volumes) != 1 {
+			return errorf(CodeNotFound, "Volume %v not found.", id)
+		}
+
+		tags := volumes.Volumes[0].Tags
+		state, to := tagValue(tags, tagHandoff), tagValue(tags, tagHandoffTo)
+		switch {
+		case state == "":
+			return nil
+		case to != d.awsInstanceId:
+			return errorf(CodeHandoff, "Volume %v is being handed off to %v.", id, to)
+		case state == handoffReleased:
+			LogCtx(ctx, "\tVolume %v was handed off to us.\n", id)
+			return d.clearHandoff(ctx, id)
+		}
+		if time.Now().After(deadline) {
+			return errorf(CodeHandoff, "Timed out waiting for volume %v to be released.", id)
+		}
+
+		LogCtx(ctx, "\tWaiting for volume %v to be released to us...\n", id)
+		if err := sleep(ctx, time.Duration(timeouts.StatePoll)); err != nil {
+			return err
+		}
+	}
+}
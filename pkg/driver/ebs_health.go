@@ -0,0 +1,140 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/health"
+)
+
+func init() {
+	DescribeMetric("blocker_ebs_health_events",
+		"Open AWS Health issues affecting EBS in this instance's region or availability zone.")
+	DescribeMetric("blocker_impaired_errors_total",
+		"Failed volume operations while AWS Health reported an EBS issue, by error code.")
+}
+
+// healthEvent is an open AWS Health issue affecting EBS near us.
+type healthEvent struct {
+	code string
+	// zone is the availability zone affected, or "" for the whole region.
+	zone  string
+	start time.Time
+}
+
+func (e healthEvent) String() string {
+	where := e.zone
+	if where == "" {
+		where = "the region"
+	}
+	return fmt.Sprintf("%v in %v since %v", e.code, where, e.start.UTC().Format(time.RFC3339))
+}
+
+// healthLoop keeps track of the open AWS Health issues affecting EBS in our
+// region, so that failures during them can say so.
+func (d *EbsVolumeDriver) healthLoop(ctx context.Context) {
+	for {
+		interval := time.Duration(GetConfig().Health.Interval)
+		if interval <= 0 {
+			d.setImpairments(ctx, nil)
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+
+		events, err := d.describeImpairments(ctx)
+		if err != nil {
+			LogCtxError(ctx, "Checking AWS Health failed: %v\n", err)
+		} else {
+			d.setImpairments(ctx, events)
+		}
+		if sleep(ctx, interval) != nil {
+			return
+		}
+	}
+}
+
+// describeImpairments asks AWS Health for the open EBS issues in our region,
+// keeping those for the whole region or our availability zone.
+func (d *EbsVolumeDriver) describeImpairments(ctx context.Context) ([]healthEvent, error) {
+	input := &health.DescribeEventsInput{
+		Filter: &health.EventFilter{
+			Services:            aws.StringSlice([]string{"EBS"}),
+			Regions:             aws.StringSlice([]string{d.awsRegion}),
+			EventStatusCodes:    aws.StringSlice([]string{health.EventStatusCodeOpen}),
+			EventTypeCategories: aws.StringSlice([]string{health.EventTypeCategoryIssue}),
+		},
+	}
+	var events []healthEvent
+	for {
+		out, err := d.health.DescribeEventsWithContext(ctx, input, d.awsOpts(ctx)...)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range out.Events {
+			zone := aws.StringValue(e.AvailabilityZone)
+			if zone != "" && zone != d.awsAvailabilityZone {
+				continue
+			}
+			events = append(events, healthEvent{
+				code:  aws.StringValue(e.EventTypeCode),
+				zone:  zone,
+				start: aws.TimeValue(e.StartTime),
+			})
+		}
+		if out.NextToken == nil {
+			return events, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// setImpairments records the open issues, logging any change.
+func (d *EbsVolumeDriver) setImpairments(ctx context.Context, events []healthEvent) {
+	d.mu.Lock()
+	before := d.impairments
+	d.impairments = events
+	d.mu.Unlock()
+	SetGauge(float64(len(events)), "blocker_ebs_health_events")
+
+	if len(events) > 0 && len(before) == 0 {
+		LogCtxError(ctx, "AWS Health reports EBS issues: %v\n", describeEvents(events))
+	} else if len(events) == 0 && len(before) > 0 {
+		LogCtx(ctx, "AWS Health no longer reports any EBS issues.\n")
+	}
+}
+
+func describeEvents(events []healthEvent) string {
+	var descs []string
+	for _, e := range events {
+		descs = append(descs, e.String())
+	}
+	return strings.Join(descs, "; ")
+}
+
+// annotateImpairment adds any open EBS issues to an error which might be down
+// to them, so that whoever sees it knows not to go looking for a bug.  Errors
+// which can't be, such as bad options, are left alone.
+func (d *EbsVolumeDriver) annotateImpairment(err error) error {
+	if err == nil {
+		return nil
+	}
+	code := ErrorCodeOf(err)
+	switch code {
+	case CodeUnknown, CodeInternal, CodeAttachTimeout, CodeAwsThrottled, CodeDeviceMissing:
+	default:
+		return err
+	}
+	d.mu.Lock()
+	events := d.impairments
+	d.mu.Unlock()
+	if len(events) == 0 {
+		return err
+	}
+	IncCounter("blocker_impaired_errors_total", "code", string(code))
+	return fmt.Errorf("%w (AWS Health reports an ongoing EBS issue: %v)", err, describeEvents(events))
+}
@@ -0,0 +1,164 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Hibernating (or suspending) an instance pauses its volumes mid-flight.  To
+// be safe, mounted filesystems are frozen beforehand (`blocker suspend`, run
+// from a systemd-sleep hook), and on resume (`blocker resume`) each volume's
+// device is checked to still be the one its filesystem is mounted from before
+// it's thawed and I/O is allowed again.  Device names aren't guaranteed to
+// survive a stop/start, so a volume whose device has moved stays frozen for
+// a human to look at.
+//
+// Freezing and thawing don't go through the volumes' actors: an operation
+// stuck behind a frozen filesystem would otherwise stop it being thawed.
+
+// frozenVolume records what a volume looked like when it was frozen.
+type frozenVolume struct {
+	device string
+	major  uint32
+	minor  uint32
+}
+
+// freeze freezes (or thaws) a mounted filesystem, as its type requires.
+func freeze(mounts []mountInfo, mnt string, frozen bool) error {
+	var fstype string
+	if m := findMountpoint(mounts, mnt); m != nil {
+		fstype = m.FSType
+	}
+	return filesystemFor(fstype).Freeze(mnt, frozen)
+}
+
+// Suspend freezes every mounted, writable volume, returning their names.
+func (d *EbsVolumeDriver) Suspend(ctx context.Context) ([]string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return []string{}, err
+	}
+
+	d.mu.Lock()
+	mounted := map[string]ebsVolume{}
+	for name, v := range d.volumes {
+		if v.mountpoint == "" || d.frozen[name] != nil {
+			continue
+		}
+		if ro, _ := v.readOnly(); ro {
+			continue
+		}
+		mounted[name] = *v
+	}
+	d.mu.Unlock()
+
+	frozen := []string{}
+	var failed []string
+	for name, v := range mounted {
+		major, minor, err := deviceNumber(v.device)
+		if err == nil {
+			err = freeze(mounts, v.mountpoint, true)
+		}
+		if err != nil {
+			LogCtxError(ctx, "Freezing %v failed: %v\n", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		d.update(func() {
+			d.frozen[name] = &frozenVolume{device: v.device, major: major, minor: minor}
+		})
+		frozen = append(frozen, name)
+		LogCtx(ctx, "Froze %v (%v at %v) for suspend.\n", name, v.device, v.mountpoint)
+	}
+	if len(failed) > 0 {
+		return frozen, fmt.Errorf("Freezing %v volume(s) failed: %v", len(failed), failed)
+	}
+	return frozen, nil
+}
+
+// Resume re-validates and thaws the volumes frozen by Suspend.  Volumes whose
+// devices no longer match stay frozen, unless force is given.  Returns the
+// names of the volumes thawed.
+func (d *EbsVolumeDriver) Resume(ctx context.Context, force bool) ([]string, error) {
+	thawed := []string{}
+	var mismatched []string
+	mounts, err := readMounts()
+	if err != nil {
+		return thawed, err
+	}
+
+	type frozenMount struct {
+		v ebsVolume
+		f *frozenVolume
+	}
+	d.mu.Lock()
+	frozen := map[string]frozenMount{}
+	for name, f := range d.frozen {
+		v, exists := d.volumes[name]
+		if !exists || v.mountpoint == "" {
+			delete(d.frozen, name)
+			continue
+		}
+		frozen[name] = frozenMount{*v, f}
+	}
+	d.mu.Unlock()
+
+	for name, fm := range frozen {
+		v, f := &fm.v, fm.f
+		if err := d.checkResumedDevice(v, f, mounts); err != nil {
+			if !force {
+				LogCtxError(ctx, "Leaving %v frozen: %v\n", name, err)
+				publishEvent(ctx, VolumeEvent{Type: eventError, Name: name,
+					VolumeId: v.id, Mountpoint: v.mountpoint, Err: err.Error()})
+				mismatched = append(mismatched, name)
+				continue
+			}
+			LogCtxError(ctx, "Thawing %v anyway: %v\n", name, err)
+		}
+		if err := freeze(mounts, v.mountpoint, false); err != nil {
+			LogCtxError(ctx, "Thawing %v failed: %v\n", name, err)
+			mismatched = append(mismatched, name)
+			continue
+		}
+		d.update(func() { delete(d.frozen, name) })
+		thawed = append(thawed, name)
+		LogCtx(ctx, "Thawed %v after resume.\n", name)
+	}
+	if len(mismatched) > 0 {
+		return thawed, fmt.Errorf(
+			"%v volume(s) left frozen: %v; check them, then use resume -force",
+			len(mismatched), mismatched)
+	}
+	return thawed, nil
+}
+
+// checkResumedDevice verifies that the device now backing the volume (per
+// its stable by-id name) is the same one that was frozen, and the one its
+// filesystem is mounted from.
+func (d *EbsVolumeDriver) checkResumedDevice(v *ebsVolume, f *frozenVolume, mounts []mountInfo) error {
+	dev, err := findDeviceById(v.id)
+	if err != nil {
+		return err
+	}
+	if dev == "" {
+		dev = f.device
+	}
+	major, minor, err := deviceNumber(dev)
+	if err != nil {
+		return err
+	}
+	if major != f.major || minor != f.minor {
+		return fmt.Errorf("Volume %v moved from %v (%d:%d) to %v (%d:%d).",
+			v.id, f.device, f.major, f.minor, dev, major, minor)
+	}
+	m := findMountpoint(mounts, v.mountpoint)
+	if m == nil {
+		return errors.New("The volume is no longer mounted.")
+	}
+	if m.Major != major || m.Minor != minor {
+		return fmt.Errorf("%v is mounted from %d:%d, not %v (%d:%d).",
+			v.mountpoint, m.Major, m.Minor, dev, major, minor)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// historyLength is how many operations are remembered per volume.
+const historyLength = 20
+
+// HistoryEntry records one operation on a volume.
+type HistoryEntry struct {
+	Time     time.Time
+	Op       string
+	Duration time.Duration
+	// Err is why the operation failed, or "" if it succeeded.
+	Err        string `json:",omitempty"`
+	Mountpoint string `json:",omitempty"`
+	// Caller is Docker's ID for the mount (one per container using the
+	// volume), where Docker supplies one.
+	Caller    string `json:",omitempty"`
+	RequestId string `json:",omitempty"`
+}
+
+// record appends an operation, begun at start, to the named volume's history,
+// if we know of the volume.  It's meant to be deferred by the volume's actor,
+// as in `defer d.record(ctx, name, "mount", time.Now(), &err)`.
+func (d *EbsVolumeDriver) record(ctx context.Context, name string, op string, start time.Time, err *error) {
+	elapsed := time.Since(start)
+	fields := append([]string{"op", op}, d.volumeLabels(name,
+		"duration_ms", strconv.FormatInt(elapsed.Milliseconds(), 10))...)
+	if *err != nil {
+		fields = append(fields, "error", (*err).Error(), "code", string(ErrorCodeOf(*err)))
+	}
+	LogCtxDebug(WithLogFields(ctx, fields...), "\t%v of %v took %v: %v\n", op, name, elapsed, *err)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[name]
+	if !exists {
+		return
+	}
+	e := HistoryEntry{
+		Time:       start,
+		Op:         op,
+		Duration:   elapsed,
+		Mountpoint: v.mountpoint,
+		Caller:     Caller(ctx),
+		RequestId:  RequestId(ctx),
+	}
+	if *err != nil {
+		e.Err = (*err).Error()
+	}
+	v.history = append(v.history, e)
+	d.shipOperation(name, v, e)
+	if len(v.history) > historyLength {
+		v.history = v.history[len(v.history)-historyLength:]
+	}
+}
+
+// History returns the recent operations on a volume, oldest first.
+func (d *EbsVolumeDriver) History(name string) ([]HistoryEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[name]
+	if !exists {
+		return nil, errNameNotFound
+	}
+	return append([]HistoryEntry{}, v.history...), nil
+}
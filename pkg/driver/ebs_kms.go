@@ -0,0 +1,120 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// An encrypted volume can't be made or attached while its KMS key is
+// disabled, pending deletion, or closed to this instance by the key's
+// policy, but EC2 seldom says so: the new volume goes to the error state, or
+// the attachment quietly vanishes and the attach times out.  So when creating
+// or attaching an encrypted volume fails, its key is looked up in KMS, and if
+// the key is why, the error (KeyUnavailable) names it, and it's counted in
+// blocker_kms_key_unavailable_total and announced as a key-unavailable event,
+// so that a broken key policy is found in minutes rather than by reading
+// CloudTrail.
+
+func init() {
+	DescribeMetric("blocker_kms_key_unavailable_total",
+		"Volume creates and attaches which failed because their KMS key couldn't be used, by key and state.")
+}
+
+// kmsErrorCodes are the errors AWS gives, when it says anything at all, for
+// keys which can't be used.
+var kmsErrorCodes = map[string]string{
+	kms.ErrCodeDisabledException:       kms.KeyStateDisabled,
+	kms.ErrCodeInvalidStateException:   "InvalidState",
+	kms.ErrCodeKeyUnavailableException: kms.KeyStateUnavailable,
+	"KMS.DisabledException":            kms.KeyStateDisabled,
+	"KMS.KMSInvalidStateException":     "InvalidState",
+	"KMS.KeyUnavailableException":      kms.KeyStateUnavailable,
+	"KMS.NotFoundException":            "NotFound",
+	"KMS.AccessDeniedException":        "AccessDenied",
+}
+
+// keyStates explains the states (and, for failed lookups, the reasons) in
+// which a key can't be used.
+var keyStates = map[string]string{
+	kms.KeyStateDisabled:               "is disabled",
+	kms.KeyStatePendingDeletion:        "is scheduled for deletion",
+	kms.KeyStatePendingReplicaDeletion: "is scheduled for deletion",
+	kms.KeyStatePendingImport:          "has no key material imported",
+	kms.KeyStateUnavailable:            "is unavailable (its custom key store is disconnected)",
+	kms.KeyStateCreating:               "is still being created",
+	"InvalidState":                     "is in a state it can't be used in",
+	"NotFound":                         "doesn't exist (or isn't visible to this account)",
+	"AccessDenied":                     "may not be used by this instance (access denied by its key policy or IAM)",
+}
+
+// keyState finds out whether a KMS key can be used, returning the state it's
+// in (or why it can't be looked up) if not, and "" if it can be, or if we
+// can't tell.
+func (d *EbsVolumeDriver) keyState(ctx context.Context, key string) string {
+	out, err := d.kms.DescribeKeyWithContext(ctx, &kms.DescribeKeyInput{
+		KeyId: aws.String(key),
+	}, d.awsOpts(ctx)...)
+	var aerr awserr.Error
+	switch {
+	case errors.As(err, &aerr) && aerr.Code() == kms.ErrCodeNotFoundException:
+		return "NotFound"
+	case errors.As(err, &aerr) && aerr.Code() == "AccessDeniedException":
+		return "AccessDenied"
+	case err != nil:
+		LogCtxWarn(ctx, "\tLooking up KMS key %v failed: %v\n", key, err)
+		return ""
+	case out.KeyMetadata == nil:
+		return ""
+	}
+	if state := aws.StringValue(out.KeyMetadata.KeyState); keyStates[state] != "" {
+		return state
+	}
+	return ""
+}
+
+// keyError turns a failure to create or attach an encrypted volume (op is
+// "created" or "attached") into one naming its KMS key, if the key is why.
+// Given no key, the volume's own is looked up.  Other failures are returned
+// as they are.
+func (d *EbsVolumeDriver) keyError(ctx context.Context, op string, id string, key string, err error) error {
+	if err == nil || ctx.Err() != nil || ErrorCodeOf(err) == CodeKeyUnavailable {
+		return err
+	}
+	if key == "" && id != "" {
+		vol, derr := d.describeVolume(ctx, id)
+		if derr != nil || !aws.BoolValue(vol.Encrypted) {
+			return err
+		}
+		key = aws.StringValue(vol.KmsKeyId)
+	}
+	if key == "" {
+		return err
+	}
+
+	var state string
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		state = kmsErrorCodes[aerr.Code()]
+	}
+	if s := d.keyState(ctx, key); s != "" {
+		state = s
+	}
+	if state == "" {
+		return err
+	}
+
+	IncCounter("blocker_kms_key_unavailable_total", "key", key, "state", state)
+	what := "the new volume"
+	if id != "" {
+		what = "volume " + id
+	}
+	msg := fmt.Sprintf("KMS key %v %v, so %v can't be %v.", key, keyStates[state], what, op)
+	LogCtxError(ctx, "\t%v\n", msg)
+	publishEvent(ctx, VolumeEvent{Type: eventKeyUnavailable, VolumeId: id, Err: msg})
+	return WithCode(CodeKeyUnavailable, fmt.Errorf("%v (%w)", msg, err))
+}
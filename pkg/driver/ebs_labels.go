@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Dashboards want to slice volumes' metrics by who owns them, which EC2
+// already knows from the volumes' tags.  The EBS tags named in metric_tags
+// (see Config.MetricTags), e.g. team and service, are read when a volume is
+// attached, and their values label that volume's metrics and log fields
+// alongside its name.  Tag keys become label names with anything but
+// letters, digits, and underscores replaced by underscores (so app:team
+// labels as app_team), and a volume without one of the tags gets an empty
+// label.
+
+// reservedLabels are the labels per-volume metrics already use.
+var reservedLabels = map[string]bool{"volume": true, "volume_id": true, "result": true, "le": true}
+
+// metricLabel is the label name for a tag key.
+func metricLabel(key string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, key)
+	if label != "" && label[0] >= '0' && label[0] <= '9' {
+		label = "_" + label
+	}
+	return label
+}
+
+// tagLabels picks the labels for a volume out of its tags.
+func tagLabels(tags []*ec2.Tag) map[string]string {
+	keys := GetConfig().MetricTags
+	if len(keys) == 0 {
+		return nil
+	}
+	labels := map[string]string{}
+	for _, key := range keys {
+		labels[metricLabel(key)] = ""
+	}
+	for _, t := range tags {
+		for _, key := range keys {
+			if aws.StringValue(t.Key) == key {
+				labels[metricLabel(key)] = aws.StringValue(t.Value)
+			}
+		}
+	}
+	return labels
+}
+
+// labelPairs renders the volume's tag labels as name, value pairs, in order.
+func (v *ebsVolume) labelPairs() []string {
+	var names []string
+	for name := range v.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, name, v.labels[name])
+	}
+	return pairs
+}
+
+// volumeLabels are the labels for a metric about the named volume: its name,
+// its tag labels, and then any others given.
+func (d *EbsVolumeDriver) volumeLabels(name string, extra ...string) []string {
+	labels := []string{"volume", name}
+	d.mu.Lock()
+	if v, ok := d.volumes[name]; ok {
+		labels = append(labels, v.labelPairs()...)
+	}
+	d.mu.Unlock()
+	return append(labels, extra...)
+}
+
+// withVolumeFields adds the volume's ID and tag labels, and any other fields
+// given, to the log fields of ctx.
+func withVolumeFields(ctx context.Context, v *ebsVolume, extra ...string) context.Context {
+	fields := append([]string{"volume_id", v.id}, extra...)
+	return WithLogFields(ctx, append(fields, v.labelPairs()...)...)
+}
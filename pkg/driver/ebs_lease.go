@@ -0,0 +1,133 @@
+package driver
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// leaseSettle is how long to wait after writing a lease before reading it
+// back.  Tag writes are last-writer-wins, so if another instance raced us
+// for the volume, one of us will see the other's tags and back off.
+const leaseSettle = 2 * time.Second
+
+// acquireLease claims a volume for this instance by tagging it with our
+// instance ID and an expiry time, refusing if another instance holds an
+// unexpired lease.  This gives clusters without a lock service some
+// protection against two hosts attaching (or, for multi-attach volumes,
+// mounting) the same volume at once.  Leases are renewed by leaseLoop while
+// the volume is mounted, and dropped when it's unmounted.
+func (d *EbsVolumeDriver) acquireLease(ctx context.Context, id string) error {
+	lease := GetConfig().Lease
+	if !lease.Enabled {
+		return nil
+	}
+
+	if err := d.checkLease(ctx, id); err != nil {
+		return err
+	}
+	if err := d.writeLease(ctx, id, time.Duration(lease.TTL)); err != nil {
+		return err
+	}
+
+	// Read it back after a moment, in case someone else wrote theirs too.
+	time.Sleep(leaseSettle)
+	if err := d.checkLease(ctx, id); err != nil {
+		return err
+	}
+	LogCtx(ctx, "\tAcquired lease on EBS volume %v.\n", id)
+	return nil
+}
+
+// checkLease returns an error if another instance holds a live lease on the
+// volume.
+func (d *EbsVolumeDriver) checkLease(ctx context.Context, id string) error {
+	volumes, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return err
+	}
+	if len(volumes.Volumes) != 1 {
+		return errorf(CodeNotFound, "Volume %v not found.", id)
+	}
+
+	tags := volumes.Volumes[0].Tags
+	owner := tagValue(tags, tagLeaseOwner)
+	if owner == "" || owner == d.awsInstanceId {
+		return nil
+	}
+	expiry, err := time.Parse(time.RFC3339, tagValue(tags, tagLeaseExpiry))
+	if err != nil {
+		// A malformed lease can't be trusted to ever expire.
+		LogCtxWarn(ctx, "\tIgnoring malformed lease on %v held by %v.\n", id, owner)
+		return nil
+	}
+	if time.Now().After(expiry) {
+		LogCtx(ctx, "\tLease on %v held by %v expired at %v; taking it over.\n",
+			id, owner, expiry.Format(time.RFC3339))
+		return nil
+	}
+	return errorf(CodeLeased, "Volume %v is leased to %v until %v.",
+		id, owner, expiry.Format(time.RFC3339))
+}
+
+func (d *EbsVolumeDriver) writeLease(ctx context.Context, id string, ttl time.Duration) error {
+	expiry := time.Now().Add(ttl).UTC().Format(time.RFC3339)
+	_, err := d.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags: []*ec2.Tag{
+			newTag(tagLeaseOwner, d.awsInstanceId),
+			newTag(tagLeaseExpiry, expiry),
+		},
+	}, d.awsOpts(ctx)...)
+	return err
+}
+
+// releaseLease drops our lease on a volume, if leasing is enabled.
+func (d *EbsVolumeDriver) releaseLease(ctx context.Context, id string) error {
+	if !GetConfig().Lease.Enabled {
+		return nil
+	}
+	_, err := d.ec2.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags: []*ec2.Tag{
+			{Key: aws.String(tagLeaseOwner), Value: aws.String(d.awsInstanceId)},
+			{Key: aws.String(tagLeaseExpiry)},
+		},
+	}, d.awsOpts(ctx)...)
+	return err
+}
+
+// leaseLoop renews the leases on attached (mounted or prefetched) volumes well
+// before they expire.
+func (d *EbsVolumeDriver) leaseLoop(ctx context.Context) {
+	for {
+		lease := GetConfig().Lease
+		if !lease.Enabled {
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+		if sleep(ctx, time.Duration(lease.TTL)/3) != nil {
+			return
+		}
+
+		d.mu.Lock()
+		attached := map[string]string{}
+		for name, v := range d.volumes {
+			if v.device != "" {
+				attached[name] = v.id
+			}
+		}
+		d.mu.Unlock()
+		for name, id := range attached {
+			if err := d.writeLease(ctx, id, time.Duration(lease.TTL)); err != nil {
+				LogCtxError(ctx, "Renewing lease on %v (%v) failed: %v\n", name, id, err)
+			}
+		}
+	}
+}
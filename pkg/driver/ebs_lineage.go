@@ -0,0 +1,185 @@
+package driver
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// maxLineageDepth bounds how far back Lineage walks, in case of cycles or
+// very long chains of restores.
+const maxLineageDepth = 32
+
+// LineageNode is one EBS volume in a lineage.
+type LineageNode struct {
+	VolumeId string
+	Name     string `json:",omitempty"`
+	// SnapshotId is the snapshot the volume was created from, if any.
+	SnapshotId string `json:",omitempty"`
+	Created    time.Time
+	// Deleted means the volume no longer exists; only its ID is known.
+	Deleted bool `json:",omitempty"`
+}
+
+// Lineage traces where a volume's data came from and where it has gone.
+type Lineage struct {
+	Volume LineageNode
+	// Ancestors are the volumes it was (transitively) restored from,
+	// parent first.
+	Ancestors []LineageNode
+	// Children are the volumes restored from its snapshots.
+	Children []LineageNode
+}
+
+// lineageNode describes an existing volume.
+func lineageNode(vol *ec2.Volume) LineageNode {
+	return LineageNode{
+		VolumeId:   aws.StringValue(vol.VolumeId),
+		Name:       tagValue(vol.Tags, "Name"),
+		SnapshotId: aws.StringValue(vol.SnapshotId),
+		Created:    aws.TimeValue(vol.CreateTime),
+	}
+}
+
+// snapshotParent finds the volume a snapshot was taken of, following our
+// copies (see copySnapshot) back to their source.  Returns "" if unknown.
+func (d *EbsVolumeDriver) snapshotParent(ctx context.Context, id string) (string, error) {
+	for i := 0; i < maxLineageDepth; i++ {
+		snapshots, err := d.ec2.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(id)},
+		}, d.awsOpts(ctx)...)
+		if err != nil {
+			return "", err
+		}
+		if len(snapshots.Snapshots) != 1 {
+			return "", nil
+		}
+		snap := snapshots.Snapshots[0]
+		if from := tagValue(snap.Tags, tagCopiedFrom); from != "" {
+			id = from
+			continue
+		}
+		if v := tagValue(snap.Tags, tagArchivedFrom); v != "" {
+			return v, nil
+		}
+		// Copies made outside blocker carry a meaningless volume ID.
+		if v := aws.StringValue(snap.VolumeId); v != "vol-ffffffff" {
+			return v, nil
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// volumeParent finds the volume a volume was restored from, preferring the
+// tag we record when we create one.
+func (d *EbsVolumeDriver) volumeParent(ctx context.Context, vol *ec2.Volume) (string, error) {
+	if parent := tagValue(vol.Tags, tagParentVolume); parent != "" {
+		return parent, nil
+	}
+	if snap := aws.StringValue(vol.SnapshotId); snap != "" {
+		return d.snapshotParent(ctx, snap)
+	}
+	return "", nil
+}
+
+// Lineage traces a volume's ancestors and children.  Volumes which have yet
+// to be created from a snapshot are traced from the snapshot.
+func (d *EbsVolumeDriver) Lineage(ctx context.Context, name string) (Lineage, error) {
+	d.mu.Lock()
+	v, exists := d.volumes[name]
+	var id, snap string
+	if exists {
+		id, snap = v.id, v.opts["snapshot"]
+	}
+	d.mu.Unlock()
+	if !exists {
+		return Lineage{}, errNameNotFound
+	}
+
+	var l Lineage
+	var parent string
+	if id != "" {
+		vol, err := d.describeVolume(ctx, id)
+		if err != nil {
+			return Lineage{}, err
+		}
+		l.Volume = lineageNode(vol)
+		if parent, err = d.volumeParent(ctx, vol); err != nil {
+			return Lineage{}, err
+		}
+		if l.Children, err = d.lineageChildren(ctx, id); err != nil {
+			return Lineage{}, err
+		}
+	} else {
+		l.Volume = LineageNode{Name: name, SnapshotId: snap}
+		var err error
+		if parent, err = d.snapshotParent(ctx, snap); err != nil {
+			return Lineage{}, err
+		}
+	}
+
+	seen := map[string]bool{id: true}
+	for parent != "" && !seen[parent] && len(l.Ancestors) < maxLineageDepth {
+		seen[parent] = true
+		vol, err := d.describeVolume(ctx, parent)
+		if err != nil {
+			// Most likely it's been deleted, which ends the trail.
+			l.Ancestors = append(l.Ancestors, LineageNode{VolumeId: parent, Deleted: true})
+			break
+		}
+		l.Ancestors = append(l.Ancestors, lineageNode(vol))
+		if parent, err = d.volumeParent(ctx, vol); err != nil {
+			return Lineage{}, err
+		}
+	}
+	return l, nil
+}
+
+// lineageChildren finds the volumes restored from a volume's snapshots: those
+// we tagged as its children, and any others made from its snapshots.
+func (d *EbsVolumeDriver) lineageChildren(ctx context.Context, id string) ([]LineageNode, error) {
+	queries := []*ec2.DescribeVolumesInput{{
+		Filters: []*ec2.Filter{newFilter("tag:"+tagParentVolume, id)},
+	}}
+	snapshots, err := d.ec2.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters:  []*ec2.Filter{newFilter("volume-id", id)},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots.Snapshots) > 0 {
+		var ids []string
+		for _, snap := range snapshots.Snapshots {
+			ids = append(ids, aws.StringValue(snap.SnapshotId))
+		}
+		queries = append(queries, &ec2.DescribeVolumesInput{
+			Filters: []*ec2.Filter{newFilter("snapshot-id", ids...)},
+		})
+	}
+
+	seen := make(map[string]bool)
+	children := []LineageNode{}
+	for _, q := range queries {
+		volumes, err := d.ec2.DescribeVolumesWithContext(ctx, q, d.awsOpts(ctx)...)
+		if err != nil {
+			return nil, err
+		}
+		for _, vol := range volumes.Volumes {
+			child := aws.StringValue(vol.VolumeId)
+			if seen[child] {
+				continue
+			}
+			seen[child] = true
+			children = append(children, lineageNode(vol))
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Created.Before(children[j].Created)
+	})
+	return children, nil
+}
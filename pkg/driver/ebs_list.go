@@ -0,0 +1,276 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// VolumeInfo describes a volume for Docker's List and Get.  Status is shown
+// by `docker volume inspect`.
+type VolumeInfo struct {
+	Name       string
+	Mountpoint string                 `json:",omitempty"`
+	Status     map[string]interface{} `json:",omitempty"`
+}
+
+// List reports every volume we know of, sorted by name.  Their Status has
+// their scope labels (see scopeLabels) and, for volumes under maintenance or
+// pinned, says so.
+func (d *EbsVolumeDriver) List(ctx context.Context) ([]VolumeInfo, error) {
+	if err := d.fillScopes(ctx); err != nil {
+		LogCtxWarn(ctx, "\tReading volumes' scope labels failed: %v\n", err)
+	}
+	d.mu.Lock()
+	infos := []VolumeInfo{}
+	for name, v := range d.volumes {
+		info := VolumeInfo{Name: name, Mountpoint: v.mountpoint}
+		status := map[string]interface{}{}
+		if v.maintenance != "" {
+			status["Maintenance"] = v.maintenance
+		}
+		if pinned, _ := v.pinned(); pinned {
+			status["Pinned"] = true
+		}
+		scopeStatus(status, v.scope)
+		if len(status) > 0 {
+			info.Status = status
+		}
+		infos = append(infos, info)
+	}
+	d.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// volumeStates are the states a volume can be in, here.
+var volumeStates = []string{"registered", "prefetched", "mounted"}
+
+// state says whether the volume is mounted, attached ahead of its mount
+// (prefetched), or merely registered.
+func (v *ebsVolume) state() string {
+	switch {
+	case v.mountpoint != "":
+		return "mounted"
+	case !v.prefetched.IsZero():
+		return "prefetched"
+	}
+	return "registered"
+}
+
+// Get reports a volume, with its state here and, where it has an EBS volume,
+// what EBS says of it, its snapshots, and its recent history.
+func (d *EbsVolumeDriver) Get(ctx context.Context, name string) (VolumeInfo, error) {
+	d.mu.Lock()
+	v, exists := d.volumes[name]
+	if !exists {
+		d.mu.Unlock()
+		return VolumeInfo{}, errNameNotFound
+	}
+	info := VolumeInfo{Name: name, Mountpoint: v.mountpoint}
+	status := map[string]interface{}{
+		"State":   v.state(),
+		"Options": v.requested,
+		"Created": v.created,
+	}
+	if v.device != "" {
+		status["Device"] = v.device
+	}
+	if n := v.userCount(); n > 0 {
+		status["Mounts"] = n
+	}
+	if v.maintenance != "" {
+		status["Maintenance"] = v.maintenance
+	}
+	if pinned, _ := v.pinned(); pinned {
+		status["Pinned"] = true
+	}
+	if v.mountpoint != "" && !v.expires.IsZero() {
+		status["Expires"] = v.expires
+	}
+	id := v.id
+	d.mu.Unlock()
+
+	if id != "" {
+		status["VolumeId"] = id
+		if vol, err := d.describeVolume(ctx, id); err != nil {
+			LogCtxWarn(ctx, "\tDescribing %v failed: %v\n", id, err)
+		} else {
+			status["SizeGiB"] = aws.Int64Value(vol.Size)
+			status["Type"] = aws.StringValue(vol.VolumeType)
+			status["AvailabilityZone"] = aws.StringValue(vol.AvailabilityZone)
+			status["EBSState"] = aws.StringValue(vol.State)
+			status["Encrypted"] = aws.BoolValue(vol.Encrypted)
+			scopeStatus(status, scopeLabels(vol))
+			if vol.Iops != nil {
+				status["Iops"] = aws.Int64Value(vol.Iops)
+			}
+			if vol.Throughput != nil {
+				status["Throughput"] = aws.Int64Value(vol.Throughput)
+			}
+		}
+	}
+	if snapshots, err := d.Snapshots(ctx, name); err != nil {
+		LogCtxWarn(ctx, "\tListing snapshots of %v failed: %v\n", name, err)
+	} else if len(snapshots) > 0 {
+		status["Snapshots"] = snapshots
+	}
+	if history, err := d.History(name); err == nil && len(history) > 0 {
+		status["History"] = history
+	}
+	info.Status = status
+	return info, nil
+}
+
+// Fleets' automation walks the volumes a page at a time, in name order, each
+// page starting after the last name of the one before (Next), so that volumes
+// created or removed meanwhile don't shift the pages about.
+
+// VolumeFilter selects volumes for Volumes.  Empty fields select everything.
+type VolumeFilter struct {
+	// State is registered, prefetched, or mounted.
+	State string
+	// Tags are EBS tags, as key:value or just key, which volumes must all
+	// carry.
+	Tags []string
+	// After is the name to start after: the previous page's Next.
+	After string
+	// Limit is the most volumes to return.  Zero is no limit.
+	Limit int
+}
+
+// VolumeSummary describes a volume in Volumes.
+type VolumeSummary struct {
+	Name        string
+	VolumeId    string `json:",omitempty"`
+	State       string
+	Mountpoint  string `json:",omitempty"`
+	Device      string `json:",omitempty"`
+	Maintenance string `json:",omitempty"`
+	Pinned      bool   `json:",omitempty"`
+	Created     time.Time
+}
+
+// VolumePage is a page of Volumes.  Next, if set, is the After of the next
+// page.
+type VolumePage struct {
+	Volumes []VolumeSummary
+	Next    string `json:",omitempty"`
+}
+
+// tagCheckBatch is how many volumes' tags are checked with one call.
+const tagCheckBatch = 200
+
+// Volumes lists the volumes matching a filter, sorted by name, a page at a
+// time.
+func (d *EbsVolumeDriver) Volumes(ctx context.Context, f VolumeFilter) (VolumePage, error) {
+	known := f.State == ""
+	for _, state := range volumeStates {
+		known = known || state == f.State
+	}
+	if !known {
+		return VolumePage{}, errorf(CodeInvalidOption, "Unknown volume state %q; expected one of %v.",
+			f.State, strings.Join(volumeStates, ", "))
+	}
+	if f.Limit < 0 {
+		return VolumePage{}, errorf(CodeInvalidOption, "The limit must not be negative.")
+	}
+	var tagFilters []*ec2.Filter
+	for _, t := range f.Tags {
+		kv := strings.SplitN(t, ":", 2)
+		if kv[0] == "" {
+			return VolumePage{}, errorf(CodeInvalidOption, "Invalid tag %q: expected key:value or key.", t)
+		}
+		if len(kv) == 1 {
+			tagFilters = append(tagFilters, newFilter("tag-key", kv[0]))
+		} else {
+			tagFilters = append(tagFilters, newFilter("tag:"+kv[0], kv[1]))
+		}
+	}
+
+	d.mu.Lock()
+	var candidates []VolumeSummary
+	for name, v := range d.volumes {
+		if f.After != "" && name <= f.After {
+			continue
+		}
+		s := VolumeSummary{
+			Name:        name,
+			VolumeId:    v.id,
+			State:       v.state(),
+			Mountpoint:  v.mountpoint,
+			Device:      v.device,
+			Maintenance: v.maintenance,
+			Created:     v.created,
+		}
+		s.Pinned, _ = v.pinned()
+		if f.State != "" && s.State != f.State {
+			continue
+		}
+		// Volumes without an EBS volume yet have no tags to match.
+		if len(tagFilters) > 0 && s.VolumeId == "" {
+			continue
+		}
+		candidates = append(candidates, s)
+	}
+	d.mu.Unlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+
+	// A page is only full once a volume is found for the next one, so Next
+	// is only set when there's more to come.
+	page := VolumePage{Volumes: []VolumeSummary{}}
+	for len(candidates) > 0 {
+		batch := candidates
+		if len(tagFilters) > 0 && len(batch) > tagCheckBatch {
+			batch = batch[:tagCheckBatch]
+		}
+		candidates = candidates[len(batch):]
+		var tagged map[string]bool
+		if len(tagFilters) > 0 {
+			var err error
+			if tagged, err = d.taggedVolumes(ctx, batch, tagFilters); err != nil {
+				return VolumePage{}, err
+			}
+		}
+
+		for _, s := range batch {
+			if tagged != nil && !tagged[s.VolumeId] {
+				continue
+			}
+			if f.Limit > 0 && len(page.Volumes) == f.Limit {
+				page.Next = page.Volumes[len(page.Volumes)-1].Name
+				return page, nil
+			}
+			page.Volumes = append(page.Volumes, s)
+		}
+	}
+	return page, nil
+}
+
+// taggedVolumes finds which of the volumes carry the tags filtered for.
+func (d *EbsVolumeDriver) taggedVolumes(
+	ctx context.Context, volumes []VolumeSummary, tagFilters []*ec2.Filter) (map[string]bool, error) {
+	var ids []string
+	for _, s := range volumes {
+		ids = append(ids, s.VolumeId)
+	}
+	// Filtering (rather than asking for the IDs) means a deleted volume is
+	// simply missing from the results, rather than failing the lot.
+	out, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: append([]*ec2.Filter{newFilter("volume-id", ids...)}, tagFilters...),
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return nil, fmt.Errorf("Checking volumes' tags failed: %v", err)
+	}
+	tagged := make(map[string]bool)
+	for _, vol := range out.Volumes {
+		tagged[aws.StringValue(vol.VolumeId)] = true
+	}
+	return tagged, nil
+}
@@ -0,0 +1,132 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// Hosts without a log agent can still have blocker's operation log (the
+// entries kept in each volume's history) collected centrally: with a
+// CloudWatch Logs group configured, every operation is shipped there as a
+// JSON log event, in a stream named after the instance.
+
+func init() {
+	DescribeMetric("blocker_log_events_dropped_total",
+		"Operation log events dropped because CloudWatch Logs couldn't keep up.")
+}
+
+const (
+	// logShipInterval is how often shipped log events are sent.
+	logShipInterval = 5 * time.Second
+	// logShipBuffer is how many log events may wait to be sent; any more
+	// are dropped.  It's well under PutLogEvents' limit of 10,000 a call.
+	logShipBuffer = 1000
+)
+
+// shippedOperation is an operation as shipped to CloudWatch Logs.
+type shippedOperation struct {
+	HistoryEntry
+	Name       string
+	VolumeId   string `json:",omitempty"`
+	InstanceId string
+}
+
+// shipOperation queues an operation for shipping, if shipping is configured.
+// It never blocks.
+func (d *EbsVolumeDriver) shipOperation(name string, v *ebsVolume, e HistoryEntry) {
+	if GetConfig().CloudWatchLogs.Group == "" {
+		return
+	}
+	select {
+	case d.shipped <- shippedOperation{e, name, v.id, d.awsInstanceId}:
+	default:
+		IncCounter("blocker_log_events_dropped_total")
+	}
+}
+
+// logShipLoop sends queued operations to CloudWatch Logs.
+func (d *EbsVolumeDriver) logShipLoop(ctx context.Context) {
+	var batch []shippedOperation
+	var stream string // the group we've made our stream in
+	ticker := time.NewTicker(logShipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case op := <-d.shipped:
+			batch = append(batch, op)
+			continue
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		group := GetConfig().CloudWatchLogs.Group
+		if len(batch) == 0 || group == "" {
+			batch = nil
+			continue
+		}
+		if stream != group {
+			if err := d.createLogStream(ctx, group); err != nil {
+				LogCtxError(ctx, "Creating log stream %v in %v failed: %v\n",
+					d.awsInstanceId, group, err)
+				continue
+			}
+			stream = group
+		}
+		if err := d.putLogEvents(ctx, group, batch); err != nil {
+			LogCtxError(ctx, "Shipping %v log event(s) to %v failed: %v\n",
+				len(batch), group, err)
+			// Keep them for next time, unless they're piling up.
+			if len(batch) < logShipBuffer {
+				continue
+			}
+			for range batch {
+				IncCounter("blocker_log_events_dropped_total")
+			}
+		}
+		batch = nil
+	}
+}
+
+func (d *EbsVolumeDriver) createLogStream(ctx context.Context, group string) error {
+	_, err := d.logs.CreateLogStreamWithContext(ctx, &cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(group),
+		LogStreamName: aws.String(d.awsInstanceId),
+	}, d.awsOpts(ctx)...)
+	if awsErr, ok := err.(awserr.Error); ok &&
+		awsErr.Code() == cloudwatchlogs.ErrCodeResourceAlreadyExistsException {
+		return nil
+	}
+	return err
+}
+
+func (d *EbsVolumeDriver) putLogEvents(ctx context.Context, group string, batch []shippedOperation) error {
+	// CloudWatch Logs wants events in order, but operations on different
+	// volumes finish out of order.
+	sort.SliceStable(batch, func(i, j int) bool {
+		return batch[i].Time.Before(batch[j].Time)
+	})
+	var events []*cloudwatchlogs.InputLogEvent
+	for _, op := range batch {
+		msg, err := json.Marshal(op)
+		if err != nil {
+			return err
+		}
+		events = append(events, &cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(string(msg)),
+			Timestamp: aws.Int64(op.Time.UnixNano() / int64(time.Millisecond)),
+		})
+	}
+	_, err := d.logs.PutLogEventsWithContext(ctx, &cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  aws.String(group),
+		LogStreamName: aws.String(d.awsInstanceId),
+		LogEvents:     events,
+	}, d.awsOpts(ctx)...)
+	return err
+}
@@ -0,0 +1,185 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// Volumes with the encrypted-fs option hold a LUKS (dm-crypt) container, and
+// their filesystem lives inside it, so that the data is unreadable without a
+// key that never goes near EBS.  The container is opened (as
+// /dev/mapper/blocker-<volume ID>) before the filesystem is mounted, and
+// closed again before the volume is detached.  A blank volume has its
+// container made, and then a filesystem made in that, on first mount.
+//
+// The key comes from the luks-key option, which names where to find it:
+//
+//	file:<path>              the contents of a file on the host
+//	env:<variable>           an environment variable of the daemon
+//	secretsmanager:<secret>  an AWS Secrets Manager secret (name or ARN)
+
+// mapperPrefix prefixes the names of the dm-crypt devices we open.
+const mapperPrefix = "blocker-"
+
+// encryptedFS reports whether the volume's filesystem is inside a LUKS
+// container, according to its encrypted-fs option, checking that it has a
+// usable luks-key if so.
+func (v *ebsVolume) encryptedFS() (bool, error) {
+	e, ok := v.opts["encrypted-fs"]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(e)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for encrypted-fs: %q.", e)
+	}
+	if !b {
+		return false, nil
+	}
+	if _, ok := v.opts["pool"]; ok {
+		return false, fmt.Errorf("encrypted-fs can't be used with pool, whose volumes are formatted already.")
+	}
+	if _, _, err := parseSecretRef(v.opts["luks-key"]); err != nil {
+		return false, fmt.Errorf("encrypted-fs needs a luks-key: %v", err)
+	}
+	return true, nil
+}
+
+// luksKey fetches the key named by the volume's luks-key option.
+func (d *EbsVolumeDriver) luksKey(ctx context.Context, v *ebsVolume) ([]byte, error) {
+	return ReadSecret(ctx, v.opts["luks-key"])
+}
+
+// secretValue fetches the version of a Secrets Manager secret with the given
+// stage (AWSCURRENT if ""), returning it and its version ID.
+func (d *EbsVolumeDriver) secretValue(ctx context.Context, id string, stage string) ([]byte, string, error) {
+	input := &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)}
+	if stage != "" {
+		input.VersionStage = aws.String(stage)
+	}
+	out, err := d.secrets.GetSecretValueWithContext(ctx, input, d.awsOpts(ctx)...)
+	if err != nil {
+		return nil, "", err
+	}
+	value := out.SecretBinary
+	if out.SecretString != nil {
+		value = []byte(aws.StringValue(out.SecretString))
+	}
+	return value, aws.StringValue(out.VersionId), nil
+}
+
+// cryptsetup runs cryptsetup, passing it the key on standard input.
+func cryptsetup(key []byte, args ...string) error {
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(key)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup %v failed: %v\n%v", args[0], err, string(out))
+	}
+	return nil
+}
+
+// openEncrypted opens the LUKS container on an encrypted volume's device,
+// making it (and a filesystem inside it) if the device is blank, and returns
+// the device to mount.  Other volumes' devices are returned as they are.
+func (d *EbsVolumeDriver) openEncrypted(
+	ctx context.Context, name string, v *ebsVolume, dev string, ro bool, mo mountOptions) (string, error) {
+	if encrypted, _ := v.encryptedFS(); !encrypted {
+		return dev, nil
+	}
+	mapped := "/dev/mapper/" + mapperPrefix + v.id
+	if _, err := os.Lstat(mapped); err == nil {
+		// Still open from a previous mount that didn't close it.
+		return mapped, nil
+	}
+	key, err := d.luksKey(ctx, v)
+	if err != nil {
+		return "", err
+	}
+
+	fresh := false
+	if exec.Command("cryptsetup", "isLuks", dev).Run() != nil {
+		blank, err := blankDevice(dev)
+		if err != nil {
+			return "", err
+		}
+		if !blank {
+			return "", errorf(CodeInvalidOption,
+				"Volume %v has data but no LUKS container; refusing to encrypt it.", v.id)
+		}
+		if ro {
+			return "", errorf(CodeInvalidOption,
+				"Volume %v is blank, and can't be encrypted when mounted read-only.", v.id)
+		}
+		if err := v.confirmed(name, "making a LUKS container on "+v.id); err != nil {
+			return "", err
+		}
+		LogCtx(ctx, "\tDevice %v is blank; making a LUKS container on it.\n", dev)
+		if err := cryptsetup(key, "luksFormat", "--batch-mode", "--key-file=-", dev); err != nil {
+			return "", err
+		}
+		fresh = true
+	}
+
+	args := []string{"open", "--type", "luks", "--key-file=-"}
+	if ro {
+		args = append(args, "--readonly")
+	}
+	if err := cryptsetup(key, append(args, dev, filepath.Base(mapped))...); err != nil {
+		return "", err
+	}
+	LogCtx(ctx, "\tOpened LUKS container on %v as %v.\n", dev, mapped)
+
+	if fresh {
+		// What a new container reads as isn't blank, so formatIfBlank would
+		// leave it alone.
+		fstype := mo.FSType
+		if fstype == "" {
+			fstype = GetConfig().Format.FSType
+		}
+		if fstype == "" {
+			fstype = DefaultFSType
+		}
+		if err := formatFilesystem(ctx, fstype, mapped, mo.MkfsFlags); err != nil {
+			closeEncrypted(ctx, v.id)
+			return "", err
+		}
+	}
+	d.backupLUKSHeaderIfNeeded(ctx, v, dev, fresh)
+	return mapped, nil
+}
+
+// closeEncrypted closes the LUKS container opened on a volume, if there is
+// one, and anything stacked on it (see teardownStack).
+func closeEncrypted(ctx context.Context, id string) error {
+	name := mapperPrefix + id
+	mapped := "/dev/mapper/" + name
+	if _, err := os.Lstat(mapped); err != nil {
+		return nil
+	}
+	block, err := blockName(mapped)
+	if err != nil {
+		return err
+	}
+	if err := teardownHolders(ctx, block); err != nil {
+		return err
+	}
+	return removeDM(ctx, name)
+}
+
+// resizeEncrypted grows an open LUKS container to fill its (enlarged)
+// device, ahead of growing the filesystem inside it.
+func resizeEncrypted(dev string) error {
+	if !strings.HasPrefix(dev, "/dev/mapper/"+mapperPrefix) {
+		return nil
+	}
+	return run("cryptsetup", "resize", filepath.Base(dev))
+}
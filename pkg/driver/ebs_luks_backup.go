@@ -0,0 +1,212 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// A LUKS container's header holds its key slots; if it's damaged, the data
+// is gone for good, key or no key.  With luks_backup configured, the header
+// of each encrypted-fs volume is copied to S3 (encrypted with SSE-KMS) when
+// its container is made or its key is rotated, and at any mount which finds it
+// hasn't been backed up yet (say, because the last attempt failed, or the
+// volume predates the configuration).  Where the header went is recorded in the volume's
+// blocker:luks-header-backup tag.  A header backup alone can't open the
+// volume: the key is still needed.
+//
+// `blocker luks-restore <name>` writes the backup over a damaged header,
+// having first checked that the volume's key opens it.
+
+func init() {
+	DescribeMetric("blocker_luks_header_backups_total",
+		"LUKS header backups to S3, by result.")
+}
+
+// luksBackupKey is the S3 key of a volume's LUKS header backup.
+func luksBackupKey(c LUKSBackupConfig, id string) string {
+	prefix := c.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + id + ".luks-header"
+}
+
+// luksBackupURL is where a volume's LUKS header is backed up to, as recorded
+// in its blocker:luks-header-backup tag.
+func luksBackupURL(c LUKSBackupConfig, id string) string {
+	return "s3://" + c.Bucket + "/" + luksBackupKey(c, id)
+}
+
+// backupLUKSHeaderIfNeeded backs up the header of the LUKS container on a
+// volume's device, unless its tag says it's been backed up to the configured
+// place already.  fresh says the container was just made (so its tag can't
+// be trusted).  Failures are logged, and retried at the next mount.
+func (d *EbsVolumeDriver) backupLUKSHeaderIfNeeded(ctx context.Context, v *ebsVolume, dev string, fresh bool) {
+	c := GetConfig().LUKSBackup
+	if c.Bucket == "" {
+		return
+	}
+	if !fresh {
+		vol, err := d.describeVolume(ctx, v.id)
+		if err != nil {
+			LogCtxWarn(ctx, "\tChecking for a LUKS header backup of %v failed: %v\n", v.id, err)
+			return
+		}
+		if tagValue(vol.Tags, tagLUKSBackup) == luksBackupURL(c, v.id) {
+			return
+		}
+	}
+	if err := d.backupLUKSHeader(ctx, v.id, dev); err != nil {
+		LogCtxError(ctx, "Backing up the LUKS header of %v failed (will retry at the next mount): %v\n",
+			v.id, err)
+		IncCounter("blocker_luks_header_backups_total", "result", "failure")
+		return
+	}
+	IncCounter("blocker_luks_header_backups_total", "result", "success")
+}
+
+// backupLUKSHeader copies the header of the LUKS container on a device to S3,
+// and records that it has in the volume's tag.
+func (d *EbsVolumeDriver) backupLUKSHeader(ctx context.Context, id string, dev string) error {
+	c := GetConfig().LUKSBackup
+	dir, err := ioutil.TempDir("", "blocker-luks-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// cryptsetup refuses to write over an existing file.
+	file := filepath.Join(dir, "header")
+	if err := run("cryptsetup", "luksHeaderBackup", dev, "--header-backup-file", file); err != nil {
+		return err
+	}
+	header, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	input := &s3manager.UploadInput{
+		Bucket:               aws.String(c.Bucket),
+		Key:                  aws.String(luksBackupKey(c, id)),
+		Body:                 bytes.NewReader(header),
+		ServerSideEncryption: aws.String("aws:kms"),
+		Metadata: map[string]*string{
+			"volume-id":   aws.String(id),
+			"backed-up":   aws.String(time.Now().UTC().Format(time.RFC3339)),
+			"instance-id": aws.String(d.awsInstanceId),
+		},
+	}
+	if c.KMSKey != "" {
+		input.SSEKMSKeyId = aws.String(c.KMSKey)
+	}
+	uploader := s3manager.NewUploaderWithClient(d.s3Client(c.Region))
+	if _, err := uploader.UploadWithContext(ctx, input); err != nil {
+		return err
+	}
+
+	url := luksBackupURL(c, id)
+	if _, err := d.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      []*ec2.Tag{newTag(tagLUKSBackup, url)},
+	}, d.awsOpts(ctx)...); err != nil {
+		return fmt.Errorf("Tagging %v with its backup failed: %v", id, err)
+	}
+	LogCtx(ctx, "\tBacked up the LUKS header of %v to %v.\n", id, url)
+	return nil
+}
+
+// RestoreLUKSHeader writes the backup of an unmounted encrypted-fs volume's
+// LUKS header over the header on the volume, once the volume's key is shown
+// to open it.  version picks an S3 object version, for versioned buckets;
+// "" is the latest backup.  In strict mode, confirm must name the volume.
+func (d *EbsVolumeDriver) RestoreLUKSHeader(
+	ctx context.Context, name string, version string, confirm string) error {
+	return d.do(name, func() (err error) {
+		defer d.record(ctx, name, "luks-restore", time.Now(), &err)
+		return d.restoreLUKSHeader(ctx, name, version, confirm)
+	})
+}
+
+func (d *EbsVolumeDriver) restoreLUKSHeader(ctx context.Context, name string, version string, confirm string) error {
+	c := GetConfig().LUKSBackup
+	if c.Bucket == "" {
+		return fmt.Errorf("No LUKS header backup bucket is configured.")
+	}
+	v, exists := d.volume(name)
+	if !exists {
+		return errNameNotFound
+	}
+	if v.id == "" {
+		return errorf(CodeNotFound, "Volume %v has no EBS volume yet.", name)
+	}
+	if encrypted, _ := v.encryptedFS(); !encrypted {
+		return errorf(CodeInvalidOption, "Volume %v isn't encrypted with encrypted-fs.", name)
+	}
+	if v.mountpoint != "" || !v.prefetched.IsZero() {
+		return errorf(CodeAlreadyMounted,
+			"Volume %v is attached; unmount it before restoring its LUKS header.", name)
+	}
+	if readOnlyMode() {
+		return errReadOnly("restoring the LUKS header of " + v.id)
+	}
+	if err := v.confirmedBy(confirm, "-confirm", name, "restoring the LUKS header of "+v.id); err != nil {
+		return err
+	}
+	key, err := d.luksKey(ctx, v)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "blocker-luks-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "header")
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(luksBackupKey(c, v.id)),
+	}
+	if version != "" {
+		input.VersionId = aws.String(version)
+	}
+	_, err = s3manager.NewDownloaderWithClient(d.s3Client(c.Region)).DownloadWithContext(ctx, f, input)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("Fetching the LUKS header backup of %v failed: %v", v.id, err)
+	}
+
+	return d.withDevice(ctx, name, v, func(dev string) error {
+		// Make sure the backup is one the key opens before writing it over
+		// whatever is there.
+		cmd := exec.Command("cryptsetup", "open", "--test-passphrase", "--type", "luks",
+			"--header", file, "--key-file=-", dev)
+		cmd.Stdin = bytes.NewReader(key)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("The volume's key doesn't open the LUKS header backup of %v; not restoring it: %v\n%v",
+				v.id, err, string(out))
+		}
+		if err := run("cryptsetup", "luksHeaderRestore", dev, "--batch-mode",
+			"--header-backup-file", file); err != nil {
+			return err
+		}
+		LogCtx(ctx, "\tRestored the LUKS header of %v from %v.\n", v.id, luksBackupURL(c, v.id))
+		return nil
+	})
+}
@@ -0,0 +1,394 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// RotateLUKSKey replaces the key of an encrypted-fs volume with a new, random
+// one, kept where the old one was: a new version of its Secrets Manager
+// secret, or a new file at its path (env: keys can't be rotated by blocker).
+// Its progress is recorded in the volume's blocker:luks-key-rotation tag, so
+// that a rotation which is interrupted is finished by running it again:
+//
+//	staged    the new key is stored beside the current one (the secret's
+//	          AWSPENDING version, or <path>.pending)
+//	added     the new key is added to a key slot, and shown to open the volume
+//	promoted  the new key replaces the current one (AWSCURRENT, or <path>),
+//	          the old one being kept as AWSPREVIOUS or <path>.previous
+//
+// Last, the old key's slot is removed, and the tag with it.  Until the new key
+// is promoted the old one opens the volume, and after it the new one does, so
+// the volume can be mounted at any point.  Afterwards the LUKS header is backed
+// up, if that's configured.
+//
+// With kmsKey, a Secrets Manager secret is re-encrypted under that KMS key
+// before the new key is stored.  rewrapOnly just re-encrypts the current key
+// under kmsKey, leaving the volume as it is.
+
+func init() {
+	DescribeMetric("blocker_luks_key_rotations_total",
+		"Rotations of encrypted volumes' LUKS keys, by result.")
+}
+
+// Steps of a key rotation, as recorded in blocker:luks-key-rotation.
+const (
+	rotationStaged   = "staged"
+	rotationAdded    = "added"
+	rotationPromoted = "promoted"
+)
+
+// RotateLUKSKey rotates the LUKS key of an encrypted-fs volume, or finishes
+// rotating it.  In strict mode, confirm must name the volume.
+func (d *EbsVolumeDriver) RotateLUKSKey(
+	ctx context.Context, name string, kmsKey string, rewrapOnly bool, confirm string) error {
+	return d.do(name, func() (err error) {
+		defer d.record(ctx, name, "rotate-key", time.Now(), &err)
+		err = d.rotateLUKSKey(ctx, name, kmsKey, rewrapOnly, confirm)
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		IncCounter("blocker_luks_key_rotations_total", "result", result)
+		return err
+	})
+}
+
+func (d *EbsVolumeDriver) rotateLUKSKey(
+	ctx context.Context, name string, kmsKey string, rewrapOnly bool, confirm string) error {
+	v, exists := d.volume(name)
+	if !exists {
+		return errNameNotFound
+	}
+	if v.id == "" {
+		return errorf(CodeNotFound, "Volume %v has no EBS volume yet.", name)
+	}
+	if encrypted, _ := v.encryptedFS(); !encrypted {
+		return errorf(CodeInvalidOption, "Volume %v isn't encrypted with encrypted-fs.", name)
+	}
+	if readOnlyMode() {
+		return errReadOnly("rotating the LUKS key of " + v.id)
+	}
+	if err := v.confirmedBy(confirm, "-confirm", name, "rotating the LUKS key of "+v.id); err != nil {
+		return err
+	}
+
+	parts := strings.SplitN(v.opts["luks-key"], ":", 2)
+	source, ref := parts[0], parts[1]
+	if source != "file" && source != "secretsmanager" {
+		return errorf(CodeInvalidOption,
+			"The LUKS key of %v comes from %v, where blocker can't change it.", name, source)
+	}
+	if kmsKey != "" && source != "secretsmanager" {
+		return errorf(CodeInvalidOption, "Only keys kept in Secrets Manager can be re-encrypted with a KMS key.")
+	}
+	if rewrapOnly {
+		if kmsKey == "" {
+			return errorf(CodeInvalidOption, "Re-encrypting the key of %v needs a KMS key.", name)
+		}
+		return d.rewrapSecret(ctx, ref, kmsKey)
+	}
+
+	vol, err := d.describeVolume(ctx, v.id)
+	if err != nil {
+		return err
+	}
+	step := tagValue(vol.Tags, tagLUKSRotation)
+	if step != "" {
+		LogCtx(ctx, "\tResuming the rotation of the LUKS key of %v, which was %v.\n", v.id, step)
+	}
+
+	return d.withDevice(ctx, name, v, func(dev string) error {
+		if step == "" {
+			if kmsKey != "" {
+				if _, err := d.secrets.UpdateSecretWithContext(ctx, &secretsmanager.UpdateSecretInput{
+					SecretId: aws.String(ref),
+					KmsKeyId: aws.String(kmsKey),
+				}, d.awsOpts(ctx)...); err != nil {
+					return err
+				}
+			}
+			if err := d.stageKey(ctx, source, ref); err != nil {
+				return err
+			}
+			if err := d.setRotationStep(ctx, v.id, rotationStaged); err != nil {
+				return err
+			}
+			step = rotationStaged
+		}
+
+		if step == rotationStaged {
+			old, err := d.luksKey(ctx, v)
+			if err != nil {
+				return err
+			}
+			key, err := d.pendingKey(ctx, source, ref)
+			if err != nil {
+				return err
+			}
+			if !luksKeyOpens(dev, key) {
+				if err := addLUKSKey(dev, old, key); err != nil {
+					return err
+				}
+				if !luksKeyOpens(dev, key) {
+					return fmt.Errorf("The new LUKS key of %v doesn't open it after being added.", v.id)
+				}
+			}
+			if err := d.setRotationStep(ctx, v.id, rotationAdded); err != nil {
+				return err
+			}
+			step = rotationAdded
+		}
+
+		if step == rotationAdded {
+			if err := d.promoteKey(ctx, source, ref); err != nil {
+				return err
+			}
+			if err := d.setRotationStep(ctx, v.id, rotationPromoted); err != nil {
+				return err
+			}
+			step = rotationPromoted
+		}
+
+		if step != rotationPromoted {
+			return fmt.Errorf("Volume %v is tagged with an unknown key rotation step, %q.", v.id, step)
+		}
+		key, err := d.luksKey(ctx, v)
+		if err != nil {
+			return err
+		}
+		if !luksKeyOpens(dev, key) {
+			return fmt.Errorf("The new LUKS key of %v doesn't open it; keeping the old one.", v.id)
+		}
+		old, err := d.previousKey(ctx, source, ref)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(old, key) && luksKeyOpens(dev, old) {
+			if err := cryptsetup(old, "luksRemoveKey", "--batch-mode", "--key-file=-", dev); err != nil {
+				return err
+			}
+		}
+		if err := d.forgetPreviousKey(ctx, source, ref); err != nil {
+			LogCtxWarn(ctx, "\tCleaning up after rotating the LUKS key of %v failed: %v\n", v.id, err)
+		}
+		if _, err := d.ec2.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+			Resources: []*string{aws.String(v.id)},
+			Tags:      []*ec2.Tag{{Key: aws.String(tagLUKSRotation)}},
+		}, d.awsOpts(ctx)...); err != nil {
+			return err
+		}
+		LogCtx(ctx, "\tRotated the LUKS key of %v.\n", v.id)
+
+		// The header's key slots have changed, so back it up afresh.
+		d.backupLUKSHeaderIfNeeded(ctx, v, dev, true)
+		return nil
+	})
+}
+
+// withDevice runs fn with a volume's device, attaching the volume for the
+// while if it isn't attached already.  A mounted encrypted volume's device is
+// the one under its open LUKS container.
+func (d *EbsVolumeDriver) withDevice(ctx context.Context, name string, v *ebsVolume, fn func(dev string) error) error {
+	if strings.HasPrefix(v.device, "/dev/mapper/"+mapperPrefix) {
+		dev, err := luksBackingDevice(v.device)
+		if err != nil {
+			return err
+		}
+		return fn(dev)
+	}
+	if v.device != "" {
+		return fn(v.device)
+	}
+	dev, err := d.attach(ctx, name, v)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		d.detachVolume(ctx, v.id)
+		d.releaseLease(ctx, v.id)
+	}()
+	return fn(dev)
+}
+
+// luksBackingDevice finds the device an open LUKS container is on.
+func luksBackingDevice(mapped string) (string, error) {
+	out, err := exec.Command("cryptsetup", "status", filepath.Base(mapped)).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("cryptsetup status %v failed: %v\n%v", mapped, err, string(out))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "device:" {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("cryptsetup status %v didn't name its device.", mapped)
+}
+
+func (d *EbsVolumeDriver) setRotationStep(ctx context.Context, id string, step string) error {
+	_, err := d.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      []*ec2.Tag{newTag(tagLUKSRotation, step)},
+	}, d.awsOpts(ctx)...)
+	return err
+}
+
+// luksKeyOpens reports whether a key opens the LUKS container on a device.
+func luksKeyOpens(dev string, key []byte) bool {
+	cmd := exec.Command("cryptsetup", "open", "--test-passphrase", "--type", "luks", "--key-file=-", dev)
+	cmd.Stdin = bytes.NewReader(key)
+	return cmd.Run() == nil
+}
+
+// addLUKSKey adds a key to a free key slot of the LUKS container on a device,
+// authorized by one it already has.
+func addLUKSKey(dev string, old []byte, key []byte) error {
+	dir, err := ioutil.TempDir("", "blocker-luks-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(file, key, 0600); err != nil {
+		return err
+	}
+	return cryptsetup(old, "luksAddKey", "--batch-mode", "--key-file=-", dev, file)
+}
+
+// stageKey makes a new key and stores it beside the current one.
+func (d *EbsVolumeDriver) stageKey(ctx context.Context, source string, ref string) error {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(raw)
+
+	switch source {
+	case "secretsmanager":
+		_, err := d.secrets.PutSecretValueWithContext(ctx, &secretsmanager.PutSecretValueInput{
+			SecretId:      aws.String(ref),
+			SecretString:  aws.String(key),
+			VersionStages: []*string{aws.String("AWSPENDING")},
+		}, d.awsOpts(ctx)...)
+		return err
+	case "file":
+		tmp := ref + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(key), 0600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, ref+".pending")
+	}
+	return fmt.Errorf("Can't rotate %v keys.", source)
+}
+
+// pendingKey fetches the staged key.
+func (d *EbsVolumeDriver) pendingKey(ctx context.Context, source string, ref string) ([]byte, error) {
+	if source == "secretsmanager" {
+		key, _, err := d.secretValue(ctx, ref, "AWSPENDING")
+		return key, err
+	}
+	return ioutil.ReadFile(ref + ".pending")
+}
+
+// previousKey fetches the key the staged one replaced.
+func (d *EbsVolumeDriver) previousKey(ctx context.Context, source string, ref string) ([]byte, error) {
+	if source == "secretsmanager" {
+		key, _, err := d.secretValue(ctx, ref, "AWSPREVIOUS")
+		return key, err
+	}
+	return ioutil.ReadFile(ref + ".previous")
+}
+
+// promoteKey makes the staged key the current one.  Each part is skipped if
+// it was done already.
+func (d *EbsVolumeDriver) promoteKey(ctx context.Context, source string, ref string) error {
+	if source == "secretsmanager" {
+		_, pending, err := d.secretValue(ctx, ref, "AWSPENDING")
+		if err != nil {
+			return err
+		}
+		_, current, err := d.secretValue(ctx, ref, "")
+		if err != nil {
+			return err
+		}
+		if pending == current {
+			return nil
+		}
+		// Secrets Manager moves AWSPREVIOUS to the version which was current.
+		_, err = d.secrets.UpdateSecretVersionStageWithContext(ctx, &secretsmanager.UpdateSecretVersionStageInput{
+			SecretId:            aws.String(ref),
+			VersionStage:        aws.String("AWSCURRENT"),
+			MoveToVersionId:     aws.String(pending),
+			RemoveFromVersionId: aws.String(current),
+		}, d.awsOpts(ctx)...)
+		return err
+	}
+
+	pending := ref + ".pending"
+	if _, err := os.Stat(pending); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(ref); err == nil {
+		if err := os.Rename(ref, ref+".previous"); err != nil {
+			return err
+		}
+	}
+	return os.Rename(pending, ref)
+}
+
+// forgetPreviousKey cleans up once the previous key has been removed from the
+// volume: the secret's AWSPENDING stage, or <path>.previous.  (The secret's
+// AWSPREVIOUS version is left to Secrets Manager.)
+func (d *EbsVolumeDriver) forgetPreviousKey(ctx context.Context, source string, ref string) error {
+	if source == "secretsmanager" {
+		_, pending, err := d.secretValue(ctx, ref, "AWSPENDING")
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		_, err = d.secrets.UpdateSecretVersionStageWithContext(ctx, &secretsmanager.UpdateSecretVersionStageInput{
+			SecretId:            aws.String(ref),
+			VersionStage:        aws.String("AWSPENDING"),
+			RemoveFromVersionId: aws.String(pending),
+		}, d.awsOpts(ctx)...)
+		return err
+	}
+	if err := os.Remove(ref + ".previous"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// rewrapSecret re-encrypts the current version of a secret under a KMS key, by
+// storing its value afresh as a new version.
+func (d *EbsVolumeDriver) rewrapSecret(ctx context.Context, ref string, kmsKey string) error {
+	key, _, err := d.secretValue(ctx, ref, "")
+	if err != nil {
+		return err
+	}
+	if _, err := d.secrets.UpdateSecretWithContext(ctx, &secretsmanager.UpdateSecretInput{
+		SecretId:     aws.String(ref),
+		KmsKeyId:     aws.String(kmsKey),
+		SecretString: aws.String(string(key)),
+	}, d.awsOpts(ctx)...); err != nil {
+		return err
+	}
+	LogCtx(ctx, "\tRe-encrypted secret %v under %v.\n", ref, kmsKey)
+	return nil
+}
@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"context"
+	"time"
+)
+
+// A volume under maintenance (say, while it's being restored or migrated)
+// can't be mounted: Docker's Mounts, and handoffs to this host, fail with a
+// Maintenance error naming the reason until maintenance is ended.  Its
+// current mounts may be drained, that is unmounted and the volume detached,
+// whoever is using them.
+
+// SetMaintenance puts a volume under maintenance for the given reason,
+// draining its mounts if asked, or with on false takes it out again.
+func (d *EbsVolumeDriver) SetMaintenance(
+	ctx context.Context, name string, on bool, reason string, drain bool) error {
+	return d.do(name, func() (err error) {
+		defer d.record(ctx, name, "maintenance", time.Now(), &err)
+		return d.setMaintenance(ctx, name, on, reason, drain)
+	})
+}
+
+func (d *EbsVolumeDriver) setMaintenance(
+	ctx context.Context, name string, on bool, reason string, drain bool) error {
+	v, exists := d.volume(name)
+	if !exists {
+		return errNameNotFound
+	}
+	if !on {
+		d.update(func() { v.maintenance = "" })
+		LogCtx(ctx, "\tVolume %v is no longer under maintenance.\n", name)
+		return nil
+	}
+
+	if reason == "" {
+		reason = "no reason given"
+	}
+	d.update(func() { v.maintenance = reason })
+	LogCtx(ctx, "\tVolume %v is under maintenance (%v).\n", name, reason)
+	if drain && v.mountpoint != "" {
+		LogCtx(ctx, "\tDraining %v mount(s) of %v.\n", v.userCount(), name)
+		return d.doUnmount(ctx, name)
+	}
+	return nil
+}
+
+// checkMaintenance refuses to mount a volume under maintenance.
+func (v *ebsVolume) checkMaintenance(name string) error {
+	if v.maintenance == "" {
+		return nil
+	}
+	return errorf(CodeMaintenance, "Volume %v is under maintenance (%v); try again later.",
+		name, v.maintenance)
+}
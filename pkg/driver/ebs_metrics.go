@@ -0,0 +1,94 @@
+package driver
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func init() {
+	DescribeMetric("blocker_aws_errors_total",
+		"AWS API calls which failed, by service, operation, and error code.")
+	DescribeMetric("blocker_attach_duration_seconds",
+		"How long attaching EBS volumes took, until the device was ready.")
+	DescribeMetric("blocker_detach_duration_seconds",
+		"How long detaching EBS volumes took, until EBS reported them available.")
+	DescribeMetric("blocker_volumes_attached",
+		"EBS volumes attached to this instance by blocker.")
+	DescribeMetric("blocker_volumes_mounted",
+		"EBS volumes mounted by blocker.")
+}
+
+// unhealthyFailures is how many AWS calls in a row must fail for the daemon
+// to report itself unhealthy.
+const unhealthyFailures = 3
+
+// awsFailures counts the AWS calls which have failed in a row, and
+// lastAwsError is the latest failure.
+var (
+	awsFailuresMu sync.Mutex
+	awsFailures   int
+	lastAwsError  error
+)
+
+// watchAwsCalls counts the failures of calls by every client created from the
+// session, and keeps track of whether AWS is reachable at all.
+func watchAwsCalls(sess *session.Session) {
+	sess.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "blocker.Metrics",
+		Fn: func(r *request.Request) {
+			awsFailuresMu.Lock()
+			defer awsFailuresMu.Unlock()
+			if r.Error == nil {
+				awsFailures = 0
+				return
+			}
+			awsFailures++
+			lastAwsError = r.Error
+
+			code := "Unknown"
+			if aerr, ok := r.Error.(awserr.Error); ok {
+				code = aerr.Code()
+			}
+			var op string
+			if r.Operation != nil {
+				op = r.Operation.Name
+			}
+			IncCounter("blocker_aws_errors_total",
+				"service", r.ClientInfo.ServiceName, "operation", op, "code", code)
+		},
+	})
+}
+
+// Healthy reports why the daemon can't do its job, if it can't: for now, that
+// its recent AWS calls have all failed (say, for want of credentials, or
+// because the endpoint can't be reached).
+func (d *EbsVolumeDriver) Healthy() error {
+	awsFailuresMu.Lock()
+	defer awsFailuresMu.Unlock()
+	if awsFailures >= unhealthyFailures {
+		return fmt.Errorf("The last %v AWS calls failed, most recently with: %v",
+			awsFailures, lastAwsError)
+	}
+	return nil
+}
+
+// setVolumeGauges counts the volumes attached and mounted.
+func (d *EbsVolumeDriver) setVolumeGauges() {
+	d.mu.Lock()
+	var attached, mounted int
+	for _, v := range d.volumes {
+		if v.device != "" {
+			attached++
+		}
+		if v.mountpoint != "" {
+			mounted++
+		}
+	}
+	d.mu.Unlock()
+	SetGauge(float64(attached), "blocker_volumes_attached")
+	SetGauge(float64(mounted), "blocker_volumes_mounted")
+}
@@ -0,0 +1,315 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mountOptions are the options controlling how a volume's filesystem is
+// mounted, as opposed to which EBS volume is used.
+type mountOptions struct {
+	// FSType is passed to mount -t; empty lets mount detect it.
+	FSType string
+	// Flags are extra mount -o flags, e.g. noatime.
+	Flags []string
+	// MkfsFlags are extra flags for formatting a blank volume as FSType.
+	MkfsFlags []string
+	// UID and GID, if set, are applied to the root of the filesystem once
+	// it's mounted (read-write), so that containers running as other users
+	// can write to it.
+	UID string
+	GID string
+}
+
+// mountOptions extracts the mount options from a volume's options.
+func (v *ebsVolume) mountOptions() (mountOptions, error) {
+	mo := mountOptions{
+		FSType: v.opts["fstype"],
+		UID:    v.opts["uid"],
+		GID:    v.opts["gid"],
+	}
+	// mountopts is another name for mount-flags, as other volume plugins
+	// call it.
+	flags, alias := v.opts["mount-flags"], v.opts["mountopts"]
+	if flags != "" && alias != "" {
+		return mo, fmt.Errorf("Only one of mount-flags and mountopts may be given.")
+	} else if alias != "" {
+		flags = alias
+	}
+	if flags != "" {
+		mo.Flags = strings.Split(flags, ",")
+	}
+	if name := v.opts["workload"]; name != "" {
+		p, err := workloadPolicy(name)
+		if err != nil {
+			return mo, err
+		}
+		if mo.FSType == "" {
+			mo.FSType, mo.MkfsFlags = p.FSType, p.MkfsFlags
+		}
+		if flags == "" {
+			mo.Flags = p.MountFlags
+		}
+	}
+	for _, id := range []string{mo.UID, mo.GID} {
+		if id == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(id); err != nil || n < 0 {
+			return mo, fmt.Errorf("Invalid uid or gid %q.", id)
+		}
+	}
+	return mo, nil
+}
+
+// owner is the configured owner, as chown takes it (-1 for unchanged).
+func (mo mountOptions) owner() (int, int) {
+	uid, gid := -1, -1
+	if mo.UID != "" {
+		uid, _ = strconv.Atoi(mo.UID)
+	}
+	if mo.GID != "" {
+		gid, _ = strconv.Atoi(mo.GID)
+	}
+	return uid, gid
+}
+
+// chown applies the configured owner to a freshly mounted filesystem.
+func (mo mountOptions) chown(mnt string) error {
+	if mo.UID == "" && mo.GID == "" {
+		return nil
+	}
+	uid, gid := mo.owner()
+	return os.Chown(mnt, uid, gid)
+}
+
+// layerOptions merges sets of volume options; later sets take precedence.
+func layerOptions(layers ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, layer := range layers {
+		for k, v := range layer {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// parseTagOptions parses the value of a blocker:opts tag, which holds
+// whitespace separated key=value pairs, e.g. "fstype=xfs mount-flags=noatime".
+// See applyTags.
+func parseTagOptions(s string) (map[string]string, error) {
+	opts := make(map[string]string)
+	for _, field := range strings.Fields(s) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Invalid option %q in %v tag.", field, tagOptions)
+		}
+		opts[kv[0]] = kv[1]
+	}
+	return opts, nil
+}
+
+// tagOptionNames are the options a blocker:opts tag may set: how the volume's
+// filesystem is mounted, but nothing which changes which volume is used or
+// what's done with it (force, snapshot, ttl, and so on).
+var tagOptionNames = []string{"fstype", "gid", "mount-flags", "mountopts", "ro", "uid"}
+
+// checkTagOptions rejects options from a blocker:opts tag which are unknown,
+// or which the tag may not set.
+func checkTagOptions(tagged map[string]string) error {
+	if err := checkOptionNames(tagged, ebsOptionNames); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	allowed := map[string]bool{}
+	for _, k := range tagOptionNames {
+		allowed[k] = true
+	}
+	var refused []string
+	for k := range tagged {
+		if !allowed[k] {
+			refused = append(refused, k)
+		}
+	}
+	if len(refused) == 0 {
+		return nil
+	}
+	sort.Strings(refused)
+	return errorf(CodeInvalidOption, "The %v tag can't set %v; it may only set %v.",
+		tagOptions, strings.Join(refused, ", "), strings.Join(tagOptionNames, ", "))
+}
+
+// applyTags reads the settings a volume carries in its tags.  The mount
+// options in its blocker:opts tag (see tagOptionNames) are layered between
+// the configured defaults and the options given at Create, letting a volume
+// bring its own settings (filesystem, flags, ownership) to whichever host
+// mounts it.
+func (d *EbsVolumeDriver) applyTags(ctx context.Context, v *ebsVolume) error {
+	vol, err := d.describeVolume(ctx, v.id)
+	if err != nil {
+		return err
+	}
+	d.update(func() {
+		v.ephemeral = isEphemeral(vol)
+		v.pinnedTag = isPinned(vol)
+		v.labels = tagLabels(vol.Tags)
+		v.scope = scopeLabels(vol)
+	})
+	tag := tagValue(vol.Tags, tagOptions)
+	if tag == "" {
+		return nil
+	}
+	tagged, err := parseTagOptions(tag)
+	if err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if err := checkTagOptions(tagged); err != nil {
+		return err
+	}
+
+	opts, err := volumeOptions("ebs", tagged, v.requested)
+	if err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	check := &ebsVolume{opts: opts}
+	if _, err := check.readOnly(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := check.mountOptions(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	LogCtx(ctx, "\tApplying options from %v tag: %v\n", tagOptions, tag)
+	d.update(func() { v.opts = opts })
+	return nil
+}
+
+// profileOptions finds the options of the profile named by the profile
+// option, if there is one.
+func profileOptions(opts map[string]string) (map[string]string, error) {
+	name, ok := opts["profile"]
+	if !ok {
+		return nil, nil
+	}
+	profile, ok := GetConfig().Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown profile %q.", name)
+	}
+	return profile, nil
+}
+
+// classOptions finds the options the backend has for the class named by the
+// class option, if there is one.  A class must be configured for whichever
+// backend is in use.
+func classOptions(backend string, opts map[string]string) (map[string]string, error) {
+	name, ok := opts["class"]
+	if !ok {
+		return nil, nil
+	}
+	class, ok := GetConfig().Classes[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown class %q.", name)
+	}
+	options, ok := class[backend]
+	if !ok {
+		return nil, fmt.Errorf("Class %q isn't available with the %v driver.", name, backend)
+	}
+	return options, nil
+}
+
+// volumeOptions layers the options requested for a volume over those of the
+// profile and class they name, any options from its tag, and the configured
+// defaults.  The class may be named by any of the other layers, so that a
+// profile or the defaults can choose one.
+func volumeOptions(backend string, tagged, requested map[string]string) (map[string]string, error) {
+	profile, err := profileOptions(requested)
+	if err != nil {
+		return nil, err
+	}
+	defaults := GetConfig().DefaultOptions
+	class, err := classOptions(backend, layerOptions(defaults, tagged, profile, requested))
+	if err != nil {
+		return nil, err
+	}
+	return layerOptions(defaults, tagged, class, profile, requested), nil
+}
+
+// ebsOptionNames are the options EBS volumes take.  Anything else is most
+// likely misspelt, and would otherwise be silently ignored.
+var ebsOptionNames = []string{
+	"archive", "audit", "audit-paths", "class", "confirm", "critical",
+	"encrypted", "encrypted-fs", "features", "force", "from", "fsck",
+	"fstype", "gid", "iops", "kms-key", "luks-key", "max-monthly-cost",
+	"mount-flags", "mountopts", "multi-attach", "nr-requests", "pinned",
+	"pool", "profile", "read-ahead-kb", "repair", "replicate-to", "restore",
+	"ro", "scheduler", "seed", "size", "snapshot", "snapshot-group",
+	"snapshot-on-remove", "tags", "throughput", "ttl", "type", "uid",
+	"workload",
+}
+
+// gceOptionNames are the options persistent disks take.
+var gceOptionNames = []string{
+	"class", "disk", "fstype", "gid", "mount-flags", "mountopts", "profile", "ro",
+	"size", "type", "uid", "workload",
+}
+
+// checkOptionNames rejects options which aren't among the known ones,
+// suggesting the closest known option where there's a likely one.
+func checkOptionNames(opts map[string]string, known []string) error {
+	isKnown := map[string]bool{}
+	for _, k := range known {
+		isKnown[k] = true
+	}
+	var unknown []string
+	for k := range opts {
+		if !isKnown[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	if s := suggestOption(unknown[0], known); s != "" {
+		return fmt.Errorf("Unknown option %q; did you mean %q?", unknown[0], s)
+	}
+	return fmt.Errorf("Unknown option %q; the options are %v.",
+		unknown[0], strings.Join(known, ", "))
+}
+
+// suggestOption finds the known option closest to a misspelt one, if any is
+// close enough to be what was meant.
+func suggestOption(name string, known []string) string {
+	normalized := strings.ToLower(strings.Replace(name, "_", "-", -1))
+	// Allow about one mistake in every three letters.
+	best, bestDistance := "", len(name)/3+1
+	for _, k := range known {
+		if d := editDistance(normalized, k); d < bestDistance {
+			best, bestDistance = k, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
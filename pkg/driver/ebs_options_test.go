@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckTagOptions(t *testing.T) {
+	for _, tc := range []struct {
+		tag string
+		err string
+	}{
+		{"fstype=xfs mount-flags=noatime uid=999 gid=999 ro=true", ""},
+		{"mountopts=noatime", ""},
+		{"ttl=1h", "can't set ttl"},
+		{"fstype=xfs force=true snapshot=snap-0123", "can't set force, snapshot"},
+		{"fstpye=xfs", `did you mean "fstype"`},
+	} {
+		tagged, err := parseTagOptions(tc.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkTagOptions(tagged)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%q: %v", tc.tag, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%q: got %v, want an error mentioning %q", tc.tag, err, tc.err)
+		case err != nil && ErrorCodeOf(err) != CodeInvalidOption:
+			t.Errorf("%q: got a %v error, want %v", tc.tag, ErrorCodeOf(err), CodeInvalidOption)
+		}
+	}
+}
+
+func TestCheckOptionNames(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  string
+	}{
+		{"size", ""},
+		{"mount-flags", ""},
+		{"sise", `did you mean "size"`},
+		{"Mount_Flags", `did you mean "mount-flags"`},
+		{"snapshto", `did you mean "snapshot"`},
+		{"colour", "the options are"},
+		{"x", "the options are"},
+	} {
+		err := checkOptionNames(map[string]string{tc.name: "1"}, ebsOptionNames)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%q: %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%q: got %v, want an error mentioning %q", tc.name, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Volumes blocker creates can outlive their use: a daemon that dies between
+// creating a volume and attaching it, an instance terminated with a snapshot
+// mount's temporary volume detached, or a Docker volume removed while its
+// host was gone.  Nothing then refers to them, and they cost money every month
+// without anyone noticing.  Orphans finds the EBS volumes blocker created
+// (within its namespace, if it has one) which are attached nowhere, are older
+// than a threshold, and aren't known to this daemon, in the middle of a
+// handoff, leased, or pinned; `blocker orphans` lists them, and with -delete deletes
+// them.  Temporary, standby, and ephemeral volumes are only scratch space, so
+// are simply deleted (ephemeral ones archived first, if archive.enabled is
+// set); other volumes may hold data someone still wants, so are always
+// archived before they're deleted, and kept if that fails.
+
+func init() {
+	DescribeMetric("blocker_orphans_deleted_total",
+		"Orphaned volumes deleted by `blocker orphans -delete`, by outcome.")
+}
+
+// Orphan is an unattached EBS volume blocker created that nothing uses.
+type Orphan struct {
+	VolumeId string
+	Name     string `json:",omitempty"`
+	// Kind is temporary, standby, ephemeral, or volume (one that may hold
+	// data).
+	Kind        string
+	Type        string
+	SizeGiB     int64
+	Created     time.Time
+	MonthlyCost float64
+	// Deleted and Error report what became of the volume, when orphans
+	// are deleted.
+	Deleted bool   `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+// orphanKind classifies a volume blocker created by what it was for.
+func orphanKind(vol *ec2.Volume) string {
+	switch {
+	case tagValue(vol.Tags, tagTemporary) == "true":
+		return "temporary"
+	case tagValue(vol.Tags, tagPool) != "":
+		return "standby"
+	case isEphemeral(vol):
+		return "ephemeral"
+	}
+	return "volume"
+}
+
+// inUse reports whether an unattached volume is nonetheless spoken for: on
+// its way to another host, leased to one, or pinned.
+func inUse(vol *ec2.Volume, now time.Time) bool {
+	if tagValue(vol.Tags, tagHandoff) != "" || isPinned(vol) {
+		return true
+	}
+	if tagValue(vol.Tags, tagLeaseOwner) == "" {
+		return false
+	}
+	expiry, err := time.Parse(time.RFC3339, tagValue(vol.Tags, tagLeaseExpiry))
+	return err == nil && now.Before(expiry)
+}
+
+// Orphans finds the orphaned volumes created more than olderThan ago,
+// deleting them if remove is set.
+func (d *EbsVolumeDriver) Orphans(ctx context.Context, olderThan time.Duration, remove bool) ([]Orphan, error) {
+	if remove && readOnlyMode() {
+		return nil, errReadOnly("deleting orphaned volumes")
+	}
+	d.mu.Lock()
+	known := map[string]bool{}
+	for _, v := range d.volumes {
+		if v.id != "" {
+			known[v.id] = true
+		}
+	}
+	d.mu.Unlock()
+
+	var vols []*ec2.Volume
+	if err := d.ec2.DescribeVolumesPagesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: ownedFilters(
+			newFilter("status", ec2.VolumeStateAvailable),
+			newFilter("tag-key", tagCreatedBy, tagTemporary, tagEphemeral, tagPool),
+		),
+	}, func(out *ec2.DescribeVolumesOutput, _ bool) bool {
+		vols = append(vols, out.Volumes...)
+		return true
+	}, d.awsOpts(ctx)...); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	orphans := []Orphan{}
+	for _, vol := range vols {
+		id := aws.StringValue(vol.VolumeId)
+		created := aws.TimeValue(vol.CreateTime)
+		if known[id] || now.Sub(created) < olderThan || inUse(vol, now) {
+			continue
+		}
+		o := Orphan{
+			VolumeId: id,
+			Name:     tagValue(vol.Tags, "Name"),
+			Kind:     orphanKind(vol),
+			Type:     aws.StringValue(vol.VolumeType),
+			SizeGiB:  aws.Int64Value(vol.Size),
+			Created:  created,
+		}
+		if e, err := estimateCost(volumeSpec{Type: o.Type, SizeGiB: o.SizeGiB,
+			Iops: aws.Int64Value(vol.Iops), Throughput: aws.Int64Value(vol.Throughput)}); err == nil {
+			o.MonthlyCost = e.MonthlyCost
+		}
+		if remove {
+			if err := d.deleteOrphan(ctx, o); err != nil {
+				LogCtxError(ctx, "Deleting orphaned volume %v failed: %v\n", id, err)
+				o.Error = err.Error()
+				IncCounter("blocker_orphans_deleted_total", "outcome", "failed")
+			} else {
+				o.Deleted = true
+				IncCounter("blocker_orphans_deleted_total", "outcome", "deleted")
+			}
+		}
+		orphans = append(orphans, o)
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Created.Before(orphans[j].Created)
+	})
+	return orphans, nil
+}
+
+// deleteOrphan deletes an orphaned volume, archiving it first if it may hold
+// data.
+func (d *EbsVolumeDriver) deleteOrphan(ctx context.Context, o Orphan) error {
+	name := o.Name
+	if name == "" {
+		name = o.VolumeId
+	}
+	ctx = WithLogFields(ctx, "volume", name, "volume_id", o.VolumeId)
+	archive := o.Kind == "volume" || (o.Kind == "ephemeral" && GetConfig().Archive.Enabled)
+	if archive {
+		if err := d.archive(ctx, name, o.VolumeId); err != nil {
+			return fmt.Errorf("Archiving %v failed, so it was kept: %v", o.VolumeId, err)
+		}
+	}
+	LogCtx(ctx, "Deleting orphaned %v volume %v, created %v.\n",
+		o.Kind, o.VolumeId, o.Created.Format(time.RFC3339))
+	return d.deleteVolume(ctx, o.VolumeId)
+}
@@ -0,0 +1,112 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// A pinned volume (one created with -o pinned=true, or tagged
+// blocker:pinned=true) holds data too important to lose to a stray `docker
+// compose down -v`.  Docker's Unmounts and Removes of it fail with a Pinned
+// error, leaving it mounted and registered; batch unmounts skip it; and
+// blocker never deletes it, as ephemeral or as an orphan.  Only an admin can
+// let go of it, with `blocker unmount -force` or `blocker remove -force`.
+// Volumes blocker creates with the option are tagged, so that the pin
+// follows them to other hosts; an existing volume can be pinned by tagging
+// it, which is noticed when it's next mounted.
+
+func init() {
+	DescribeMetric("blocker_pinned_refusals_total",
+		"Unmounts, removes, and deletes of pinned volumes refused, by operation.")
+}
+
+// unpinKey marks a context as an admin's forced action, which may let go of
+// pinned volumes.
+type unpinKey struct{}
+
+func withUnpinned(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unpinKey{}, true)
+}
+
+func unpinned(ctx context.Context) bool {
+	b, _ := ctx.Value(unpinKey{}).(bool)
+	return b
+}
+
+// isPinned reports whether an EBS volume is tagged as pinned.
+func isPinned(vol *ec2.Volume) bool {
+	return tagValue(vol.Tags, tagPinned) == "true"
+}
+
+// pinned reports whether the volume is pinned, by its pinned option or its
+// tag.
+func (v *ebsVolume) pinned() (bool, error) {
+	if v.pinnedTag {
+		return true, nil
+	}
+	p, ok := v.opts["pinned"]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(p)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for pinned: %q.", p)
+	}
+	return b, nil
+}
+
+// checkPinned refuses an operation (unmount, remove, or delete) on a pinned
+// volume, unless an admin forced it.
+func (v *ebsVolume) checkPinned(ctx context.Context, name string, op string) error {
+	if pinned, _ := v.pinned(); !pinned || unpinned(ctx) {
+		return nil
+	}
+	IncCounter("blocker_pinned_refusals_total", "op", op)
+	cmd := op
+	if op == "delete" {
+		cmd = "remove"
+	}
+	return errorf(CodePinned, "Volume %v is pinned; refusing to %v it without `blocker %v -force %v`.",
+		name, op, cmd, name)
+}
+
+// AdminUnmount unmounts and detaches a volume, whoever is using it, at an
+// admin's request.  A pinned volume is only unmounted with force.
+func (d *EbsVolumeDriver) AdminUnmount(ctx context.Context, name string, force bool) error {
+	if force {
+		ctx = withUnpinned(ctx)
+	}
+	return d.do(name, func() (err error) {
+		defer d.record(ctx, name, "admin-unmount", time.Now(), &err)
+		v, exists := d.volume(name)
+		if !exists {
+			return errNameNotFound
+		}
+		if v.mountpoint == "" {
+			return errorf(CodeNotMounted, "Volume %v is not mounted here.", name)
+		}
+		if err := v.checkPinned(ctx, name, "unmount"); err != nil {
+			return err
+		}
+		if n := v.userCount(); n > 0 {
+			LogCtx(ctx, "\tUnmounting %v, though %v mount(s) are using it.\n", name, n)
+		}
+		return d.doUnmount(ctx, name)
+	})
+}
+
+// AdminRemove removes a volume as Docker's Remove does, at an admin's
+// request.  A pinned volume is only removed (and, if it's ephemeral,
+// deleted) with force.
+func (d *EbsVolumeDriver) AdminRemove(ctx context.Context, name string, force bool) error {
+	if force {
+		ctx = withUnpinned(ctx)
+	}
+	return d.do(name, func() error {
+		return d.remove(ctx, name)
+	})
+}
@@ -0,0 +1,234 @@
+package driver
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Volumes created with the pool option are blank scratch volumes of one of
+// the configured pool classes.  To make mounting them fast, we keep a few of
+// each class created, attached, and formatted in advance; a Mount just takes
+// one and mounts it, and poolLoop provisions a replacement in the background.
+
+// standbyVolume is a pooled volume waiting to be taken.
+type standbyVolume struct {
+	id     string
+	device string
+}
+
+func init() {
+	DescribeMetric("blocker_pool_takes_total",
+		"Volumes taken from the warm pool, by class and whether one was ready.")
+}
+
+// poolLoop keeps each class's pool topped up to its configured count,
+// releasing standby volumes of classes which have shrunk or gone away.
+func (d *EbsVolumeDriver) poolLoop(ctx context.Context) {
+	d.adoptStandby(ctx)
+	for {
+		interval := time.Duration(GetConfig().Pool.Interval)
+		if interval <= 0 {
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+		if sleep(ctx, interval) != nil {
+			return
+		}
+
+		if !readOnlyMode() {
+			d.refillPool(ctx)
+		}
+	}
+}
+
+func (d *EbsVolumeDriver) refillPool(ctx context.Context) {
+	classes := GetConfig().Pool.Classes
+
+	// Let go of anything we no longer want.
+	d.mu.Lock()
+	var extra []standbyVolume
+	for name, pool := range d.pool {
+		want := classes[name].Count
+		if len(pool) > want {
+			extra = append(extra, pool[want:]...)
+			d.pool[name] = pool[:want]
+		}
+	}
+	d.mu.Unlock()
+	for _, sb := range extra {
+		LogCtx(ctx, "Releasing surplus standby volume %v.\n", sb.id)
+		if err := d.releaseStandby(ctx, sb); err != nil {
+			LogCtxError(ctx, "Releasing standby volume %v failed: %v\n", sb.id, err)
+		}
+	}
+
+	for name, class := range classes {
+		for {
+			d.mu.Lock()
+			n := len(d.pool[name])
+			d.mu.Unlock()
+			if n >= class.Count {
+				break
+			}
+			sb, err := d.provisionStandby(ctx, name, class)
+			if err != nil {
+				LogCtxError(ctx, "Provisioning a standby %v volume failed: %v\n", name, err)
+				break
+			}
+			d.mu.Lock()
+			d.pool[name] = append(d.pool[name], sb)
+			d.mu.Unlock()
+			LogCtx(ctx, "Added standby volume %v (%v) to the %v pool.\n",
+				sb.id, sb.device, name)
+		}
+	}
+}
+
+// provisionStandby creates, attaches, and formats a volume of the given
+// class.
+func (d *EbsVolumeDriver) provisionStandby(
+	ctx context.Context, name string, class PoolClass) (standbyVolume, error) {
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(d.awsAvailabilityZone),
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeVolume),
+			Tags: ownedTags(
+				newTag("Name", "blocker-standby"),
+				newTag(tagPool, name),
+				newTag(tagPoolHost, d.awsInstanceId),
+				newTag(tagEphemeral, "true"),
+				newTag(tagCreatedBy, d.awsInstanceId),
+			),
+		}},
+	}
+	class.spec().apply(input)
+	vol, err := d.ec2.CreateVolumeWithContext(ctx, input, d.awsOpts(ctx)...)
+	if err != nil {
+		return standbyVolume{}, err
+	}
+	sb := standbyVolume{id: aws.StringValue(vol.VolumeId)}
+	if err := d.waitUntilAvailable(ctx, sb.id); err != nil {
+		d.deleteVolume(ctx, sb.id)
+		return standbyVolume{}, err
+	}
+
+	sb.device, err = d.attachVolume(ctx, sb.id)
+	if err != nil {
+		d.deleteVolume(ctx, sb.id)
+		return standbyVolume{}, err
+	}
+	if err := d.setDeleteOnTermination(ctx, sb.id); err != nil {
+		LogCtxWarn(ctx, "\tMarking %v delete-on-termination failed: %v\n", sb.id, err)
+	}
+	if err := filesystemFor(class.fstype()).Format(sb.device); err != nil {
+		d.releaseStandby(ctx, sb)
+		return standbyVolume{}, err
+	}
+	return sb, nil
+}
+
+// releaseStandby detaches and deletes a standby volume.
+func (d *EbsVolumeDriver) releaseStandby(ctx context.Context, sb standbyVolume) error {
+	if err := d.detachVolume(ctx, sb.id); err != nil {
+		return err
+	}
+	if err := d.waitUntilAvailable(ctx, sb.id); err != nil {
+		return err
+	}
+	return d.deleteVolume(ctx, sb.id)
+}
+
+// takeStandby hands over an attached, formatted volume of the given class for
+// the named volume, provisioning one on the spot if the pool is empty.
+func (d *EbsVolumeDriver) takeStandby(ctx context.Context, name string, class string) (standbyVolume, error) {
+	c, ok := GetConfig().Pool.Classes[class]
+	if !ok {
+		return standbyVolume{}, errorf(CodeInvalidOption, "Unknown pool class %q.", class)
+	}
+
+	var sb standbyVolume
+	d.mu.Lock()
+	if pool := d.pool[class]; len(pool) > 0 {
+		sb, d.pool[class] = pool[0], pool[1:]
+	}
+	d.mu.Unlock()
+	if sb.id != "" {
+		IncCounter("blocker_pool_takes_total", "class", class, "outcome", "hit")
+		LogCtx(ctx, "\tTook standby volume %v from the %v pool.\n", sb.id, class)
+	} else {
+		IncCounter("blocker_pool_takes_total", "class", class, "outcome", "miss")
+		LogCtx(ctx, "\tThe %v pool is empty; provisioning a volume now.\n", class)
+		var err error
+		if sb, err = d.provisionStandby(ctx, class, c); err != nil {
+			return standbyVolume{}, err
+		}
+	}
+
+	// From here on it's an ordinary (ephemeral) volume, found by its name.
+	if _, err := d.ec2.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(sb.id)},
+		Tags:      []*ec2.Tag{{Key: aws.String(tagPool)}, {Key: aws.String(tagPoolHost)}},
+	}, d.awsOpts(ctx)...); err != nil {
+		d.releaseStandby(ctx, sb)
+		return standbyVolume{}, err
+	}
+	if _, err := d.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(sb.id)},
+		Tags:      []*ec2.Tag{newTag("Name", name)},
+	}, d.awsOpts(ctx)...); err != nil {
+		LogCtxWarn(ctx, "\tNaming standby volume %v failed: %v\n", sb.id, err)
+	}
+	return sb, nil
+}
+
+// adoptStandby picks up the standby volumes a previous run of the daemon left
+// attached, and deletes any it created but never got as far as attaching.
+// Their device letters were reserved at startup, so are freed up again.
+func (d *EbsVolumeDriver) adoptStandby(ctx context.Context) {
+	volumes, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: ownedFilters(newFilter("tag:"+tagPoolHost, d.awsInstanceId)),
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		LogCtxError(ctx, "Looking for standby volumes failed: %v\n", err)
+		return
+	}
+
+	classes := GetConfig().Pool.Classes
+	for _, vol := range volumes.Volumes {
+		id := aws.StringValue(vol.VolumeId)
+		class := tagValue(vol.Tags, tagPool)
+		if aws.StringValue(vol.State) == ec2.VolumeStateAvailable {
+			LogCtx(ctx, "Deleting unattached standby volume %v.\n", id)
+			d.deleteVolume(ctx, id)
+			continue
+		}
+		for _, a := range vol.Attachments {
+			if aws.StringValue(a.InstanceId) != d.awsInstanceId ||
+				aws.StringValue(a.State) != ec2.VolumeAttachmentStateAttached {
+				continue
+			}
+			dev := aws.StringValue(a.Device)
+			local, err := d.attacher.ResolveDevice(ctx, id, dev)
+			if err == nil {
+				// It may not have been formatted before we went away.
+				err = filesystemFor(classes[class].fstype()).Format(local)
+			}
+			if err != nil {
+				LogCtxError(ctx, "Adopting standby volume %v failed: %v\n", id, err)
+				continue
+			}
+			d.mu.Lock()
+			d.pool[class] = append(d.pool[class], standbyVolume{id: id, device: local})
+			d.mu.Unlock()
+			d.attachMu.Lock()
+			delete(d.reserved, deviceLetter(dev))
+			d.attachMu.Unlock()
+			LogCtx(ctx, "Adopted standby volume %v (%v) into the %v pool.\n", id, local, class)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package driver
+
+import (
+	"context"
+	"time"
+)
+
+// A scheduler which knows a container is about to land on this host can have
+// its volumes attached in advance (`blocker prefetch`), so that the container
+// doesn't wait on EBS when it starts: Docker's Mount finds the volume already
+// attached and just mounts it.  Prefetched volumes that aren't mounted within
+// the configured TTL are detached again.
+
+// Prefetch attaches a volume, without mounting it, returning its device.
+func (d *EbsVolumeDriver) Prefetch(ctx context.Context, name string) (dev string, err error) {
+	err = d.do(name, func() (err error) {
+		defer d.record(ctx, name, "prefetch", time.Now(), &err)
+		dev, err = d.prefetch(ctx, name)
+		return err
+	})
+	return dev, err
+}
+
+func (d *EbsVolumeDriver) prefetch(ctx context.Context, name string) (string, error) {
+	v, exists := d.volume(name)
+	if !exists {
+		if err := d.create(ctx, name, nil); err != nil {
+			return "", err
+		}
+		v, _ = d.volume(name)
+	}
+	if v.mountpoint != "" || !v.prefetched.IsZero() {
+		return v.device, nil
+	}
+
+	dev, err := d.attach(ctx, name, v)
+	if err != nil {
+		return "", err
+	}
+	at := time.Now()
+	d.update(func() {
+		v.device = dev
+		v.prefetched = at
+	})
+	LogCtx(ctx, "\tPrefetched volume %v (%v) at %v.\n", name, v.id, dev)
+
+	d.expirePrefetchAfter(ctx, name, at)
+	return dev, nil
+}
+
+// expirePrefetchAfter arranges for a volume prefetched at the given time to
+// be detached once the TTL has passed.
+func (d *EbsVolumeDriver) expirePrefetchAfter(ctx context.Context, name string, at time.Time) {
+	ttl := time.Duration(GetConfig().Prefetch.TTL)
+	if ttl <= 0 {
+		return
+	}
+	// The request will be long gone by then.
+	bg := WithRequestId(context.Background(), RequestId(ctx))
+	time.AfterFunc(time.Until(at.Add(ttl)), func() {
+		d.submit(name, func() { d.expirePrefetch(bg, name, at) })
+	})
+}
+
+// expirePrefetch detaches a volume prefetched at the given time, if it still
+// hasn't been mounted.
+func (d *EbsVolumeDriver) expirePrefetch(ctx context.Context, name string, at time.Time) {
+	v, exists := d.volume(name)
+	if !exists || !v.prefetched.Equal(at) {
+		return
+	}
+	LogCtx(ctx, "Prefetched volume %v wasn't mounted in time; detaching it.\n", name)
+	if err := d.detachPrefetched(ctx, v); err != nil {
+		LogCtxError(ctx, "Detaching prefetched volume %v failed: %v\n", name, err)
+	}
+}
+
+// detachPrefetched detaches a prefetched volume that's no longer wanted.
+func (d *EbsVolumeDriver) detachPrefetched(ctx context.Context, v *ebsVolume) error {
+	if err := d.detachVolume(ctx, v.id); err != nil {
+		return err
+	}
+	if err := d.releaseLease(ctx, v.id); err != nil {
+		LogCtxWarn(ctx, "\tReleasing lease on %v failed: %v\n", v.id, err)
+	}
+	if err := d.cleanupTemporary(ctx, v); err != nil {
+		return err
+	}
+	d.update(func() {
+		v.device = ""
+		v.prefetched = time.Time{}
+	})
+	return nil
+}
@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// A `docker volume create` naming a volume that doesn't exist yet creates it,
+// if a size is given: e.g. `-o size=100 -o type=gp3 -o encrypted=true -o
+// tags=team:data`.  It's made in our availability zone and given the name in
+// its Name tag, which is how it's found from then on.  With a restore
+// option (`-o restore=snap-...`) it's made from that snapshot instead of
+// blank, and the size defaults to the snapshot's.
+
+// encrypted reports whether a new volume should be encrypted, according to
+// its encrypted option.
+func (v *ebsVolume) encrypted() (bool, error) {
+	e, ok := v.opts["encrypted"]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(e)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for encrypted: %q.", e)
+	}
+	return b, nil
+}
+
+// parseVolumeTags parses the tags option, a comma separated list of
+// key:value pairs.
+func parseVolumeTags(s string) ([]*ec2.Tag, error) {
+	var tags []*ec2.Tag
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Invalid tag %q: expected key:value.", pair)
+		}
+		if kv[0] == "Name" || strings.HasPrefix(kv[0], "blocker:") {
+			return nil, fmt.Errorf("The %v tag is managed by blocker.", kv[0])
+		}
+		tags = append(tags, newTag(kv[0], kv[1]))
+	}
+	return tags, nil
+}
+
+// provisionVolume creates a new EBS volume with the given name, blank or
+// restored from a snapshot according to the volume's options, and waits
+// until it's ready to attach.
+func (d *EbsVolumeDriver) provisionVolume(ctx context.Context, name string, v *ebsVolume) (string, error) {
+	spec, err := parseVolumeSpec(v.opts)
+	if err != nil {
+		return "", err
+	}
+	extra, err := parseVolumeTags(v.opts["tags"])
+	if err != nil {
+		return "", err
+	}
+	tags := append([]*ec2.Tag{newTag("Name", name), newTag(tagCreatedBy, d.awsInstanceId)}, extra...)
+	if pinned, _ := v.pinned(); pinned {
+		tags = append(tags, newTag(tagPinned, "true"))
+	}
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(d.awsAvailabilityZone),
+	}
+	if snap := v.opts["restore"]; snap != "" {
+		input.SnapshotId = aws.String(snap)
+		// Record where the data came from, for Lineage.
+		if parent, err := d.snapshotParent(ctx, snap); err != nil {
+			LogCtxWarn(ctx, "\tFinding the parent of snapshot %v failed: %v\n", snap, err)
+		} else if parent != "" {
+			tags = append(tags, newTag(tagParentVolume, parent))
+		}
+	}
+	input.TagSpecifications = []*ec2.TagSpecification{{
+		ResourceType: aws.String(ec2.ResourceTypeVolume),
+		Tags:         ownedTags(tags...),
+	}}
+	spec.apply(input)
+	if encrypted, _ := v.encrypted(); encrypted {
+		input.Encrypted = aws.Bool(true)
+		if key := volumeKey(v.opts); key != "" {
+			input.KmsKeyId = aws.String(key)
+		}
+	}
+	if input.SnapshotId != nil {
+		if err := d.inheritEncryption(ctx, *input.SnapshotId, v.opts, input); err != nil {
+			return "", err
+		}
+	}
+
+	vol, err := d.ec2.CreateVolumeWithContext(ctx, input, d.awsOpts(ctx)...)
+	if err != nil {
+		return "", d.keyError(ctx, "created", "", aws.StringValue(input.KmsKeyId), err)
+	}
+	id := aws.StringValue(vol.VolumeId)
+	if input.SnapshotId != nil {
+		LogCtx(ctx, "\tCreated EBS volume %v for %v from %v.\n", id, name, *input.SnapshotId)
+	} else {
+		LogCtx(ctx, "\tCreated EBS volume %v for %v.\n", id, name)
+	}
+	// Once made, the volume is waited for even if the request is cancelled,
+	// so that it's registered rather than left behind.
+	if err := d.waitUntilAvailable(context.WithoutCancel(ctx), id); err != nil {
+		return "", d.keyError(ctx, "created", id, "", err)
+	}
+	return id, nil
+}
@@ -0,0 +1,135 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	// publishDelay batches up bursts of events (a container starting with
+	// several volumes, say) into one update.
+	publishDelay = 2 * time.Second
+	// maxTagValue is the longest value EC2 allows in a tag.
+	maxTagValue = 256
+)
+
+// hostSummary is the compact description of this host's state published for
+// fleet dashboards.
+type hostSummary struct {
+	Version  string
+	Volumes  []string
+	Attached int
+	Mounted  int
+	Draining bool `json:",omitempty"`
+}
+
+// tagString renders the summary compactly enough for an instance tag, e.g.
+// "v0.3 mounted=2/3 vol-1,vol-2,vol-3", truncating the volume list if need be.
+func (s hostSummary) tagString() string {
+	str := fmt.Sprintf("%s mounted=%d/%d", s.Version, s.Mounted, s.Attached)
+	if s.Draining {
+		str += " draining"
+	}
+	if len(s.Volumes) > 0 {
+		str += " " + strings.Join(s.Volumes, ",")
+	}
+	if len(str) > maxTagValue {
+		str = str[:maxTagValue-3] + "..."
+	}
+	return str
+}
+
+func (d *EbsVolumeDriver) summary() hostSummary {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := hostSummary{Version: Version, Volumes: []string{}, Draining: IsDraining()}
+	for _, v := range d.volumes {
+		if v.device != "" {
+			s.Attached++
+			s.Volumes = append(s.Volumes, v.id)
+		}
+		if v.mountpoint != "" {
+			s.Mounted++
+		}
+	}
+	sort.Strings(s.Volumes)
+	return s
+}
+
+// publishLoop keeps this host's summary up to date in an instance tag and/or
+// an SSM parameter (as configured), so that fleet-wide views can be built
+// from AWS APIs alone.  It publishes at startup and whenever a volume event
+// changes the summary.
+func (d *EbsVolumeDriver) publishLoop(ctx context.Context) {
+	ch := Events.Subscribe()
+	defer Events.Unsubscribe(ch)
+
+	var last hostSummary
+	published := false
+	for {
+		c := GetConfig().Publish
+		if c.InstanceTag != "" || c.SSMParameter != "" {
+			s := d.summary()
+			if !published || fmt.Sprint(s) != fmt.Sprint(last) {
+				if err := d.publishSummary(ctx, s); err != nil {
+					LogCtxError(ctx, "Publishing host state failed: %v\n", err)
+				} else {
+					last, published = s, true
+				}
+			}
+		}
+
+		// Wait for something to happen, then let things settle.
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+		if sleep(ctx, publishDelay) != nil {
+			return
+		}
+		for len(ch) > 0 {
+			<-ch
+		}
+	}
+}
+
+func (d *EbsVolumeDriver) publishSummary(ctx context.Context, s hostSummary) error {
+	c := GetConfig().Publish
+	if c.InstanceTag != "" {
+		if _, err := d.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+			Resources: []*string{aws.String(d.awsInstanceId)},
+			Tags:      []*ec2.Tag{newTag(c.InstanceTag, s.tagString())},
+		}, d.awsOpts(ctx)...); err != nil {
+			return err
+		}
+	}
+	if c.SSMParameter != "" {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		name := strings.Replace(c.SSMParameter, "{instance}", d.awsInstanceId, -1)
+		if _, err := d.ssm.PutParameterWithContext(ctx, &ssm.PutParameterInput{
+			Name:      aws.String(name),
+			Value:     aws.String(string(data)),
+			Type:      aws.String(ssm.ParameterTypeString),
+			Overwrite: aws.Bool(true),
+		}, d.awsOpts(ctx)...); err != nil {
+			return err
+		}
+	}
+	LogCtxDebug(ctx, "Published host state: %v\n", s.tagString())
+	return nil
+}
@@ -0,0 +1,19 @@
+package driver
+
+// In read-only mode (see Config.ReadOnly), for hosts inspecting production
+// volumes during an incident, every volume is mounted read-only, and nothing
+// blocker does may change a volume's data or delete it: blank volumes aren't
+// formatted, damaged filesystems aren't repaired or grown, ephemeral volumes
+// are kept, no volumes are created (except the throwaway copies snapshot
+// mounts use), and none are forced off other instances.  Snapshots, which
+// only add, are still taken.
+
+// readOnlyMode reports whether the daemon is in read-only mode.
+func readOnlyMode() bool {
+	return GetConfig().ReadOnly
+}
+
+// errReadOnly refuses an operation in read-only mode.
+func errReadOnly(what string) error {
+	return errorf(CodeReadOnly, "This host is in read-only mode; %v refused.", what)
+}
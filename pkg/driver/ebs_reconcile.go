@@ -0,0 +1,223 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Drift describes a difference between what we believe about a volume and
+// what EC2 or the kernel report, and what was done about it.
+type Drift struct {
+	Name   string
+	Kind   string
+	Detail string
+	// Action is what was done: "alerted" (only logged, as the policy is
+	// alert), "unmounted", "detached", or "updated" (our record, to match),
+	// "skipped" if the volume had moved on before it could be repaired, or
+	// "deferred" if it's left for the watchdog to re-mount.
+	Action string
+	// Error is why the action failed, if it did.
+	Error string `json:",omitempty"`
+}
+
+const (
+	// driftDetached means EBS no longer shows the volume attached to us.
+	driftDetached = "detached"
+	// driftDeleted means EBS no longer knows of the volume at all.
+	driftDeleted = "deleted"
+	// driftUnmounted means the mountpoint is gone from the mount table.
+	driftUnmounted = "unmounted"
+	// driftDeviceMoved means the volume is mounted from a different device.
+	driftDeviceMoved = "device-moved"
+)
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%v: %v (%v)", d.Name, d.Kind, d.Detail)
+}
+
+// reconcileLoop periodically looks for drift between our state and reality.
+func (d *EbsVolumeDriver) reconcileLoop(ctx context.Context) {
+	for {
+		interval := time.Duration(GetConfig().Reconcile.Interval)
+		if interval <= 0 {
+			// Reconciliation is off; check back in case a reload enables it.
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+		if sleep(ctx, interval) != nil {
+			return
+		}
+
+		if r := d.reconcilePass(ctx, reconcilePeriodic); r.Error != "" {
+			LogCtxError(ctx, "Reconciliation failed: %v\n", r.Error)
+		}
+	}
+}
+
+// mountedVolume is what reconcile knows of a mounted volume.
+type mountedVolume struct {
+	id         string
+	mountpoint string
+	device     string
+}
+
+// reconcile compares every mounted volume against EC2 and the mount table,
+// logging any drift and repairing it if the policy says to.  Volumes with
+// operations under way are skipped, as they're expected to be in flux.
+func (d *EbsVolumeDriver) reconcile(ctx context.Context) (ReconcileReport, error) {
+	var report ReconcileReport
+	d.mu.Lock()
+	mounted := map[string]mountedVolume{}
+	var ids []string
+	for name, v := range d.volumes {
+		if v.mountpoint != "" && !d.busy(name) {
+			mounted[name] = mountedVolume{v.id, v.mountpoint, v.device}
+			ids = append(ids, v.id)
+		}
+	}
+	d.mu.Unlock()
+	report.Checked = len(ids)
+	if len(ids) == 0 {
+		return report, nil
+	}
+
+	mounts, err := readMounts()
+	if err != nil {
+		return report, err
+	}
+	// Filtering (rather than asking for the IDs) means a deleted volume is
+	// simply missing from the results, rather than failing the lot.
+	volumes, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{newFilter("volume-id", ids...)},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return report, err
+	}
+	exists := make(map[string]bool)
+	attached := make(map[string]bool)
+	for _, vol := range volumes.Volumes {
+		exists[aws.StringValue(vol.VolumeId)] = true
+		for _, a := range vol.Attachments {
+			if aws.StringValue(a.InstanceId) == d.awsInstanceId &&
+				aws.StringValue(a.State) == ec2.VolumeAttachmentStateAttached {
+				attached[aws.StringValue(vol.VolumeId)] = true
+			}
+		}
+	}
+
+	var seen []mountedVolume
+	for name, v := range mounted {
+		var found *Drift
+		if !exists[v.id] {
+			found = &Drift{Name: name, Kind: driftDeleted,
+				Detail: "EBS reports the volume no longer exists"}
+		} else if !attached[v.id] {
+			found = &Drift{Name: name, Kind: driftDetached,
+				Detail: "EBS reports the volume is no longer attached to " + d.awsInstanceId}
+		} else if m := findMountpoint(mounts, v.mountpoint); m == nil {
+			found = &Drift{Name: name, Kind: driftUnmounted,
+				Detail: v.mountpoint + " is no longer mounted"}
+		} else if major, minor, err := deviceNumber(v.device); err != nil ||
+			major != m.Major || minor != m.Minor {
+			found = &Drift{Name: name, Kind: driftDeviceMoved,
+				Detail: fmt.Sprintf("%v is now mounted from %v, not %v",
+					v.mountpoint, m.Source, v.device)}
+			v.device = m.Source
+		}
+		if found == nil {
+			continue
+		}
+		if (found.Kind == driftDetached || found.Kind == driftDeleted) &&
+			GetConfig().Reconcile.CloudTrail {
+			if who, err := d.responsibleFor(ctx, v.id); err != nil {
+				found.Detail += "; CloudTrail: " + err.Error()
+			} else {
+				found.Detail += "; CloudTrail: " + who
+			}
+		}
+
+		LogCtxError(ctx, "Drift detected: %v\n", found)
+		found.Action = "alerted"
+		report.Drift = append(report.Drift, *found)
+		seen = append(seen, v)
+	}
+
+	// Repairs run on the volumes' actors; the report waits for them.
+	if GetConfig().Reconcile.Policy == "repair" {
+		var wg sync.WaitGroup
+		for i := range report.Drift {
+			found, v := &report.Drift[i], seen[i]
+			wg.Add(1)
+			d.submit(found.Name, func() {
+				defer wg.Done()
+				d.repairDrift(ctx, v, found)
+			})
+		}
+		wg.Wait()
+	}
+	return report, nil
+}
+
+// repairDrift fixes up our bookkeeping for a volume whose mount has gone
+// away, tidying up whatever is left behind, so that Docker's next Mount
+// attaches and mounts it afresh, and records what it did in found.  It runs
+// on the volume's actor, and does nothing if the volume has moved on since
+// reconcile saw it.
+func (d *EbsVolumeDriver) repairDrift(ctx context.Context, seen mountedVolume, found *Drift) {
+	name := found.Name
+	v, exists := d.volume(name)
+	if !exists || v.id != seen.id || v.mountpoint != seen.mountpoint {
+		found.Action = "skipped"
+		return
+	}
+
+	switch found.Kind {
+	case driftDetached, driftDeleted:
+		// The device has gone; a lazy unmount clears any stale mount.
+		d.stopAudit(v)
+		exec.Command("umount", forceUnmountFlag, v.mountpoint).Run()
+		found.Action = "unmounted"
+	case driftUnmounted:
+		// The watchdog puts such volumes back; detaching them here would
+		// undo its work (or have it re-attach them).
+		if watchdogRemounts() {
+			found.Action = "deferred"
+			return
+		}
+		// The volume is still attached, but no longer in use.
+		d.stopAudit(v)
+		found.Action = "detached"
+		if err := d.detachVolume(ctx, v.id); err != nil {
+			LogCtxWarn(ctx, "\tRepair of %v failed: %v\n", name, err)
+			found.Error = err.Error()
+			return
+		}
+		if err := d.cleanupTemporary(ctx, v); err != nil {
+			LogCtxWarn(ctx, "\tRepair of %v failed: %v\n", name, err)
+			found.Error = err.Error()
+		}
+	default:
+		// Just bring our record up to date.
+		d.update(func() { v.device = seen.device })
+		LogCtx(ctx, "\tRepaired: %v is now using %v.\n", name, seen.device)
+		found.Action = "updated"
+		return
+	}
+
+	os.Remove(v.mountpoint)
+	LogCtx(ctx, "\tRepaired: %v is no longer mounted at %v.\n", name, v.mountpoint)
+	d.update(func() {
+		v.mountpoint = ""
+		v.device = ""
+		v.users = nil
+	})
+}
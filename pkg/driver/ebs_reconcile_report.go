@@ -0,0 +1,120 @@
+package driver
+
+import (
+	"context"
+	"time"
+)
+
+// Every reconciliation pass (the one restoring state at startup, the periodic
+// ones, and those asked for through the admin API) produces a report of what
+// it checked, the drift it found, and what it did about it, kept for the
+// latest reconcileHistory passes (see ReconcileReports) and summed up in the
+// blocker_reconcile_* metrics.  Fleet automation can then pick out hosts
+// whose storage keeps drifting, from blocker_reconcile_drifting_passes, say,
+// without scraping logs.
+
+func init() {
+	DescribeMetric("blocker_reconcile_passes_total",
+		"Reconciliation passes, by pass (startup, periodic, or requested) and result (clean, drift, or failed).")
+	DescribeMetric("blocker_reconcile_drift_total",
+		"Drift found by reconciliation, by pass, kind, and action taken.")
+	DescribeMetric("blocker_reconcile_adopted_total",
+		"Mounted volumes missing from the saved state, adopted at startup.")
+	DescribeMetric("blocker_reconcile_drifting_passes",
+		"Consecutive reconciliation passes which found drift (0 after a clean one).")
+	DescribeMetric("blocker_reconcile_seconds",
+		"How long reconciliation passes take, by pass.")
+}
+
+const (
+	reconcileStartup   = "startup"
+	reconcilePeriodic  = "periodic"
+	reconcileRequested = "requested"
+
+	// reconcileHistory is how many passes' reports are kept.
+	reconcileHistory = 50
+)
+
+// ReconcileReport is the outcome of a reconciliation pass.
+type ReconcileReport struct {
+	// Pass is startup, periodic, or requested (through the admin API).
+	Pass     string
+	Started  time.Time
+	Duration time.Duration
+	// Checked is how many volumes were compared against EC2 and the mount
+	// table.
+	Checked int
+	// Rebooted says the instance had restarted since the state was saved,
+	// so mounts missing at startup were expected.
+	Rebooted bool `json:",omitempty"`
+	// Adopted are the volumes found mounted at startup which the saved
+	// state didn't know of.
+	Adopted []string `json:",omitempty"`
+	Drift   []Drift  `json:",omitempty"`
+	// Error is why the pass failed, if it did.
+	Error string `json:",omitempty"`
+}
+
+// reconcilePass runs a reconciliation pass and records its report.
+func (d *EbsVolumeDriver) reconcilePass(ctx context.Context, pass string) ReconcileReport {
+	start := time.Now()
+	r, err := d.reconcile(ctx)
+	r.Pass, r.Started, r.Duration = pass, start, time.Since(start)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	d.recordReconcile(r)
+	return r
+}
+
+// recordReconcile keeps a pass's report, and counts what it found.
+func (d *EbsVolumeDriver) recordReconcile(r ReconcileReport) {
+	result := "clean"
+	switch {
+	case r.Error != "":
+		result = "failed"
+	case len(r.Drift) > 0:
+		result = "drift"
+	}
+	IncCounter("blocker_reconcile_passes_total", "pass", r.Pass, "result", result)
+	ObserveDuration(r.Duration, "blocker_reconcile_seconds", "pass", r.Pass)
+	for _, found := range r.Drift {
+		IncCounter("blocker_reconcile_drift_total", "pass", r.Pass, "kind", found.Kind,
+			"action", found.Action)
+	}
+	AddCounter(float64(len(r.Adopted)), "blocker_reconcile_adopted_total")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reconciled = append(d.reconciled, r)
+	if len(d.reconciled) > reconcileHistory {
+		d.reconciled = d.reconciled[len(d.reconciled)-reconcileHistory:]
+	}
+	// Mounts lost to a restart are expected, and a failed pass says
+	// nothing either way.
+	switch {
+	case result == "drift" && !r.Rebooted:
+		d.driftingPasses++
+	case result == "clean":
+		d.driftingPasses = 0
+	}
+	SetGauge(float64(d.driftingPasses), "blocker_reconcile_drifting_passes")
+}
+
+// ReconcileReports returns the latest reconciliation passes' reports, newest
+// first.
+func (d *EbsVolumeDriver) ReconcileReports() []ReconcileReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	reports := make([]ReconcileReport, 0, len(d.reconciled))
+	for i := len(d.reconciled) - 1; i >= 0; i-- {
+		reports = append(reports, d.reconciled[i])
+	}
+	return reports
+}
+
+// Reconcile runs a reconciliation pass now, whether or not periodic ones are
+// enabled, returning its report.
+func (d *EbsVolumeDriver) Reconcile(ctx context.Context) ReconcileReport {
+	return d.reconcilePass(ctx, reconcileRequested)
+}
@@ -0,0 +1,62 @@
+package driver
+
+// Several containers can use a volume at once.  The first Mount mounts it,
+// later ones are handed the same mountpoint, and only the last Unmount
+// unmounts and detaches it.  Docker identifies each container's mount with
+// an ID, which we count the volume's users by; older versions of Docker
+// don't, so anonymous mounts are simply counted.  These are called by the
+// volume's actor, holding d.mu.
+
+// mountUsers counts a volume's mounts, by Docker's mount ID.
+type mountUsers map[string]int
+
+// add records a mount.  Docker may repeat a Mount, so a mount ID is only
+// counted once.
+func (u *mountUsers) add(caller string) {
+	if *u == nil {
+		*u = make(mountUsers)
+	}
+	if caller == "" {
+		(*u)[caller]++
+	} else {
+		(*u)[caller] = 1
+	}
+}
+
+// drop records an unmount, returning how many mounts are left.  An unmount
+// by a mount we don't know of changes nothing, so a volume with no known
+// mounts (say, one adopted at startup) is simply unmounted.
+func (u mountUsers) drop(caller string) int {
+	if _, ok := u[caller]; !ok {
+		return u.count()
+	}
+	if u[caller]--; u[caller] <= 0 {
+		delete(u, caller)
+	}
+	return u.count()
+}
+
+// count returns how many mounts there are.
+func (u mountUsers) count() int {
+	n := 0
+	for _, count := range u {
+		n += count
+	}
+	return n
+}
+
+// addUser records a mount of the volume.
+func (v *ebsVolume) addUser(caller string) {
+	v.users.add(caller)
+}
+
+// dropUser records an unmount of the volume, returning how many mounts are
+// left.
+func (v *ebsVolume) dropUser(caller string) int {
+	return v.users.drop(caller)
+}
+
+// userCount returns how many mounts the volume has.
+func (v *ebsVolume) userCount() int {
+	return v.users.count()
+}
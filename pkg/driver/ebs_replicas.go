@@ -0,0 +1,154 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Scale-out read workloads (search indexes, training sets, reporting) want
+// several recent copies of one dataset.  Replicate snapshots a volume and
+// registers count read-only replicas of it, named <name>-replica-<n>, each a
+// snapshot mount (see the snapshot option) of the new snapshot, with the
+// source's filesystem options: its EBS volume is made when it's first
+// mounted (or straight away, with prefetch), and deleted again when it's
+// unmounted.  Replicating again replaces the replicas which aren't mounted
+// with copies of a fresh snapshot.  The snapshot is tagged
+// blocker:replica-of=<name>, and other hosts can mount copies of their own
+// with `-o snapshot=<id>`, or `-o from=<volume id>@<now>` for the latest.
+
+// maxReplicas is the most replicas one Replicate makes.  Each takes an
+// attachment slot once mounted.
+const maxReplicas = 16
+
+// replicaOptions are the source's options its replicas are given.
+var replicaOptions = []string{
+	"encrypted-fs", "fstype", "gid", "iops", "luks-key", "mount-flags", "mountopts",
+	"throughput", "type", "uid", "workload",
+}
+
+// ReplicaSet reports the read-only replicas made of a volume.
+type ReplicaSet struct {
+	Source     string
+	VolumeId   string
+	SnapshotId string
+	Replicas   []Replica
+}
+
+// Replica is one of a ReplicaSet.  Device is set once it's attached.
+type Replica struct {
+	Name   string
+	Device string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// replicaName names a volume's nth replica.
+func replicaName(name string, n int) string {
+	return fmt.Sprintf("%v-replica-%d", name, n)
+}
+
+// Replicate snapshots a volume and registers count read-only replicas of it,
+// attaching them too if prefetch is set.  A replica which can't be made is
+// reported, but doesn't stop the others.
+func (d *EbsVolumeDriver) Replicate(
+	ctx context.Context, name string, count int, prefetch bool) (ReplicaSet, error) {
+	if count < 1 || count > maxReplicas {
+		return ReplicaSet{}, errorf(CodeInvalidOption, "The count must be from 1 to %v.", maxReplicas)
+	}
+	set := ReplicaSet{Source: name}
+	opts := map[string]string{}
+	err := d.do(name, func() (err error) {
+		defer d.record(ctx, name, "replicate", time.Now(), &err)
+		v, exists := d.volume(name)
+		if !exists {
+			return errNameNotFound
+		}
+		if v.id == "" || v.temporary {
+			return errorf(CodeNotFound, "Volume %v has no EBS volume of its own to replicate.", name)
+		}
+		for _, key := range replicaOptions {
+			if value, ok := v.opts[key]; ok {
+				opts[key] = value
+			}
+		}
+		set.VolumeId = v.id
+		var out *ec2.Snapshot
+		err = queueSnapshot(ctx, func() (err error) {
+			out, err = d.ec2.CreateSnapshotWithContext(ctx, &ec2.CreateSnapshotInput{
+				VolumeId:    aws.String(v.id),
+				Description: aws.String("blocker snapshot of " + name + " for replicas"),
+				TagSpecifications: []*ec2.TagSpecification{{
+					ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+					Tags: ownedTags(newTag("Name", name), newTag(tagVolume, name),
+						newTag(tagReplicaOf, name)),
+				}},
+			}, d.awsOpts(ctx)...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		set.SnapshotId = aws.StringValue(out.SnapshotId)
+		return nil
+	})
+	if err != nil {
+		return set, err
+	}
+	LogCtx(ctx, "Replicating %v (%v) %v time(s) from %v...\n", name, set.VolumeId, count, set.SnapshotId)
+	// The volume needn't wait on the snapshot, but its replicas do.
+	if err := d.waitUntilSnapshotCompleted(ctx, d.ec2, set.SnapshotId); err != nil {
+		return set, err
+	}
+	opts["snapshot"] = set.SnapshotId
+
+	set.Replicas = make([]Replica, count)
+	var wg sync.WaitGroup
+	for i := range set.Replicas {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := Replica{Name: replicaName(name, i+1)}
+			dev, err := d.replica(ctx, r.Name, opts, prefetch)
+			if err != nil {
+				r.Error = err.Error()
+				LogCtxError(ctx, "Making replica %v failed: %v\n", r.Name, err)
+			}
+			r.Device = dev
+			set.Replicas[i] = r
+		}()
+	}
+	wg.Wait()
+	return set, nil
+}
+
+// replica (re)registers a replica with the given options, attaching it if
+// prefetch is set, and returns its device if it's attached.
+func (d *EbsVolumeDriver) replica(
+	ctx context.Context, name string, opts map[string]string, prefetch bool) (dev string, err error) {
+	err = d.do(name, func() (err error) {
+		defer d.record(ctx, name, "replica", time.Now(), &err)
+		if v, exists := d.volume(name); exists {
+			if v.mountpoint != "" {
+				return errorf(CodeAlreadyMounted, "Replica %v is mounted, so it's been left as it was.", name)
+			}
+			if !v.prefetched.IsZero() {
+				if err := d.detachPrefetched(ctx, v); err != nil {
+					return err
+				}
+			}
+		}
+		if err := d.create(ctx, name, opts); err != nil {
+			return err
+		}
+		if prefetch {
+			dev, err = d.prefetch(ctx, name)
+		}
+		return err
+	})
+	return dev, err
+}
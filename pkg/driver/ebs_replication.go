@@ -0,0 +1,360 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// A volume created with replicate-to=<zone> is kept warm in another
+// availability zone, or, naming a zone in another region, another region:
+// every replication.interval it's snapshotted, and a copy of it is made
+// there from the snapshot, replacing the one before.  A host there takes
+// over by creating the volume under the same name, which resolves to the
+// copy as the volume in its zone (see resolveVolumeId), losing at most an
+// interval's writes.  Only the latest snapshot is kept, so that (within a
+// region) the next is incremental.  Copies are tagged
+// blocker:copy-of=<volume ID>, and a copy that's been attached (after a
+// failover, say) is never replaced, so its new host's data isn't pulled from
+// under it.  `blocker refresh-copy <name>` refreshes a volume's copy now.
+
+func init() {
+	DescribeMetric("blocker_replications_total",
+		"Refreshes of volumes' copies in other availability zones or regions, by outcome.")
+	DescribeMetric("blocker_replication_snapshot_timestamp_seconds",
+		"When the snapshot each volume's copy was last made from was taken, in seconds since the epoch.")
+}
+
+// zonePattern matches availability zone names, e.g. us-west-2a.
+var zonePattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+[a-z]$`)
+
+// zoneRegion is the region an availability zone is in.
+func zoneRegion(zone string) string {
+	return zone[:len(zone)-1]
+}
+
+// replicateTo is the availability zone the volume is replicated to, by its
+// replicate-to option, or "" if it isn't.
+func (v *ebsVolume) replicateTo() (string, error) {
+	zone := v.opts["replicate-to"]
+	if zone == "" {
+		return "", nil
+	}
+	if !zonePattern.MatchString(zone) {
+		return "", fmt.Errorf("Invalid value for replicate-to: %q; expected an availability zone, "+
+			"e.g. us-west-2a.", zone)
+	}
+	return zone, nil
+}
+
+// copyTakenOver is the error of refreshing a copy that's been attached.
+type copyTakenOver struct {
+	id       string
+	instance string
+}
+
+func (e copyTakenOver) Error() string {
+	return fmt.Sprintf("The copy %v is attached to %v, so it's no longer refreshed.", e.id, e.instance)
+}
+
+// copying holds the volumes whose copies are being refreshed, by ID.
+var (
+	copyingMu sync.Mutex
+	copying   = map[string]bool{}
+)
+
+// replicationLoop periodically refreshes the copies of volumes with the
+// replicate-to option.
+func (d *EbsVolumeDriver) replicationLoop(ctx context.Context) {
+	for {
+		c := GetConfig().Replication
+		if c.Interval <= 0 {
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+		if sleep(ctx, time.Duration(c.Interval)) != nil {
+			return
+		}
+
+		var names []string
+		d.mu.Lock()
+		for name, v := range d.volumes {
+			if zone, _ := v.replicateTo(); zone != "" && v.id != "" && !v.temporary {
+				names = append(names, name)
+			}
+		}
+		d.mu.Unlock()
+		for _, name := range names {
+			if err := d.RefreshCopy(ctx, name); err != nil {
+				LogCtxError(ctx, "Refreshing the copy of %v failed: %v\n", name, err)
+			}
+		}
+	}
+}
+
+// RefreshCopy snapshots a volume with the replicate-to option, and replaces
+// its copy in the zone it names with one made from the snapshot.
+func (d *EbsVolumeDriver) RefreshCopy(ctx context.Context, name string) error {
+	var id, zone string
+	err := d.do(name, func() error {
+		v, exists := d.volume(name)
+		if !exists {
+			return errNameNotFound
+		}
+		if v.id == "" || v.temporary {
+			return errorf(CodeNotFound, "Volume %v has no EBS volume of its own to replicate.", name)
+		}
+		var err error
+		if zone, err = v.replicateTo(); err != nil {
+			return WithCode(CodeInvalidOption, err)
+		} else if zone == "" {
+			return errorf(CodeInvalidOption, "Volume %v has no replicate-to option.", name)
+		}
+		id = v.id
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	copyingMu.Lock()
+	if copying[id] {
+		copyingMu.Unlock()
+		return fmt.Errorf("The copy of %v is already being refreshed.", name)
+	}
+	copying[id] = true
+	copyingMu.Unlock()
+	defer func() {
+		copyingMu.Lock()
+		delete(copying, id)
+		copyingMu.Unlock()
+	}()
+
+	start := time.Now()
+	ctx = WithLogFields(ctx, "volume", name, "volume_id", id)
+	outcome := "refreshed"
+	err = d.refreshCopy(ctx, name, id, zone)
+	var taken copyTakenOver
+	if errors.As(err, &taken) {
+		outcome = "taken_over"
+	} else if err != nil {
+		outcome = "failed"
+	}
+	d.record(ctx, name, "refresh-copy", start, &err)
+	IncCounter("blocker_replications_total", d.volumeLabels(name, "outcome", outcome)...)
+	return err
+}
+
+func (d *EbsVolumeDriver) refreshCopy(ctx context.Context, name string, id string, zone string) error {
+	region := zoneRegion(zone)
+	var svc ec2iface.EC2API = d.ec2
+	if region != d.awsRegion {
+		svc = ec2.New(d.session, &aws.Config{Region: aws.String(region)})
+	}
+
+	// Leave alone a copy that's been taken over.
+	previous, err := d.copiesOf(ctx, svc, id)
+	if err != nil {
+		return err
+	}
+	for _, c := range previous {
+		if len(c.Attachments) > 0 {
+			return copyTakenOver{aws.StringValue(c.VolumeId), aws.StringValue(c.Attachments[0].InstanceId)}
+		}
+	}
+
+	vol, err := d.describeVolume(ctx, id)
+	if err != nil {
+		return err
+	}
+	tags := []*ec2.Tag{newTag("Name", name), newTag(tagVolume, name), newTag(tagCopyOf, id)}
+	LogCtx(ctx, "Refreshing the copy of %v in %v...\n", name, zone)
+	var out *ec2.Snapshot
+	err = queueSnapshot(ctx, func() (err error) {
+		out, err = d.ec2.CreateSnapshotWithContext(ctx, &ec2.CreateSnapshotInput{
+			VolumeId:    aws.String(id),
+			Description: aws.String("blocker replication of " + name),
+			TagSpecifications: []*ec2.TagSpecification{{
+				ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+				Tags:         ownedTags(tags...),
+			}},
+		}, d.awsOpts(ctx)...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	snap := aws.StringValue(out.SnapshotId)
+	taken := aws.TimeValue(out.StartTime)
+	if err := d.waitUntilSnapshotCompleted(ctx, d.ec2, snap); err != nil {
+		return err
+	}
+
+	// Copy it to the other region, and keep only the copy.
+	if region != d.awsRegion {
+		input := &ec2.CopySnapshotInput{
+			SourceSnapshotId: aws.String(snap),
+			SourceRegion:     aws.String(d.awsRegion),
+			Description:      aws.String("blocker replication of " + name),
+			TagSpecifications: []*ec2.TagSpecification{{
+				ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+				Tags:         ownedTags(tags...),
+			}},
+		}
+		if key := GetConfig().Replication.KMSKey; key != "" {
+			input.Encrypted = aws.Bool(true)
+			input.KmsKeyId = aws.String(key)
+		} else if aws.BoolValue(vol.Encrypted) {
+			// KMS keys don't leave their region, so the copy can't keep
+			// the volume's.
+			input.Encrypted = aws.Bool(true)
+			LogCtxWarn(ctx, "\tThe copy of %v is re-encrypted with the default EBS key in %v; "+
+				"set replication.kms_key to choose one.\n", name, region)
+		}
+		copied, err := svc.CopySnapshotWithContext(ctx, input, d.awsOpts(ctx)...)
+		if err != nil {
+			return err
+		}
+		LogCtx(ctx, "\tCopying snapshot %v to %v in %v...\n", snap, aws.StringValue(copied.SnapshotId), region)
+		if err := d.waitUntilSnapshotCompleted(ctx, svc, aws.StringValue(copied.SnapshotId)); err != nil {
+			return err
+		}
+		if _, err := d.ec2.DeleteSnapshotWithContext(ctx, &ec2.DeleteSnapshotInput{
+			SnapshotId: aws.String(snap),
+		}, d.awsOpts(ctx)...); err != nil {
+			LogCtxWarn(ctx, "\tDeleting local snapshot %v failed: %v\n", snap, err)
+		}
+		snap = aws.StringValue(copied.SnapshotId)
+	}
+
+	// Make the new copy, as the volume is, with its settings, before
+	// throwing the old one away.
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(zone),
+		SnapshotId:       aws.String(snap),
+		VolumeType:       vol.VolumeType,
+		Iops:             vol.Iops,
+		Throughput:       vol.Throughput,
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeVolume),
+			Tags:         ownedTags(append(copyTags(vol.Tags), newTag(tagCopyOf, id))...),
+		}},
+	}
+	switch aws.StringValue(input.VolumeType) {
+	case ec2.VolumeTypeGp3:
+	case ec2.VolumeTypeIo1, ec2.VolumeTypeIo2:
+		input.Throughput = nil
+	default:
+		input.Iops, input.Throughput = nil, nil
+	}
+	created, err := svc.CreateVolumeWithContext(ctx, input, d.awsOpts(ctx)...)
+	if err != nil {
+		return err
+	}
+	copyId := aws.StringValue(created.VolumeId)
+	if err := d.waitUntilCopyAvailable(ctx, svc, copyId); err != nil {
+		return err
+	}
+	LogCtx(ctx, "\tMade copy %v of %v in %v from %v.\n", copyId, name, zone, snap)
+
+	for _, c := range previous {
+		old := aws.StringValue(c.VolumeId)
+		if _, err := svc.DeleteVolumeWithContext(ctx, &ec2.DeleteVolumeInput{
+			VolumeId: aws.String(old),
+		}, d.awsOpts(ctx)...); err != nil {
+			LogCtxWarn(ctx, "\tDeleting the old copy %v failed: %v\n", old, err)
+		}
+	}
+	d.pruneCopySnapshots(ctx, svc, id, snap)
+
+	SetGauge(float64(taken.Unix()), "blocker_replication_snapshot_timestamp_seconds",
+		d.volumeLabels(name)...)
+	publishEvent(ctx, VolumeEvent{Type: eventReplicated, Name: name, VolumeId: copyId})
+	return nil
+}
+
+// copiesOf finds a volume's copies, in svc's region.
+func (d *EbsVolumeDriver) copiesOf(ctx context.Context, svc ec2iface.EC2API, id string) ([]*ec2.Volume, error) {
+	out, err := svc.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: ownedFilters(newFilter("tag:"+tagCopyOf, id)),
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+	return out.Volumes, nil
+}
+
+// copyTags are the tags of a volume its copies carry too: its name, its
+// options, and those it was given with the tags option.
+func copyTags(tags []*ec2.Tag) []*ec2.Tag {
+	var kept []*ec2.Tag
+	for _, t := range tags {
+		key := aws.StringValue(t.Key)
+		if key == tagOptions || !(strings.HasPrefix(key, "blocker:") || strings.HasPrefix(key, "aws:")) {
+			kept = append(kept, newTag(key, aws.StringValue(t.Value)))
+		}
+	}
+	return kept
+}
+
+// pruneCopySnapshots deletes the snapshots made for a volume's copies in
+// svc's region, but for the latest, keep.
+func (d *EbsVolumeDriver) pruneCopySnapshots(ctx context.Context, svc ec2iface.EC2API, id string, keep string) {
+	out, err := svc.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters:  ownedFilters(newFilter("tag:"+tagCopyOf, id)),
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		LogCtxWarn(ctx, "\tListing old replication snapshots failed: %v\n", err)
+		return
+	}
+	for _, snap := range out.Snapshots {
+		if sid := aws.StringValue(snap.SnapshotId); sid != keep {
+			if _, err := svc.DeleteSnapshotWithContext(ctx, &ec2.DeleteSnapshotInput{
+				SnapshotId: aws.String(sid),
+			}, d.awsOpts(ctx)...); err != nil {
+				LogCtxWarn(ctx, "\tDeleting old replication snapshot %v failed: %v\n", sid, err)
+			}
+		}
+	}
+}
+
+// waitUntilCopyAvailable polls, using svc for the copy's region, until a new
+// copy is ready.
+func (d *EbsVolumeDriver) waitUntilCopyAvailable(ctx context.Context, svc ec2iface.EC2API, id string) error {
+	timeouts := GetConfig().Timeouts
+	deadline := time.Now().Add(time.Duration(timeouts.StateWait))
+	for {
+		out, err := svc.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(id)},
+		}, d.awsOpts(ctx)...)
+		if err != nil {
+			return err
+		}
+		if len(out.Volumes) != 1 {
+			return errorf(CodeNotFound, "Volume %v not found.", id)
+		}
+		switch state := aws.StringValue(out.Volumes[0].State); state {
+		case ec2.VolumeStateAvailable:
+			return nil
+		case ec2.VolumeStateError:
+			return fmt.Errorf("Copy %v failed: its state is %v.", id, state)
+		}
+		if time.Now().After(deadline) {
+			return errorf(CodeAttachTimeout, "Copy %v still isn't available.", id)
+		}
+		if err := sleep(ctx, time.Duration(timeouts.StatePoll)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package driver
+
+import (
+	"context"
+	"sort"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Report summarizes the EBS volumes blocker manages, for capacity and cost
+// reviews.  Those are the volumes this daemon knows of, plus any carrying
+// blocker's tags (within its namespace, if it has one), wherever they are.
+type Report struct {
+	Volumes  int
+	TotalGiB int64
+	// ByType totals the volumes by EBS volume type.
+	ByType map[string]ReportTotals
+	// Unattached totals the volumes attached nowhere, which cost money
+	// without being used: candidates for cleanup.
+	Unattached ReportTotals
+	// Details lists every volume, sorted by name.
+	Details []ReportVolume
+}
+
+type ReportTotals struct {
+	Volumes  int
+	TotalGiB int64
+}
+
+type ReportVolume struct {
+	Name     string
+	VolumeId string
+	Type     string
+	SizeGiB  int64
+	// State is the EBS state, e.g. available or in-use.
+	State string
+	// InstanceId is the instance the volume is attached to, if any.
+	InstanceId string `json:",omitempty"`
+	// Mountpoint, UsedGiB, and UsedPercent are only known for volumes
+	// mounted on this host.
+	Mountpoint  string  `json:",omitempty"`
+	UsedGiB     float64 `json:",omitempty"`
+	UsedPercent float64 `json:",omitempty"`
+}
+
+// Report builds the report.
+func (d *EbsVolumeDriver) Report(ctx context.Context) (Report, error) {
+	d.mu.Lock()
+	known := map[string]string{}
+	mounted := map[string]string{}
+	for name, v := range d.volumes {
+		if v.id == "" {
+			continue
+		}
+		known[v.id] = name
+		if v.mountpoint != "" {
+			mounted[v.id] = v.mountpoint
+		}
+	}
+	d.mu.Unlock()
+
+	volumes := map[string]*ec2.Volume{}
+	collect := func(out *ec2.DescribeVolumesOutput, _ bool) bool {
+		for _, vol := range out.Volumes {
+			volumes[aws.StringValue(vol.VolumeId)] = vol
+		}
+		return true
+	}
+	if err := d.ec2.DescribeVolumesPagesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: ownedFilters(newFilter("tag-key", "blocker:*")),
+	}, collect, d.awsOpts(ctx)...); err != nil {
+		return Report{}, err
+	}
+	if len(known) > 0 {
+		var ids []string
+		for id := range known {
+			ids = append(ids, id)
+		}
+		if err := d.ec2.DescribeVolumesPagesWithContext(ctx, &ec2.DescribeVolumesInput{
+			Filters: []*ec2.Filter{newFilter("volume-id", ids...)},
+		}, collect, d.awsOpts(ctx)...); err != nil {
+			return Report{}, err
+		}
+	}
+
+	report := Report{ByType: map[string]ReportTotals{}, Details: []ReportVolume{}}
+	for id, vol := range volumes {
+		rv := ReportVolume{
+			Name:     known[id],
+			VolumeId: id,
+			Type:     aws.StringValue(vol.VolumeType),
+			SizeGiB:  aws.Int64Value(vol.Size),
+			State:    aws.StringValue(vol.State),
+		}
+		if rv.Name == "" {
+			rv.Name = tagValue(vol.Tags, "Name")
+		}
+		for _, a := range vol.Attachments {
+			rv.InstanceId = aws.StringValue(a.InstanceId)
+		}
+		if mnt, ok := mounted[id]; ok {
+			rv.Mountpoint = mnt
+			var fs syscall.Statfs_t
+			if err := syscall.Statfs(mnt, &fs); err != nil {
+				LogCtxWarn(ctx, "\tChecking usage of %v failed: %v\n", mnt, err)
+			} else if total := fs.Blocks * uint64(fs.Bsize); total > 0 {
+				used := (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
+				rv.UsedGiB = float64(used) / (1 << 30)
+				rv.UsedPercent = 100 * float64(used) / float64(total)
+			}
+		}
+
+		report.Volumes++
+		report.TotalGiB += rv.SizeGiB
+		t := report.ByType[rv.Type]
+		t.Volumes++
+		t.TotalGiB += rv.SizeGiB
+		report.ByType[rv.Type] = t
+		if rv.State == ec2.VolumeStateAvailable {
+			report.Unattached.Volumes++
+			report.Unattached.TotalGiB += rv.SizeGiB
+		}
+		report.Details = append(report.Details, rv)
+	}
+	sort.Slice(report.Details, func(i, j int) bool {
+		a, b := report.Details[i], report.Details[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.VolumeId < b.VolumeId
+	})
+	return report, nil
+}
@@ -0,0 +1,80 @@
+package driver
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// deviceLetter extracts the drive letter from an EC2 device name such as
+// "/dev/sda1", "sdf", or "xvdb", returning "" for names it doesn't recognize
+// (NVMe names, for instance, don't follow the lettering scheme).
+func deviceLetter(name string) string {
+	name = strings.TrimPrefix(name, "/dev/")
+	for _, prefix := range []string{"xvd", "sd", "hd"} {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		if len(rest) == 0 || rest[0] < 'a' || rest[0] > 'z' {
+			return ""
+		}
+		if strings.Trim(rest[1:], "0123456789") != "" {
+			return ""
+		}
+		return rest[:1]
+	}
+	return ""
+}
+
+// findReservedDevices works out which device letters are already spoken for:
+// the root device, the AMI's block device mappings (including instance-store
+// volumes), and anything attached to the instance at startup.  Attaching over
+// one of these could be catastrophic on customized AMIs, so we avoid them
+// even if they're within the configured range.
+func (d *EbsVolumeDriver) findReservedDevices(ctx context.Context) map[string]string {
+	reserved := make(map[string]string)
+	reserve := func(name string, why string) {
+		if l := deviceLetter(name); l != "" {
+			if _, ok := reserved[l]; !ok {
+				reserved[l] = why
+				LogCtx(ctx, "\tReserving device letter %v (%v: %v)\n", l, why, name)
+			}
+		}
+	}
+
+	// The metadata service knows the AMI's mappings, including ephemerals.
+	if d.ec2meta != nil {
+		if keys, err := d.ec2meta.GetMetadata("block-device-mapping/"); err == nil {
+			for _, key := range strings.Fields(keys) {
+				key = strings.TrimSuffix(key, "/")
+				if name, err := d.ec2meta.GetMetadata(
+					"block-device-mapping/" + key); err == nil {
+					reserve(name, key)
+				}
+			}
+		} else {
+			LogCtxError(ctx, "Reading block device mappings from metadata failed: %v\n", err)
+		}
+	}
+
+	// EC2 knows the root device and what's attached right now.
+	out, err := d.ec2.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(d.awsInstanceId)},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		LogCtxError(ctx, "Describing instance %v failed: %v\n", d.awsInstanceId, err)
+		return reserved
+	}
+	for _, r := range out.Reservations {
+		for _, inst := range r.Instances {
+			reserve(aws.StringValue(inst.RootDeviceName), "root")
+			for _, m := range inst.BlockDeviceMappings {
+				reserve(aws.StringValue(m.DeviceName), "attached")
+			}
+		}
+	}
+	return reserved
+}
@@ -0,0 +1,55 @@
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+func TestDeviceLetter(t *testing.T) {
+	got := map[string]string{}
+	for _, name := range []string{"/dev/sda1", "sdf", "/dev/xvdb", "hdc", "/dev/sdf12",
+		"/dev/nvme0n1", "/dev/sd", "/dev/sdfx"} {
+		got[name] = deviceLetter(name)
+	}
+	want := map[string]string{"/dev/sda1": "a", "sdf": "f", "/dev/xvdb": "b", "hdc": "c",
+		"/dev/sdf12": "f", "/dev/nvme0n1": "", "/dev/sd": "", "/dev/sdfx": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("deviceLetter = %v, want %v", got, want)
+	}
+}
+
+// instanceEC2 describes an instance with the given root device and other
+// block device mappings.
+type instanceEC2 struct {
+	ec2iface.EC2API
+	root     string
+	mappings []string
+}
+
+func (e instanceEC2) DescribeInstancesWithContext(ctx aws.Context, in *ec2.DescribeInstancesInput,
+	opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	inst := &ec2.Instance{InstanceId: in.InstanceIds[0], RootDeviceName: aws.String(e.root)}
+	for _, m := range e.mappings {
+		inst.BlockDeviceMappings = append(inst.BlockDeviceMappings,
+			&ec2.InstanceBlockDeviceMapping{DeviceName: aws.String(m)})
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{inst}}}}, nil
+}
+
+func TestFindReservedDevices(t *testing.T) {
+	d := newTestDriver(t)
+	d.awsInstanceId = "i-0123456789abcdef0"
+	d.ec2 = instanceEC2{root: "/dev/xvda", mappings: []string{"/dev/xvda", "/dev/sdf", "xvdg", "/dev/nvme1n1"}}
+
+	reserved := d.findReservedDevices(context.Background())
+	want := map[string]string{"a": "root", "f": "attached", "g": "attached"}
+	if !reflect.DeepEqual(reserved, want) {
+		t.Errorf("findReservedDevices() = %v, want %v", reserved, want)
+	}
+}
@@ -0,0 +1,83 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// isVolumeId reports whether a name is already an EBS volume ID.
+func isVolumeId(name string) bool {
+	return strings.HasPrefix(name, "vol-")
+}
+
+// resolveVolumeId maps a Docker volume name to an EBS volume ID.  Names which
+// are already volume IDs are used as-is; anything else is looked up by its
+// EBS Name tag.  Returns "" if no volume has that name.
+func (d *EbsVolumeDriver) resolveVolumeId(ctx context.Context, name string) (string, error) {
+	if isVolumeId(name) {
+		return name, nil
+	}
+
+	out, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: ownedFilters(newFilter("tag:Name", name)),
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return "", err
+	}
+	candidates := out.Volumes
+	if len(candidates) == 0 {
+		return "", nil
+	}
+
+	// Prefer volumes we can actually attach: those in our availability zone,
+	// and among those, ones not attached elsewhere.  Ties go to the oldest
+	// volume (then the lowest ID), so that every host makes the same choice.
+	rank := func(v *ec2.Volume) int {
+		r := 0
+		if aws.StringValue(v.AvailabilityZone) == d.awsAvailabilityZone {
+			r += 2
+		}
+		if aws.StringValue(v.State) == ec2.VolumeStateAvailable {
+			r += 1
+		}
+		return r
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if ra, rb := rank(a), rank(b); ra != rb {
+			return ra > rb
+		}
+		ta, tb := aws.TimeValue(a.CreateTime), aws.TimeValue(b.CreateTime)
+		if !ta.Equal(tb) {
+			return ta.Before(tb)
+		}
+		return aws.StringValue(a.VolumeId) < aws.StringValue(b.VolumeId)
+	})
+
+	best := candidates[0]
+	id := aws.StringValue(best.VolumeId)
+	if zone := aws.StringValue(best.AvailabilityZone); zone != d.awsAvailabilityZone {
+		return "", errorf(CodeAZMismatch,
+			"Volume %v (%v) is in availability zone %v, but this instance is in %v.",
+			name, id, zone, d.awsAvailabilityZone)
+	}
+	if len(candidates) > 1 {
+		var others []string
+		for _, c := range candidates[1:] {
+			others = append(others, fmt.Sprintf("%v (%v, %v)",
+				aws.StringValue(c.VolumeId), aws.StringValue(c.AvailabilityZone),
+				aws.StringValue(c.State)))
+		}
+		LogCtx(ctx, "\tName %v matches %v volumes; chose %v (%v, %v) over %v.\n",
+			name, len(candidates), id, aws.StringValue(best.AvailabilityZone),
+			aws.StringValue(best.State), strings.Join(others, ", "))
+	} else {
+		LogCtx(ctx, "\tResolved name %v to %v.\n", name, id)
+	}
+	return id, nil
+}
@@ -0,0 +1,60 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// A mistyped volume ID in a compose file could name the instance's own root
+// volume, which is attached already: blocker would happily adopt it, and
+// later unmount, detach, or (were it ever blank) format the OS disk.  So the
+// root volume, found from the instance's block device mappings, is refused
+// whatever it's called.
+
+// rootVolume finds the EBS volume the instance boots from, or "" if it boots
+// from instance store.  It's looked up once, when first needed.
+func (d *EbsVolumeDriver) rootVolume(ctx context.Context) (string, error) {
+	d.rootMu.Lock()
+	defer d.rootMu.Unlock()
+	if d.rootKnown {
+		return d.rootId, nil
+	}
+
+	out, err := d.ec2.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(d.awsInstanceId)},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return "", fmt.Errorf("Finding this instance's root volume failed: %v", err)
+	}
+	for _, r := range out.Reservations {
+		for _, inst := range r.Instances {
+			root := aws.StringValue(inst.RootDeviceName)
+			for _, m := range inst.BlockDeviceMappings {
+				if aws.StringValue(m.DeviceName) == root && m.Ebs != nil {
+					d.rootId = aws.StringValue(m.Ebs.VolumeId)
+				}
+			}
+		}
+	}
+	d.rootKnown = true
+	return d.rootId, nil
+}
+
+// refuseRoot fails if an EBS volume is the instance's root volume.
+func (d *EbsVolumeDriver) refuseRoot(ctx context.Context, id string) error {
+	if id == "" {
+		return nil
+	}
+	root, err := d.rootVolume(ctx)
+	if err != nil {
+		return err
+	}
+	if id == root {
+		return errorf(CodeInvalidOption,
+			"Volume %v is this instance's root volume; refusing to touch it.", id)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	// saturationPeriod is the CloudWatch period examined, in seconds.
+	saturationPeriod = 60
+	// modifyCooldown is how long EBS makes us wait between modifications
+	// of the same volume.
+	modifyCooldown = 6 * time.Hour
+	// gp3 baselines, which are free, and its limits.
+	gp3BaseIops       = 3000
+	gp3BaseThroughput = 125
+)
+
+func init() {
+	DescribeMetric("blocker_volume_saturated_total",
+		"Times a mounted volume's queue was found saturated, by volume.")
+	DescribeMetric("blocker_volume_remediations_total",
+		"Automatic IOPS/throughput increases made to saturated volumes, by volume.")
+}
+
+// saturationLoop watches the CloudWatch queue length of mounted volumes and
+// reports those which stay saturated.  Optionally, saturated gp3 volumes have
+// their provisioned IOPS and throughput raised (within configured caps).
+func (d *EbsVolumeDriver) saturationLoop(ctx context.Context) {
+	for {
+		interval := time.Duration(GetConfig().Saturation.Interval)
+		if interval <= 0 {
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+		if sleep(ctx, interval) != nil {
+			return
+		}
+
+		d.mu.Lock()
+		targets := make(map[string]string)
+		for name, v := range d.volumes {
+			if v.mountpoint != "" && !v.temporary {
+				targets[name] = v.id
+			}
+		}
+		d.mu.Unlock()
+
+		for name, id := range targets {
+			if err := d.checkSaturation(ctx, name, id); err != nil {
+				LogCtxError(ctx, "Checking saturation of %v (%v) failed: %v\n", name, id, err)
+			}
+		}
+	}
+}
+
+// sustainedQueueLength returns the lowest per-minute average queue length of
+// a volume over the configured window; if even that is above the threshold,
+// the volume has been saturated throughout.
+func (d *EbsVolumeDriver) sustainedQueueLength(ctx context.Context, id string) (float64, bool, error) {
+	window := time.Duration(GetConfig().Saturation.Window)
+	end := time.Now()
+	stats, err := d.cloudwatch.GetMetricStatisticsWithContext(ctx,
+		&cloudwatch.GetMetricStatisticsInput{
+			Namespace:  aws.String("AWS/EBS"),
+			MetricName: aws.String("VolumeQueueLength"),
+			Dimensions: []*cloudwatch.Dimension{{
+				Name: aws.String("VolumeId"), Value: aws.String(id),
+			}},
+			StartTime:  aws.Time(end.Add(-window)),
+			EndTime:    aws.Time(end),
+			Period:     aws.Int64(saturationPeriod),
+			Statistics: []*string{aws.String(cloudwatch.StatisticAverage)},
+		}, d.awsOpts(ctx)...)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Demand most of the window be present, so a gap isn't mistaken for a
+	// sustained problem.
+	want := int(window.Seconds()/saturationPeriod) * 3 / 4
+	if len(stats.Datapoints) == 0 || len(stats.Datapoints) < want {
+		return 0, false, nil
+	}
+	lowest := -1.0
+	for _, p := range stats.Datapoints {
+		if avg := aws.Float64Value(p.Average); lowest < 0 || avg < lowest {
+			lowest = avg
+		}
+	}
+	return lowest, true, nil
+}
+
+func (d *EbsVolumeDriver) checkSaturation(ctx context.Context, name string, id string) error {
+	c := GetConfig().Saturation
+	queue, ok, err := d.sustainedQueueLength(ctx, id)
+	if err != nil || !ok || queue < c.QueueLength {
+		return err
+	}
+
+	IncCounter("blocker_volume_saturated_total", d.volumeLabels(name)...)
+	msg := fmt.Sprintf("Volume %v (%v) has had a queue length of at least %.1f for %v.",
+		name, id, queue, time.Duration(c.Window))
+	LogCtxError(ctx, "%v\n", msg)
+	publishEvent(ctx, VolumeEvent{Type: eventSaturated, Name: name, VolumeId: id, Err: msg})
+	if !c.Remediate || readOnlyMode() {
+		return nil
+	}
+	if !maintenanceOpen() {
+		// It'll still be saturated then, if it needs remediating.
+		IncCounter("blocker_maintenance_deferred_total", "work", "remediation")
+		LogCtx(ctx, "Deferring remediation of %v until a maintenance window.\n", id)
+		return nil
+	}
+	return d.remediate(ctx, name, id)
+}
+
+// remediate doubles a saturated gp3 volume's IOPS and throughput, up to the
+// configured caps.
+func (d *EbsVolumeDriver) remediate(ctx context.Context, name string, id string) error {
+	c := GetConfig().Saturation
+	d.mu.Lock()
+	last := d.remediated[id]
+	d.mu.Unlock()
+	if time.Since(last) < modifyCooldown {
+		LogCtx(ctx, "Not remediating %v again until %v.\n",
+			id, last.Add(modifyCooldown).Format(time.RFC3339))
+		return nil
+	}
+
+	vol, err := d.describeVolume(ctx, id)
+	if err != nil {
+		return err
+	}
+	if t := aws.StringValue(vol.VolumeType); t != ec2.VolumeTypeGp3 {
+		LogCtx(ctx, "Not remediating %v: only gp3 volumes are tuned, and it's %v.\n", id, t)
+		return nil
+	}
+
+	iops, throughput := aws.Int64Value(vol.Iops), aws.Int64Value(vol.Throughput)
+	if iops == 0 {
+		iops = gp3BaseIops
+	}
+	if throughput == 0 {
+		throughput = gp3BaseThroughput
+	}
+	newIops := min(iops*2, c.MaxIops)
+	newThroughput := min(throughput*2, c.MaxThroughput)
+	if newIops <= iops && newThroughput <= throughput {
+		LogCtxError(ctx, "Volume %v is already at its caps (%v IOPS, %v MiB/s).\n",
+			id, iops, throughput)
+		return nil
+	}
+
+	input := &ec2.ModifyVolumeInput{VolumeId: aws.String(id)}
+	if newIops > iops {
+		input.Iops = aws.Int64(newIops)
+	}
+	if newThroughput > throughput {
+		input.Throughput = aws.Int64(newThroughput)
+	}
+	if _, err := d.ec2.ModifyVolumeWithContext(ctx, input, d.awsOpts(ctx)...); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.remediated[id] = time.Now()
+	d.mu.Unlock()
+	IncCounter("blocker_volume_remediations_total", d.volumeLabels(name)...)
+	LogCtx(ctx, "Raised %v (%v) from %v IOPS, %v MiB/s to %v IOPS, %v MiB/s.\n",
+		name, id, iops, throughput, max(iops, newIops), max(throughput, newThroughput))
+	return nil
+}
@@ -0,0 +1,101 @@
+package driver
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Schedulers place services by constraints on their nodes' labels, knowing
+// nothing of where the services' volumes are: a service whose EBS volume is
+// in us-east-1a is no use on a host in us-east-1b.  So List and Get report
+// each volume's scope labels in its Status (Labels): blocker.az,
+// blocker.type, blocker.encrypted, and blocker.size (in GiB).  Its
+// Constraints are the same as Swarm placement constraints, e.g.
+// node.labels.blocker.az==us-east-1a, which hold on nodes labelled with
+// their availability zone (`docker node update --label-add
+// blocker.az=us-east-1a ...`).  The labels are read from EBS when a volume
+// is attached, or the first time it's listed, and remembered.  Volumes
+// without an EBS volume yet have none.
+
+// scopeLabels are the scope labels of an EBS volume.
+func scopeLabels(vol *ec2.Volume) map[string]string {
+	return map[string]string{
+		"blocker.az":        aws.StringValue(vol.AvailabilityZone),
+		"blocker.type":      aws.StringValue(vol.VolumeType),
+		"blocker.encrypted": strconv.FormatBool(aws.BoolValue(vol.Encrypted)),
+		"blocker.size":      strconv.FormatInt(aws.Int64Value(vol.Size), 10),
+	}
+}
+
+// scopeConstraints are the placement constraints for a volume with the given
+// scope labels.  Only its availability zone constrains where it can be used.
+func scopeConstraints(labels map[string]string) []string {
+	var constraints []string
+	for _, key := range []string{"blocker.az"} {
+		if value := labels[key]; value != "" {
+			constraints = append(constraints, "node.labels."+key+"=="+value)
+		}
+	}
+	return constraints
+}
+
+// scopeStatus adds a volume's scope labels and constraints to its status.
+func scopeStatus(status map[string]interface{}, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	status["Labels"] = labels
+	status["Constraints"] = scopeConstraints(labels)
+}
+
+// fillScopes reads the scope labels of the volumes which have EBS volumes but
+// no labels yet, a batch at a time.  Volumes EBS no longer has are left
+// with none, rather than being looked for again.
+func (d *EbsVolumeDriver) fillScopes(ctx context.Context) error {
+	byId := map[string]*ebsVolume{}
+	d.mu.Lock()
+	for _, v := range d.volumes {
+		if v.id != "" && v.scope == nil {
+			byId[v.id] = v
+		}
+	}
+	d.mu.Unlock()
+	var ids []string
+	for id := range byId {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > tagCheckBatch {
+			batch = batch[:tagCheckBatch]
+		}
+		ids = ids[len(batch):]
+		// Filtering (rather than asking for the IDs) means a deleted
+		// volume is simply missing from the results.
+		out, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+			Filters: []*ec2.Filter{newFilter("volume-id", batch...)},
+		}, d.awsOpts(ctx)...)
+		if err != nil {
+			return err
+		}
+		d.update(func() {
+			for _, id := range batch {
+				if v := byId[id]; v.id == id && v.scope == nil {
+					v.scope = map[string]string{}
+				}
+			}
+			for _, vol := range out.Volumes {
+				if v, ok := byId[aws.StringValue(vol.VolumeId)]; ok && v.id == aws.StringValue(vol.VolumeId) {
+					v.scope = scopeLabels(vol)
+				}
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// scrubChunk is how much of a device is read at a time.
+const scrubChunk = 1 << 20
+
+func init() {
+	DescribeMetric("blocker_scrubs_total",
+		"Scrubs of mounted volumes, by volume and result.")
+	DescribeMetric("blocker_scrub_bad_blocks_total",
+		"Unreadable (or checksum failing) regions found by scrubbing, by volume.")
+}
+
+// scrubLoop periodically reads through every mounted volume, so that latent
+// bad blocks surface in the log (and metrics) before the application trips
+// over them.
+func (d *EbsVolumeDriver) scrubLoop(ctx context.Context) {
+	for {
+		interval := time.Duration(GetConfig().Scrub.Interval)
+		if interval <= 0 {
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+		if sleep(ctx, interval) != nil {
+			return
+		}
+		if awaitMaintenance(ctx, "scrub") != nil {
+			return
+		}
+		d.scrubAll(ctx)
+	}
+}
+
+type scrubTarget struct {
+	name, device, mountpoint string
+}
+
+func (d *EbsVolumeDriver) scrubAll(ctx context.Context) {
+	// Scrubbing takes a long time, so work from a copy of what's mounted.
+	var targets []scrubTarget
+	d.mu.Lock()
+	for name, v := range d.volumes {
+		if v.mountpoint != "" {
+			targets = append(targets, scrubTarget{name, v.device, v.mountpoint})
+		}
+	}
+	d.mu.Unlock()
+
+	for i, t := range targets {
+		if !maintenanceOpen() {
+			LogCtx(ctx, "The maintenance window closed; leaving %v volume(s) for the next scrub.\n",
+				len(targets)-i)
+			return
+		}
+		LogCtx(ctx, "Scrubbing %v (%v)...\n", t.name, t.device)
+		bad, err := scrub(ctx, t)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// If the volume was unmounted while we worked, errors mean nothing.
+		d.mu.Lock()
+		v, ok := d.volumes[t.name]
+		stillMounted := ok && v.device == t.device && v.mountpoint == t.mountpoint
+		d.mu.Unlock()
+		if !stillMounted {
+			LogCtx(ctx, "Volume %v was unmounted during its scrub.\n", t.name)
+			continue
+		}
+
+		result := "clean"
+		switch {
+		case err != nil:
+			result = "failed"
+			LogCtxError(ctx, "Scrubbing %v failed: %v\n", t.name, err)
+		case len(bad) > 0:
+			result = "errors"
+			for range bad {
+				IncCounter("blocker_scrub_bad_blocks_total", d.volumeLabels(t.name)...)
+			}
+			LogCtxError(ctx, "Scrubbing %v found %v bad region(s): %v\n",
+				t.name, len(bad), strings.Join(bad, ", "))
+			publishEvent(ctx, VolumeEvent{Type: eventError, Name: t.name,
+				Device: t.device, Mountpoint: t.mountpoint,
+				Err: fmt.Sprintf("Scrub found %v bad region(s).", len(bad))})
+		default:
+			LogCtx(ctx, "Scrubbing %v found no errors.\n", t.name)
+		}
+		IncCounter("blocker_scrubs_total", d.volumeLabels(t.name, "result", result)...)
+	}
+}
+
+// scrub checks one mounted volume, returning descriptions of any bad regions.
+// Filesystems with their own checksums (btrfs and ZFS) are asked to scrub
+// themselves, which verifies data rather than just readability; anything
+// else has its block device read end to end.  It gives up once ctx is done.
+func scrub(ctx context.Context, t scrubTarget) ([]string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+	m := findMountpoint(mounts, t.mountpoint)
+	if m == nil {
+		return nil, fmt.Errorf("%v is not mounted.", t.mountpoint)
+	}
+
+	switch m.FSType {
+	case "btrfs":
+		// -B waits for completion, and -c 3 uses the idle I/O class.
+		out, err := exec.CommandContext(ctx, "btrfs", "scrub", "start", "-B", "-c", "3",
+			t.mountpoint).CombinedOutput()
+		if err != nil {
+			return []string{strings.TrimSpace(string(out))}, nil
+		}
+		return nil, nil
+	case "zfs":
+		pool := strings.SplitN(m.Source, "/", 2)[0]
+		out, err := exec.CommandContext(ctx, "zpool", "scrub", "-w", pool).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("zpool scrub %v failed: %v\n%v", pool, err, string(out))
+		}
+		out, err = exec.Command("zpool", "status", "-x", pool).CombinedOutput()
+		if err != nil || !strings.Contains(string(out), "is healthy") {
+			return []string{strings.TrimSpace(string(out))}, nil
+		}
+		return nil, nil
+	}
+	return readDevice(ctx, t.device, GetConfig().Scrub.RateMiB)
+}
+
+// readDevice reads a whole block device at no more than rateMiB MiB/s (if
+// positive), at idle I/O priority, returning the offsets which couldn't be
+// read.  It gives up once ctx is done.
+func readDevice(ctx context.Context, dev string, rateMiB int) ([]string, error) {
+	// I/O priorities belong to threads, so pin ourselves to one.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	setIdleIOPriority()
+
+	f, err := os.Open(dev)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var bad []string
+	buf := make([]byte, scrubChunk)
+	var perChunk time.Duration
+	if rateMiB > 0 {
+		perChunk = time.Second * scrubChunk / time.Duration(rateMiB<<20)
+	}
+	for off := int64(0); ; off += scrubChunk {
+		start := time.Now()
+		n, err := f.ReadAt(buf, off)
+		if err == io.EOF && n < scrubChunk {
+			break
+		}
+		if err != nil && err != io.EOF {
+			bad = append(bad, fmt.Sprintf("%v@%d", dev, off))
+		}
+		if rest := perChunk - time.Since(start); rest > 0 {
+			if err := sleep(ctx, rest); err != nil {
+				return nil, err
+			}
+		} else if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return bad, nil
+}
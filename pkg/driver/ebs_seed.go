@@ -0,0 +1,265 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// A volume with the seed option (`-o seed=s3://bucket/prefix`, or the name of
+// a tarball in seed.dir) is filled with that content at its first mount, once
+// its new filesystem is mounted but before the mount is handed to Docker, so
+// that applications find their config and fixtures there without an init
+// container.  The objects under the prefix are copied with their keys (less
+// the prefix) as paths; a tarball is extracted, compressed or not.  Either is
+// unpacked into a staging directory on the volume and only then moved into
+// place, and the volume is tagged blocker:seeded once it's done, so a seed
+// which fails (failing the mount) is tried afresh at the next mount, and a
+// seeded volume is never seeded again.  Only filesystems with nothing in them
+// (bar lost+found) are seeded.
+
+func init() {
+	DescribeMetric("blocker_seeds_total",
+		"Volumes seeded with initial content, by source (s3 or tar) and result.")
+}
+
+// seedStaging is the directory on a volume that its seed is unpacked into.
+const seedStaging = ".blocker-seed"
+
+// seedSource is where a volume's initial content comes from.
+type seedSource struct {
+	// Bucket and Prefix name the S3 objects to copy, or Tarball the local
+	// tarball to extract.
+	Bucket  string
+	Prefix  string
+	Tarball string
+}
+
+func (s seedSource) kind() string {
+	if s.Tarball != "" {
+		return "tar"
+	}
+	return "s3"
+}
+
+func (s seedSource) String() string {
+	if s.Tarball != "" {
+		return s.Tarball
+	}
+	return "s3://" + s.Bucket + "/" + s.Prefix
+}
+
+// seed parses the volume's seed option; nil means it has none.  Tarballs must
+// be in seed.dir, and relative names are taken to be there.
+func (v *ebsVolume) seed() (*seedSource, error) {
+	s := v.opts["seed"]
+	if s == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(s, "s3://") {
+		parts := strings.SplitN(strings.TrimPrefix(s, "s3://"), "/", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("Invalid seed %q: expected s3://<bucket>/<prefix>.", s)
+		}
+		source := &seedSource{Bucket: parts[0]}
+		if len(parts) == 2 && parts[1] != "" {
+			source.Prefix = strings.TrimSuffix(parts[1], "/") + "/"
+		}
+		return source, nil
+	}
+	dir := GetConfig().Seed.Dir
+	if dir == "" {
+		return nil, fmt.Errorf("Invalid seed %q: only s3://<bucket>/<prefix> may be given, "+
+			"since seed.dir isn't configured.", s)
+	}
+	path := s
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("Invalid seed %q: tarballs must be in %v.", s, dir)
+	}
+	return &seedSource{Tarball: path}, nil
+}
+
+// seedIfEmpty fills a volume's freshly mounted filesystem with its seed, if
+// it has one and the filesystem is empty and has never been seeded.
+func (d *EbsVolumeDriver) seedIfEmpty(ctx context.Context, v *ebsVolume, mnt string, mo mountOptions) error {
+	source, err := v.seed()
+	if err != nil || source == nil {
+		return err
+	}
+	empty, err := emptyFilesystem(mnt)
+	if err != nil || !empty {
+		return err
+	}
+	vol, err := d.describeVolume(ctx, v.id)
+	if err != nil {
+		return err
+	}
+	if seeded := tagValue(vol.Tags, tagSeeded); seeded != "" {
+		LogCtxDebug(ctx, "\tVolume %v was seeded from %v already; leaving it empty.\n", v.id, seeded)
+		return nil
+	}
+
+	LogCtx(ctx, "\tSeeding %v from %v...\n", v.id, source)
+	err = d.seedFilesystem(ctx, source, mnt, mo)
+	if err == nil {
+		_, err = d.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+			Resources: []*string{aws.String(v.id)},
+			Tags:      []*ec2.Tag{newTag(tagSeeded, source.String())},
+		}, d.awsOpts(ctx)...)
+	}
+	if err != nil {
+		IncCounter("blocker_seeds_total", "source", source.kind(), "result", "failure")
+		return fmt.Errorf("Seeding %v from %v failed: %v", v.id, source, err)
+	}
+	IncCounter("blocker_seeds_total", "source", source.kind(), "result", "success")
+	LogCtx(ctx, "\tSeeded %v from %v.\n", v.id, source)
+	return nil
+}
+
+// emptyFilesystem reports whether a mounted filesystem holds nothing but
+// lost+found (and what's left of an interrupted seed).
+func emptyFilesystem(mnt string) (bool, error) {
+	entries, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Name() != "lost+found" && e.Name() != seedStaging {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// seedFilesystem unpacks a seed into a staging directory on the filesystem,
+// gives it the volume's owner (if it has one), and moves it into place.
+func (d *EbsVolumeDriver) seedFilesystem(ctx context.Context, source *seedSource, mnt string, mo mountOptions) error {
+	staging := filepath.Join(mnt, seedStaging)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.Mkdir(staging, 0755); err != nil {
+		return err
+	}
+	var err error
+	if source.Tarball != "" {
+		err = extractTarball(source.Tarball, staging)
+	} else {
+		err = d.downloadSeed(ctx, source, staging)
+	}
+	if err == nil {
+		err = mo.chownTree(staging)
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.Rename(filepath.Join(staging, e.Name()), filepath.Join(mnt, e.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(staging)
+}
+
+// extractTarball extracts a (possibly compressed) tarball into a directory.
+func extractTarball(tarball string, dir string) error {
+	if _, err := os.Stat(tarball); err != nil {
+		return err
+	}
+	if out, err := exec.Command("tar", "-x", "-f", tarball, "-C", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("Extracting %v failed: %v\n%v", tarball, err, string(out))
+	}
+	return nil
+}
+
+// downloadSeed copies the objects under an S3 prefix into a directory, at
+// their keys less the prefix.  Keys ending in / (folders, as the S3 console
+// makes them) become empty directories.
+func (d *EbsVolumeDriver) downloadSeed(ctx context.Context, source *seedSource, dir string) error {
+	svc := d.s3Client(GetConfig().Seed.Region)
+	downloader := s3manager.NewDownloaderWithClient(svc)
+	var keys []string
+	err := svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(source.Bucket),
+		Prefix: aws.String(source.Prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			keys = append(keys, aws.StringValue(o.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("Nothing was found under %v.", source)
+	}
+
+	for _, key := range keys {
+		rel := strings.TrimPrefix(key, source.Prefix)
+		if rel == "" {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if r, err := filepath.Rel(dir, path); err != nil || strings.HasPrefix(r, "..") {
+			return fmt.Errorf("Object %v would be written outside the volume.", key)
+		}
+		if strings.HasSuffix(key, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = downloader.DownloadWithContext(ctx, f, &s3.GetObjectInput{
+			Bucket: aws.String(source.Bucket),
+			Key:    aws.String(key),
+		})
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("Downloading s3://%v/%v failed: %v", source.Bucket, key, err)
+		}
+	}
+	return nil
+}
+
+// chownTree applies the configured owner to everything under a directory.
+func (mo mountOptions) chownTree(dir string) error {
+	if mo.UID == "" && mo.GID == "" {
+		return nil
+	}
+	uid, gid := mo.owner()
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
@@ -0,0 +1,362 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// createVolumeFromSnapshot provisions a new EBS volume in our availability
+// zone from the snapshot named in the options, waiting until it's ready to
+// attach.  If a KMS key is given, the snapshot is first copied and
+// re-encrypted with it, which is how snapshots shared from other accounts
+// (encrypted with their keys) are made usable here.  Otherwise the volume is
+// encrypted as the snapshot is (see inheritEncryption).
+func (d *EbsVolumeDriver) createVolumeFromSnapshot(
+	ctx context.Context, name string, opts map[string]string) (string, error) {
+	snapshot := opts["snapshot"]
+	source := snapshot
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(d.awsAvailabilityZone),
+	}
+	spec, err := parseVolumeSpec(opts)
+	if err != nil {
+		return "", err
+	}
+	spec.apply(input)
+	if key := opts["kms-key"]; key != "" {
+		if snapshot, err = d.copySnapshot(ctx, snapshot, key); err != nil {
+			return "", err
+		}
+		input.Encrypted = aws.Bool(true)
+		input.KmsKeyId = aws.String(key)
+	} else if err := d.inheritEncryption(ctx, snapshot, opts, input); err != nil {
+		return "", err
+	}
+	input.SnapshotId = aws.String(snapshot)
+	tags := ownedTags(
+		newTag("Name", name),
+		newTag(tagTemporary, "true"),
+		newTag(tagSnapshot, source),
+		newTag(tagCreatedBy, d.awsInstanceId),
+	)
+	// Record where the data came from, for Lineage.
+	if parent, err := d.snapshotParent(ctx, source); err != nil {
+		LogCtxWarn(ctx, "\tFinding the parent of snapshot %v failed: %v\n", source, err)
+	} else if parent != "" {
+		tags = append(tags, newTag(tagParentVolume, parent))
+	}
+	input.TagSpecifications = []*ec2.TagSpecification{{
+		ResourceType: aws.String(ec2.ResourceTypeVolume),
+		Tags:         tags,
+	}}
+
+	vol, err := d.ec2.CreateVolumeWithContext(ctx, input, d.awsOpts(ctx)...)
+	if err != nil {
+		return "", d.keyError(ctx, "created", "", aws.StringValue(input.KmsKeyId), err)
+	}
+
+	id := aws.StringValue(vol.VolumeId)
+	LogCtx(ctx, "\tCreated temporary EBS volume %v from %v.\n", id, snapshot)
+	// Once made, the volume is waited for even if the request is cancelled,
+	// so that it's deleted (or used) rather than left behind.
+	cleanup := context.WithoutCancel(ctx)
+	if err := d.waitUntilAvailable(cleanup, id); err != nil {
+		err = d.keyError(ctx, "created", id, "", err)
+		d.deleteVolume(cleanup, id)
+		return "", err
+	}
+	return id, nil
+}
+
+// copySnapshot makes a copy of a (possibly foreign) snapshot in this account,
+// encrypted with the given KMS key, and returns its ID.  Copies are tagged
+// with their source so that later mounts can reuse them.
+func (d *EbsVolumeDriver) copySnapshot(ctx context.Context, snapshot string, key string) (string, error) {
+	existing, err := d.ec2.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters: ownedFilters(
+			newFilter("tag:"+tagCopiedFrom, snapshot),
+			newFilter("status", ec2.SnapshotStateCompleted),
+		),
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return "", err
+	}
+	for _, snap := range existing.Snapshots {
+		if aws.StringValue(snap.KmsKeyId) == key ||
+			strings.HasSuffix(aws.StringValue(snap.KmsKeyId), "/"+key) {
+			id := aws.StringValue(snap.SnapshotId)
+			LogCtx(ctx, "\tReusing copy %v of snapshot %v.\n", id, snapshot)
+			return id, nil
+		}
+	}
+
+	out, err := d.ec2.CopySnapshotWithContext(ctx, &ec2.CopySnapshotInput{
+		SourceSnapshotId: aws.String(snapshot),
+		SourceRegion:     aws.String(d.awsRegion),
+		Encrypted:        aws.Bool(true),
+		KmsKeyId:         aws.String(key),
+		Description:      aws.String("blocker copy of " + snapshot),
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+			Tags:         ownedTags(newTag(tagCopiedFrom, snapshot)),
+		}},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return "", err
+	}
+
+	id := aws.StringValue(out.SnapshotId)
+	LogCtx(ctx, "\tCopying snapshot %v to %v, re-encrypted with %v...\n", snapshot, id, key)
+	if err := d.waitUntilSnapshotCompleted(ctx, d.ec2, id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// waitUntilSnapshotCompleted polls (using svc, for the snapshot's region)
+// until a snapshot finishes.  Snapshots and copies take much longer than
+// volume state changes, so this has its own timeout.
+func (d *EbsVolumeDriver) waitUntilSnapshotCompleted(ctx context.Context, svc ec2iface.EC2API, id string) error {
+	timeouts := GetConfig().Timeouts
+	deadline := time.Now().Add(time.Duration(timeouts.SnapshotWait))
+	for {
+		snapshots, err := svc.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(id)},
+		}, d.awsOpts(ctx)...)
+		if err != nil {
+			return err
+		}
+		if len(snapshots.Snapshots) != 1 {
+			return errorf(CodeNotFound, "Snapshot %v not found.", id)
+		}
+
+		snap := snapshots.Snapshots[0]
+		switch aws.StringValue(snap.State) {
+		case ec2.SnapshotStateCompleted:
+			return nil
+		case ec2.SnapshotStateError:
+			return fmt.Errorf("Snapshot %v failed.", id)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for snapshot %v (%v).",
+				id, aws.StringValue(snap.Progress))
+		}
+
+		LogCtx(ctx, "\tWaiting for snapshot %v to complete (%v)...\n",
+			id, aws.StringValue(snap.Progress))
+		if err := sleep(ctx, time.Duration(timeouts.StatePoll)); err != nil {
+			return err
+		}
+	}
+}
+
+// cleanupTemporary deletes the EBS volume behind a snapshot mount, once it
+// has been detached.  Other volumes are left alone.
+func (d *EbsVolumeDriver) cleanupTemporary(ctx context.Context, v *ebsVolume) error {
+	if !v.temporary {
+		return nil
+	}
+
+	// Detaching is asynchronous, and attached volumes can't be deleted.
+	if err := d.waitUntilAvailable(ctx, v.id); err != nil {
+		return err
+	}
+	if err := d.deleteVolume(ctx, v.id); err != nil {
+		return err
+	}
+	d.update(func() {
+		v.id = ""
+		v.temporary = false
+	})
+	return nil
+}
+
+func (d *EbsVolumeDriver) deleteVolume(ctx context.Context, id string) error {
+	if _, err := d.ec2.DeleteVolumeWithContext(ctx, &ec2.DeleteVolumeInput{
+		VolumeId: aws.String(id),
+	}, d.awsOpts(ctx)...); err != nil {
+		return err
+	}
+
+	LogCtx(ctx, "\tDeleted EBS volume %v.\n", id)
+	return nil
+}
+
+// Timestamp formats accepted in point-in-time requests, most precise first.
+var pointInTimeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+}
+
+// findSnapshotAt resolves a point-in-time request of the form
+// "vol-x@2024-05-01T00:00Z" to the newest completed snapshot of the volume
+// taken at or before that time.
+func (d *EbsVolumeDriver) findSnapshotAt(ctx context.Context, from string) (string, error) {
+	parts := strings.SplitN(from, "@", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "vol-") {
+		return "", errorf(CodeInvalidOption,
+			"Invalid point-in-time %q; expected vol-id@timestamp.", from)
+	}
+	source := parts[0]
+
+	var at time.Time
+	var err error
+	for _, format := range pointInTimeFormats {
+		if at, err = time.Parse(format, parts[1]); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", errorf(CodeInvalidOption, "Invalid timestamp %q in %q.", parts[1], from)
+	}
+
+	snapshots, err := d.ec2.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		Filters: []*ec2.Filter{
+			newFilter("volume-id", source),
+			newFilter("status", ec2.SnapshotStateCompleted),
+		},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return "", err
+	}
+
+	var best *ec2.Snapshot
+	for _, snap := range snapshots.Snapshots {
+		start := aws.TimeValue(snap.StartTime)
+		if start.After(at) {
+			continue
+		}
+		if best == nil || start.After(aws.TimeValue(best.StartTime)) {
+			best = snap
+		}
+	}
+	if best == nil {
+		return "", errorf(CodeNotFound, "No snapshot of %v exists from before %v.",
+			source, at.Format(time.RFC3339))
+	}
+
+	id := aws.StringValue(best.SnapshotId)
+	LogCtx(ctx, "\tResolved %v to snapshot %v taken %v.\n",
+		from, id, aws.TimeValue(best.StartTime).Format(time.RFC3339))
+	return id, nil
+}
+
+// SnapshotInfo summarizes one EBS snapshot for listing.
+type SnapshotInfo struct {
+	SnapshotId  string
+	VolumeId    string
+	StartTime   time.Time
+	SizeGiB     int64
+	State       string
+	Progress    string
+	Description string
+}
+
+// Snapshots lists the restore points for a volume, newest first: snapshots
+// of its EBS volume, plus any tagged as belonging to it (which covers
+// snapshots of earlier incarnations of the same named volume).
+func (d *EbsVolumeDriver) Snapshots(ctx context.Context, name string) ([]SnapshotInfo, error) {
+	d.mu.Lock()
+	v, exists := d.volumes[name]
+	var id string
+	if exists && !v.temporary {
+		id = v.id
+	}
+	d.mu.Unlock()
+	if !exists {
+		return nil, errNameNotFound
+	}
+
+	var queries []*ec2.DescribeSnapshotsInput
+	if id != "" {
+		queries = append(queries, &ec2.DescribeSnapshotsInput{
+			Filters: []*ec2.Filter{newFilter("volume-id", id)},
+		})
+	}
+	queries = append(queries, &ec2.DescribeSnapshotsInput{
+		Filters: ownedFilters(newFilter("tag:"+tagVolume, name)),
+	})
+
+	seen := make(map[string]bool)
+	infos := []SnapshotInfo{}
+	for _, q := range queries {
+		snapshots, err := d.ec2.DescribeSnapshotsWithContext(ctx, q, d.awsOpts(ctx)...)
+		if err != nil {
+			return nil, err
+		}
+		for _, snap := range snapshots.Snapshots {
+			snapId := aws.StringValue(snap.SnapshotId)
+			if seen[snapId] {
+				continue
+			}
+			seen[snapId] = true
+			infos = append(infos, SnapshotInfo{
+				SnapshotId:  snapId,
+				VolumeId:    aws.StringValue(snap.VolumeId),
+				StartTime:   aws.TimeValue(snap.StartTime),
+				SizeGiB:     aws.Int64Value(snap.VolumeSize),
+				State:       aws.StringValue(snap.State),
+				Progress:    aws.StringValue(snap.Progress),
+				Description: aws.StringValue(snap.Description),
+			})
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartTime.After(infos[j].StartTime)
+	})
+	return infos, nil
+}
+
+// snapshotOnRemove reports whether the volume should be snapshotted when
+// Docker removes it, according to its snapshot-on-remove option.
+func (v *ebsVolume) snapshotOnRemove() (bool, error) {
+	s, ok := v.opts["snapshot-on-remove"]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for snapshot-on-remove: %q.", s)
+	}
+	return b, nil
+}
+
+// snapshotIfRequested takes a snapshot of a volume being removed, if its
+// options ask for one, so that its data can be restored later (see the
+// restore option).  The removal fails if the snapshot can't be started, but
+// needn't wait for it to complete: EBS finishes it even if the volume is
+// then deleted.
+func (d *EbsVolumeDriver) snapshotIfRequested(ctx context.Context, name string, v *ebsVolume) error {
+	if snap, _ := v.snapshotOnRemove(); !snap || v.id == "" || v.temporary {
+		return nil
+	}
+	var out *ec2.Snapshot
+	err := queueSnapshot(ctx, func() (err error) {
+		out, err = d.ec2.CreateSnapshotWithContext(ctx, &ec2.CreateSnapshotInput{
+			VolumeId:    aws.String(v.id),
+			Description: aws.String("blocker snapshot of " + name + " on removal"),
+			TagSpecifications: []*ec2.TagSpecification{{
+				ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+				Tags:         ownedTags(newTag("Name", name), newTag(tagVolume, name)),
+			}},
+		}, d.awsOpts(ctx)...)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Snapshotting %v before removing it failed: %v", v.id, err)
+	}
+	LogCtx(ctx, "\tSnapshotting EBS volume %v as %v before removing it.\n",
+		v.id, aws.StringValue(out.SnapshotId))
+	return nil
+}
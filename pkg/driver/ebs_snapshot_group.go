@@ -0,0 +1,114 @@
+package driver
+
+import (
+	"context"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Applications whose data spans several volumes (a database's data and its
+// write-ahead log, say) need those volumes snapshotted at the same instant,
+// or a restore finds them out of step.  Volumes created with the same
+// snapshot-group option form a group, which `blocker snapshot-group` (see
+// SnapshotGroup) snapshots with EBS's multi-volume CreateSnapshots: the
+// snapshots are crash-consistent with one another, as if the instance had
+// lost power.
+
+// GroupSnapshot is one of the snapshots taken of a group.
+type GroupSnapshot struct {
+	Name       string
+	VolumeId   string
+	SnapshotId string
+}
+
+// SnapshotGroup snapshots every volume in the named group at once, returning
+// the snapshots started.  Every volume in the group must be mounted (or
+// prefetched) here.  The snapshots are tagged with the group and with their
+// volume's name, so they're listed by Snapshots like any other.
+func (d *EbsVolumeDriver) SnapshotGroup(ctx context.Context, group string) ([]GroupSnapshot, error) {
+	members := map[string]string{}
+	d.mu.Lock()
+	for name, v := range d.volumes {
+		if v.opts["snapshot-group"] != group {
+			continue
+		}
+		if v.device == "" {
+			d.mu.Unlock()
+			return nil, errorf(CodeNotMounted,
+				"Volume %v of snapshot group %v isn't attached here.", name, group)
+		}
+		members[v.id] = name
+	}
+	d.mu.Unlock()
+	if group == "" || len(members) == 0 {
+		return nil, errorf(CodeNotFound, "No volumes are in snapshot group %q.", group)
+	}
+
+	// CreateSnapshots takes every volume attached to the instance, bar those
+	// excluded, so exclude everything outside the group.
+	attached, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{newFilter("attachment.instance-id", d.awsInstanceId)},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+	var exclude []*string
+	for _, vol := range attached.Volumes {
+		if _, ok := members[aws.StringValue(vol.VolumeId)]; !ok {
+			exclude = append(exclude, vol.VolumeId)
+		}
+	}
+
+	LogCtx(ctx, "Snapshotting group %v (%v volume(s))...\n", group, len(members))
+	var out *ec2.CreateSnapshotsOutput
+	err = queueSnapshot(ctx, func() (err error) {
+		out, err = d.ec2.CreateSnapshotsWithContext(ctx, &ec2.CreateSnapshotsInput{
+			Description: aws.String("blocker snapshot of group " + group),
+			InstanceSpecification: &ec2.InstanceSpecification{
+				InstanceId:           aws.String(d.awsInstanceId),
+				ExcludeBootVolume:    aws.Bool(true),
+				ExcludeDataVolumeIds: exclude,
+			},
+			TagSpecifications: []*ec2.TagSpecification{{
+				ResourceType: aws.String(ec2.ResourceTypeSnapshot),
+				Tags:         ownedTags(newTag(tagSnapshotGroup, group)),
+			}},
+		}, d.awsOpts(ctx)...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []GroupSnapshot{}
+	for _, snap := range out.Snapshots {
+		id, snapId := aws.StringValue(snap.VolumeId), aws.StringValue(snap.SnapshotId)
+		name := members[id]
+		delete(members, id)
+		if _, err := d.ec2.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+			Resources: []*string{snap.SnapshotId},
+			Tags:      []*ec2.Tag{newTag("Name", name), newTag(tagVolume, name)},
+		}, d.awsOpts(ctx)...); err != nil {
+			LogCtxWarn(ctx, "\tTagging snapshot %v failed: %v\n", snapId, err)
+		}
+		LogCtx(ctx, "\tStarted snapshot %v of %v (%v).\n", snapId, name, id)
+		snapshots = append(snapshots, GroupSnapshot{Name: name, VolumeId: id, SnapshotId: snapId})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name < snapshots[j].Name
+	})
+
+	// A volume detached in the meantime is simply missing from the result.
+	if len(members) > 0 {
+		var missing []string
+		for _, name := range members {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return snapshots, errorf(CodeNotMounted,
+			"Snapshot group %v is incomplete; no longer attached: %v.", group, missing)
+	}
+	return snapshots, nil
+}
@@ -0,0 +1,113 @@
+package driver
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Snapshot storms (a batch snapshot of every volume, cron jobs on every host
+// firing at once, or a fleet removing snapshot-on-remove volumes together)
+// run into EC2's limits on CreateSnapshot, and the snapshots it refuses are
+// backups missed.  So every snapshot blocker takes goes through one queue:
+// at most snapshots.concurrency CreateSnapshot(s) calls at once, starting at
+// most snapshots.rate a second.  Calls EC2 throttles anyway are retried, up
+// to snapshots.retries times, waiting a second before the first retry and
+// doubling it (give or take half) each time.  Scheduled snapshots, those
+// batch operations take, first wait a random delay of up to
+// snapshots.jitter, so that hosts whose schedules fire together spread out.
+
+func init() {
+	DescribeMetric("blocker_snapshot_throttled_total",
+		"CreateSnapshot calls EC2 throttled, by outcome (retried or failed).")
+	DescribeMetric("blocker_snapshot_queue_seconds",
+		"How long snapshots waited in the queue before being started.")
+}
+
+// snapshotQueue limits the concurrency and rate of CreateSnapshot(s) calls.
+var snapshotQueue struct {
+	sync.Mutex
+	// slots holds a token for each call under way; it's replaced when the
+	// concurrency is reconfigured.
+	slots chan struct{}
+	limit *rateLimiter
+	rate  int
+}
+
+// snapshotSlots returns the queue's slots and rate limiter, as configured.
+func snapshotSlots() (chan struct{}, *rateLimiter) {
+	c := GetConfig().Snapshots
+	snapshotQueue.Lock()
+	defer snapshotQueue.Unlock()
+	if snapshotQueue.slots == nil || cap(snapshotQueue.slots) != c.Concurrency {
+		snapshotQueue.slots = make(chan struct{}, c.Concurrency)
+	}
+	if snapshotQueue.limit == nil || snapshotQueue.rate != c.Rate {
+		snapshotQueue.limit, snapshotQueue.rate = newRateLimiter(c.Rate), c.Rate
+	}
+	return snapshotQueue.slots, snapshotQueue.limit
+}
+
+// waitSnapshotRate waits until the rate limiter lets another call start.
+func waitSnapshotRate(ctx context.Context, limit *rateLimiter) error {
+	for {
+		snapshotQueue.Lock()
+		ok, _ := limit.allow(time.Now())
+		snapshotQueue.Unlock()
+		if ok {
+			return nil
+		}
+		if err := sleep(ctx, time.Second/time.Duration(limit.rate)); err != nil {
+			return err
+		}
+	}
+}
+
+// queueSnapshot makes a CreateSnapshot(s) call when the queue allows,
+// retrying it while EC2 throttles it.
+func queueSnapshot(ctx context.Context, create func() error) error {
+	start := time.Now()
+	slots, limit := snapshotSlots()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-slots }()
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if err := waitSnapshotRate(ctx, limit); err != nil {
+			return err
+		}
+		if attempt == 0 {
+			ObserveDuration(time.Since(start), "blocker_snapshot_queue_seconds")
+		}
+		err := create()
+		if ErrorCodeOf(err) != CodeAwsThrottled {
+			return err
+		}
+		if attempt >= GetConfig().Snapshots.Retries {
+			IncCounter("blocker_snapshot_throttled_total", "outcome", "failed")
+			return err
+		}
+		IncCounter("blocker_snapshot_throttled_total", "outcome", "retried")
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		LogCtxWarn(ctx, "\tSnapshot throttled by EC2; retrying in %v: %v\n", wait.Round(time.Millisecond), err)
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// snapshotJitter delays a scheduled snapshot by a random part of
+// snapshots.jitter.
+func snapshotJitter(ctx context.Context) error {
+	jitter := time.Duration(GetConfig().Snapshots.Jitter)
+	if jitter <= 0 {
+		return nil
+	}
+	return sleep(ctx, time.Duration(rand.Int63n(int64(jitter))))
+}
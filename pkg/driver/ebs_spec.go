@@ -0,0 +1,212 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// volumeSpec describes the EBS volume to provision, as given by the "type",
+// "size", "iops", "throughput", and "multi-attach" options.  Zero values mean
+// "let EBS (or the snapshot) decide".
+type volumeSpec struct {
+	Type       string
+	SizeGiB    int64
+	Iops       int64
+	Throughput int64
+	// MultiAttach enables EBS Multi-Attach, which only io1 and io2 volumes
+	// have.
+	MultiAttach bool
+}
+
+// hddVolumeTypes describes the throughput-optimized and cold HDD types, which
+// have constraints the SSD types don't.
+var hddVolumeTypes = map[string]struct {
+	// baselineMiBPerTiB is the baseline throughput per TiB of size.
+	baselineMiBPerTiB int64
+}{
+	ec2.VolumeTypeSt1: {40},
+	ec2.VolumeTypeSc1: {12},
+}
+
+// volumeLimits are the sizes, IOPS, and throughput a volume type allows.
+// Zero IOPS or throughput limits mean the type can't be provisioned with
+// them.
+type volumeLimits struct {
+	minSizeGiB, maxSizeGiB int64
+	minIops, maxIops       int64
+	// iopsPerGiB caps the IOPS for the volume's size, above baselineIops,
+	// which every size gets.
+	iopsPerGiB   int64
+	baselineIops int64
+	// iopsRequired means the IOPS must be given.
+	iopsRequired                 bool
+	minThroughput, maxThroughput int64
+	// iopsPerMiB is how many IOPS each MiB/s of throughput needs.
+	iopsPerMiB int64
+}
+
+// volumeTypeLimits are the limits of each EBS volume type.  io2 volumes are
+// all Block Express now, up to 64 TiB and 256,000 IOPS, and need a Nitro
+// instance to reach those.
+var volumeTypeLimits = map[string]volumeLimits{
+	ec2.VolumeTypeGp2: {minSizeGiB: 1, maxSizeGiB: 16384},
+	ec2.VolumeTypeGp3: {minSizeGiB: 1, maxSizeGiB: 16384,
+		minIops: 3000, maxIops: 16000, iopsPerGiB: 500, baselineIops: 3000,
+		minThroughput: 125, maxThroughput: 1000, iopsPerMiB: 4},
+	ec2.VolumeTypeIo1: {minSizeGiB: 4, maxSizeGiB: 16384,
+		minIops: 100, maxIops: 64000, iopsPerGiB: 50, iopsRequired: true},
+	ec2.VolumeTypeIo2: {minSizeGiB: 4, maxSizeGiB: 65536,
+		minIops: 100, maxIops: 256000, iopsPerGiB: 1000, iopsRequired: true},
+	ec2.VolumeTypeSt1:      {minSizeGiB: hddMinSizeGiB, maxSizeGiB: 16384},
+	ec2.VolumeTypeSc1:      {minSizeGiB: hddMinSizeGiB, maxSizeGiB: 16384},
+	ec2.VolumeTypeStandard: {minSizeGiB: 1, maxSizeGiB: 1024},
+}
+
+const (
+	hddMinSizeGiB = 125
+	// maxSizeGiB is the largest size of any type (io2 Block Express).
+	maxSizeGiB = 65536
+	// hddSmallSizeGiB is the size below which HDD throughput is poor enough
+	// that we warn about it.
+	hddSmallSizeGiB = 500
+)
+
+func parseVolumeSpec(opts map[string]string) (volumeSpec, error) {
+	spec := volumeSpec{Type: opts["type"]}
+	for _, f := range []struct {
+		key string
+		dst *int64
+	}{
+		{"size", &spec.SizeGiB},
+		{"iops", &spec.Iops},
+		{"throughput", &spec.Throughput},
+	} {
+		s, ok := opts[f.key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			return spec, fmt.Errorf("Invalid value for %v: %q.", f.key, s)
+		}
+		*f.dst = n
+	}
+	if s, ok := opts["multi-attach"]; ok {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return spec, fmt.Errorf("Invalid value for multi-attach: %q.", s)
+		}
+		spec.MultiAttach = b
+	}
+	return spec, spec.validate()
+}
+
+func (s volumeSpec) validate() error {
+	if s.SizeGiB > maxSizeGiB {
+		return fmt.Errorf("Volumes can be at most %v GiB (requested %v).",
+			maxSizeGiB, s.SizeGiB)
+	}
+	if s.MultiAttach && s.Type != ec2.VolumeTypeIo1 && s.Type != ec2.VolumeTypeIo2 {
+		return fmt.Errorf("Only io1 and io2 volumes can be Multi-Attach; add type=io2.")
+	}
+	if s.Type == "" {
+		// EBS picks the type, and checks the rest.
+		return nil
+	}
+	limits, ok := volumeTypeLimits[s.Type]
+	if !ok {
+		return fmt.Errorf("Unknown volume type %q.", s.Type)
+	}
+
+	if s.SizeGiB != 0 && s.SizeGiB < limits.minSizeGiB {
+		if _, isHDD := hddVolumeTypes[s.Type]; isHDD {
+			return fmt.Errorf(
+				"%v volumes must be at least %v GiB (requested %v); "+
+					"use gp3 for smaller volumes.", s.Type, limits.minSizeGiB, s.SizeGiB)
+		}
+		return fmt.Errorf("%v volumes must be at least %v GiB (requested %v).",
+			s.Type, limits.minSizeGiB, s.SizeGiB)
+	}
+	if s.SizeGiB > limits.maxSizeGiB {
+		hint := ""
+		if s.Type != ec2.VolumeTypeIo2 {
+			hint = "; io2 volumes can be up to 64 TiB"
+		}
+		return fmt.Errorf("%v volumes can be at most %v GiB (requested %v)%v.",
+			s.Type, limits.maxSizeGiB, s.SizeGiB, hint)
+	}
+
+	if hdd, isHDD := hddVolumeTypes[s.Type]; isHDD {
+		if s.Iops != 0 || s.Throughput != 0 {
+			return fmt.Errorf(
+				"%v volumes don't support provisioned IOPS or throughput; "+
+					"use gp3 or io2 instead.", s.Type)
+		}
+		if s.SizeGiB != 0 && s.SizeGiB < hddSmallSizeGiB {
+			Log("\tWarning: %v is built for large, sequential I/O; at %v GiB its "+
+				"baseline throughput is only %v MiB/s, and small random I/O "+
+				"(e.g. databases) will be slow.  Consider gp3.\n",
+				s.Type, s.SizeGiB, hdd.baselineMiBPerTiB*s.SizeGiB/1024)
+		}
+		return nil
+	}
+
+	switch {
+	case s.Iops == 0 && limits.iopsRequired:
+		return fmt.Errorf("%v volumes need an iops option (%v to %v).",
+			s.Type, limits.minIops, limits.maxIops)
+	case s.Iops != 0 && limits.maxIops == 0:
+		return fmt.Errorf("%v volumes don't support provisioned IOPS; use gp3 or io2 instead.", s.Type)
+	case s.Iops != 0 && (s.Iops < limits.minIops || s.Iops > limits.maxIops):
+		return fmt.Errorf("%v volumes take %v to %v IOPS (requested %v).",
+			s.Type, limits.minIops, limits.maxIops, s.Iops)
+	case s.Iops > limits.baselineIops && s.SizeGiB != 0 && s.Iops > limits.iopsPerGiB*s.SizeGiB:
+		// A size from a snapshot isn't known yet, and is left to EBS.
+		return fmt.Errorf("%v volumes take at most %v IOPS per GiB: %v IOPS needs at least %v GiB "+
+			"(requested %v).", s.Type, limits.iopsPerGiB, s.Iops,
+			(s.Iops+limits.iopsPerGiB-1)/limits.iopsPerGiB, s.SizeGiB)
+	}
+
+	if s.Throughput == 0 {
+		return nil
+	}
+	if limits.maxThroughput == 0 {
+		return fmt.Errorf("%v volumes don't support provisioned throughput; use gp3 instead.", s.Type)
+	}
+	if s.Throughput < limits.minThroughput || s.Throughput > limits.maxThroughput {
+		return fmt.Errorf("%v volumes take %v to %v MiB/s of throughput (requested %v).",
+			s.Type, limits.minThroughput, limits.maxThroughput, s.Throughput)
+	}
+	iops := s.Iops
+	if iops == 0 {
+		iops = limits.minIops
+	}
+	if s.Throughput*limits.iopsPerMiB > iops {
+		return fmt.Errorf("%v volumes need %v IOPS for each MiB/s of throughput: %v MiB/s needs "+
+			"at least %v IOPS (requested %v).", s.Type, limits.iopsPerMiB, s.Throughput,
+			s.Throughput*limits.iopsPerMiB, iops)
+	}
+	return nil
+}
+
+// apply fills in the parts of a CreateVolume request that the spec controls.
+func (s volumeSpec) apply(input *ec2.CreateVolumeInput) {
+	if s.Type != "" {
+		input.VolumeType = aws.String(s.Type)
+	}
+	if s.SizeGiB != 0 {
+		input.Size = aws.Int64(s.SizeGiB)
+	}
+	if s.Iops != 0 {
+		input.Iops = aws.Int64(s.Iops)
+	}
+	if s.Throughput != 0 {
+		input.Throughput = aws.Int64(s.Throughput)
+	}
+	if s.MultiAttach {
+		input.MultiAttachEnabled = aws.Bool(true)
+	}
+}
@@ -0,0 +1,45 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVolumeSpecValidate(t *testing.T) {
+	for _, tc := range []struct {
+		spec volumeSpec
+		err  string
+	}{
+		// Every gp3 volume gets 3000 IOPS, however small; only IOPS above
+		// that need the size.
+		{volumeSpec{Type: "gp3", SizeGiB: 1}, ""},
+		{volumeSpec{Type: "gp3", SizeGiB: 1, Iops: 3000}, ""},
+		{volumeSpec{Type: "gp3", SizeGiB: 8, Iops: 4000}, ""},
+		{volumeSpec{Type: "gp3", SizeGiB: 6, Iops: 3500}, "needs at least 7 GiB"},
+		{volumeSpec{Type: "gp3", SizeGiB: 100, Iops: 2000}, "take 3000 to 16000 IOPS"},
+
+		{volumeSpec{Type: "io1", SizeGiB: 100, Iops: 5000}, ""},
+		{volumeSpec{Type: "io1", SizeGiB: 100, Iops: 5001}, "at most 50 IOPS per GiB"},
+		{volumeSpec{Type: "io1", SizeGiB: 100}, "need an iops option"},
+		{volumeSpec{Type: "io2", SizeGiB: 10, Iops: 10000}, ""},
+		{volumeSpec{Type: "io2", SizeGiB: 10, Iops: 10001}, "at most 1000 IOPS per GiB"},
+		// A size from a snapshot isn't known yet.
+		{volumeSpec{Type: "io2", Iops: 64000}, ""},
+
+		{volumeSpec{Type: "gp3", SizeGiB: 100, Throughput: 125}, ""},
+		{volumeSpec{Type: "gp3", SizeGiB: 100, Throughput: 750}, ""},
+		{volumeSpec{Type: "gp3", SizeGiB: 100, Throughput: 1000}, "needs at least 4000 IOPS"},
+		{volumeSpec{Type: "gp3", SizeGiB: 100, Iops: 4000, Throughput: 1000}, ""},
+		{volumeSpec{Type: "gp3", SizeGiB: 100, Throughput: 1001}, "take 125 to 1000 MiB/s"},
+		{volumeSpec{Type: "gp2", SizeGiB: 100, Throughput: 250}, "don't support provisioned throughput"},
+		{volumeSpec{Type: "st1", SizeGiB: 1000, Iops: 3000}, "don't support provisioned IOPS"},
+	} {
+		err := tc.spec.validate()
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%+v: %v", tc.spec, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%+v: got %v, want an error mentioning %q", tc.spec, err, tc.err)
+		}
+	}
+}
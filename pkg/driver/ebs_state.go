@@ -0,0 +1,489 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// What the driver knows of its volumes is saved to the state file (see
+// Config.StateFile) after every operation, so that a restarted daemon picks
+// up where it left off: Docker's Unmount and Remove of volumes mounted before
+// the restart still work.  At startup the saved state is checked against EC2
+// and the mount table, and volumes which are attached and mounted under
+// mountRoot but missing from it (say, the state file was lost, or the
+// previous daemon predates it) are adopted too.
+//
+// Devices are named in the order the kernel finds them, which a reboot, or
+// stopping and starting the instance (especially on Nitro, where volumes are
+// NVMe devices), can change.  So the saved devices of volumes still attached
+// are looked up afresh by volume ID rather than trusted.  The state records the
+// boot it was saved in, so that mounts missing after a restart are expected
+// rather than alarming.
+//
+// The state is saved with its schema version and a checksum.  Files written
+// by older versions are migrated as they're read, but a file which is
+// corrupt, or written by a newer version, stops the daemon starting rather
+// than have it forget what's mounted; Options.RecoverState starts afresh
+// instead, keeping the bad file for inspection.
+
+// stateVersion is the version of the state file's schema we write.  Version 1
+// was the bare savedState, without a version or checksum.
+const stateVersion = 2
+
+// stateFile is the state file's contents.
+type stateFile struct {
+	Version int
+	// Checksum is the SHA-256 of State, in its compact form.
+	Checksum string
+	State    json.RawMessage
+}
+
+// savedVolume is a volume as recorded in the state file.
+type savedVolume struct {
+	Name        string
+	Id          string
+	Opts        map[string]string
+	Requested   map[string]string
+	Created     time.Time
+	EverMounted bool
+	Ephemeral   bool
+	Pinned      bool `json:",omitempty"`
+	Temporary   bool
+	Provisioned bool              `json:",omitempty"`
+	Mountpoint  string            `json:",omitempty"`
+	Device      string            `json:",omitempty"`
+	Prefetched  time.Time         `json:",omitempty"`
+	History     []HistoryEntry    `json:",omitempty"`
+	Users       map[string]int    `json:",omitempty"`
+	Maintenance string            `json:",omitempty"`
+	Expires     time.Time         `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
+}
+
+type savedState struct {
+	// BootId identifies the boot the state was saved in (see currentBootId).
+	BootId  string `json:",omitempty"`
+	Volumes []savedVolume
+}
+
+// stateMu serializes writes of the state file.
+var stateMu sync.Mutex
+
+// saveState writes the driver's state to the state file, if there is one.
+func (d *EbsVolumeDriver) saveState(ctx context.Context) {
+	path := GetConfig().StateFile
+	if path == "" {
+		return
+	}
+
+	d.mu.Lock()
+	state := savedState{BootId: currentBootId()}
+	for name, v := range d.volumes {
+		state.Volumes = append(state.Volumes, savedVolume{
+			Name:        name,
+			Id:          v.id,
+			Opts:        v.opts,
+			Requested:   v.requested,
+			Created:     v.created,
+			EverMounted: v.everMounted,
+			Ephemeral:   v.ephemeral,
+			Pinned:      v.pinnedTag,
+			Temporary:   v.temporary,
+			Provisioned: v.provisioned,
+			Mountpoint:  v.mountpoint,
+			Device:      v.device,
+			Prefetched:  v.prefetched,
+			History:     v.history,
+			Users:       v.users,
+			Maintenance: v.maintenance,
+			Expires:     v.expires,
+			Labels:      v.labels,
+		})
+	}
+	raw, err := json.Marshal(state)
+	d.mu.Unlock()
+	if err != nil {
+		LogCtxError(ctx, "Saving state failed: %v\n", err)
+		return
+	}
+	storeState(ctx, path, raw)
+}
+
+// storeState writes a state (marshalled while its driver's lock was held) to
+// the state file, with its version and checksum.
+func storeState(ctx context.Context, path string, raw []byte) {
+	data, err := json.MarshalIndent(stateFile{
+		Version:  stateVersion,
+		Checksum: stateChecksum(raw),
+		State:    raw,
+	}, "", "  ")
+	if err != nil {
+		LogCtxError(ctx, "Saving state failed: %v\n", err)
+		return
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if err := writeStateFile(path, data); err != nil {
+		LogCtxError(ctx, "Saving state failed: %v\n", err)
+	}
+}
+
+// writeStateFile writes the state file alongside and renames it into place,
+// syncing the file before the rename and its directory after, so that a crash
+// leaves either the old state or the new one, never a torn or empty file.
+func writeStateFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func stateChecksum(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// loadState reads the state file, if there is one, migrating it from older
+// versions.
+func loadState(ctx context.Context, path string) (savedState, error) {
+	var state savedState
+	if path == "" {
+		return state, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+
+	var file stateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return state, fmt.Errorf("%v is corrupt: %v", path, err)
+	}
+	switch {
+	case file.Version == 0:
+		LogCtx(ctx, "Migrating %v from version 1 of the state schema.\n", path)
+		if err := json.Unmarshal(data, &state); err != nil {
+			return state, fmt.Errorf("%v is corrupt: %v", path, err)
+		}
+		return state, nil
+	case file.Version > stateVersion:
+		return state, fmt.Errorf("%v has version %v of the state schema, but this blocker only understands up to version %v.",
+			path, file.Version, stateVersion)
+	}
+
+	var raw bytes.Buffer
+	if err := json.Compact(&raw, file.State); err != nil {
+		return state, fmt.Errorf("%v is corrupt: %v", path, err)
+	}
+	if sum := stateChecksum(raw.Bytes()); sum != file.Checksum {
+		return state, fmt.Errorf("%v is corrupt: its checksum is %v, but it should be %v.",
+			path, sum, file.Checksum)
+	}
+	if err := json.Unmarshal(raw.Bytes(), &state); err != nil {
+		return state, fmt.Errorf("%v is corrupt: %v", path, err)
+	}
+	return state, nil
+}
+
+// readState reads the state file at startup.  A state file which can't be
+// read is an error, unless recovering, in which case it's moved aside and we
+// start afresh.
+func readState(ctx context.Context, recovering bool) (savedState, error) {
+	path := GetConfig().StateFile
+	state, err := loadState(ctx, path)
+	if err == nil {
+		return state, nil
+	}
+	if !recovering {
+		return state, fmt.Errorf("Reading state failed: %v (start with -recover-state to start afresh, "+
+			"adopting whatever is still mounted)", err)
+	}
+	aside := path + ".bad-" + time.Now().UTC().Format("20060102T150405Z")
+	LogCtxError(ctx, "Reading state failed (starting afresh, and keeping the file as %v): %v\n",
+		aside, err)
+	if err := os.Rename(path, aside); err != nil {
+		LogCtxError(ctx, "Keeping %v failed: %v\n", path, err)
+	}
+	return savedState{}, nil
+}
+
+// restoreState rebuilds the driver's state at startup from the state file,
+// EC2, and the mount table, tidying up after volumes whose mounts didn't
+// survive, and reporting what it found as the startup reconciliation pass.
+func (d *EbsVolumeDriver) restoreState(ctx context.Context, recovering bool) error {
+	report := ReconcileReport{Pass: reconcileStartup, Started: time.Now()}
+	defer func() {
+		report.Duration = time.Since(report.Started)
+		d.recordReconcile(report)
+	}()
+	state, err := readState(ctx, recovering)
+	if err != nil {
+		return err
+	}
+	mounts, err := readMounts()
+	if err != nil {
+		LogCtxError(ctx, "Reading the mount table failed; not restoring state: %v\n", err)
+		report.Error = err.Error()
+		return nil
+	}
+	out, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{newFilter("attachment.instance-id", d.awsInstanceId)},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		LogCtxError(ctx, "Finding attached volumes failed; not restoring state: %v\n", err)
+		report.Error = err.Error()
+		return nil
+	}
+	attached := map[string]*ec2.Volume{}
+	for _, vol := range out.Volumes {
+		attached[aws.StringValue(vol.VolumeId)] = vol
+	}
+
+	rebooted := state.BootId != "" && state.BootId != currentBootId()
+	report.Rebooted = rebooted
+	if rebooted {
+		LogCtx(ctx, "The instance has restarted since the state was saved; finding volumes' devices afresh.\n")
+	}
+	known := map[string]bool{}
+	for _, s := range state.Volumes {
+		v := &ebsVolume{
+			id:          s.Id,
+			opts:        s.Opts,
+			requested:   s.Requested,
+			created:     s.Created,
+			everMounted: s.EverMounted,
+			ephemeral:   s.Ephemeral,
+			pinnedTag:   s.Pinned,
+			temporary:   s.Temporary,
+			provisioned: s.Provisioned,
+			mountpoint:  s.Mountpoint,
+			device:      s.Device,
+			prefetched:  s.Prefetched,
+			history:     s.History,
+			users:       s.Users,
+			maintenance: s.Maintenance,
+			expires:     s.Expires,
+			labels:      s.Labels,
+		}
+		if v.opts == nil {
+			v.opts = map[string]string{}
+		}
+		known[v.id] = true
+		report.Checked++
+		if found := d.restoreVolume(ctx, s.Name, v, attached[v.id], mounts, rebooted); found != nil {
+			report.Drift = append(report.Drift, *found)
+		}
+		d.volumes[s.Name] = v
+	}
+
+	// Adopt whatever else of ours is mounted.
+	for id, vol := range attached {
+		if known[id] || tagValue(vol.Tags, tagPoolHost) != "" {
+			continue
+		}
+		dev, err := findDeviceById(id)
+		if err != nil || dev == "" {
+			continue
+		}
+		found, err := findDeviceMounts(mounts, dev)
+		if err != nil {
+			continue
+		}
+		for _, m := range found {
+			if filepath.Dir(m.MountPoint) != mountRoot() {
+				continue
+			}
+			name := tagValue(vol.Tags, "Name")
+			if name == "" {
+				name = id
+			}
+			if _, ok := d.volumes[name]; ok {
+				name = id
+			}
+			d.volumes[name] = &ebsVolume{
+				id:          id,
+				opts:        layerOptions(GetConfig().DefaultOptions),
+				created:     time.Now(),
+				everMounted: true,
+				ephemeral:   isEphemeral(vol),
+				pinnedTag:   isPinned(vol),
+				temporary:   tagValue(vol.Tags, tagTemporary) == "true",
+				mountpoint:  m.MountPoint,
+				device:      dev,
+			}
+			d.unreserve(vol)
+			LogCtx(ctx, "Adopted volume %v (%v), mounted at %v.\n", name, id, m.MountPoint)
+			report.Adopted = append(report.Adopted, name)
+			break
+		}
+	}
+
+	// Mountpoints left behind by mounts which are gone.  Only empty
+	// directories are removed.
+	dirs, _ := filepath.Glob(filepath.Join(mountRoot(), "*"))
+	for _, dir := range dirs {
+		if findMountpoint(mounts, dir) == nil {
+			os.Remove(dir)
+		}
+	}
+	d.syncFstab(ctx)
+	d.saveState(ctx)
+	return nil
+}
+
+// restoreVolume checks a saved volume against what's attached and mounted,
+// fixing up its record (and tidying up EC2) where they differ, and returning
+// the drift, if any.  rebooted says whether the instance has restarted since
+// the state was saved.
+func (d *EbsVolumeDriver) restoreVolume(ctx context.Context, name string, v *ebsVolume,
+	vol *ec2.Volume, mounts []mountInfo, rebooted bool) *Drift {
+	if vol != nil {
+		d.unreserve(vol)
+	}
+	if v.mountpoint == "" && v.prefetched.IsZero() {
+		return nil
+	}
+	var found *Drift
+	if vol != nil {
+		if saved := v.device; d.refreshDevice(ctx, name, v) {
+			found = &Drift{Name: name, Kind: driftDeviceMoved,
+				Detail: fmt.Sprintf("the volume is now %v, not %v", v.device, saved), Action: "updated"}
+		}
+	}
+
+	if vol != nil && v.mountpoint != "" && findMountpoint(mounts, v.mountpoint) != nil {
+		LogCtx(ctx, "Restored volume %v (%v), mounted at %v.\n", name, v.id, v.mountpoint)
+		d.startAudit(ctx, name, v)
+		return found
+	}
+	if vol != nil && v.mountpoint == "" {
+		LogCtx(ctx, "Restored prefetched volume %v (%v) at %v.\n", name, v.id, v.device)
+		d.expirePrefetchAfter(ctx, name, v.prefetched)
+		return found
+	}
+
+	// The mount (or the attachment) didn't survive.  Put things back as if
+	// the volume had been unmounted.
+	if rebooted {
+		LogCtx(ctx, "Volume %v (%v) wasn't mounted again after the restart; detaching it.\n",
+			name, v.id)
+	} else {
+		LogCtxError(ctx, "Volume %v (%v) is no longer mounted at %v; detaching it.\n",
+			name, v.id, v.mountpoint)
+	}
+	if vol == nil {
+		found = &Drift{Name: name, Kind: driftDetached,
+			Detail: "EBS reports the volume is no longer attached to " + d.awsInstanceId, Action: "unmounted"}
+	} else {
+		found = &Drift{Name: name, Kind: driftUnmounted,
+			Detail: v.mountpoint + " is no longer mounted", Action: "detached"}
+	}
+	if rebooted {
+		found.Detail += " after the restart"
+	}
+	if v.mountpoint != "" {
+		if findMountpoint(mounts, v.mountpoint) != nil {
+			// Mounted, but the volume's gone from under it.
+			exec.Command("umount", forceUnmountFlag, v.mountpoint).Run()
+		}
+		os.Remove(v.mountpoint)
+	}
+	if vol != nil {
+		if err := d.detachVolume(ctx, v.id); err != nil {
+			LogCtxError(ctx, "Detaching %v failed: %v\n", v.id, err)
+			found.Error = err.Error()
+		}
+	}
+	d.releaseLease(ctx, v.id)
+	if err := d.cleanupTemporary(ctx, v); err != nil {
+		LogCtxError(ctx, "Deleting temporary volume %v failed: %v\n", v.id, err)
+		found.Error = err.Error()
+	}
+	v.mountpoint = ""
+	v.device = ""
+	v.prefetched = time.Time{}
+	v.users = nil
+	return found
+}
+
+// refreshDevice looks up the device of a volume attached here by its volume
+// ID, in case the device it was saved with now names another volume, or
+// nothing, and reports whether it changed.  A LUKS container's mapping is
+// named after the volume, so stays put.
+func (d *EbsVolumeDriver) refreshDevice(ctx context.Context, name string, v *ebsVolume) bool {
+	if v.device == "" || strings.HasPrefix(v.device, "/dev/mapper/") {
+		return false
+	}
+	dev, err := findDeviceById(v.id)
+	if err != nil || dev == "" {
+		if _, err := os.Lstat(v.device); err != nil {
+			LogCtxWarn(ctx, "Volume %v (%v) has no device by ID, and %v is gone.\n",
+				name, v.id, v.device)
+		}
+		return false
+	}
+	if dev == v.device {
+		return false
+	}
+	LogCtx(ctx, "Volume %v (%v) is now %v, not %v.\n", name, v.id, dev, v.device)
+	v.device = dev
+	return true
+}
+
+// unreserve turns the reservation of a volume attached before we started
+// into a claim, now that it's one of ours again, so that its device letter
+// can be reused once the volume is detached.
+func (d *EbsVolumeDriver) unreserve(vol *ec2.Volume) {
+	d.attachMu.Lock()
+	defer d.attachMu.Unlock()
+	for _, a := range vol.Attachments {
+		if aws.StringValue(a.InstanceId) == d.awsInstanceId {
+			if l := deviceLetter(aws.StringValue(a.Device)); l != "" {
+				delete(d.reserved, l)
+				d.claimed[l] = aws.StringValue(vol.VolumeId)
+			}
+		}
+	}
+}
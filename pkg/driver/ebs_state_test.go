@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// savedTestState saves a driver's state with one volume in it, returning the
+// state file's path and contents.
+func savedTestState(t *testing.T) (string, []byte) {
+	t.Helper()
+	d := newTestDriver(t)
+	path := filepath.Join(t.TempDir(), "state.json")
+	testConfig(t, func(c *Config) { c.StateFile = path })
+	d.volumes["data"] = &ebsVolume{
+		id:          "vol-0123456789abcdef0",
+		opts:        map[string]string{"size": "10"},
+		created:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		everMounted: true,
+		provisioned: true,
+		mountpoint:  "/mnt/blocker/data",
+		device:      "/dev/xvdf",
+	}
+	d.saveState(context.Background())
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	path, _ := savedTestState(t)
+	state, err := loadState(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Volumes) != 1 {
+		t.Fatalf("loaded %v volume(s), want 1", len(state.Volumes))
+	}
+	v := state.Volumes[0]
+	if v.Name != "data" || v.Id != "vol-0123456789abcdef0" || v.Opts["size"] != "10" ||
+		!v.EverMounted || !v.Provisioned || v.Mountpoint != "/mnt/blocker/data" ||
+		v.Device != "/dev/xvdf" {
+		t.Errorf("loaded %+v", v)
+	}
+}
+
+func TestStateChecksum(t *testing.T) {
+	path, data := savedTestState(t)
+	var reindented bytes.Buffer
+	if err := json.Indent(&reindented, data, "", "\t"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		corrupt bool
+	}{
+		{"as saved", data, false},
+		// The checksum covers the state's content, not its layout.
+		{"reindented", reindented.Bytes(), false},
+		{"edited", bytes.Replace(data, []byte("/dev/xvdf"), []byte("/dev/xvdg"), 1), true},
+		{"truncated", data[:len(data)/2], true},
+	} {
+		if err := ioutil.WriteFile(path, tc.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadState(context.Background(), path)
+		if tc.corrupt && (err == nil || !strings.Contains(err.Error(), "is corrupt")) {
+			t.Errorf("%v: loadState() = %v, want it to be corrupt", tc.name, err)
+		}
+		if !tc.corrupt && err != nil {
+			t.Errorf("%v: loadState() = %v", tc.name, err)
+		}
+	}
+}
+
+func TestStateVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	for _, tc := range []struct {
+		name    string
+		data    string
+		volumes int
+		err     string
+	}{
+		{"version 1", `{"Volumes": [{"Name": "data", "Id": "vol-0123456789abcdef0"}]}`, 1, ""},
+		{"newer", `{"Version": 3, "Checksum": "sha256:", "State": {}}`, 0, "version 3"},
+	} {
+		if err := ioutil.WriteFile(path, []byte(tc.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		state, err := loadState(context.Background(), path)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%v: loadState() = %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%v: loadState() = %v, want an error mentioning %q", tc.name, err, tc.err)
+		case len(state.Volumes) != tc.volumes:
+			t.Errorf("%v: loaded %v volume(s), want %v", tc.name, len(state.Volumes), tc.volumes)
+		}
+	}
+
+	// No state file is no state.
+	state, err := loadState(context.Background(), filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || len(state.Volumes) != 0 {
+		t.Errorf("loadState(missing) = %+v, %v", state, err)
+	}
+}
@@ -0,0 +1,39 @@
+package driver
+
+// In strict mode (see Config.Strict), for production hosts, nothing which
+// could destroy a volume's data is done unless the volume was created with
+// a confirm option naming it: formatting it, making a LUKS container on it,
+// forcibly detaching it from another instance, or deleting it as ephemeral.
+// The confirmation must be given at Create, since it's meant to be typed for
+// the one volume; defaults, profiles, and tags can't supply it.  Volumes
+// provisioned on demand have no ID until they exist, so they may be
+// confirmed with their name instead.
+
+// strictMode reports whether the daemon is in strict mode.
+func strictMode() bool {
+	return GetConfig().Strict
+}
+
+// confirmed checks that a destructive operation on a volume may go ahead:
+// that the daemon isn't in strict mode, or that the volume's confirm option
+// names it.
+func (v *ebsVolume) confirmed(name string, what string) error {
+	return v.confirmedBy(v.requested["confirm"], "-o confirm", name, what)
+}
+
+// confirmedBy checks a confirmation given some other way than the confirm
+// option, e.g. to an admin command; how says how it's given.
+func (v *ebsVolume) confirmedBy(c string, how string, name string, what string) error {
+	if !strictMode() {
+		return nil
+	}
+	if c != "" && (c == v.id || c == name) {
+		return nil
+	}
+	id := v.id
+	if id == "" {
+		id = name
+	}
+	return errorf(CodeUnconfirmed,
+		"This host is in strict mode; %v refused without %v=%v.", what, how, id)
+}
@@ -0,0 +1,121 @@
+package driver
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// stuckRetries is how many times a stuck attachment is forced off before we
+// give up and leave it for a human.
+const stuckRetries = 3
+
+func init() {
+	DescribeMetric("blocker_stuck_attachments_total",
+		"Attachments found stuck attaching or detaching at startup, by outcome.")
+}
+
+// transitional returns our attachment of the volume if it's part way through
+// attaching or detaching.
+func (d *EbsVolumeDriver) transitional(vol *ec2.Volume) *ec2.VolumeAttachment {
+	for _, a := range vol.Attachments {
+		if aws.StringValue(a.InstanceId) != d.awsInstanceId {
+			continue
+		}
+		switch aws.StringValue(a.State) {
+		case ec2.VolumeAttachmentStateAttaching, ec2.VolumeAttachmentStateDetaching:
+			return a
+		}
+	}
+	return nil
+}
+
+// repairStuckAttachments looks for volumes which are stuck attaching to, or
+// detaching from, this instance (typically because we or the instance died
+// mid-operation).  Each is given until the configured threshold to settle by
+// itself, and is then forcibly detached so that the next mount can start
+// afresh, rather than the volume being unusable until someone intervenes.
+func (d *EbsVolumeDriver) repairStuckAttachments(ctx context.Context) {
+	volumes, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			newFilter("attachment.instance-id", d.awsInstanceId),
+			newFilter("attachment.status",
+				ec2.VolumeAttachmentStateAttaching, ec2.VolumeAttachmentStateDetaching),
+		},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		LogCtxError(ctx, "Looking for stuck attachments failed: %v\n", err)
+		return
+	}
+
+	for _, vol := range volumes.Volumes {
+		a := d.transitional(vol)
+		if a == nil {
+			continue
+		}
+		id := aws.StringValue(vol.VolumeId)
+		LogCtx(ctx, "Volume %v is %v at startup (since %v).\n", id,
+			aws.StringValue(a.State), aws.TimeValue(a.AttachTime).Format(time.RFC3339))
+
+		outcome := "repaired"
+		if err := d.repairStuck(ctx, id, aws.TimeValue(a.AttachTime)); err != nil {
+			LogCtxError(ctx, "Repairing stuck volume %v failed: %v\n", id, err)
+			outcome = "failed"
+		}
+		IncCounter("blocker_stuck_attachments_total", "outcome", outcome)
+	}
+}
+
+func (d *EbsVolumeDriver) repairStuck(ctx context.Context, id string, since time.Time) error {
+	timeouts := GetConfig().Timeouts
+	threshold := since.Add(time.Duration(timeouts.StuckAttachment))
+
+	// First give it a chance to finish by itself.
+	for time.Now().Before(threshold) {
+		if err := sleep(ctx, time.Duration(timeouts.StatePoll)); err != nil {
+			return err
+		}
+		vol, err := d.describeVolume(ctx, id)
+		if err != nil {
+			return err
+		}
+		if d.transitional(vol) == nil {
+			LogCtx(ctx, "Volume %v settled by itself.\n", id)
+			return nil
+		}
+	}
+
+	// Then force it off, as many times as it takes.
+	var err error
+	for i := 1; i <= stuckRetries; i++ {
+		LogCtx(ctx, "Forcibly detaching stuck volume %v (attempt %v of %v)...\n",
+			id, i, stuckRetries)
+		if _, err = d.ec2.DetachVolumeWithContext(ctx, &ec2.DetachVolumeInput{
+			InstanceId: aws.String(d.awsInstanceId),
+			VolumeId:   aws.String(id),
+			Force:      aws.Bool(true),
+		}, d.awsOpts(ctx)...); err != nil {
+			continue
+		}
+		if err = d.waitUntilAvailable(ctx, id); err == nil {
+			LogCtx(ctx, "Stuck volume %v is detached and available again.\n", id)
+			return nil
+		}
+	}
+	return err
+}
+
+func (d *EbsVolumeDriver) describeVolume(ctx context.Context, id string) (*ec2.Volume, error) {
+	volumes, err := d.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes.Volumes) != 1 {
+		return nil, errorf(CodeNotFound, "Volume %v not found.", id)
+	}
+	return volumes.Volumes[0], nil
+}
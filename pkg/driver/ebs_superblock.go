@@ -0,0 +1,108 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// When mount can't make sense of a device's filesystem, the bare error
+// ("wrong fs type, bad option, bad superblock...") doesn't say whether the
+// volume was never formatted or its filesystem is damaged, nor what to do
+// about it.  We work out which, and say; volumes with the repair option are
+// repaired from a backup superblock and mounted again.
+
+func init() {
+	DescribeMetric("blocker_superblock_repairs_total",
+		"Filesystems repaired after their superblock failed to mount, by outcome.")
+}
+
+// badSuperblock reports whether mount's output says the filesystem couldn't
+// be read, rather than the device not being there.
+func badSuperblock(out string) bool {
+	for _, s := range []string{
+		"bad superblock",
+		"can't read superblock",
+		"Structure needs cleaning",
+	} {
+		if strings.Contains(out, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// repairable reports whether the volume's filesystem may be repaired if its
+// superblock is damaged, according to its repair option.
+func (v *ebsVolume) repairable() (bool, error) {
+	r, ok := v.opts["repair"]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(r)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value for repair: %q.", r)
+	}
+	return b, nil
+}
+
+// diagnoseSuperblock explains a mount failure due to the filesystem, with the
+// commands to investigate or fix it.
+func diagnoseSuperblock(dev string, out string) error {
+	var advice string
+	switch fs := probeFSType(dev); fs {
+	case "":
+		advice = "It has no recognizable filesystem; if the volume is new, it needs " +
+			"formatting first (e.g. with `mkfs -t ext4 <device>`)."
+	case "ext2", "ext3", "ext4":
+		advice = fmt.Sprintf("Its %v filesystem is damaged.  With the volume attached "+
+			"(but not mounted), check it with `e2fsck -n <device>`, and repair it from "+
+			"a backup superblock with `e2fsck -b 32768 <device>` (`mke2fs -n <device>` "+
+			"lists the backups), or mount it with the repair option to do so "+
+			"automatically.", fs)
+	case "xfs":
+		advice = "Its XFS filesystem is damaged.  With the volume attached (but not " +
+			"mounted), check it with `xfs_repair -n <device>` and repair it with " +
+			"`xfs_repair <device>`, or mount it with the repair option to do so " +
+			"automatically."
+	case "btrfs":
+		advice = "Its btrfs filesystem is damaged.  With the volume attached (but not " +
+			"mounted), check it with `btrfs check <device>` and recover the superblock " +
+			"with `btrfs rescue super-recover <device>`, or mount it with the repair " +
+			"option to do so automatically."
+	default:
+		advice = fmt.Sprintf("It holds a %v filesystem, which this host may not support "+
+			"(try the fstype option), or which may be damaged.", fs)
+	}
+	return errorf(CodeBadSuperblock, "Mounting %v failed: its superblock is missing or damaged.  %v\n%v",
+		dev, advice, out)
+}
+
+// repairFilesystem repairs a damaged filesystem, using its backup
+// superblocks where it has them.
+func repairFilesystem(ctx context.Context, dev string) error {
+	fs := probeFSType(dev)
+	LogCtx(ctx, "\tRepairing the %v filesystem on %v...\n", fs, dev)
+	return filesystemFor(fs).Check(ctx, dev, true)
+}
+
+// mountRepairing mounts the volume's device, repairing its filesystem and
+// trying again if its superblock is damaged and the volume allows it.
+func (d *EbsVolumeDriver) mountRepairing(
+	ctx context.Context, v *ebsVolume, dev string, mnt string, ro bool, mo mountOptions) error {
+	err := d.mountDevice(ctx, dev, mnt, ro, mo)
+	if ErrorCodeOf(err) != CodeBadSuperblock || ro {
+		return err
+	}
+	if repair, _ := v.repairable(); !repair {
+		return err
+	}
+
+	if rerr := repairFilesystem(ctx, dev); rerr != nil {
+		IncCounter("blocker_superblock_repairs_total", "outcome", "failed")
+		return fmt.Errorf("%w\nRepairing it failed too: %v", err, rerr)
+	}
+	IncCounter("blocker_superblock_repairs_total", "outcome", "repaired")
+	return d.mountDevice(ctx, dev, mnt, ro, mo)
+}
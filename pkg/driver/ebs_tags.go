@@ -0,0 +1,110 @@
+package driver
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Tags blocker puts on the EBS resources it creates.
+const (
+	// tagNamespace isolates one daemon's (or cluster's) volumes from another's.
+	tagNamespace = "blocker:namespace"
+	tagTemporary = "blocker:temporary"
+	tagSnapshot  = "blocker:snapshot"
+	// tagParentVolume names the volume a volume was restored from (see
+	// Lineage).
+	tagParentVolume = "blocker:parent-volume"
+	// tagVolume names the blocker volume a snapshot was taken of.
+	tagVolume = "blocker:volume"
+	// tagCopiedFrom names the snapshot a local copy was made from.
+	tagCopiedFrom = "blocker:copied-from"
+	// tagCopyOf names the volume a copy kept in another zone, or region, is
+	// of (see the replicate-to option), and the snapshots it's made from.
+	tagCopyOf = "blocker:copy-of"
+	// tagHandoff and tagHandoffTo coordinate moving a volume between hosts
+	// (see Release).
+	tagHandoff   = "blocker:handoff"
+	tagHandoffTo = "blocker:handoff-to"
+	// tagOptions holds default options for a volume, as space separated
+	// key=value pairs (see applyTags).
+	tagOptions = "blocker:opts"
+	// tagEphemeral marks scratch volumes, deleted when they're removed.
+	tagEphemeral = "blocker:ephemeral"
+	// tagPinned marks volumes which blocker must not unmount, remove, or
+	// delete without an admin forcing it.
+	tagPinned = "blocker:pinned"
+	// tagLeaseOwner and tagLeaseExpiry record which instance may use a
+	// volume, and until when (see acquireLease).
+	tagLeaseOwner  = "blocker:lease-owner"
+	tagLeaseExpiry = "blocker:lease-expiry"
+	// tagArchivedFrom and tagRetainUntil record the volume an archive
+	// snapshot was taken of, and how long it must be kept (see archive).
+	tagArchivedFrom = "blocker:archived-from"
+	tagRetainUntil  = "blocker:retain-until"
+	// tagPool and tagPoolHost mark standby volumes, with their class and
+	// the instance whose pool they're in (see takeStandby).
+	tagPool     = "blocker:pool"
+	tagPoolHost = "blocker:pool-host"
+	// tagSnapshotGroup names the group a snapshot was taken with (see
+	// SnapshotGroup).
+	tagSnapshotGroup = "blocker:snapshot-group"
+	// tagDevice names the device a volume would rather be attached as,
+	// e.g. sdj (see preferDevice).
+	tagDevice = "blocker:device"
+	// tagExportedTo marks a snapshot exported to S3 with where it went, so
+	// that the next export need only send what has changed since (see
+	// Export).
+	tagExportedTo = "blocker:exported-to"
+	// tagLUKSBackup records where a volume's LUKS header was last backed
+	// up (see backupLUKSHeader).
+	tagLUKSBackup = "blocker:luks-header-backup"
+	// tagLUKSRotation records how far a rotation of a volume's LUKS key has
+	// got, so that an interrupted one can be finished (see RotateLUKSKey).
+	tagLUKSRotation = "blocker:luks-key-rotation"
+	// tagCreatedBy marks the volumes blocker creates with the instance that
+	// created them, so that leaked ones can be found (see Orphans).
+	tagCreatedBy = "blocker:created-by"
+	// tagReplicaOf marks a snapshot taken to make read-only replicas of a
+	// volume, with the volume's name (see Replicate).
+	tagReplicaOf = "blocker:replica-of"
+	// tagSeeded marks a volume filled with its seed option's content, with
+	// where it came from, so that it's never seeded again (see seedIfEmpty).
+	tagSeeded = "blocker:seeded"
+)
+
+func newTag(key string, value string) *ec2.Tag {
+	return &ec2.Tag{Key: aws.String(key), Value: aws.String(value)}
+}
+
+func newFilter(name string, values ...string) *ec2.Filter {
+	return &ec2.Filter{Name: aws.String(name), Values: aws.StringSlice(values)}
+}
+
+// tagValue returns the value of the given tag, or "" if it isn't present.
+func tagValue(tags []*ec2.Tag, key string) string {
+	for _, t := range tags {
+		if aws.StringValue(t.Key) == key {
+			return aws.StringValue(t.Value)
+		}
+	}
+	return ""
+}
+
+// ownedTags adds this daemon's namespace tag (if it has one) to the tags for
+// a resource it's creating.
+func ownedTags(tags ...*ec2.Tag) []*ec2.Tag {
+	if ns := GetConfig().Namespace; ns != "" {
+		tags = append(tags, newTag(tagNamespace, ns))
+	}
+	return tags
+}
+
+// ownedFilters restricts a tag lookup to this daemon's namespace (if it has
+// one), so that clusters sharing an AWS account don't see each other's
+// volumes.
+func ownedFilters(filters ...*ec2.Filter) []*ec2.Filter {
+	if ns := GetConfig().Namespace; ns != "" {
+		filters = append(filters, newFilter("tag:"+tagNamespace, ns))
+	}
+	return filters
+}
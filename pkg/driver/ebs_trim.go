@@ -0,0 +1,91 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+func init() {
+	DescribeMetric("blocker_trims_total",
+		"Trims of mounted volumes' unused blocks, by volume and result.")
+}
+
+// trimLoop periodically trims every volume mounted read-write, so that EBS
+// (and LUKS, and the filesystem's own allocator) learns which blocks are
+// free, within the maintenance windows since it's heavy on I/O.
+func (d *EbsVolumeDriver) trimLoop(ctx context.Context) {
+	for {
+		interval := time.Duration(GetConfig().Trim.Interval)
+		if interval <= 0 {
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+		if sleep(ctx, interval) != nil {
+			return
+		}
+		if awaitMaintenance(ctx, "trim") != nil {
+			return
+		}
+		d.trimAll(ctx)
+	}
+}
+
+func (d *EbsVolumeDriver) trimAll(ctx context.Context) {
+	targets := map[string]string{}
+	d.mu.Lock()
+	for name, v := range d.volumes {
+		if ro, _ := v.readOnly(); v.mountpoint != "" && !ro {
+			targets[name] = v.mountpoint
+		}
+	}
+	d.mu.Unlock()
+
+	left := len(targets)
+	for name, mnt := range targets {
+		if !maintenanceOpen() {
+			LogCtx(ctx, "The maintenance window closed; leaving %v volume(s) for the next trim.\n", left)
+			return
+		}
+		left--
+		err := trim(mnt)
+		switch {
+		case ErrorCodeOf(err) == CodeNotSupported:
+			LogCtxDebug(ctx, "Not trimming %v: %v\n", name, err)
+			continue
+		case err != nil:
+			// If the volume was unmounted while we worked, errors mean
+			// nothing.
+			d.mu.Lock()
+			v, ok := d.volumes[name]
+			stillMounted := ok && v.mountpoint == mnt
+			d.mu.Unlock()
+			if !stillMounted {
+				continue
+			}
+			LogCtxError(ctx, "Trimming %v failed: %v\n", name, err)
+			IncCounter("blocker_trims_total", d.volumeLabels(name, "result", "failed")...)
+		default:
+			LogCtxDebug(ctx, "Trimmed %v.\n", name)
+			IncCounter("blocker_trims_total", d.volumeLabels(name, "result", "success")...)
+		}
+	}
+}
+
+// trim discards the unused blocks of the filesystem mounted at mnt.
+func trim(mnt string) error {
+	mounts, err := readMounts()
+	if err != nil {
+		return err
+	}
+	m := findMountpoint(mounts, mnt)
+	if m == nil {
+		return fmt.Errorf("%v is not mounted.", mnt)
+	}
+	if t, ok := filesystemFor(m.FSType).(Trimmer); ok {
+		return t.Trim(m.Source, mnt)
+	}
+	return fstrim(mnt)
+}
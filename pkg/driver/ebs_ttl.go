@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Batch jobs and forensic mounts are often forgotten, leaving a volume
+// attached here that another host needs.  A volume created with a ttl option
+// (e.g. `-o ttl=2h`) is unmounted and detached once it has been mounted that
+// long, provided nothing is using it: while containers still have it mounted
+// (or processes on the host hold it open, which makes umount fail) it's left
+// alone, and tried again later.  The clock restarts at each mount.
+
+func init() {
+	DescribeMetric("blocker_ttl_expirations_total",
+		"Volumes unmounted because their ttl ran out, by outcome.")
+}
+
+// ttlInterval is how often mounted volumes' TTLs are checked.
+const ttlInterval = time.Minute
+
+// ttl reports how long the volume may stay mounted, according to its ttl
+// option; zero means indefinitely.
+func (v *ebsVolume) ttl() (time.Duration, error) {
+	t, ok := v.opts["ttl"]
+	if !ok {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(t)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("Invalid value for ttl: %q; expected a positive duration, e.g. 2h.", t)
+	}
+	return ttl, nil
+}
+
+// ttlLoop periodically unmounts volumes whose TTLs have run out.  Busy
+// volumes are left until the next time round.
+func (d *EbsVolumeDriver) ttlLoop(ctx context.Context) {
+	for sleep(ctx, ttlInterval) == nil {
+		now := time.Now()
+		var expired []string
+		d.mu.Lock()
+		for name, v := range d.volumes {
+			if v.mountpoint != "" && !v.expires.IsZero() && now.After(v.expires) &&
+				!d.busy(name) {
+				expired = append(expired, name)
+			}
+		}
+		d.mu.Unlock()
+
+		for _, name := range expired {
+			name := name
+			d.submit(name, func() { d.expire(ctx, name, now) })
+		}
+	}
+}
+
+// expire unmounts a volume whose TTL has run out, unless it's in use.
+func (d *EbsVolumeDriver) expire(ctx context.Context, name string, now time.Time) {
+	v, exists := d.volume(name)
+	if !exists || v.mountpoint == "" || v.expires.IsZero() || now.Before(v.expires) {
+		return
+	}
+	// Only complain the first time round.
+	first := now.Sub(v.expires) < ttlInterval
+	if n := v.userCount(); n > 0 {
+		if first {
+			LogCtxWarn(ctx, "Volume %v's ttl has run out, but it's still in use by %v mount(s); "+
+				"leaving it mounted until they're done.\n", name, n)
+			IncCounter("blocker_ttl_expirations_total", "outcome", "in_use")
+		}
+		return
+	}
+	// A volume found to be pinned by its tag keeps its mount.
+	if err := v.checkPinned(ctx, name, "unmount"); err != nil {
+		if first {
+			LogCtxWarn(ctx, "Volume %v's ttl has run out, but %v\n", name, err)
+			IncCounter("blocker_ttl_expirations_total", "outcome", "pinned")
+		}
+		return
+	}
+
+	LogCtx(ctx, "Volume %v's ttl has run out; unmounting it.\n", name)
+	var err error
+	defer d.record(ctx, name, "expire", time.Now(), &err)
+	if err = d.doUnmount(ctx, name); err != nil {
+		if first {
+			LogCtxWarn(ctx, "Unmounting expired volume %v failed (will retry): %v\n", name, err)
+			IncCounter("blocker_ttl_expirations_total", "outcome", "failed")
+		}
+		return
+	}
+	d.update(func() { v.expires = time.Time{} })
+	IncCounter("blocker_ttl_expirations_total", "outcome", "unmounted")
+}
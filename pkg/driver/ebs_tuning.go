@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The kernel's block-device defaults (read-ahead, I/O scheduler, queue depth)
+// are often wrong for databases on EBS.  The read-ahead-kb, scheduler, and
+// nr-requests options set them for a volume's device whenever it's attached.
+
+// deviceTunable is a block-device setting under the device's queue directory
+// in SysBlockDir.
+type deviceTunable struct {
+	option string
+	file   string
+}
+
+var deviceTunables = []deviceTunable{
+	{"read-ahead-kb", "read_ahead_kb"},
+	{"scheduler", "scheduler"},
+	{"nr-requests", "nr_requests"},
+}
+
+// tuning returns the volume's block-device settings, by the file they're
+// written to.
+func (v *ebsVolume) tuning() (map[string]string, error) {
+	settings := map[string]string{}
+	for _, t := range deviceTunables {
+		value, ok := v.opts[t.option]
+		if !ok {
+			continue
+		}
+		if t.option == "scheduler" {
+			if value == "" || strings.ContainsAny(value, "/ \t\n") {
+				return nil, fmt.Errorf("Invalid value for scheduler: %q.", value)
+			}
+		} else if n, err := strconv.ParseUint(value, 10, 32); err != nil || n == 0 {
+			return nil, fmt.Errorf("Invalid value for %v: %q.", t.option, value)
+		}
+		settings[t.file] = value
+	}
+	return settings, nil
+}
+
+// tuneDevice applies the volume's block-device settings to its attached
+// device.  Failures are logged rather than failing the mount.
+func tuneDevice(ctx context.Context, v *ebsVolume, dev string) {
+	settings, _ := v.tuning()
+	if len(settings) == 0 {
+		return
+	}
+	real, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		LogCtxWarn(ctx, "\tTuning %v failed: %v\n", dev, err)
+		return
+	}
+	queue := filepath.Join(SysBlockDir, filepath.Base(real), "queue")
+	for file, value := range settings {
+		path := filepath.Join(queue, file)
+		if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+			LogCtxWarn(ctx, "\tSetting %v to %v failed: %v\n", path, value, err)
+			continue
+		}
+		LogCtx(ctx, "\tSet %v to %v.\n", path, value)
+	}
+}
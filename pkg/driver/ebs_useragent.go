@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Every AWS call we make carries blocker/<version> in its user-agent, plus
+// the configured application suffix and request tags, so that CloudTrail
+// analysis can tell our attaches and detaches from other automation in the
+// account (and, via awsOpts, which request each call was for).
+
+// addUserAgent stamps a request's user-agent, according to the configuration
+// at the time of the call.
+func addUserAgent(r *request.Request) {
+	request.AddToUserAgent(r, "blocker/"+Version)
+	c := GetConfig().AWS
+	if c.UserAgent != "" {
+		request.AddToUserAgent(r, c.UserAgent)
+	}
+	keys := make([]string, 0, len(c.RequestTags))
+	for k := range c.RequestTags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		request.AddToUserAgent(r, k+"/"+c.RequestTags[k])
+	}
+}
+
+// stampUserAgent makes every client created from the session stamp its
+// requests' user-agents.
+func stampUserAgent(sess *session.Session) {
+	sess.Handlers.Build.PushBackNamed(request.NamedHandler{
+		Name: "blocker.UserAgent",
+		Fn:   addUserAgent,
+	})
+}
+
+// validate checks that the user-agent suffix and request tags won't
+// garble the user-agent header.
+func (c AWSConfig) validate() error {
+	if strings.ContainsAny(c.UserAgent, "\r\n") {
+		return fmt.Errorf("The AWS user agent must be a single line.")
+	}
+	for k, v := range c.RequestTags {
+		if k == "" || strings.ContainsAny(k, " /\t\r\n") || strings.ContainsAny(v, " \t\r\n") {
+			return fmt.Errorf("Invalid AWS request tag %q=%q: tags may not contain "+
+				"whitespace, nor keys a slash.", k, v)
+		}
+	}
+	return nil
+}
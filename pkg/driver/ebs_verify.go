@@ -0,0 +1,260 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/satori/go.uuid"
+)
+
+func init() {
+	DescribeMetric("blocker_backup_verifications_total",
+		"Restores of a volume's latest snapshot which were checked, by volume and result.")
+}
+
+// VerifyResult reports whether a volume's latest snapshot could be restored
+// and passed its checks.
+type VerifyResult struct {
+	Volume     string
+	SnapshotId string
+	StartTime  time.Time
+	Passed     bool
+	Err        string `json:",omitempty"`
+	Output     string `json:",omitempty"`
+}
+
+// verifyLoop periodically proves that the configured volumes' backups can
+// actually be restored.
+func (d *EbsVolumeDriver) verifyLoop(ctx context.Context) {
+	for {
+		c := GetConfig().Verify
+		if c.Interval <= 0 {
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+		if sleep(ctx, time.Duration(c.Interval)) != nil {
+			return
+		}
+		if awaitMaintenance(ctx, "verify") != nil {
+			return
+		}
+
+		for i, name := range c.Volumes {
+			if !maintenanceOpen() {
+				LogCtx(ctx, "The maintenance window closed; leaving %v volume(s) for the next "+
+					"verification.\n", len(c.Volumes)-i)
+				break
+			}
+			d.Verify(ctx, name)
+		}
+	}
+}
+
+// Verify restores the most recent completed snapshot of the named volume to a
+// temporary volume, mounts it read-only, and runs the configured checks
+// against it: a command, and/or a sha256sum-style manifest on the volume.
+// The temporary volume is deleted afterwards either way.
+func (d *EbsVolumeDriver) Verify(ctx context.Context, name string) VerifyResult {
+	result := VerifyResult{Volume: name}
+	output, err := d.verify(ctx, name, &result)
+	result.Output = output
+	outcome := "pass"
+	if err != nil {
+		result.Err = err.Error()
+		outcome = "fail"
+		LogCtxError(ctx, "Backup verification of %v (%v) failed: %v\n",
+			name, result.SnapshotId, err)
+	} else {
+		result.Passed = true
+		LogCtx(ctx, "Backup verification of %v (%v) passed.\n", name, result.SnapshotId)
+	}
+	IncCounter("blocker_backup_verifications_total", d.volumeLabels(name, "result", outcome)...)
+	return result
+}
+
+func (d *EbsVolumeDriver) verify(ctx context.Context, name string, result *VerifyResult) (string, error) {
+	c := GetConfig().Verify
+	if c.Command == "" && c.Manifest == "" {
+		return "", errors.New("No verification command or manifest is configured.")
+	}
+
+	id, err := d.resolveVolumeId(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", errorf(CodeNotFound, "No EBS volume is named %v.", name)
+	}
+	snap, err := d.latestSnapshot(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	result.SnapshotId = aws.StringValue(snap.SnapshotId)
+	result.StartTime = aws.TimeValue(snap.StartTime)
+
+	mnt := mountRoot() + "/verify-" + uuid.NewV4().String()
+	v := &ebsVolume{opts: map[string]string{"snapshot": result.SnapshotId}}
+	if err := d.attachRestore(ctx, name, v, mnt); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := d.detachRestore(ctx, v, mnt); err != nil {
+			LogCtxError(ctx, "Cleaning up verification of %v failed: %v\n", name, err)
+		}
+	}()
+
+	if c.Manifest != "" {
+		if err := checkManifest(mnt, filepath.Join(mnt, c.Manifest)); err != nil {
+			return "", err
+		}
+	}
+	if c.Command != "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", c.Command)
+		cmd.Dir = mnt
+		cmd.Env = append(os.Environ(),
+			"BLOCKER_VERIFY_MOUNT="+mnt,
+			"BLOCKER_VERIFY_VOLUME="+name,
+			"BLOCKER_VERIFY_SNAPSHOT="+result.SnapshotId)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return string(out), fmt.Errorf("Verification command failed: %v", err)
+		}
+		return string(out), nil
+	}
+	return "", nil
+}
+
+// latestSnapshot finds the newest completed snapshot of an EBS volume.
+func (d *EbsVolumeDriver) latestSnapshot(ctx context.Context, id string) (*ec2.Snapshot, error) {
+	snapshots, err := d.ec2.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		Filters: []*ec2.Filter{
+			newFilter("volume-id", id),
+			newFilter("status", ec2.SnapshotStateCompleted),
+		},
+	}, d.awsOpts(ctx)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *ec2.Snapshot
+	for _, snap := range snapshots.Snapshots {
+		if latest == nil ||
+			aws.TimeValue(snap.StartTime).After(aws.TimeValue(latest.StartTime)) {
+			latest = snap
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("Volume %v has no completed snapshots.", id)
+	}
+	return latest, nil
+}
+
+// attachRestore provisions a temporary volume from v's snapshot and mounts it
+// read-only at mnt.
+func (d *EbsVolumeDriver) attachRestore(ctx context.Context, name string, v *ebsVolume, mnt string) error {
+	if err := os.MkdirAll(mnt, os.ModeDir|0700); err != nil {
+		return err
+	}
+	id, err := d.createVolumeFromSnapshot(ctx, "blocker-verify:"+name, v.opts)
+	if err != nil {
+		os.Remove(mnt)
+		return err
+	}
+	v.id = id
+	v.temporary = true
+
+	dev, err := d.attachVolume(ctx, v.id)
+	if err != nil {
+		d.cleanupTemporary(ctx, v)
+		os.Remove(mnt)
+		return err
+	}
+	if err := d.mountDevice(ctx, dev, mnt, true, mountOptions{}); err != nil {
+		d.detachVolume(ctx, v.id)
+		d.cleanupTemporary(ctx, v)
+		os.Remove(mnt)
+		return err
+	}
+	v.mountpoint = mnt
+	v.device = dev
+	return nil
+}
+
+func (d *EbsVolumeDriver) detachRestore(ctx context.Context, v *ebsVolume, mnt string) error {
+	if err := unmount(mnt, ""); err != nil {
+		return err
+	}
+	if err := os.Remove(mnt); err != nil {
+		return err
+	}
+	if err := d.detachVolume(ctx, v.id); err != nil {
+		return err
+	}
+	return d.cleanupTemporary(ctx, v)
+}
+
+// checkManifest compares the files under root against a manifest in the
+// format sha256sum writes ("<hex digest>  <path>" per line, paths relative
+// to root).
+func checkManifest(root string, manifest string) error {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var bad []string
+	checked := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("Malformed manifest line %q.", line)
+		}
+		want, path := fields[0], strings.TrimLeft(fields[1], " *")
+		got, err := fileDigest(filepath.Join(root, path))
+		if err != nil || got != want {
+			bad = append(bad, path)
+		}
+		checked++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%v of %v files failed verification: %v",
+			len(bad), checked, strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
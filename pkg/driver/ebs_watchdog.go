@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// watchdogLoop frequently checks that every volume we mounted is still in
+// the mount table.  Unlike reconciliation it makes no AWS calls, so it can
+// afford to run often.
+func (d *EbsVolumeDriver) watchdogLoop(ctx context.Context) {
+	for {
+		interval := time.Duration(GetConfig().Watchdog.Interval)
+		if interval <= 0 {
+			if sleep(ctx, time.Minute) != nil {
+				return
+			}
+			continue
+		}
+		if sleep(ctx, interval) != nil {
+			return
+		}
+
+		if err := d.watchdog(ctx); err != nil {
+			LogCtxError(ctx, "Mount watchdog failed: %v\n", err)
+		}
+	}
+}
+
+// watchdogRemounts reports whether the watchdog is re-mounting vanished
+// volumes, which reconcile then leaves to it.
+func watchdogRemounts() bool {
+	cfg := GetConfig().Watchdog
+	return cfg.Interval > 0 && cfg.Remount
+}
+
+func (d *EbsVolumeDriver) watchdog(ctx context.Context) error {
+	mounts, err := readMounts()
+	if err != nil {
+		return err
+	}
+
+	// Volumes with operations under way are left alone; they may well be
+	// mounting or unmounting right now.
+	d.mu.Lock()
+	vanished := map[string]string{}
+	for name, v := range d.volumes {
+		if v.mountpoint == "" || d.busy(name) || findMountpoint(mounts, v.mountpoint) != nil {
+			continue
+		}
+		vanished[name] = v.mountpoint
+	}
+	d.mu.Unlock()
+
+	for name, mnt := range vanished {
+		LogCtxError(ctx, "ALERT: volume %v is no longer mounted at %v.\n", name, mnt)
+		if !GetConfig().Watchdog.Remount {
+			continue
+		}
+		name, mnt := name, mnt
+		d.submit(name, func() { d.remountVanished(ctx, name, mnt) })
+	}
+	return nil
+}
+
+// remountVanished re-mounts a volume found missing from its mountpoint,
+// unless it has since been unmounted (or re-mounted).  It runs on the
+// volume's actor.
+func (d *EbsVolumeDriver) remountVanished(ctx context.Context, name string, mnt string) {
+	v, exists := d.volume(name)
+	if !exists || v.mountpoint != mnt {
+		return
+	}
+	if mounts, err := readMounts(); err == nil && findMountpoint(mounts, mnt) != nil {
+		return
+	}
+
+	start := time.Now()
+	err := d.remount(ctx, name, v)
+	d.record(ctx, name, "remount", start, &err)
+	if err != nil {
+		LogCtxError(ctx, "ALERT: re-mounting %v at %v failed: %v\n", name, mnt, err)
+		return
+	}
+	LogCtx(ctx, "Re-mounted %v at %v from %v.\n", name, mnt, v.device)
+}
+
+// remount puts a vanished volume back at its original mountpoint, so that
+// containers using it see their data again.  If the device is still present
+// it is simply mounted again; otherwise the volume is re-attached first.
+func (d *EbsVolumeDriver) remount(ctx context.Context, name string, v *ebsVolume) error {
+	if _, err := os.Lstat(v.device); err == nil {
+		ro, _ := v.readOnly()
+		mo, _ := v.mountOptions()
+		return d.mountDevice(ctx, v.device, v.mountpoint, ro, mo)
+	}
+	return d.mountAt(ctx, name, v.mountpoint)
+}
@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// ErrorCode classifies an error, so that orchestration and monitoring can
+// branch on the kind of failure rather than parsing messages.  Codes are
+// returned alongside messages in plugin (ErrCode) and admin (Code) responses.
+type ErrorCode string
+
+const (
+	CodeUnknown        ErrorCode = "Unknown"
+	CodeInternal       ErrorCode = "Internal"
+	CodeNotFound       ErrorCode = "NotFound"
+	CodeNotMounted     ErrorCode = "NotMounted"
+	CodeAlreadyMounted ErrorCode = "AlreadyMounted"
+	CodeAZMismatch     ErrorCode = "AZMismatch"
+	CodeAttachTimeout  ErrorCode = "AttachTimeout"
+	CodeAwsThrottled   ErrorCode = "AwsThrottled"
+	CodeDeviceMissing  ErrorCode = "DeviceMissing"
+	CodeNoDevices      ErrorCode = "NoDevices"
+	CodeBadSuperblock  ErrorCode = "BadSuperblock"
+	CodeInvalidOption  ErrorCode = "InvalidOption"
+	CodeDraining       ErrorCode = "Draining"
+	CodeRateLimited    ErrorCode = "RateLimited"
+	CodeHandoff        ErrorCode = "HandoffInProgress"
+	CodeLeased         ErrorCode = "Leased"
+	CodePinned         ErrorCode = "Pinned"
+	CodeNotSupported   ErrorCode = "NotSupported"
+	CodeMaintenance    ErrorCode = "Maintenance"
+	CodeReadOnly       ErrorCode = "ReadOnly"
+	CodeCorrupt        ErrorCode = "CorruptFilesystem"
+	CodeUnconfirmed    ErrorCode = "ConfirmationRequired"
+	CodeOverBudget     ErrorCode = "CostCeilingExceeded"
+	CodeKeyUnavailable ErrorCode = "KeyUnavailable"
+)
+
+// codedError attaches an ErrorCode to an error.
+type codedError struct {
+	code ErrorCode
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+// WithCode classifies an error.  A nil error stays nil.
+func WithCode(code ErrorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+// errorf is fmt.Errorf for classified errors.
+func errorf(code ErrorCode, format string, args ...interface{}) error {
+	return WithCode(code, fmt.Errorf(format, args...))
+}
+
+// ErrNotSupported is returned for optional operations a driver lacks.
+var ErrNotSupported = WithCode(CodeNotSupported, errors.New("Not supported by this driver."))
+
+var errNameNotFound = WithCode(CodeNotFound, errors.New("Name not found."))
+
+// AWS error codes which mean we're being throttled.
+var throttlingCodes = map[string]bool{
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestLimitExceeded": true,
+	// Too many snapshots of one volume at once.
+	"SnapshotCreationPerVolumeRateExceeded": true,
+}
+
+// ErrorCodeOf works out the class of an error: either the one it was given,
+// or one inferred from the AWS error code.  Returns "" for nil.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch {
+		case throttlingCodes[aerr.Code()]:
+			return CodeAwsThrottled
+		case aerr.Code() == "InvalidVolume.NotFound",
+			aerr.Code() == "InvalidSnapshot.NotFound":
+			return CodeNotFound
+		case kmsErrorCodes[aerr.Code()] != "":
+			return CodeKeyUnavailable
+		}
+	}
+	return CodeUnknown
+}
@@ -0,0 +1,102 @@
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Volume lifecycle events, streamed to admin clients (see pkg/plugin)
+// so that tooling can react to changes without polling.
+const (
+	eventCreated   = "created"
+	eventAttaching = "attaching"
+	eventAttached  = "attached"
+	eventMounted   = "mounted"
+	eventUnmounted = "unmounted"
+	eventDetached  = "detached"
+	eventResized   = "resized"
+	eventDraining  = "draining"
+	eventSaturated = "saturated"
+	eventArchived  = "archived"
+	eventError     = "error"
+
+	eventKeyUnavailable = "key-unavailable"
+	// eventReplicated's VolumeId is the volume's new copy in another zone.
+	eventReplicated = "replicated"
+)
+
+type VolumeEvent struct {
+	Time       time.Time
+	Type       string
+	Name       string `json:",omitempty"`
+	VolumeId   string `json:",omitempty"`
+	Device     string `json:",omitempty"`
+	Mountpoint string `json:",omitempty"`
+	Err        string `json:",omitempty"`
+	RequestId  string `json:",omitempty"`
+}
+
+// eventBus fans events out to subscribers.  Subscribers which fall behind
+// miss events rather than holding up the driver.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan VolumeEvent]bool
+}
+
+var Events = &eventBus{subs: make(map[chan VolumeEvent]bool)}
+
+func (b *eventBus) Subscribe() chan VolumeEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan VolumeEvent, 64)
+	b.subs[ch] = true
+	return ch
+}
+
+func (b *eventBus) Unsubscribe(ch chan VolumeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[ch] {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// closeAll ends every subscription, e.g. so that streams don't hold up
+// shutdown.
+func (b *eventBus) CloseAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+func (b *eventBus) Publish(e VolumeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publishEvent stamps an event with the time and the request that caused it,
+// and sends it to any listeners.
+func publishEvent(ctx context.Context, e VolumeEvent) {
+	e.Time = time.Now()
+	e.RequestId = RequestId(ctx)
+	Events.Publish(e)
+}
+
+// publishError reports a failed operation on a volume, if *err is set.  It's
+// meant to be deferred.
+func publishError(ctx context.Context, name string, err *error) {
+	if *err != nil {
+		publishEvent(ctx, VolumeEvent{Type: eventError, Name: name, Err: (*err).Error()})
+	}
+}
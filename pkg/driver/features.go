@@ -0,0 +1,186 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Feature flags let newer subsystems be adopted a step at a time, and turned
+// off again without going back to an older blocker.  Each flag is registered
+// with whether it's on by default.  The features section of the
+// configuration turns flags on or off for the whole daemon, and those which
+// apply to volumes one at a time can be turned on or off for a volume with
+// its features option (features=multi-attach, or features=-multi-attach to
+// turn it off).  A flag the
+// configuration turns off is off for every volume, whatever their options
+// say, so that it can be rolled back everywhere at once.  Other subsystems
+// (and programs embedding the driver) register their own with
+// RegisterFeature.
+
+// A Feature is a capability gated by a flag.
+type Feature struct {
+	Name        string
+	Description string
+	// Default is whether the feature is on where nothing says otherwise.
+	Default bool
+	// Experimental features may yet change, or go, in later releases.
+	Experimental bool
+	// PerVolume features can be turned on or off by a volume's features
+	// option.
+	PerVolume bool
+}
+
+const (
+	featureNVMe        = "nvme"
+	featureMultiAttach = "multi-attach"
+)
+
+var (
+	featuresMu sync.Mutex
+	features   = map[string]Feature{}
+)
+
+func init() {
+	RegisterFeature(Feature{
+		Name: featureNVMe,
+		Description: "Find attached volumes' devices by their NVMe serial numbers " +
+			"(the sysfs and nvme device readiness strategies).",
+		Default: true,
+	})
+	RegisterFeature(Feature{
+		Name: featureMultiAttach,
+		Description: "Create io1 and io2 volumes with EBS Multi-Attach (the multi-attach " +
+			"option), and attach them here while other instances have them attached too.",
+		Experimental: true,
+		PerVolume:    true,
+	})
+	DescribeMetric("blocker_feature_enabled",
+		"Whether each feature flag is on for the daemon (1) or off (0).")
+}
+
+// RegisterFeature adds a feature flag, replacing any registered before under
+// the same name.
+func RegisterFeature(f Feature) {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	features[f.Name] = f
+}
+
+// Features lists the registered feature flags, by name.
+func Features() []Feature {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	var list []Feature
+	for _, f := range features {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func feature(name string) (Feature, bool) {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	f, ok := features[name]
+	return f, ok
+}
+
+// FeatureEnabled reports whether a feature is on for a volume with the given
+// options or, given none, for the daemon.  Unregistered features are off.
+func FeatureEnabled(name string, opts map[string]string) bool {
+	f, ok := feature(name)
+	if !ok {
+		return false
+	}
+	on, set := GetConfig().Features[name]
+	if set && !on {
+		return false
+	}
+	if !set {
+		on = f.Default
+	}
+	if f.PerVolume && opts["features"] != "" {
+		// Checked when the volume was created.
+		flags, _ := parseFeatures(opts["features"])
+		if v, ok := flags[name]; ok {
+			on = v
+		}
+	}
+	return on
+}
+
+// parseFeatures parses a volume's features option: a comma-separated list
+// of the features to turn on, and, each prefixed with "-", those to turn
+// off.
+func parseFeatures(s string) (map[string]bool, error) {
+	flags := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		on := !strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		if name == "" {
+			continue
+		}
+		f, ok := feature(name)
+		if !ok {
+			return nil, unknownFeature(name)
+		}
+		if !f.PerVolume {
+			return nil, fmt.Errorf("The %v feature applies to the whole daemon; "+
+				"set it under features in the configuration instead.", name)
+		}
+		flags[name] = on
+	}
+	return flags, nil
+}
+
+// checkFeatures makes sure every feature the configuration sets is
+// registered.
+func checkFeatures(flags map[string]bool) error {
+	for name := range flags {
+		if _, ok := feature(name); !ok {
+			return unknownFeature(name)
+		}
+	}
+	return nil
+}
+
+func unknownFeature(name string) error {
+	var names []string
+	for _, f := range Features() {
+		names = append(names, f.Name)
+	}
+	if s := suggestOption(name, names); s != "" {
+		return fmt.Errorf("Unknown feature %q; did you mean %q?", name, s)
+	}
+	return fmt.Errorf("Unknown feature %q; the features are %v.", name, strings.Join(names, ", "))
+}
+
+// changedFeatures lists the features the configuration turns on or off
+// against their defaults, the latter prefixed with "no-", for the version
+// report.
+func changedFeatures() []string {
+	var changed []string
+	for _, f := range Features() {
+		switch on := FeatureEnabled(f.Name, nil); {
+		case on && !f.Default:
+			changed = append(changed, f.Name)
+		case !on && f.Default:
+			changed = append(changed, "no-"+f.Name)
+		}
+	}
+	return changed
+}
+
+// publishFeatures sets the blocker_feature_enabled gauges.
+func publishFeatures() {
+	for _, f := range Features() {
+		enabled := 0.0
+		if FeatureEnabled(f.Name, nil) {
+			enabled = 1
+		}
+		SetGauge(enabled, "blocker_feature_enabled", "feature", f.Name)
+	}
+}
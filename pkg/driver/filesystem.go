@@ -0,0 +1,315 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Filesystem handles everything filesystem-specific, so that the EBS side of
+// the driver needn't know one filesystem from another.  New filesystems (or,
+// in tests, stand-ins which don't touch real devices) are added with
+// RegisterFilesystem.
+type Filesystem interface {
+	// Format makes a new, empty filesystem on a blank device.
+	Format(dev string) error
+	// Check looks for damage to the (unmounted) filesystem on a device,
+	// repairing what it can if repair is set.
+	Check(ctx context.Context, dev string, repair bool) error
+	// Mount mounts a device with the given flags (as for mount -o),
+	// returning mount's output, which explains any failure.
+	Mount(dev string, mnt string, flags []string) (string, error)
+	// Grow enlarges a mounted filesystem to fill its device.
+	Grow(dev string, mnt string) error
+	// Freeze suspends (or, if frozen is false, resumes) writes to a mounted
+	// filesystem.
+	Freeze(mnt string, frozen bool) error
+}
+
+// FlagFormatter is implemented by filesystems which can be formatted with
+// extra mkfs flags (see the workload option).
+type FlagFormatter interface {
+	// FormatWithFlags makes a new, empty filesystem on a blank device,
+	// passing the flags to mkfs.
+	FormatWithFlags(dev string, flags []string) error
+}
+
+// Fscker is implemented by filesystems which can be checked before they're
+// mounted (see the fsck option).
+type Fscker interface {
+	// Fsck checks the unmounted filesystem on a device, if it might need it
+	// or force is set, repairing whatever can safely be repaired unattended.
+	// It reports whether anything was repaired (as far as the checker
+	// says), and fails with CodeCorrupt if damage remains.
+	Fsck(ctx context.Context, dev string, force bool) (bool, error)
+}
+
+// Exporter is implemented by filesystems whose storage stays in use after
+// they're unmounted (like ZFS pools), and must be let go of before their
+// device is detached.
+type Exporter interface {
+	// Export lets go of the storage under a just-unmounted filesystem,
+	// given the mount's source.
+	Export(source string) error
+}
+
+// Unmounter is implemented by filesystems which aren't unmounted with umount
+// (like stand-ins in tests, which never really mount anything).  Their mounts
+// aren't in the mount table, so they refuse to stack mounts or to mount a
+// device twice themselves.
+type Unmounter interface {
+	// Unmount unmounts the filesystem mounted at mnt.
+	Unmount(mnt string) error
+}
+
+// Trimmer is implemented by filesystems which aren't trimmed with fstrim
+// (like ZFS pools).
+type Trimmer interface {
+	// Trim discards the unused blocks of a mounted filesystem, given the
+	// mount's source.
+	Trim(source string, mnt string) error
+}
+
+var (
+	filesystemsMu sync.Mutex
+	filesystems   = map[string]Filesystem{}
+)
+
+// RegisterFilesystem makes a filesystem available by name (as used with the
+// fstype option), replacing any registered before.
+func RegisterFilesystem(name string, fs Filesystem) {
+	filesystemsMu.Lock()
+	defer filesystemsMu.Unlock()
+	filesystems[name] = fs
+}
+
+// UnregisterFilesystem removes a filesystem's handler, say a stand-in a test
+// registered, leaving the filesystem handled generically.
+func UnregisterFilesystem(name string) {
+	filesystemsMu.Lock()
+	defer filesystemsMu.Unlock()
+	delete(filesystems, name)
+}
+
+// filesystemFor returns the handler for the named filesystem.  Those without
+// one of their own are handled generically; "" leaves mount to work out the
+// filesystem for itself.
+func filesystemFor(name string) Filesystem {
+	filesystemsMu.Lock()
+	defer filesystemsMu.Unlock()
+	if fs, ok := filesystems[name]; ok {
+		return fs
+	}
+	return genericFilesystem{name}
+}
+
+func init() {
+	for _, name := range []string{"ext2", "ext3", "ext4"} {
+		RegisterFilesystem(name, extFilesystem{genericFilesystem{name}})
+	}
+	RegisterFilesystem("xfs", xfsFilesystem{genericFilesystem{"xfs"}})
+	RegisterFilesystem("btrfs", btrfsFilesystem{genericFilesystem{"btrfs"}})
+}
+
+// formatCommand is the command which formats the named filesystem.
+func formatCommand(name string) string {
+	switch name {
+	case "zfs":
+		return "zpool"
+	case "ufs":
+		return "newfs"
+	}
+	return "mkfs." + name
+}
+
+// run runs a command, including its output in any error.
+func run(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v failed: %v\n%v", name, err, string(out))
+	}
+	return nil
+}
+
+// genericFilesystem does what can be done without knowing the filesystem.
+type genericFilesystem struct {
+	name string
+}
+
+func (g genericFilesystem) Format(dev string) error {
+	return g.FormatWithFlags(dev, nil)
+}
+
+func (g genericFilesystem) FormatWithFlags(dev string, flags []string) error {
+	if g.name == "" {
+		return errors.New("No filesystem type was given to format with.")
+	}
+	args := append(append([]string{"-t", g.name}, flags...), dev)
+	if out, err := exec.Command("mkfs", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Formatting %v as %v failed: %v\n%v", dev, g.name, err, string(out))
+	}
+	return nil
+}
+
+func (g genericFilesystem) Check(ctx context.Context, dev string, repair bool) error {
+	return fmt.Errorf("Don't know how to check a %q filesystem.", g.name)
+}
+
+func (g genericFilesystem) Mount(dev string, mnt string, flags []string) (string, error) {
+	var args []string
+	if g.name != "" {
+		args = append(args, "-t", g.name)
+	}
+	if len(flags) > 0 {
+		args = append(args, "-o", strings.Join(flags, ","))
+	}
+	args = append(args, dev, mnt)
+	out, err := exec.Command("mount", args...).CombinedOutput()
+	return string(out), err
+}
+
+func (g genericFilesystem) Grow(dev string, mnt string) error {
+	return fmt.Errorf("Growing %v filesystems isn't supported.", g.name)
+}
+
+func (g genericFilesystem) Freeze(mnt string, frozen bool) error {
+	flag := "-u"
+	if frozen {
+		flag = "-f"
+	}
+	if out, err := exec.Command("fsfreeze", flag, mnt).CombinedOutput(); err != nil {
+		return fmt.Errorf("fsfreeze %v %v failed: %v\n%v", flag, mnt, err, string(out))
+	}
+	return nil
+}
+
+// e2fsBackupSuperblocks are where ext2/3/4 keep their first backup superblock
+// for 4KiB, and then 1KiB, blocks.
+var e2fsBackupSuperblocks = []string{"32768", "8193"}
+
+type extFilesystem struct {
+	genericFilesystem
+}
+
+// Check repairs from the backup superblocks in turn, since the primary one
+// is usually what's wrong.
+func (e extFilesystem) Check(ctx context.Context, dev string, repair bool) error {
+	if !repair {
+		return run("e2fsck", "-n", dev)
+	}
+	err := errors.New("No repair was attempted.")
+	for _, sb := range e2fsBackupSuperblocks {
+		var out []byte
+		out, err = exec.CommandContext(ctx, "e2fsck", "-y", "-b", sb, dev).CombinedOutput()
+		// e2fsck exits 1 or 2 when it has fixed things.
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() < 4 {
+			err = nil
+		}
+		if err == nil {
+			LogCtx(ctx, "\tRepaired %v from backup superblock %v.\n", dev, sb)
+			return nil
+		}
+		LogCtxWarn(ctx, "\te2fsck -b %v %v failed: %v\n%s", sb, dev, err, out)
+	}
+	return err
+}
+
+// Fsck preens the filesystem, which e2fsck skips if it was cleanly unmounted
+// and isn't due a check.
+func (e extFilesystem) Fsck(ctx context.Context, dev string, force bool) (bool, error) {
+	args := []string{"-p"}
+	if force {
+		args = append(args, "-f")
+	}
+	out, err := exec.CommandContext(ctx, "e2fsck", append(args, dev)...).CombinedOutput()
+	// e2fsck exits 1 or 2 when it has fixed things, and 4 when it's left
+	// things which need a human to fix.
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.As(err, &exit) && exit.ExitCode() < 4:
+		return true, nil
+	case errors.As(err, &exit) && exit.ExitCode()&4 != 0:
+		return false, errorf(CodeCorrupt, "%v has damage e2fsck can't safely repair unattended; "+
+			"run `e2fsck %v` by hand.\n%s", dev, dev, out)
+	}
+	return false, fmt.Errorf("e2fsck %v failed: %v\n%s", dev, err, out)
+}
+
+func (e extFilesystem) Grow(dev string, mnt string) error {
+	return run("resize2fs", dev)
+}
+
+type xfsFilesystem struct {
+	genericFilesystem
+}
+
+func (x xfsFilesystem) Check(ctx context.Context, dev string, repair bool) error {
+	if !repair {
+		return run("xfs_repair", "-n", dev)
+	}
+	return run("xfs_repair", dev)
+}
+
+// Fsck only does anything if forced: XFS replays its log and checks its
+// metadata as it's mounted, and xfs_repair can't run until the log has been
+// replayed.
+func (x xfsFilesystem) Fsck(ctx context.Context, dev string, force bool) (bool, error) {
+	if !force {
+		return false, nil
+	}
+	out, err := exec.CommandContext(ctx, "xfs_repair", dev).CombinedOutput()
+	// xfs_repair exits 2 when the log needs replaying first.
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		// xfs_repair doesn't say whether it changed anything.
+		return false, nil
+	case errors.As(err, &exit) && exit.ExitCode() == 2:
+		return false, errorf(CodeCorrupt, "%v has an XFS log to replay before it can be checked; "+
+			"mount it without fsck=force first.\n%s", dev, out)
+	case errors.As(err, &exit):
+		return false, errorf(CodeCorrupt, "%v has damage xfs_repair couldn't repair; "+
+			"run `xfs_repair %v` by hand.\n%s", dev, dev, out)
+	}
+	return false, fmt.Errorf("xfs_repair %v failed: %v\n%s", dev, err, out)
+}
+
+func (x xfsFilesystem) Grow(dev string, mnt string) error {
+	return run("xfs_growfs", mnt)
+}
+
+type btrfsFilesystem struct {
+	genericFilesystem
+}
+
+func (b btrfsFilesystem) Check(ctx context.Context, dev string, repair bool) error {
+	if !repair {
+		return run("btrfs", "check", "--readonly", dev)
+	}
+	return run("btrfs", "rescue", "super-recover", "-y", dev)
+}
+
+// Fsck only checks, and only if forced: btrfs checksums its data and metadata
+// as it goes, and `btrfs check --repair` is too dangerous to run unattended.
+func (b btrfsFilesystem) Fsck(ctx context.Context, dev string, force bool) (bool, error) {
+	if !force {
+		return false, nil
+	}
+	out, err := exec.CommandContext(ctx, "btrfs", "check", "--readonly", dev).CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return false, errorf(CodeCorrupt, "%v is damaged; see `btrfs check %v`.\n%s", dev, dev, out)
+	} else if err != nil {
+		return false, fmt.Errorf("btrfs check %v failed: %v\n%s", dev, err, out)
+	}
+	return false, nil
+}
+
+func (b btrfsFilesystem) Grow(dev string, mnt string) error {
+	return run("btrfs", "filesystem", "resize", "max", mnt)
+}
@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// DefaultFSType is what blank volumes are formatted as, unless configured
+// otherwise.
+const DefaultFSType = "zfs"
+
+func init() {
+	RegisterFilesystem("ufs", ufsFilesystem{genericFilesystem{"ufs"}})
+}
+
+// probeFSType reports the filesystem on a device according to fstyp(8), or
+// "" if there isn't one.
+func probeFSType(dev string) string {
+	out, _ := exec.Command("fstyp", dev).Output()
+	return strings.TrimSpace(string(out))
+}
+
+// hasSignature reports whether fstyp recognizes anything on a device.
+func hasSignature(dev string) bool {
+	return probeFSType(dev) != ""
+}
+
+// mountFSType is the filesystem to mount a device as, given its fstype
+// option.  FreeBSD's mount assumes UFS unless told otherwise, so it's told.
+func mountFSType(dev string, fstype string) string {
+	if fstype == "" {
+		return probeFSType(dev)
+	}
+	return fstype
+}
+
+type ufsFilesystem struct {
+	genericFilesystem
+}
+
+// FormatWithFlags makes the filesystem with newfs, with soft updates unless
+// the flags say otherwise.
+func (u ufsFilesystem) FormatWithFlags(dev string, flags []string) error {
+	if len(flags) == 0 {
+		flags = []string{"-U"}
+	}
+	if out, err := exec.Command("newfs", append(flags, dev)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Formatting %v as ufs failed: %v\n%v", dev, err, string(out))
+	}
+	return nil
+}
+
+func (u ufsFilesystem) Format(dev string) error {
+	return u.FormatWithFlags(dev, nil)
+}
+
+func (u ufsFilesystem) Check(ctx context.Context, dev string, repair bool) error {
+	if !repair {
+		return run("fsck_ufs", "-n", dev)
+	}
+	return run("fsck_ufs", "-y", dev)
+}
+
+// Fsck preens the filesystem, which fsck_ufs skips if it's clean.
+func (u ufsFilesystem) Fsck(ctx context.Context, dev string, force bool) (bool, error) {
+	args := []string{"-p"}
+	if force {
+		args = []string{"-y", "-f"}
+	}
+	out, err := exec.CommandContext(ctx, "fsck_ufs", append(args, dev)...).CombinedOutput()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		// fsck_ufs doesn't say whether it changed anything.
+		return false, nil
+	case errors.As(err, &exit):
+		return false, errorf(CodeCorrupt, "%v has damage fsck_ufs can't safely repair unattended; "+
+			"run `fsck_ufs %v` by hand.\n%s", dev, dev, out)
+	}
+	return false, fmt.Errorf("fsck_ufs %v failed: %v\n%s", dev, err, out)
+}
+
+func (u ufsFilesystem) Grow(dev string, mnt string) error {
+	return run("growfs", "-y", dev)
+}
+
+// Freeze fails: FreeBSD has no way to suspend writes from userland.
+func (u ufsFilesystem) Freeze(mnt string, frozen bool) error {
+	return errors.New("UFS filesystems can't be frozen on FreeBSD.")
+}
+
+// fstrim fails: UFS can't be trimmed on demand, only as it frees blocks.
+func fstrim(mnt string) error {
+	return errorf(CodeNotSupported, "UFS can't be trimmed on demand; enable TRIM with "+
+		"`tunefs -t enable` instead.")
+}
@@ -0,0 +1,39 @@
+package driver
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// DefaultFSType is what blank volumes are formatted as, unless configured
+// otherwise.
+const DefaultFSType = "ext4"
+
+// probeFSType reports the filesystem on a device according to its signature,
+// or "" if there isn't one.
+func probeFSType(dev string) string {
+	out, _ := exec.Command("blkid", "-p", "-o", "value", "-s", "TYPE", dev).Output()
+	return strings.TrimSpace(string(out))
+}
+
+// hasSignature reports whether blkid finds any filesystem, RAID, or partition
+// table signature on a device.
+func hasSignature(dev string) bool {
+	out, _ := exec.Command("blkid", "-p", dev).Output()
+	return strings.TrimSpace(string(out)) != ""
+}
+
+// mountFSType is the filesystem to mount a device as, given its fstype
+// option.  mount works out the rest for itself, but not ZFS pools, which
+// have to be imported first.
+func mountFSType(dev string, fstype string) string {
+	if fstype == "" && probeFSType(dev) == "zfs_member" {
+		return "zfs"
+	}
+	return fstype
+}
+
+// fstrim discards the unused blocks of a mounted filesystem.
+func fstrim(mnt string) error {
+	return run("fstrim", mnt)
+}
@@ -0,0 +1,230 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal client for the parts of the GCE metadata service and Compute
+// Engine API the GCE driver needs, using only the standard library.
+
+const (
+	// gceMetadataURL is the root of the GCE instance metadata service.
+	gceMetadataURL = "http://metadata.google.internal/computeMetadata/v1/"
+	// gceComputeURL is the root of the Compute Engine API.
+	gceComputeURL = "https://compute.googleapis.com/compute/v1/"
+)
+
+// gceMetadata fetches a value from the metadata service.
+func gceMetadata(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", gceMetadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Fetching %v from GCE metadata failed: %v", path, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// gceCompute calls the Compute Engine API for a project and zone,
+// authenticating as the instance's default service account.
+type gceCompute struct {
+	endpoint string
+	project  string
+	zone     string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// gceDisk is the part of a Compute Engine disk we use.
+type gceDisk struct {
+	Name   string   `json:"name"`
+	SizeGb string   `json:"sizeGb"`
+	Status string   `json:"status"`
+	Users  []string `json:"users"`
+}
+
+// gceOperation is a Compute Engine long-running operation.
+type gceOperation struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+// gceError is an error response from the API.
+type gceError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// accessToken returns an OAuth token for the default service account,
+// fetching a new one when the last is about to expire.
+func (c *gceCompute) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+	body, err := gceMetadata(ctx, "instance/service-accounts/default/token")
+	if err != nil {
+		return "", err
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(body), &t); err != nil {
+		return "", err
+	}
+	c.token = t.AccessToken
+	c.expires = time.Now().Add(time.Duration(t.ExpiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
+
+// call makes an API request on a path under the zone, decoding the reply
+// into out.
+func (c *gceCompute) call(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	u := c.endpoint + "projects/" + c.project + "/zones/" + c.zone + "/" + path
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	ua := "blocker/" + Version
+	if id := RequestId(ctx); id != "" {
+		ua += " blocker-request/" + id
+	}
+	req.Header.Set("User-Agent", ua)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e gceError
+		json.NewDecoder(resp.Body).Decode(&e)
+		if resp.StatusCode == http.StatusNotFound {
+			return errorf(CodeNotFound, "%v", e.Error.Message)
+		}
+		return fmt.Errorf("Compute Engine %v %v failed: %v %v",
+			method, path, resp.Status, e.Error.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// wait waits for an operation to finish, returning its error if it failed.
+func (c *gceCompute) wait(ctx context.Context, op *gceOperation) error {
+	deadline := time.Now().Add(time.Duration(GetConfig().Timeouts.StateWait))
+	for op.Status != "DONE" {
+		if time.Now().After(deadline) {
+			return errorf(CodeAttachTimeout, "Timed out waiting for operation %v.", op.Name)
+		}
+		// The wait method returns when the operation is done, or after a
+		// couple of minutes, whichever is sooner.
+		if err := c.call(ctx, "POST", "operations/"+op.Name+"/wait", nil, op); err != nil {
+			return err
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		var msgs []string
+		for _, e := range op.Error.Errors {
+			msgs = append(msgs, e.Code+": "+e.Message)
+		}
+		return fmt.Errorf("Operation %v failed: %v", op.Name, strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+func (c *gceCompute) getDisk(ctx context.Context, name string) (*gceDisk, error) {
+	var disk gceDisk
+	if err := c.call(ctx, "GET", "disks/"+url.PathEscape(name), nil, &disk); err != nil {
+		return nil, err
+	}
+	return &disk, nil
+}
+
+func (c *gceCompute) createDisk(ctx context.Context, name string, sizeGb int64, diskType string) error {
+	in := map[string]interface{}{
+		"name":   name,
+		"sizeGb": fmt.Sprint(sizeGb),
+		"labels": map[string]string{"blocker": "true"},
+	}
+	if diskType != "" {
+		in["type"] = "zones/" + c.zone + "/diskTypes/" + diskType
+	}
+	var op gceOperation
+	if err := c.call(ctx, "POST", "disks", in, &op); err != nil {
+		return err
+	}
+	return c.wait(ctx, &op)
+}
+
+func (c *gceCompute) attachDisk(ctx context.Context, instance string, disk string, deviceName string, ro bool) error {
+	mode := "READ_WRITE"
+	if ro {
+		mode = "READ_ONLY"
+	}
+	var op gceOperation
+	if err := c.call(ctx, "POST", "instances/"+url.PathEscape(instance)+"/attachDisk",
+		map[string]string{
+			"source":     "projects/" + c.project + "/zones/" + c.zone + "/disks/" + disk,
+			"deviceName": deviceName,
+			"mode":       mode,
+		}, &op); err != nil {
+		return err
+	}
+	return c.wait(ctx, &op)
+}
+
+func (c *gceCompute) detachDisk(ctx context.Context, instance string, deviceName string) error {
+	var op gceOperation
+	if err := c.call(ctx, "POST", "instances/"+url.PathEscape(instance)+
+		"/detachDisk?deviceName="+url.QueryEscape(deviceName), nil, &op); err != nil {
+		return err
+	}
+	return c.wait(ctx, &op)
+}
@@ -0,0 +1,456 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// GceVolumeDriver serves Google Compute Engine persistent disks, so that the
+// same plugin can be used outside AWS.  It covers the basics (using existing
+// disks, creating new ones given a size, and attaching, formatting, and
+// mounting them), with the same filesystem options as EBS volumes; the
+// EBS-specific extras (snapshots, pools, handoffs and so on) aren't offered.
+// Operations on a volume run one at a time, but those on different volumes
+// run concurrently.  What the driver knows of its volumes is kept in the
+// state file, as the EBS driver's is, so that a restarted daemon can still
+// unmount the volumes mounted before.
+type GceVolumeDriver struct {
+	compute  *gceCompute
+	instance string
+
+	// mu guards volumes and locks.  A volume's fields are changed holding
+	// both its lock and mu, so either is enough to read them.  mu is never
+	// held across calls of the Compute Engine API, or waiting for devices.
+	mu      sync.Mutex
+	volumes map[string]*gceVolume
+	// locks serialize the operations on each volume, by name (see lock).
+	locks map[string]*sync.Mutex
+}
+
+type gceVolume struct {
+	// disk is the persistent disk's name.
+	disk       string
+	opts       map[string]string
+	mountpoint string
+	device     string
+	// users counts the Docker mounts of the volume, by Docker's mount ID.
+	users mountUsers
+}
+
+// GceOptions controls how the GCE driver discovers where it's running.
+// Ordinarily everything comes from the GCE metadata service.
+type GceOptions struct {
+	NoMetadata bool
+	Project    string
+	Zone       string
+	Instance   string
+	// Endpoint overrides the Compute Engine API's URL.
+	Endpoint string
+	// RecoverState starts afresh if the state file is corrupt, rather than
+	// refusing to start.
+	RecoverState bool
+}
+
+func NewGceVolumeDriver(opts GceOptions) (*GceVolumeDriver, error) {
+	ctx := WithRequestId(context.Background(), "startup")
+	for _, f := range []struct {
+		value *string
+		path  string
+	}{
+		{&opts.Project, "project/project-id"},
+		{&opts.Zone, "instance/zone"},
+		{&opts.Instance, "instance/name"},
+	} {
+		if *f.value != "" {
+			continue
+		}
+		if opts.NoMetadata {
+			return nil, errors.New("Without metadata, the project, zone, and instance must be given.")
+		}
+		v, err := gceMetadata(ctx, f.path)
+		if err != nil {
+			return nil, err
+		}
+		// The zone comes as projects/<number>/zones/<zone>.
+		*f.value = path.Base(v)
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = gceComputeURL
+	}
+
+	d := &GceVolumeDriver{
+		compute: &gceCompute{
+			endpoint: opts.Endpoint,
+			project:  opts.Project,
+			zone:     opts.Zone,
+		},
+		instance: opts.Instance,
+		volumes:  make(map[string]*gceVolume),
+		locks:    make(map[string]*sync.Mutex),
+	}
+	Log("Auto-detected GCE information:\n")
+	Log("\tProject  : %v\n", opts.Project)
+	Log("\tZone     : %v\n", opts.Zone)
+	Log("\tInstance : %v\n", opts.Instance)
+	SetLogFields("instance_id", opts.Instance)
+	if err := d.restoreState(ctx, opts.RecoverState); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// restoreState picks up the volumes saved in the state file.  Those whose
+// mounts didn't survive (say, the instance rebooted) are restored unmounted.
+func (d *GceVolumeDriver) restoreState(ctx context.Context, recovering bool) error {
+	state, err := readState(ctx, recovering)
+	if err != nil {
+		return err
+	}
+	mounted := map[string]bool{}
+	if mounts, err := readMounts(); err != nil {
+		LogCtxError(ctx, "Reading the mount table failed; restoring volumes unmounted: %v\n", err)
+	} else {
+		for _, m := range mounts {
+			mounted[m.MountPoint] = true
+		}
+	}
+	for _, sv := range state.Volumes {
+		v := &gceVolume{disk: sv.Id, opts: sv.Opts}
+		if sv.Mountpoint != "" && mounted[sv.Mountpoint] {
+			v.mountpoint, v.device, v.users = sv.Mountpoint, sv.Device, sv.Users
+		} else if sv.Mountpoint != "" {
+			LogCtxWarn(ctx, "Volume %v is no longer mounted at %v.\n", sv.Name, sv.Mountpoint)
+		}
+		d.volumes[sv.Name] = v
+	}
+	if len(state.Volumes) > 0 {
+		LogCtx(ctx, "Restored %v volume(s) from %v.\n", len(state.Volumes), GetConfig().StateFile)
+	}
+	return nil
+}
+
+// saveState writes the driver's state to the state file, if there is one.
+// Persistent disks are recorded as volumes whose IDs are the disks' names.
+func (d *GceVolumeDriver) saveState(ctx context.Context) {
+	path := GetConfig().StateFile
+	if path == "" {
+		return
+	}
+	d.mu.Lock()
+	var state savedState
+	for name, v := range d.volumes {
+		state.Volumes = append(state.Volumes, savedVolume{
+			Name:       name,
+			Id:         v.disk,
+			Opts:       v.opts,
+			Mountpoint: v.mountpoint,
+			Device:     v.device,
+			Users:      v.users,
+		})
+	}
+	raw, err := json.Marshal(state)
+	d.mu.Unlock()
+	if err != nil {
+		LogCtxError(ctx, "Saving state failed: %v\n", err)
+		return
+	}
+	storeState(ctx, path, raw)
+}
+
+// lock starts an operation on a volume, waiting for any other under way,
+// and returns the function which ends it.
+func (d *GceVolumeDriver) lock(name string) func() {
+	d.mu.Lock()
+	l, ok := d.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		d.locks[name] = l
+	}
+	d.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// volume looks up a volume by name.
+func (d *GceVolumeDriver) volume(name string) (*gceVolume, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, exists := d.volumes[name]
+	return v, exists
+}
+
+// gceDeviceName is the name a disk is attached under, which also names its
+// device in /dev/disk/by-id.
+func gceDeviceName(disk string) string {
+	return "blocker-" + disk
+}
+
+func (d *GceVolumeDriver) Create(ctx context.Context, name string, opts map[string]string) error {
+	defer d.lock(name)()
+
+	if v, exists := d.volume(name); exists && v.mountpoint != "" {
+		return nil
+	}
+	merged, err := volumeOptions("gce", nil, opts)
+	if err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if err := checkOptionNames(merged, gceOptionNames); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	check := &ebsVolume{opts: merged}
+	if _, err := check.readOnly(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+	if _, err := check.mountOptions(); err != nil {
+		return WithCode(CodeInvalidOption, err)
+	}
+
+	// The name is the disk's, unless the disk option names another.
+	disk := name
+	if dn, ok := merged["disk"]; ok {
+		disk = dn
+	}
+	_, err = d.compute.getDisk(ctx, disk)
+	if ErrorCodeOf(err) == CodeNotFound {
+		size, ok := merged["size"]
+		if !ok {
+			return errorf(CodeNotFound, "No persistent disk is named %v.", disk)
+		}
+		gb, perr := strconv.ParseInt(size, 10, 64)
+		if perr != nil || gb <= 0 {
+			return errorf(CodeInvalidOption, "Invalid size %q.", size)
+		}
+		LogCtx(ctx, "\tCreating %vGB persistent disk %v.\n", gb, disk)
+		err = d.compute.createDisk(ctx, disk, gb, merged["type"])
+	}
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.volumes[name] = &gceVolume{disk: disk, opts: merged}
+	d.mu.Unlock()
+	d.saveState(ctx)
+	return nil
+}
+
+func (d *GceVolumeDriver) Mount(ctx context.Context, name string) (string, error) {
+	defer d.lock(name)()
+
+	v, exists := d.volume(name)
+	if !exists {
+		return "", errNameNotFound
+	}
+	// Another container may already be using the volume, or Docker may be
+	// retrying a Mount it thinks failed; either way, just hand back where
+	// it's mounted.
+	caller := Caller(ctx)
+	if v.mountpoint != "" {
+		d.mu.Lock()
+		v.users.add(caller)
+		d.mu.Unlock()
+		d.saveState(ctx)
+		return v.mountpoint, nil
+	}
+	check := &ebsVolume{opts: v.opts}
+	ro, _ := check.readOnly()
+	mo, _ := check.mountOptions()
+
+	mnt := mountRoot() + "/" + uuid.NewV4().String()
+	if err := os.MkdirAll(mnt, os.ModeDir|0700); err != nil {
+		return "", err
+	}
+	deviceName := gceDeviceName(v.disk)
+	// A failed mount is tidied up even if the request was cancelled,
+	// including an attach we stopped waiting for (which may yet finish).
+	cleanup := context.WithoutCancel(ctx)
+	if err := d.compute.attachDisk(ctx, d.instance, v.disk, deviceName, ro); err != nil {
+		if ctx.Err() != nil || ErrorCodeOf(err) == CodeAttachTimeout {
+			d.compute.detachDisk(cleanup, d.instance, deviceName)
+		}
+		os.Remove(mnt)
+		return "", err
+	}
+	LogCtx(ctx, "\tAttached disk %v to %v.\n", v.disk, d.instance)
+
+	dev, err := waitForDevice(ctx, "/dev/disk/by-id/google-"+deviceName)
+	if err == nil {
+		err = formatIfBlank(ctx, dev, ro, mo, nil)
+	}
+	if err == nil {
+		flags := mo.Flags
+		if ro {
+			flags = append([]string{"ro"}, flags...)
+		}
+		var out string
+		if out, err = filesystemFor(mo.FSType).Mount(dev, mnt, flags); err != nil {
+			err = fmt.Errorf("Mounting device %v to %v failed: %v\n%v", dev, mnt, err, out)
+		}
+	}
+	if err == nil {
+		err = mo.chown(mnt)
+	}
+	if err != nil {
+		exec.Command("umount", mnt).Run()
+		d.compute.detachDisk(cleanup, d.instance, deviceName)
+		os.Remove(mnt)
+		return "", err
+	}
+
+	d.mu.Lock()
+	v.mountpoint = mnt
+	v.device = dev
+	v.users.add(caller)
+	d.mu.Unlock()
+	d.saveState(ctx)
+	publishEvent(ctx, VolumeEvent{Type: eventMounted,
+		Name: name, VolumeId: v.disk, Device: dev, Mountpoint: mnt})
+	return mnt, nil
+}
+
+// waitForDevice waits for an attached disk's device to appear, or the
+// request to be cancelled.
+func waitForDevice(ctx context.Context, dev string) (string, error) {
+	timeouts := GetConfig().Timeouts
+	deadline := time.Now().Add(time.Duration(timeouts.StateWait))
+	for {
+		if _, err := os.Stat(dev); err == nil {
+			return dev, nil
+		}
+		if time.Now().After(deadline) {
+			return "", errorf(CodeDeviceMissing, "Device %v didn't appear.", dev)
+		}
+		if err := sleep(ctx, time.Second); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (d *GceVolumeDriver) Path(ctx context.Context, name string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, exists := d.volumes[name]
+	if !exists {
+		return "", errNameNotFound
+	}
+	if v.mountpoint == "" {
+		return "", WithCode(CodeNotMounted, errors.New("Volume not mounted."))
+	}
+	return v.mountpoint, nil
+}
+
+func (d *GceVolumeDriver) Unmount(ctx context.Context, name string) error {
+	defer d.lock(name)()
+
+	v, exists := d.volume(name)
+	if !exists {
+		return errNameNotFound
+	}
+	if v.mountpoint == "" {
+		return nil
+	}
+	// Leave the volume mounted while other containers are using it.
+	d.mu.Lock()
+	left := v.users.drop(Caller(ctx))
+	d.mu.Unlock()
+	if left > 0 {
+		d.saveState(ctx)
+		LogCtx(ctx, "\tVolume %v is still in use by %v mount(s); leaving it mounted.\n", name, left)
+		return nil
+	}
+	err := d.unmount(ctx, name, v)
+	d.saveState(ctx)
+	return err
+}
+
+func (d *GceVolumeDriver) unmount(ctx context.Context, name string, v *gceVolume) error {
+	// Once unmounted, the disk is detached even if the request is cancelled.
+	ctx = context.WithoutCancel(ctx)
+	if out, err := exec.Command("umount", v.mountpoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unmounting %v failed: %v\n%v", v.mountpoint, err, string(out))
+	}
+	publishEvent(ctx, VolumeEvent{Type: eventUnmounted,
+		Name: name, VolumeId: v.disk, Mountpoint: v.mountpoint})
+	if err := os.Remove(v.mountpoint); err != nil {
+		return err
+	}
+	if err := d.compute.detachDisk(ctx, d.instance, gceDeviceName(v.disk)); err != nil {
+		return err
+	}
+	LogCtx(ctx, "\tDetached disk %v from %v.\n", v.disk, d.instance)
+	d.mu.Lock()
+	v.mountpoint = ""
+	v.device = ""
+	v.users = nil
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *GceVolumeDriver) Remove(ctx context.Context, name string) error {
+	defer d.lock(name)()
+
+	v, exists := d.volume(name)
+	if !exists {
+		return errNameNotFound
+	}
+	if v.mountpoint != "" {
+		if err := d.unmount(ctx, name, v); err != nil {
+			return err
+		}
+	}
+	d.mu.Lock()
+	delete(d.volumes, name)
+	d.mu.Unlock()
+	d.saveState(ctx)
+	return nil
+}
+
+// List reports every volume we know of, sorted by name.
+func (d *GceVolumeDriver) List(ctx context.Context) ([]VolumeInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	infos := []VolumeInfo{}
+	for name, v := range d.volumes {
+		infos = append(infos, VolumeInfo{Name: name, Mountpoint: v.mountpoint})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Get reports a volume, with what Compute Engine says of its disk.
+func (d *GceVolumeDriver) Get(ctx context.Context, name string) (VolumeInfo, error) {
+	d.mu.Lock()
+	v, exists := d.volumes[name]
+	if !exists {
+		d.mu.Unlock()
+		return VolumeInfo{}, errNameNotFound
+	}
+	mountpoint := v.mountpoint
+	status := map[string]interface{}{"Disk": v.disk, "Zone": d.compute.zone}
+	if v.device != "" {
+		status["Device"] = v.device
+	}
+	d.mu.Unlock()
+
+	if disk, err := d.compute.getDisk(ctx, v.disk); err != nil {
+		LogCtxWarn(ctx, "\tDescribing disk %v failed: %v\n", v.disk, err)
+	} else {
+		status["SizeGb"] = disk.SizeGb
+		status["DiskStatus"] = disk.Status
+	}
+	return VolumeInfo{Name: name, Mountpoint: mountpoint, Status: status}, nil
+}
@@ -0,0 +1,5 @@
+package driver
+
+// setIdleIOPriority does nothing: only Linux has I/O priorities.  Scrubs
+// are still held to scrub.rate_mib.
+func setIdleIOPriority() {}
@@ -0,0 +1,12 @@
+package driver
+
+import "syscall"
+
+// ioprioIdle is the "idle" I/O scheduling class for ioprio_set(2), so
+// scrubbing only uses the disk when nothing else wants it.
+const ioprioIdle = 3 << 13
+
+// setIdleIOPriority drops the calling thread to idle I/O priority.
+func setIdleIOPriority() {
+	syscall.Syscall(syscall.SYS_IOPRIO_SET, 1, 0, ioprioIdle)
+}
@@ -0,0 +1,204 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logs are leveled (debug, info, warn, and error, with warnings and errors
+// going to stderr) and come in two formats: the traditional text, one line
+// per message with the request ID in front, or JSON, one object per message
+// carrying the message's fields (see WithLogFields) for log aggregators to
+// index.  Fields don't appear in the text format, whose messages already say
+// what they're about.
+
+var stdout *Logger
+var stdwarn *Logger
+var stderr *Logger
+
+func init() {
+	stdout = New(os.Stdout, "", Ldate|Ltime)
+	stdwarn = New(os.Stderr, "warning: ", Ldate|Ltime)
+	stderr = New(os.Stderr, "error: ", Ldate|Ltime)
+}
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var currentLogLevel = int32(levelInfo)
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch s {
+	case "debug":
+		return levelDebug, nil
+	case "info", "":
+		return levelInfo, nil
+	case "warn":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	}
+	return levelInfo, fmt.Errorf("Unknown log level %q.", s)
+}
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	}
+	return "info"
+}
+
+func setLogLevel(l logLevel) {
+	atomic.StoreInt32(&currentLogLevel, int32(l))
+}
+
+func logEnabled(l logLevel) bool {
+	return logLevel(atomic.LoadInt32(&currentLogLevel)) <= l
+}
+
+// jsonLogs is set when logs are written as JSON.
+var jsonLogs int32
+
+// SetLogFormat chooses the log format: text (the default) or json.
+func SetLogFormat(format string) error {
+	switch format {
+	case "text", "":
+		atomic.StoreInt32(&jsonLogs, 0)
+	case "json":
+		atomic.StoreInt32(&jsonLogs, 1)
+	default:
+		return fmt.Errorf("Unknown log format %q.", format)
+	}
+	return nil
+}
+
+type logFieldsKey struct{}
+
+// WithLogFields adds fields, given as alternating keys and values, to the
+// messages logged with a context (and those derived from it), e.g. the
+// volume ID and device a request is working on.
+func WithLogFields(ctx context.Context, kv ...string) context.Context {
+	fields, _ := ctx.Value(logFieldsKey{}).([]string)
+	fields = append(fields[:len(fields):len(fields)], kv...)
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+// globalFields are added to every message, for fields such as the instance
+// ID which never change.
+var (
+	globalFieldsMu sync.Mutex
+	globalFields   []string
+)
+
+// SetLogFields adds fields, given as alternating keys and values, to every
+// message logged from now on.
+func SetLogFields(kv ...string) {
+	globalFieldsMu.Lock()
+	defer globalFieldsMu.Unlock()
+	globalFields = append(globalFields, kv...)
+}
+
+// logAt writes a message at the given level.
+func logAt(ctx context.Context, level logLevel, format string, a ...interface{}) {
+	if !logEnabled(level) {
+		return
+	}
+	out := stdout
+	switch level {
+	case levelWarn:
+		out = stdwarn
+	case levelError:
+		out = stderr
+	}
+	if atomic.LoadInt32(&jsonLogs) == 0 {
+		out.Printf(ctxPrefix(ctx)+format, a...)
+		return
+	}
+
+	entry := map[string]string{}
+	globalFieldsMu.Lock()
+	addFields(entry, globalFields)
+	globalFieldsMu.Unlock()
+	fields, _ := ctx.Value(logFieldsKey{}).([]string)
+	addFields(entry, fields)
+	if id := RequestId(ctx); id != "" {
+		entry["request_id"] = id
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = strings.TrimSpace(fmt.Sprintf(format, a...))
+	b, _ := json.Marshal(entry)
+	jsonMu.Lock()
+	defer jsonMu.Unlock()
+	out.Writer().Write(append(b, '\n'))
+}
+
+// jsonMu keeps JSON messages written at once from interleaving.
+var jsonMu sync.Mutex
+
+func addFields(entry map[string]string, kv []string) {
+	for i := 0; i+1 < len(kv); i += 2 {
+		entry[kv[i]] = kv[i+1]
+	}
+}
+
+func LogDebug(format string, a ...interface{}) {
+	logAt(context.Background(), levelDebug, format, a...)
+}
+
+func Log(format string, a ...interface{}) {
+	logAt(context.Background(), levelInfo, format, a...)
+}
+
+func LogWarn(format string, a ...interface{}) {
+	logAt(context.Background(), levelWarn, format, a...)
+}
+
+func LogError(format string, a ...interface{}) {
+	logAt(context.Background(), levelError, format, a...)
+}
+
+// The LogCtx variants prefix each line with the context's request ID, so
+// that everything done on behalf of one request can be traced in the logs,
+// and add the context's fields to JSON logs.
+
+func ctxPrefix(ctx context.Context) string {
+	if id := RequestId(ctx); id != "" {
+		return "[" + id + "] "
+	}
+	return ""
+}
+
+func LogCtxDebug(ctx context.Context, format string, a ...interface{}) {
+	logAt(ctx, levelDebug, format, a...)
+}
+
+func LogCtx(ctx context.Context, format string, a ...interface{}) {
+	logAt(ctx, levelInfo, format, a...)
+}
+
+func LogCtxWarn(ctx context.Context, format string, a ...interface{}) {
+	logAt(ctx, levelWarn, format, a...)
+}
+
+func LogCtxError(ctx context.Context, format string, a ...interface{}) {
+	logAt(ctx, levelError, format, a...)
+}
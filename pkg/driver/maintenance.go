@@ -0,0 +1,147 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Background work which is heavy on I/O, or changes volumes (scrubs, backup
+// verification, trims, and raising saturated volumes' IOPS and throughput),
+// is deferred to the configured maintenance windows, so that it stays out of
+// peak hours; outside them blocker only serves Docker (mounts, unmounts, and
+// so on) and does its light bookkeeping.  Work that's due outside a window
+// waits for the next one, and work under way when a window closes stops at
+// the next volume, leaving the rest for the next window.  Without windows,
+// work runs whenever it's due.  Operations asked for through the admin API
+// or CLI always run at once.
+
+func init() {
+	DescribeMetric("blocker_maintenance_deferred_total",
+		"Background work put off until the next maintenance window, by work.")
+}
+
+// maintenanceDays are the days windows are given for, as Weekday numbers.
+var maintenanceDays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseClock parses a time of day (HH:MM) into minutes past midnight.
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Invalid time of day %q: expected HH:MM.", s)
+	}
+	h, herr := strconv.Atoi(parts[0])
+	m, merr := strconv.Atoi(parts[1])
+	if herr != nil || merr != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("Invalid time of day %q: expected HH:MM.", s)
+	}
+	return h*60 + m, nil
+}
+
+// check rejects a window which can't be understood.
+func (w MaintenanceWindow) check() error {
+	for _, day := range w.Days {
+		if _, ok := maintenanceDays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("Invalid day %q: expected one of sun, mon, tue, wed, thu, fri, or sat.", day)
+		}
+	}
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	_, err := parseClock(w.End)
+	return err
+}
+
+// startsOn reports whether the window opens on the given day.
+func (w MaintenanceWindow) startsOn(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if maintenanceDays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether the window is open at the given (local) time.  A
+// window ending no later than it starts runs past midnight.
+func (w MaintenanceWindow) contains(t time.Time) bool {
+	start, _ := parseClock(w.Start)
+	end, _ := parseClock(w.End)
+	now := t.Hour()*60 + t.Minute()
+	if start < end {
+		return w.startsOn(t.Weekday()) && now >= start && now < end
+	}
+	return (w.startsOn(t.Weekday()) && now >= start) ||
+		(w.startsOn(t.AddDate(0, 0, -1).Weekday()) && now < end)
+}
+
+// location is the time zone the windows are given in.
+func (c MaintenanceConfig) location() *time.Location {
+	if c.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// open reports whether deferred work may run at the given time: always, if
+// there are no windows.
+func (c MaintenanceConfig) open(t time.Time) bool {
+	if len(c.Windows) == 0 {
+		return true
+	}
+	t = t.In(c.location())
+	for _, w := range c.Windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// next is when the next window opens after the given time (to the minute),
+// or the zero time if none does within a week.
+func (c MaintenanceConfig) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	for i := 0; i <= 7*24*60; i++ {
+		t = t.Add(time.Minute)
+		if c.open(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// maintenanceOpen reports whether deferred work may run now.
+func maintenanceOpen() bool {
+	return GetConfig().Maintenance.open(time.Now())
+}
+
+// awaitMaintenance waits for a maintenance window to be open, logging that the
+// work is put off if it isn't.
+func awaitMaintenance(ctx context.Context, work string) error {
+	if maintenanceOpen() {
+		return nil
+	}
+	IncCounter("blocker_maintenance_deferred_total", "work", work)
+	if next := GetConfig().Maintenance.next(time.Now()); !next.IsZero() {
+		LogCtx(ctx, "Deferring %v until the maintenance window at %v.\n", work, next.Format(time.RFC3339))
+	}
+	for !maintenanceOpen() {
+		if err := sleep(ctx, time.Minute); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A deliberately tiny metrics registry, exposed in the Prometheus text format
+// so that fleets can scrape it without blocker taking on more dependencies.
+
+var (
+	metricsMu  sync.Mutex
+	counters   = make(map[string]float64)
+	gauges     = make(map[string]float64)
+	histograms = make(map[string]*histogram)
+	help       = make(map[string]string)
+)
+
+// durationBuckets are the histogram buckets, in seconds, for how long things
+// take: from quick API calls to attaches that drag on for minutes.
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// histogram is one series of a histogram family.
+type histogram struct {
+	name   string
+	labels []string
+	// counts[i] counts the observations up to durationBuckets[i].
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metricKey renders a metric name and label pairs as a series identifier,
+// e.g. `blocker_panics_total{handler="/VolumeDriver.Mount"}`.
+func metricKey(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// DescribeMetric records the help text for a metric family.
+func DescribeMetric(name string, text string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	help[name] = text
+}
+
+// IncCounter adds one to a counter.  Labels are given as name, value pairs.
+func IncCounter(name string, labels ...string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	counters[metricKey(name, labels...)]++
+}
+
+// AddCounter adds the given amount to a counter, e.g. a count of bytes.
+func AddCounter(value float64, name string, labels ...string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	counters[metricKey(name, labels...)] += value
+}
+
+// SetGauge sets a gauge to the given value.
+func SetGauge(value float64, name string, labels ...string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	gauges[metricKey(name, labels...)] = value
+}
+
+// ObserveDuration records how long something took in a histogram.
+func ObserveDuration(d time.Duration, name string, labels ...string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	key := metricKey(name, labels...)
+	h, ok := histograms[key]
+	if !ok {
+		h = &histogram{name: name, labels: labels, counts: make([]uint64, len(durationBuckets))}
+		histograms[key] = h
+	}
+	for i, le := range durationBuckets {
+		if d.Seconds() <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += d.Seconds()
+	h.count++
+}
+
+func WriteMetrics(w io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	writeFamily(w, counters, "counter")
+	writeFamily(w, gauges, "gauge")
+	writeHistograms(w)
+}
+
+func writeHeader(w io.Writer, name string, kind string) {
+	if text, ok := help[name]; ok {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, text)
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func writeFamily(w io.Writer, series map[string]float64, kind string) {
+	var keys []string
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	described := make(map[string]bool)
+	for _, k := range keys {
+		name := strings.SplitN(k, "{", 2)[0]
+		if !described[name] {
+			described[name] = true
+			writeHeader(w, name, kind)
+		}
+		fmt.Fprintf(w, "%s %v\n", k, series[k])
+	}
+}
+
+func writeHistograms(w io.Writer) {
+	var keys []string
+	for k := range histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	described := make(map[string]bool)
+	for _, k := range keys {
+		h := histograms[k]
+		if !described[h.name] {
+			described[h.name] = true
+			writeHeader(w, h.name, "histogram")
+		}
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "%s %v\n", metricKey(h.name+"_bucket",
+				append(h.labels[:len(h.labels):len(h.labels)], "le", fmt.Sprint(le))...), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s %v\n", metricKey(h.name+"_bucket",
+			append(h.labels[:len(h.labels):len(h.labels)], "le", "+Inf")...), h.count)
+		fmt.Fprintf(w, "%s %v\n", metricKey(h.name+"_sum", h.labels...), h.sum)
+		fmt.Fprintf(w, "%s %v\n", metricKey(h.name+"_count", h.labels...), h.count)
+	}
+}
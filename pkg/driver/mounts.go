@@ -0,0 +1,126 @@
+package driver
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// mountInfo is a single entry from the mount table.
+type mountInfo struct {
+	Major      uint32
+	Minor      uint32
+	MountPoint string
+	FSType     string
+	Source     string
+	Options    string
+}
+
+// deviceNumber returns the major and minor numbers of a disk's device node.
+func deviceNumber(dev string) (uint32, uint32, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dev, &st); err != nil {
+		return 0, 0, err
+	}
+	if st.Mode&syscall.S_IFMT != diskNodeType {
+		return 0, 0, fmt.Errorf("%v is not a block device.", dev)
+	}
+	major, minor := splitRdev(uint64(st.Rdev))
+	return major, minor, nil
+}
+
+// findMountpoint returns the mount table entry for path, if path is itself a
+// mountpoint.
+func findMountpoint(mounts []mountInfo, path string) *mountInfo {
+	path = filepath.Clean(path)
+	for i := range mounts {
+		if mounts[i].MountPoint == path {
+			return &mounts[i]
+		}
+	}
+	return nil
+}
+
+// findDeviceMounts returns every place the given block device is mounted.
+func findDeviceMounts(mounts []mountInfo, dev string) ([]mountInfo, error) {
+	major, minor, err := deviceNumber(dev)
+	if err != nil {
+		return nil, err
+	}
+	var found []mountInfo
+	for _, m := range mounts {
+		if m.Major == major && m.Minor == minor {
+			found = append(found, m)
+		}
+	}
+	return found, nil
+}
+
+// checkMountTarget makes sure that mounting dev at mnt won't stack a mount on
+// top of an existing one or mount a device that's already in use elsewhere.
+func checkMountTarget(dev string, mnt string) error {
+	mounts, err := readMounts()
+	if err != nil {
+		return err
+	}
+	if m := findMountpoint(mounts, mnt); m != nil {
+		return errorf(CodeAlreadyMounted, "Mountpoint %v is already in use by %v (%v).",
+			mnt, m.Source, m.FSType)
+	}
+	existing, err := findDeviceMounts(mounts, dev)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		var where []string
+		for _, m := range existing {
+			where = append(where, m.MountPoint)
+		}
+		return errorf(CodeAlreadyMounted, "Device %v is already mounted at %v.",
+			dev, strings.Join(where, ", "))
+	}
+	return nil
+}
+
+// unmount unmounts the filesystem at mnt, then lets go of its storage if it
+// has to be (see Exporter), so that its device can be detached.  fstype, if
+// known, is the filesystem's type, in case it has its own way of unmounting
+// (see Unmounter).
+func unmount(mnt string, fstype string) error {
+	mounts, _ := readMounts()
+	m := findMountpoint(mounts, mnt)
+	if m != nil {
+		fstype = m.FSType
+	}
+	if u, ok := filesystemFor(fstype).(Unmounter); ok {
+		return u.Unmount(mnt)
+	}
+	if out, err := exec.Command("umount", mnt).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unmounting %v failed: %v\n%v", mnt, err, string(out))
+	}
+	if m != nil {
+		if e, ok := filesystemFor(m.FSType).(Exporter); ok {
+			return e.Export(m.Source)
+		}
+	}
+	return nil
+}
+
+// deviceNotReady reports whether mount's output says the device isn't there
+// (yet), as opposed to it being there but unmountable.
+func deviceNotReady(out string) bool {
+	for _, s := range []string{
+		"does not exist",
+		"No such device",
+		"No such file or directory",
+		"no medium found",
+		"Device not configured",
+	} {
+		if strings.Contains(out, s) {
+			return true
+		}
+	}
+	return false
+}
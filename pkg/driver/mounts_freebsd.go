@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// FreeBSD has no block devices: disks are character devices.
+const diskNodeType = syscall.S_IFCHR
+
+// forceUnmountFlag makes umount let go of a filesystem whose device has gone.
+const forceUnmountFlag = "-f"
+
+// Flags from getfsstat(2) and statfs(2); see sys/mount.h.
+const (
+	mntNoWait  = 2
+	mntRdonly  = 0x1
+	mntNoatime = 0x10000000
+)
+
+// readMounts fetches the current mount table from the kernel.  The device
+// numbers are filled in only for filesystems mounted from a device node.
+func readMounts() ([]mountInfo, error) {
+	n, err := syscall.Getfsstat(nil, mntNoWait)
+	if err != nil {
+		return nil, err
+	}
+	// Leave room for mounts made meanwhile.
+	buf := make([]syscall.Statfs_t, n+16)
+	n, err = syscall.Getfsstat(buf, mntNoWait)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := make([]mountInfo, 0, n)
+	for _, st := range buf[:n] {
+		m := mountInfo{
+			MountPoint: filepath.Clean(cString(st.Mntonname[:])),
+			FSType:     cString(st.Fstypename[:]),
+			Source:     cString(st.Mntfromname[:]),
+			Options:    "rw",
+		}
+		if st.Flags&mntRdonly != 0 {
+			m.Options = "ro"
+		}
+		if st.Flags&mntNoatime != 0 {
+			m.Options += ",noatime"
+		}
+		if filepath.IsAbs(m.Source) {
+			if fi, err := os.Stat(m.Source); err == nil && fi.Mode()&os.ModeDevice != 0 {
+				m.Major, m.Minor, _ = deviceNumber(m.Source)
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// cString converts a NUL-terminated C string in a fixed-size array.
+func cString(s []int8) string {
+	b := make([]byte, 0, len(s))
+	for _, c := range s {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b)
+}
+
+// splitRdev splits a device number into its major and minor numbers.  See
+// sys/types.h.
+func splitRdev(rdev uint64) (uint32, uint32) {
+	major := uint32((rdev>>32)&0xffffff00) | uint32((rdev>>8)&0xff)
+	minor := uint32((rdev>>24)&0xff00) | uint32(rdev&0xffff00ff)
+	return major, minor
+}
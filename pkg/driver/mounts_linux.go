@@ -0,0 +1,88 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// MountInfoFile lists every mount visible to this process.  See proc(5).
+const MountInfoFile = "/proc/self/mountinfo"
+
+// diskNodeType is the type of disks' device nodes.
+const diskNodeType = syscall.S_IFBLK
+
+// forceUnmountFlag makes umount let go of a filesystem whose device has gone
+// (lazily, on Linux).
+const forceUnmountFlag = "-l"
+
+// readMounts parses the current mount table.
+func readMounts() ([]mountInfo, error) {
+	f, err := os.Open(MountInfoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines look like this, with a variable number of optional fields
+		// terminated by a lone hyphen:
+		//     36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 6 || sep < 6 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("Malformed line in %v: %v",
+				MountInfoFile, scanner.Text())
+		}
+
+		var m mountInfo
+		if _, err := fmt.Sscanf(fields[2], "%d:%d", &m.Major, &m.Minor); err != nil {
+			return nil, fmt.Errorf("Malformed device number in %v: %v",
+				MountInfoFile, fields[2])
+		}
+		m.MountPoint = unescapeMountField(fields[4])
+		m.Options = fields[5]
+		m.FSType = fields[sep+1]
+		m.Source = unescapeMountField(fields[sep+2])
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountField undoes the octal escaping (e.g. \040 for a space) which
+// the kernel applies to paths in the mount table.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// splitRdev splits a device number into its major and minor numbers.
+func splitRdev(rdev uint64) (uint32, uint32) {
+	major := uint32((rdev>>8)&0xfff) | uint32((rdev>>32)&^0xfff)
+	minor := uint32(rdev&0xff) | uint32((rdev>>12)&^0xff)
+	return major, minor
+}
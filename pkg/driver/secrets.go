@@ -0,0 +1,184 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// Secrets, such as LUKS keys and the admin API's shared secret, needn't live
+// in plain text in the configuration or on disk.  Wherever one is needed it's
+// named by reference, as <provider>:<name>:
+//
+//	file:/etc/blocker/secret      a file on the host
+//	env:BLOCKER_SECRET            a variable in the daemon's environment
+//	secretsmanager:prod/blocker   an AWS Secrets Manager secret, by name or ARN
+//	ssm:/blocker/secret           an SSM parameter (SecureStrings decrypted)
+//
+// Other providers (Vault, say) are added with RegisterSecretProvider.  The
+// daemon fetches AWS secrets with its own session, so they honor -assume-role
+// and the like; the CLI fetches them with the default credential chain.
+
+// SecretProvider fetches secrets from one kind of store.
+type SecretProvider interface {
+	// Secret fetches the named secret.
+	Secret(ctx context.Context, name string) ([]byte, error)
+}
+
+// SecretProviderFunc adapts a function to a SecretProvider.
+type SecretProviderFunc func(ctx context.Context, name string) ([]byte, error)
+
+func (f SecretProviderFunc) Secret(ctx context.Context, name string) ([]byte, error) {
+	return f(ctx, name)
+}
+
+var (
+	secretProvidersMu sync.Mutex
+	secretProviders   = map[string]SecretProvider{}
+)
+
+// RegisterSecretProvider makes a provider available by name (as used in
+// secret references), replacing any registered before.
+func RegisterSecretProvider(name string, p SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+	secretProviders[name] = p
+}
+
+func init() {
+	RegisterSecretProvider("file", SecretProviderFunc(func(_ context.Context, path string) ([]byte, error) {
+		return ioutil.ReadFile(path)
+	}))
+	RegisterSecretProvider("env", SecretProviderFunc(func(_ context.Context, name string) ([]byte, error) {
+		return []byte(os.Getenv(name)), nil
+	}))
+	RegisterSecretProvider("secretsmanager", SecretProviderFunc(func(ctx context.Context, id string) ([]byte, error) {
+		sess, err := defaultSecretSession()
+		if err != nil {
+			return nil, err
+		}
+		return secretsManagerSecret(ctx, secretsmanager.New(sess), id)
+	}))
+	RegisterSecretProvider("ssm", SecretProviderFunc(func(ctx context.Context, name string) ([]byte, error) {
+		sess, err := defaultSecretSession()
+		if err != nil {
+			return nil, err
+		}
+		return ssmSecret(ctx, ssm.New(sess), name)
+	}))
+}
+
+// parseSecretRef splits a secret reference into its provider and name,
+// checking that the provider is known.
+func parseSecretRef(ref string) (SecretProvider, string, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, "", fmt.Errorf("Invalid secret %q; expected <provider>:<name>, with a provider of %v.",
+			ref, secretProviderNames())
+	}
+	secretProvidersMu.Lock()
+	p, ok := secretProviders[parts[0]]
+	secretProvidersMu.Unlock()
+	if !ok {
+		return nil, "", fmt.Errorf("Unknown secret provider %q; expected one of %v.",
+			parts[0], secretProviderNames())
+	}
+	return p, parts[1], nil
+}
+
+func secretProviderNames() string {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+	var names []string
+	for name := range secretProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// ReadSecret fetches the secret a reference names.  An empty secret is an
+// error, since it's surely a mistake.
+func ReadSecret(ctx context.Context, ref string) ([]byte, error) {
+	p, name, err := parseSecretRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := p.Secret(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("Fetching secret %v failed: %v", ref, err)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Secret %v is empty.", ref)
+	}
+	return secret, nil
+}
+
+var secretSession struct {
+	sync.Once
+	sess *session.Session
+	err  error
+}
+
+// defaultSecretSession is the AWS session secrets are fetched with outside
+// the daemon, in the region of the environment or else the instance's.
+func defaultSecretSession() (*session.Session, error) {
+	secretSession.Do(func() {
+		sess, err := session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			secretSession.err = err
+			return
+		}
+		if aws.StringValue(sess.Config.Region) == "" {
+			region, err := ec2metadata.New(sess).Region()
+			if err != nil {
+				secretSession.err = fmt.Errorf("No AWS region is configured, and the instance's can't be found: %v", err)
+				return
+			}
+			sess = sess.Copy(&aws.Config{Region: aws.String(region)})
+		}
+		secretSession.sess = sess
+	})
+	return secretSession.sess, secretSession.err
+}
+
+// secretsManagerSecret fetches the current version of a Secrets Manager
+// secret.
+func secretsManagerSecret(ctx context.Context, svc *secretsmanager.SecretsManager, id string,
+	opts ...request.Option) ([]byte, error) {
+	out, err := svc.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(id),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if out.SecretString != nil {
+		return []byte(aws.StringValue(out.SecretString)), nil
+	}
+	return out.SecretBinary, nil
+}
+
+// ssmSecret fetches an SSM parameter, decrypting it if it's a SecureString.
+func ssmSecret(ctx context.Context, svc *ssm.SSM, name string, opts ...request.Option) ([]byte, error) {
+	out, err := svc.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(aws.StringValue(out.Parameter.Value)), nil
+}
@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"context"
+	"time"
+)
+
+// slowAttacher delays another Attacher's attaches, detaches, and device
+// appearances by the amounts configured in slow_ebs (none, normally), to
+// simulate a slow EBS.
+type slowAttacher struct {
+	Attacher
+}
+
+func (s slowAttacher) Attach(ctx context.Context, id string) (string, error) {
+	dev, err := s.Attacher.Attach(ctx, id)
+	if err == nil {
+		err = slowDown(ctx, "attach of "+id, GetConfig().SlowEBS.Attach)
+	}
+	return dev, err
+}
+
+func (s slowAttacher) Detach(ctx context.Context, id string) error {
+	err := s.Attacher.Detach(ctx, id)
+	if err == nil {
+		err = slowDown(ctx, "detach of "+id, GetConfig().SlowEBS.Detach)
+	}
+	return err
+}
+
+func (s slowAttacher) ResolveDevice(ctx context.Context, id string, dev string) (string, error) {
+	if err := slowDown(ctx, "device "+dev, GetConfig().SlowEBS.Device); err != nil {
+		return "", err
+	}
+	return s.Attacher.ResolveDevice(ctx, id, dev)
+}
+
+func slowDown(ctx context.Context, what string, delay Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	LogCtx(ctx, "\tSlowing %v by %v (slow_ebs).\n", what, time.Duration(delay))
+	return sleep(ctx, time.Duration(delay))
+}
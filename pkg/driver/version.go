@@ -0,0 +1,77 @@
+package driver
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Version and GitCommit identify the build.  Release builds stamp these via
+// the linker, e.g.:
+//
+//	go build -ldflags "-X github.com/ewindisch/blocker/pkg/driver.Version=v0.4 -X github.com/ewindisch/blocker/pkg/driver.GitCommit=$(git rev-parse HEAD)"
+var (
+	Version   = "v0.3"
+	GitCommit = "unknown"
+)
+
+// BuildInfo describes this binary, so that fleet tooling can inventory which
+// plugin versions (and which optional features) are running on each host.
+type BuildInfo struct {
+	Version   string
+	GitCommit string
+	GoVersion string
+	Features  []string
+}
+
+func CurrentBuildInfo() BuildInfo {
+	return BuildInfo{
+		Version:   Version,
+		GitCommit: GitCommit,
+		GoVersion: runtime.Version(),
+		Features:  enabledFeatures(),
+	}
+}
+
+// enabledFeatures lists the optional behaviors turned on for this daemon.
+func enabledFeatures() []string {
+	features := []string{}
+	c := GetConfig()
+	if c.AutoCreate {
+		features = append(features, "auto-create")
+	}
+	if c.Watchdog.Interval > 0 && c.Watchdog.Remount {
+		features = append(features, "auto-remount")
+	}
+	if c.Verify.Interval > 0 {
+		features = append(features, "backup-verify")
+	}
+	if c.Saturation.Interval > 0 && c.Saturation.Remediate {
+		features = append(features, "auto-tune")
+	}
+	if c.Grow.Interval > 0 {
+		features = append(features, "auto-grow")
+	}
+	if c.Scrub.Interval > 0 {
+		features = append(features, "scrub")
+	}
+	if len(c.Pool.Classes) > 0 {
+		features = append(features, "warm-pool")
+	}
+	if c.Lease.Enabled {
+		features = append(features, "attach-lease")
+	}
+	if c.Reconcile.Interval > 0 {
+		features = append(features, "reconcile-"+c.Reconcile.Policy)
+	}
+	return append(features, changedFeatures()...)
+}
+
+func (b BuildInfo) String() string {
+	features := "none"
+	if len(b.Features) > 0 {
+		features = strings.Join(b.Features, ",")
+	}
+	return fmt.Sprintf("blocker %s (commit %s, %s, features: %s)",
+		b.Version, b.GitCommit, b.GoVersion, features)
+}
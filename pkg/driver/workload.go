@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+)
+
+// Choosing a filesystem, and the mkfs and mount flags to go with it, takes
+// more expertise than most people creating a volume have.  The workload
+// option names what the volume is for (db, logs, or scratch, or anything else
+// configured in workloads), and the workload's policy supplies the fstype,
+// the flags a blank volume is formatted with, and the mount flags.  An fstype
+// option overrides the policy's filesystem, and with it the policy's mkfs
+// flags, which are specific to its filesystem; a mount-flags option overrides
+// the policy's mount flags.
+
+// defaultWorkloads are the built-in workload policies, which workloads in
+// the configuration may replace.
+var defaultWorkloads = map[string]WorkloadPolicy{
+	// Databases do small random writes and fsync often, which XFS handles
+	// well; a new EBS volume has nothing to discard.
+	"db": {FSType: "xfs", MkfsFlags: []string{"-K"}, MountFlags: []string{"noatime"}},
+	// Logs are appended to, and can stand losing their last minute in a
+	// crash in exchange for fewer journal commits.
+	"logs": {FSType: "ext4", MkfsFlags: []string{"-m", "1"}, MountFlags: []string{"noatime", "commit=60"}},
+	// Scratch space doesn't survive a crash anyway, so needs neither a
+	// journal nor space reserved for root.
+	"scratch": {FSType: "ext4", MkfsFlags: []string{"-m", "0", "-O", "^has_journal"},
+		MountFlags: []string{"noatime"}},
+}
+
+// defaultWorkloadPolicies copies the built-in workload policies, for a new
+// configuration to add to.
+func defaultWorkloadPolicies() map[string]WorkloadPolicy {
+	workloads := map[string]WorkloadPolicy{}
+	for name, p := range defaultWorkloads {
+		workloads[name] = p
+	}
+	return workloads
+}
+
+// workloadPolicy finds the policy for the named workload.
+func workloadPolicy(name string) (WorkloadPolicy, error) {
+	p, ok := GetConfig().Workloads[name]
+	if !ok {
+		return p, fmt.Errorf("Unknown workload %q.", name)
+	}
+	return p, nil
+}
+
+// formatFilesystem formats a device with the named filesystem, passing mkfs
+// any flags given if the filesystem can take them.
+func formatFilesystem(ctx context.Context, fstype string, dev string, flags []string) error {
+	fs := filesystemFor(fstype)
+	if len(flags) == 0 {
+		return fs.Format(dev)
+	}
+	if ff, ok := fs.(FlagFormatter); ok {
+		return ff.FormatWithFlags(dev, flags)
+	}
+	LogCtxWarn(ctx, "\tFormatting %v without mkfs flags %v: %q filesystems can't take them.\n",
+		dev, flags, fstype)
+	return fs.Format(dev)
+}
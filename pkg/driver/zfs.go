@@ -0,0 +1,131 @@
+package driver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Each ZFS volume is a pool of its own, on the whole disk, whose root
+// dataset is mounted like any other filesystem (its mountpoint property is
+// "legacy", so ZFS never mounts it anywhere by itself).  Pools are imported
+// as they're mounted, and exported once they're unmounted, so that the disk
+// can be detached and imported elsewhere; they're never recorded in a
+// cachefile, so nothing tries to import them at boot.  A pool is named after
+// the device it's on (e.g. blocker-DISK-vol0123456789abcdef0), renaming it as
+// it's imported if need be, so that volumes formatted on different hosts
+// never clash.
+
+func init() {
+	RegisterFilesystem("zfs", zfsFilesystem{})
+}
+
+type zfsFilesystem struct{}
+
+// zfsPoolName is the name of the pool on a device.
+func zfsPoolName(dev string) string {
+	name := []byte("blocker-" + filepath.Base(dev))
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// zfsPool is the pool holding a ZFS mount's source (pool/dataset).
+func zfsPool(source string) string {
+	return strings.SplitN(source, "/", 2)[0]
+}
+
+func (z zfsFilesystem) Format(dev string) error {
+	pool := zfsPoolName(dev)
+	if out, err := exec.Command("zpool", "create", "-o", "cachefile=none", "-m", "legacy",
+		pool, dev).CombinedOutput(); err != nil {
+		return fmt.Errorf("Creating ZFS pool %v on %v failed: %v\n%v", pool, dev, err, string(out))
+	}
+	return run("zpool", "export", pool)
+}
+
+// Check fails: ZFS has no offline check, and checks (and repairs) its data as
+// it reads it.
+func (z zfsFilesystem) Check(ctx context.Context, dev string, repair bool) error {
+	return errors.New("ZFS has no offline check; mount the volume and scrub its pool " +
+		"(`zpool scrub <pool>`) instead.")
+}
+
+// zfsPoolId finds the GUID of the exported pool on a device, as
+// `zpool import -d` lists it.
+func zfsPoolId(dev string) (string, error) {
+	out, err := exec.Command("zpool", "import", "-d", dev).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("No ZFS pool to import was found on %v: %v\n%v", dev, err, string(out))
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == "id:" {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("No ZFS pool to import was found on %v.\n%v", dev, string(out))
+}
+
+// Mount imports the device's pool (unless it's still imported from before),
+// read-only for read-only mounts, and mounts its root dataset.
+func (z zfsFilesystem) Mount(dev string, mnt string, flags []string) (string, error) {
+	pool := zfsPoolName(dev)
+	if exec.Command("zpool", "list", "-H", "-o", "name", pool).Run() != nil {
+		id, err := zfsPoolId(dev)
+		if err != nil {
+			return err.Error(), err
+		}
+		args := []string{"import", "-d", dev, "-N", "-o", "cachefile=none"}
+		for _, f := range flags {
+			if f == "ro" {
+				args = append(args, "-o", "readonly=on")
+			}
+		}
+		if out, err := exec.Command("zpool", append(args, id, pool)...).CombinedOutput(); err != nil {
+			return string(out), err
+		}
+	}
+
+	args := []string{"-t", "zfs"}
+	if len(flags) > 0 {
+		args = append(args, "-o", strings.Join(flags, ","))
+	}
+	out, err := exec.Command("mount", append(args, pool, mnt)...).CombinedOutput()
+	if err != nil {
+		exec.Command("zpool", "export", pool).Run()
+	}
+	return string(out), err
+}
+
+// Grow expands the pool onto the rest of its (enlarged) device.
+func (z zfsFilesystem) Grow(dev string, mnt string) error {
+	return run("zpool", "online", "-e", zfsPoolName(dev), dev)
+}
+
+// Freeze fails: ZFS can't be frozen, but needn't be, since its writes are
+// transactional and an EBS snapshot of it is as good as a crash.
+func (z zfsFilesystem) Freeze(mnt string, frozen bool) error {
+	return errors.New("ZFS filesystems can't be frozen (nor need to be for their " +
+		"snapshots to be consistent).")
+}
+
+// Export exports the pool, so that its device can be detached.
+func (z zfsFilesystem) Export(source string) error {
+	return run("zpool", "export", zfsPool(source))
+}
+
+// Trim trims the pool, waiting until it's done.
+func (z zfsFilesystem) Trim(source string, mnt string) error {
+	return run("zpool", "trim", "-w", zfsPool(source))
+}
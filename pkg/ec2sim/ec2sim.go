@@ -0,0 +1,567 @@
+// Package ec2sim simulates, in process, the parts of the EC2 API that blocker
+// uses: volumes and their lifecycle (creating, available, in-use, deleting),
+// attachments (attaching, attached, detaching), snapshots, volume
+// modifications, the instances volumes are attached to, and the state of the
+// KMS keys encrypted volumes depend on (see SetKeyState).  Transitions take
+// as long as they're set to (see SetLatency), or never finish (see Stall),
+// and any call can be made to fail with whatever error EC2 might give (see
+// Fail), so that the driver's handling of a slow or misbehaving EC2 can be
+// exercised without an AWS account.  The driver uses a simulation in place of
+// EC2 when given one in its Options; this package's tests drive the driver
+// through Docker's requests over one.
+package ec2sim
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// Owner is the account the simulated resources belong to.
+const Owner = "123456789012"
+
+// DefaultKey is the KMS key encrypted volumes and snapshots get when they
+// aren't given one.
+const DefaultKey = "alias/aws/ebs"
+
+// RootDevice is the device instances boot from.
+const RootDevice = "/dev/xvda"
+
+// The transitions which take time (see SetLatency and Stall).
+const (
+	Create   = "create"   // creating volumes, until they're available
+	Attach   = "attach"   // attaching volumes, until they're attached
+	Detach   = "detach"   // detaching volumes, until they're available again
+	Delete   = "delete"   // deleting volumes, until they're gone
+	Snapshot = "snapshot" // taking snapshots, until they're completed
+	Modify   = "modify"   // modifying volumes, until they're optimizing, then completed
+)
+
+type volume struct {
+	vol ec2.Volume
+	// done is when the volume's creation or deletion finishes.
+	done       time.Time
+	attachment *attachment
+	mod        *ec2.VolumeModification
+	// modDone is when the modification's current stage finishes.
+	modDone time.Time
+}
+
+type attachment struct {
+	instance            string
+	device              string
+	state               string
+	since               time.Time
+	done                time.Time
+	forced              bool
+	deleteOnTermination bool
+}
+
+type snapshot struct {
+	snap ec2.Snapshot
+	done time.Time
+}
+
+type instance struct {
+	root string
+	tags []*ec2.Tag
+}
+
+type failure struct {
+	code string
+	// left is how many more calls fail; negative means all of them.
+	left int
+}
+
+// EC2 is a simulation of EC2, in a single availability zone.  It implements
+// only the calls blocker makes; the rest panic.
+type EC2 struct {
+	ec2iface.EC2API
+
+	mu        sync.Mutex
+	zone      string
+	latency   map[string]time.Duration
+	stalled   map[string]bool
+	failures  map[string]*failure
+	calls     map[string]int
+	volumes   map[string]*volume
+	snapshots map[string]*snapshot
+	instances map[string]*instance
+	keys      map[string]*key
+	next      int
+}
+
+// New makes a simulation of EC2 in the given availability zone, with the
+// given instances running in it, each booted from a root volume (tagged
+// Name=root) attached at RootDevice.
+func New(zone string, instances ...string) *EC2 {
+	e := &EC2{
+		zone:      zone,
+		latency:   map[string]time.Duration{},
+		stalled:   map[string]bool{},
+		failures:  map[string]*failure{},
+		calls:     map[string]int{},
+		volumes:   map[string]*volume{},
+		snapshots: map[string]*snapshot{},
+		instances: map[string]*instance{},
+		keys:      map[string]*key{},
+	}
+	for _, id := range instances {
+		e.AddInstance(id)
+	}
+	return e
+}
+
+// Zone is the availability zone the instances run in.
+func (e *EC2) Zone() string {
+	return e.zone
+}
+
+// SetLatency sets how long a transition (Create, Attach, and so on) takes
+// from when it's asked for, or, given the name of a call (like
+// "DescribeVolumes"), how long the call takes to answer.
+func (e *EC2) SetLatency(name string, d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.latency[name] = d
+}
+
+// Stall stops transitions of the given kind finishing (leaving volumes stuck
+// attaching, say), or with stalled false lets them finish again.  Forced
+// detaches finish regardless.
+func (e *EC2) Stall(transition string, stalled bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stalled[transition] = stalled
+}
+
+// Fail makes the next n calls of the named kind (like "AttachVolume") fail
+// with the given EC2 error code, or every call if n is negative.  An empty
+// code stops them failing.  DescribeVolumesPages counts as DescribeVolumes.
+func (e *EC2) Fail(call string, code string, n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if code == "" || n == 0 {
+		delete(e.failures, call)
+		return
+	}
+	e.failures[call] = &failure{code: code, left: n}
+}
+
+// Calls reports how many calls of the named kind have been made.
+func (e *EC2) Calls(call string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls[call]
+}
+
+// AddInstance starts an instance, booted from a new root volume.
+func (e *EC2) AddInstance(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	root := e.newId("vol")
+	e.volumes[root] = &volume{
+		vol: ec2.Volume{
+			VolumeId:         aws.String(root),
+			AvailabilityZone: aws.String(e.zone),
+			CreateTime:       aws.Time(now),
+			Size:             aws.Int64(8),
+			VolumeType:       aws.String(ec2.VolumeTypeGp3),
+			Encrypted:        aws.Bool(false),
+			State:            aws.String(ec2.VolumeStateInUse),
+			Tags:             []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("root")}},
+		},
+		attachment: &attachment{instance: id, device: RootDevice,
+			state: ec2.VolumeAttachmentStateAttached, since: now, deleteOnTermination: true},
+	}
+	e.instances[id] = &instance{root: root}
+}
+
+// AddVolume makes an available volume of the given size (in GiB) in the
+// given availability zone, returning its ID.
+func (e *EC2) AddVolume(zone string, size int64, tags map[string]string) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id := e.newId("vol")
+	e.volumes[id] = &volume{vol: ec2.Volume{
+		VolumeId:         aws.String(id),
+		AvailabilityZone: aws.String(zone),
+		CreateTime:       aws.Time(time.Now()),
+		Size:             aws.Int64(size),
+		VolumeType:       aws.String(ec2.VolumeTypeGp3),
+		Encrypted:        aws.Bool(false),
+		State:            aws.String(ec2.VolumeStateAvailable),
+		Tags:             mapTags(tags),
+	}}
+	return id
+}
+
+// AddSnapshot makes a completed snapshot of a volume of the given size (in
+// GiB), returning its ID.
+func (e *EC2) AddSnapshot(size int64, tags map[string]string) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id := e.newId("snap")
+	e.snapshots[id] = &snapshot{snap: ec2.Snapshot{
+		SnapshotId: aws.String(id),
+		VolumeId:   aws.String("vol-ffffffff"),
+		VolumeSize: aws.Int64(size),
+		OwnerId:    aws.String(Owner),
+		Encrypted:  aws.Bool(false),
+		StartTime:  aws.Time(time.Now()),
+		State:      aws.String(ec2.SnapshotStateCompleted),
+		Progress:   aws.String("100%"),
+		Tags:       mapTags(tags),
+	}}
+	return id
+}
+
+// Volume describes a volume as DescribeVolumes would, without counting as a
+// call, or returns nil if there's no such volume.
+func (e *EC2) Volume(id string) *ec2.Volume {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+	if v, ok := e.volumes[id]; ok {
+		return v.describe()
+	}
+	return nil
+}
+
+// VolumesNamed describes the volumes with the given Name tag, oldest first,
+// without counting as a call.
+func (e *EC2) VolumesNamed(name string) []*ec2.Volume {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+	var found []*ec2.Volume
+	for _, id := range e.volumeIds() {
+		v := e.volumes[id]
+		if tagValue(v.vol.Tags, "Name") == name {
+			found = append(found, v.describe())
+		}
+	}
+	return found
+}
+
+// errorf makes an error as EC2 would return it.
+func errorf(code string, format string, args ...interface{}) error {
+	return awserr.New(code, fmt.Sprintf(format, args...), nil)
+}
+
+// call accounts for a call of the named kind, making it fail if it's meant
+// to, and taking as long as it's meant to.
+func (e *EC2) call(ctx context.Context, name string) error {
+	e.mu.Lock()
+	e.calls[name]++
+	delay := e.latency[name]
+	var err error
+	if f, ok := e.failures[name]; ok {
+		err = errorf(f.code, "Simulated %v failure.", name)
+		if f.left > 0 {
+			if f.left--; f.left == 0 {
+				delete(e.failures, name)
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+		case <-t.C:
+		}
+	}
+	if ctx.Err() != nil {
+		return awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+	}
+	return err
+}
+
+func (e *EC2) newId(prefix string) string {
+	e.next++
+	return fmt.Sprintf("%v-%017x", prefix, e.next)
+}
+
+// due reports whether a transition begun earlier has finished by now.
+func (e *EC2) due(transition string, done time.Time, now time.Time) bool {
+	return !e.stalled[transition] && !now.Before(done)
+}
+
+// advance finishes the transitions due by now.  Time moves on only when
+// someone looks, which is all anyone could tell.
+func (e *EC2) advance() {
+	now := time.Now()
+	for id, v := range e.volumes {
+		switch aws.StringValue(v.vol.State) {
+		case ec2.VolumeStateCreating:
+			if e.due(Create, v.done, now) {
+				v.vol.State = aws.String(ec2.VolumeStateAvailable)
+				if !e.usable(v) {
+					v.vol.State = aws.String(ec2.VolumeStateError)
+				}
+			}
+		case ec2.VolumeStateDeleting:
+			if e.due(Delete, v.done, now) {
+				delete(e.volumes, id)
+				continue
+			}
+		}
+		if a := v.attachment; a != nil {
+			switch a.state {
+			case ec2.VolumeAttachmentStateAttaching:
+				if e.due(Attach, a.done, now) {
+					a.state = ec2.VolumeAttachmentStateAttached
+					if !e.usable(v) {
+						// EBS can't decrypt it, and says nothing.
+						v.attachment = nil
+						v.vol.State = aws.String(ec2.VolumeStateAvailable)
+					}
+				}
+			case ec2.VolumeAttachmentStateDetaching:
+				if (a.forced && !now.Before(a.done)) || e.due(Detach, a.done, now) {
+					v.attachment = nil
+					v.vol.State = aws.String(ec2.VolumeStateAvailable)
+				}
+			}
+		}
+		if m := v.mod; m != nil && e.due(Modify, v.modDone, now) {
+			switch aws.StringValue(m.ModificationState) {
+			case ec2.VolumeModificationStateModifying:
+				// The new size and performance apply from here on.
+				v.vol.Size = m.TargetSize
+				v.vol.Iops = m.TargetIops
+				v.vol.Throughput = m.TargetThroughput
+				v.vol.VolumeType = m.TargetVolumeType
+				m.ModificationState = aws.String(ec2.VolumeModificationStateOptimizing)
+				m.Progress = aws.Int64(50)
+				v.modDone = now.Add(e.latency[Modify])
+			case ec2.VolumeModificationStateOptimizing:
+				m.ModificationState = aws.String(ec2.VolumeModificationStateCompleted)
+				m.Progress = aws.Int64(100)
+				m.EndTime = aws.Time(now)
+			}
+		}
+	}
+	for _, s := range e.snapshots {
+		if aws.StringValue(s.snap.State) == ec2.SnapshotStatePending && e.due(Snapshot, s.done, now) {
+			s.snap.State = aws.String(ec2.SnapshotStateCompleted)
+			s.snap.Progress = aws.String("100%")
+		}
+	}
+}
+
+func (e *EC2) volumeIds() []string {
+	ids := make([]string, 0, len(e.volumes))
+	for id := range e.volumes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (e *EC2) snapshotIds() []string {
+	ids := make([]string, 0, len(e.snapshots))
+	for id := range e.snapshots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// describe is the volume as DescribeVolumes reports it.
+func (v *volume) describe() *ec2.Volume {
+	out := v.vol
+	out.Tags = copyTags(v.vol.Tags)
+	out.Attachments = []*ec2.VolumeAttachment{}
+	if a := v.attachment; a != nil {
+		out.Attachments = append(out.Attachments, v.describeAttachment())
+	}
+	return &out
+}
+
+func (v *volume) describeAttachment() *ec2.VolumeAttachment {
+	a := v.attachment
+	return &ec2.VolumeAttachment{
+		VolumeId:            v.vol.VolumeId,
+		InstanceId:          aws.String(a.instance),
+		Device:              aws.String(a.device),
+		State:               aws.String(a.state),
+		AttachTime:          aws.Time(a.since),
+		DeleteOnTermination: aws.Bool(a.deleteOnTermination),
+	}
+}
+
+// fields are a volume's values for the filters DescribeVolumes takes.
+func (v *volume) fields(name string) ([]string, bool) {
+	if values, ok := tagFields(v.vol.Tags, name); ok {
+		return values, true
+	}
+	a := v.attachment
+	switch name {
+	case "volume-id":
+		return []string{aws.StringValue(v.vol.VolumeId)}, true
+	case "status":
+		return []string{aws.StringValue(v.vol.State)}, true
+	case "availability-zone":
+		return []string{aws.StringValue(v.vol.AvailabilityZone)}, true
+	case "snapshot-id":
+		return []string{aws.StringValue(v.vol.SnapshotId)}, true
+	case "volume-type":
+		return []string{aws.StringValue(v.vol.VolumeType)}, true
+	case "attachment.instance-id":
+		if a == nil {
+			return nil, true
+		}
+		return []string{a.instance}, true
+	case "attachment.status":
+		if a == nil {
+			return nil, true
+		}
+		return []string{a.state}, true
+	case "attachment.device":
+		if a == nil {
+			return nil, true
+		}
+		return []string{a.device}, true
+	}
+	return nil, false
+}
+
+// fields are a snapshot's values for the filters DescribeSnapshots takes.
+func (s *snapshot) fields(name string) ([]string, bool) {
+	if values, ok := tagFields(s.snap.Tags, name); ok {
+		return values, true
+	}
+	switch name {
+	case "snapshot-id":
+		return []string{aws.StringValue(s.snap.SnapshotId)}, true
+	case "volume-id":
+		return []string{aws.StringValue(s.snap.VolumeId)}, true
+	case "status":
+		return []string{aws.StringValue(s.snap.State)}, true
+	case "owner-id":
+		return []string{aws.StringValue(s.snap.OwnerId)}, true
+	case "description":
+		return []string{aws.StringValue(s.snap.Description)}, true
+	}
+	return nil, false
+}
+
+// tagFields are the values of the tag:<key> and tag-key filters.
+func tagFields(tags []*ec2.Tag, name string) ([]string, bool) {
+	if name == "tag-key" {
+		var keys []string
+		for _, t := range tags {
+			keys = append(keys, aws.StringValue(t.Key))
+		}
+		return keys, true
+	}
+	if strings.HasPrefix(name, "tag:") {
+		key := strings.TrimPrefix(name, "tag:")
+		for _, t := range tags {
+			if aws.StringValue(t.Key) == key {
+				return []string{aws.StringValue(t.Value)}, true
+			}
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+// matches applies filters, as EC2 does: a resource matches if, for every
+// filter, one of its values matches one of the filter's (which may have *
+// and ? wildcards).  Filters EC2 doesn't know are refused.
+func matches(filters []*ec2.Filter, fields func(string) ([]string, bool)) (bool, error) {
+	for _, f := range filters {
+		name := aws.StringValue(f.Name)
+		have, ok := fields(name)
+		if !ok {
+			return false, errorf("InvalidParameterValue", "The filter '%v' is invalid", name)
+		}
+		found := false
+		for _, want := range f.Values {
+			for _, value := range have {
+				if ok, _ := path.Match(aws.StringValue(want), value); ok {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func tagValue(tags []*ec2.Tag, key string) string {
+	for _, t := range tags {
+		if aws.StringValue(t.Key) == key {
+			return aws.StringValue(t.Value)
+		}
+	}
+	return ""
+}
+
+func copyTags(tags []*ec2.Tag) []*ec2.Tag {
+	out := make([]*ec2.Tag, 0, len(tags))
+	for _, t := range tags {
+		out = append(out, &ec2.Tag{Key: t.Key, Value: t.Value})
+	}
+	return out
+}
+
+func mapTags(tags map[string]string) []*ec2.Tag {
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var out []*ec2.Tag
+	for _, k := range keys {
+		out = append(out, &ec2.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return out
+}
+
+// setTags adds tags, replacing any with the same keys.
+func setTags(tags []*ec2.Tag, add []*ec2.Tag) []*ec2.Tag {
+	for _, t := range add {
+		replaced := false
+		for _, have := range tags {
+			if aws.StringValue(have.Key) == aws.StringValue(t.Key) {
+				have.Value = aws.String(aws.StringValue(t.Value))
+				replaced = true
+			}
+		}
+		if !replaced {
+			tags = append(tags, &ec2.Tag{Key: aws.String(aws.StringValue(t.Key)),
+				Value: aws.String(aws.StringValue(t.Value))})
+		}
+	}
+	return tags
+}
+
+// specTags are the tags given for a resource type in TagSpecifications.
+func specTags(specs []*ec2.TagSpecification, resourceType string) []*ec2.Tag {
+	var tags []*ec2.Tag
+	for _, s := range specs {
+		if aws.StringValue(s.ResourceType) == resourceType {
+			tags = setTags(tags, s.Tags)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,348 @@
+package ec2sim
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/ewindisch/blocker/pkg/driver"
+)
+
+const (
+	// localInstance is the instance the driver runs on in scenarios, and
+	// otherInstance another in the same availability zone.
+	localInstance = "i-0123456789abcdef0"
+	otherInstance = "i-0fedcba9876543210"
+	// simRegion and simZone are where they run.
+	simRegion = "us-east-1"
+	simZone   = "us-east-1a"
+
+	// simFS is the stand-in filesystem scenarios' volumes are formatted
+	// with, which is never really mounted.
+	simFS = "ec2simfs"
+	// simStrategy is the device readiness strategy which finds scenarios'
+	// stand-in devices.
+	simStrategy = "ec2sim"
+
+	// deviceSize is the size of the sparse files standing in for devices.
+	deviceSize = 2 << 20
+)
+
+// fsMagic marks a stand-in device as formatted.
+var fsMagic = []byte("ec2simfs")
+
+// A harness is a scenario under way: a simulation of EC2, the driver using
+// it, and the stand-ins for the devices and filesystems of the volumes
+// attached to localInstance.
+type harness struct {
+	sim *EC2
+	d   *driver.EbsVolumeDriver
+
+	dir string
+
+	mu sync.Mutex
+	// mounts are the stand-in filesystems mounted, by mountpoint.
+	mounts  map[string]string
+	formats int
+	// hidden hides the devices of attached volumes, as if they never
+	// showed up.
+	hidden bool
+}
+
+// newHarness starts a scenario: its simulation, and a driver using it, with
+// state, mounts, and devices kept in a scratch directory, no default options
+// or feature flags, no background work, and the scenario's own adjustments
+// to the configuration.  Everything is put back as it was at the end of the
+// test.  Only the driver's errors are logged, unless the test is verbose.
+func newHarness(t *testing.T, s scenario) *harness {
+	t.Helper()
+	h := &harness{
+		sim:    New(simZone, localInstance, otherInstance),
+		dir:    t.TempDir(),
+		mounts: map[string]string{},
+	}
+
+	old := driver.GetConfig()
+	c := *old
+	c.LogLevel = "error"
+	if testing.Verbose() {
+		c.LogLevel = "debug"
+	}
+	c.StateFile = ""
+	c.MountRoot = filepath.Join(h.dir, "mnt")
+	c.Fstab.Path = filepath.Join(h.dir, "fstab")
+	c.DefaultOptions = map[string]string{}
+	c.AutoCreate = false
+	c.Namespace = ""
+	c.Features = nil
+	c.DeviceReadiness = driver.DeviceReadinessConfig{Strategies: []string{simStrategy}}
+	c.Format.FSType = simFS
+	c.SlowEBS = driver.SlowEBSConfig{}
+	c.Lease.Enabled = false
+	c.Reconcile.Interval = 0
+	c.Watchdog.Interval = 0
+	c.Grow.Interval = 0
+	c.Pool.Interval = 0
+	c.Verify.Interval = 0
+	c.Scrub.Interval = 0
+	c.Trim.Interval = 0
+	c.Saturation.Interval = 0
+	c.Health.Interval = 0
+	c.DockerEvents.Socket = ""
+	c.Publish = driver.PublishConfig{}
+	c.CloudWatchLogs = driver.CloudWatchLogsConfig{}
+	c.MountRetry.Backoff = driver.Duration(10 * time.Millisecond)
+	c.Timeouts.StatePoll = driver.Duration(50 * time.Millisecond)
+	c.Timeouts.StateWait = driver.Duration(5 * time.Second)
+	c.Timeouts.DeviceWait = driver.Duration(2 * time.Second)
+	if s.config != nil {
+		s.config(&c)
+	}
+	driver.RegisterDeviceStrategy(simStrategy, func(id string, names []string) (string, error) {
+		return h.device(id)
+	})
+	driver.RegisterFilesystem(simFS, simfs{h})
+	driver.SetConfig(&c)
+	t.Cleanup(func() {
+		driver.SetConfig(old)
+		driver.UnregisterDeviceStrategy(simStrategy)
+		driver.UnregisterFilesystem(simFS)
+	})
+
+	if s.setup != nil {
+		if err := s.setup(h); err != nil {
+			t.Fatalf("setup: %v", err)
+		}
+	}
+	var err error
+	if h.d, err = driver.NewEbsVolumeDriver(driver.Options{
+		NoMetadata:       true,
+		InstanceId:       localInstance,
+		Region:           simRegion,
+		AvailabilityZone: simZone,
+		EC2:              h.sim,
+		KMS:              h.sim.KMS(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.d.Close)
+	return h
+}
+
+// device finds (making it if need be) the stand-in device for a volume, if
+// it's attached to localInstance.
+func (h *harness) device(id string) (string, error) {
+	h.mu.Lock()
+	hidden := h.hidden
+	h.mu.Unlock()
+	v := h.sim.Volume(id)
+	if hidden || v == nil || len(v.Attachments) != 1 {
+		return "", nil
+	}
+	if a := v.Attachments[0]; aws.StringValue(a.InstanceId) != localInstance ||
+		aws.StringValue(a.State) != ec2.VolumeAttachmentStateAttached {
+		return "", nil
+	}
+	dev := filepath.Join(h.dir, "dev", id)
+	if _, err := os.Stat(dev); err == nil {
+		return dev, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dev), 0755); err != nil {
+		return "", err
+	}
+	f, err := os.Create(dev)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return dev, f.Truncate(deviceSize)
+}
+
+// hideDevices hides (or shows again) attached volumes' devices, as if they
+// never showed up on the instance.
+func (h *harness) hideDevices(hidden bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hidden = hidden
+}
+
+// mountpoints lists the mountpoints of the stand-in filesystems mounted.
+func (h *harness) mountpoints() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var mounts []string
+	for mnt := range h.mounts {
+		mounts = append(mounts, mnt)
+	}
+	sort.Strings(mounts)
+	return mounts
+}
+
+// formatted is how many stand-in devices have been formatted.
+func (h *harness) formatted() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.formats
+}
+
+func (h *harness) mounted(mnt string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dev, ok := h.mounts[mnt]
+	return dev, ok
+}
+
+// simfs is the stand-in filesystem: formatting marks the device, and
+// mounting only records the mount.  It unmounts itself (see
+// driver.Unmounter), so its mounts aren't looked for in the mount table.
+type simfs struct {
+	h *harness
+}
+
+func (fs simfs) Format(dev string) error {
+	f, err := os.OpenFile(dev, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(fsMagic, 0); err != nil {
+		return err
+	}
+	fs.h.mu.Lock()
+	fs.h.formats++
+	fs.h.mu.Unlock()
+	return nil
+}
+
+func (simfs) Check(ctx context.Context, dev string, repair bool) error {
+	return nil
+}
+
+func (fs simfs) Mount(dev string, mnt string, flags []string) (string, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return fmt.Sprintf("mount: %v: special device %v does not exist.", mnt, dev), err
+	}
+	defer f.Close()
+	magic := make([]byte, len(fsMagic))
+	if _, err := f.ReadAt(magic, 0); err != nil || !bytes.Equal(magic, fsMagic) {
+		return fmt.Sprintf("mount: %v: wrong fs type, bad option, bad superblock on %v, "+
+			"missing codepage or helper program, or other error.", mnt, dev), errors.New("exit status 32")
+	}
+	fs.h.mu.Lock()
+	defer fs.h.mu.Unlock()
+	if d, ok := fs.h.mounts[mnt]; ok {
+		return fmt.Sprintf("mount: %v: %v already mounted on %v.", mnt, d, mnt), errors.New("exit status 32")
+	}
+	for m, d := range fs.h.mounts {
+		if d == dev {
+			return fmt.Sprintf("mount: %v: %v already mounted on %v.", mnt, dev, m), errors.New("exit status 32")
+		}
+	}
+	fs.h.mounts[mnt] = dev
+	return "", nil
+}
+
+func (fs simfs) Unmount(mnt string) error {
+	fs.h.mu.Lock()
+	defer fs.h.mu.Unlock()
+	if _, ok := fs.h.mounts[mnt]; !ok {
+		return fmt.Errorf("Unmounting %v failed: exit status 32\numount: %v: not mounted.", mnt, mnt)
+	}
+	delete(fs.h.mounts, mnt)
+	return nil
+}
+
+func (simfs) Grow(dev string, mnt string) error {
+	return nil
+}
+
+func (simfs) Freeze(mnt string, frozen bool) error {
+	return nil
+}
+
+// run makes the scenario's requests, in turn, then checks what they left.
+func (h *harness) run(t *testing.T, s scenario) {
+	t.Helper()
+	for i, st := range s.steps {
+		if err := h.step(t.Name(), i, st); err != nil {
+			t.Fatalf("step %v (%v %v): %v", i+1, st.op, st.name, err)
+		}
+	}
+	if s.check != nil {
+		if err := s.check(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// step makes one of Docker's requests, checking how it turns out.
+func (h *harness) step(scenario string, i int, st step) error {
+	if st.before != nil {
+		st.before(h)
+	}
+	caller := st.caller
+	if caller == "" {
+		caller = "c1"
+	}
+	ctx := driver.WithRequestId(context.Background(), fmt.Sprintf("%v-%v", scenario, i+1))
+	ctx = driver.WithCaller(ctx, caller)
+
+	var err error
+	switch st.op {
+	case "create":
+		opts := map[string]string{"fstype": simFS}
+		for k, v := range st.opts {
+			opts[k] = v
+		}
+		err = h.d.Create(ctx, st.name, opts)
+	case "mount":
+		var mnt string
+		if mnt, err = h.d.Mount(ctx, st.name); err == nil {
+			if _, mounted := h.mounted(mnt); !mounted {
+				return fmt.Errorf("mounted at %v, but nothing's mounted there", mnt)
+			}
+		}
+	case "unmount":
+		err = h.d.Unmount(ctx, st.name)
+	case "remove":
+		err = h.d.Remove(ctx, st.name)
+	default:
+		return fmt.Errorf("unknown operation %q", st.op)
+	}
+
+	switch code := driver.ErrorCodeOf(err); {
+	case st.want == "" && err != nil:
+		return fmt.Errorf("failed: %v", err)
+	case st.want != "" && err == nil:
+		return fmt.Errorf("succeeded, but should have failed with %v", st.want)
+	case st.want != "" && code != st.want:
+		return fmt.Errorf("failed with %v, not %v: %v", code, st.want, err)
+	}
+	if st.after != nil {
+		return st.after(h)
+	}
+	return nil
+}
+
+// eventually retries a check until it passes, or it's still failing after
+// the given time.
+func eventually(wait time.Duration, check func() error) error {
+	deadline := time.Now().Add(wait)
+	for {
+		err := check()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
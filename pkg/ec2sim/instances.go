@@ -0,0 +1,205 @@
+package ec2sim
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// describeInstance is the instance as DescribeInstances reports it, with its
+// attached volumes as block device mappings.  The caller holds e.mu.
+func (e *EC2) describeInstance(id string) *ec2.Instance {
+	inst := e.instances[id]
+	out := &ec2.Instance{
+		InstanceId:          aws.String(id),
+		InstanceType:        aws.String("m5.large"),
+		RootDeviceName:      aws.String(RootDevice),
+		State:               &ec2.InstanceState{Code: aws.Int64(16), Name: aws.String(ec2.InstanceStateNameRunning)},
+		Tags:                copyTags(inst.tags),
+		BlockDeviceMappings: []*ec2.InstanceBlockDeviceMapping{},
+	}
+	for _, vid := range e.volumeIds() {
+		a := e.volumes[vid].attachment
+		if a == nil || a.instance != id {
+			continue
+		}
+		out.BlockDeviceMappings = append(out.BlockDeviceMappings, &ec2.InstanceBlockDeviceMapping{
+			DeviceName: aws.String(a.device),
+			Ebs: &ec2.EbsInstanceBlockDevice{
+				VolumeId:            aws.String(vid),
+				Status:              aws.String(a.state),
+				AttachTime:          aws.Time(a.since),
+				DeleteOnTermination: aws.Bool(a.deleteOnTermination),
+			},
+		})
+	}
+	return out
+}
+
+func (e *EC2) DescribeInstancesWithContext(ctx aws.Context, in *ec2.DescribeInstancesInput,
+	_ ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	if err := e.call(ctx, "DescribeInstances"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	ids := aws.StringValueSlice(in.InstanceIds)
+	if len(ids) == 0 {
+		for id := range e.instances {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+	}
+	out := &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{}}
+	for _, id := range ids {
+		inst, ok := e.instances[id]
+		if !ok {
+			return nil, errorf("InvalidInstanceID.NotFound", "The instance ID '%v' does not exist", id)
+		}
+		match, err := matches(in.Filters, func(name string) ([]string, bool) {
+			if values, ok := tagFields(inst.tags, name); ok {
+				return values, true
+			}
+			switch name {
+			case "instance-id":
+				return []string{id}, true
+			case "instance-state-name":
+				return []string{ec2.InstanceStateNameRunning}, true
+			case "availability-zone":
+				return []string{e.zone}, true
+			}
+			return nil, false
+		})
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			out.Reservations = append(out.Reservations,
+				&ec2.Reservation{Instances: []*ec2.Instance{e.describeInstance(id)}})
+		}
+	}
+	return out, nil
+}
+
+// ModifyInstanceAttributeWithContext changes only whether the instance's
+// volumes are deleted when it's terminated.
+func (e *EC2) ModifyInstanceAttributeWithContext(ctx aws.Context, in *ec2.ModifyInstanceAttributeInput,
+	_ ...request.Option) (*ec2.ModifyInstanceAttributeOutput, error) {
+	if err := e.call(ctx, "ModifyInstanceAttribute"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	id := aws.StringValue(in.InstanceId)
+	if _, ok := e.instances[id]; !ok {
+		return nil, errorf("InvalidInstanceID.NotFound", "The instance ID '%v' does not exist", id)
+	}
+	for _, m := range in.BlockDeviceMappings {
+		device := aws.StringValue(m.DeviceName)
+		var found *attachment
+		for _, v := range e.volumes {
+			if a := v.attachment; a != nil && a.instance == id && a.device == device {
+				found = a
+			}
+		}
+		if found == nil {
+			return nil, errorf("InvalidInstanceAttributeValue", "No device is currently mapped at %v", device)
+		}
+		if m.Ebs != nil && m.Ebs.DeleteOnTermination != nil {
+			found.deleteOnTermination = aws.BoolValue(m.Ebs.DeleteOnTermination)
+		}
+	}
+	return &ec2.ModifyInstanceAttributeOutput{}, nil
+}
+
+// tags finds the tags of a volume, snapshot, or instance, by ID.  The caller
+// holds e.mu.
+func (e *EC2) tags(id string) (*[]*ec2.Tag, error) {
+	switch {
+	case strings.HasPrefix(id, "vol-"):
+		if v, ok := e.volumes[id]; ok {
+			return &v.vol.Tags, nil
+		}
+		return nil, errorf("InvalidVolume.NotFound", "The volume '%v' does not exist.", id)
+	case strings.HasPrefix(id, "snap-"):
+		if s, ok := e.snapshots[id]; ok {
+			return &s.snap.Tags, nil
+		}
+		return nil, errorf("InvalidSnapshot.NotFound", "The snapshot '%v' does not exist.", id)
+	case strings.HasPrefix(id, "i-"):
+		if inst, ok := e.instances[id]; ok {
+			return &inst.tags, nil
+		}
+		return nil, errorf("InvalidInstanceID.NotFound", "The instance ID '%v' does not exist", id)
+	}
+	return nil, errorf("InvalidID", "The ID '%v' is not valid", id)
+}
+
+func (e *EC2) CreateTagsWithContext(ctx aws.Context, in *ec2.CreateTagsInput,
+	_ ...request.Option) (*ec2.CreateTagsOutput, error) {
+	if err := e.call(ctx, "CreateTags"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	// Either every resource is tagged, or none is.
+	var all []*[]*ec2.Tag
+	for _, id := range aws.StringValueSlice(in.Resources) {
+		tags, err := e.tags(id)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, tags)
+	}
+	for _, tags := range all {
+		*tags = setTags(*tags, in.Tags)
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// DeleteTagsWithContext removes tags by key, or, for those given with a
+// value, only if they have that value.
+func (e *EC2) DeleteTagsWithContext(ctx aws.Context, in *ec2.DeleteTagsInput,
+	_ ...request.Option) (*ec2.DeleteTagsOutput, error) {
+	if err := e.call(ctx, "DeleteTags"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	var all []*[]*ec2.Tag
+	for _, id := range aws.StringValueSlice(in.Resources) {
+		tags, err := e.tags(id)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, tags)
+	}
+	for _, tags := range all {
+		var kept []*ec2.Tag
+		for _, t := range *tags {
+			drop := false
+			for _, d := range in.Tags {
+				if aws.StringValue(d.Key) == aws.StringValue(t.Key) &&
+					(d.Value == nil || aws.StringValue(d.Value) == aws.StringValue(t.Value)) {
+					drop = true
+				}
+			}
+			if !drop {
+				kept = append(kept, t)
+			}
+		}
+		*tags = kept
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
@@ -0,0 +1,89 @@
+package ec2sim
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// key is the state of a KMS key, as far as EBS cares.  Keys are enabled, and
+// usable by everyone, unless made otherwise.
+type key struct {
+	state  string
+	denied bool
+}
+
+// SetKeyState puts a KMS key (named as volumes name it) in one of KMS's key
+// states.  Volumes encrypted with a key that isn't Enabled go to the error
+// state when they're created, and their attaches fall through, leaving them
+// available, as EC2's do.
+func (e *EC2) SetKeyState(id string, state string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.key(id).state = state
+}
+
+// DenyKey closes a KMS key to the instances (or, with denied false, opens it
+// again), as a key policy might, with the same effect on volumes as disabling
+// it.
+func (e *EC2) DenyKey(id string, denied bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.key(id).denied = denied
+}
+
+// key finds a KMS key, making it if need be.  The caller holds e.mu.
+func (e *EC2) key(id string) *key {
+	k, ok := e.keys[id]
+	if !ok {
+		k = &key{state: kms.KeyStateEnabled}
+		e.keys[id] = k
+	}
+	return k
+}
+
+// usable reports whether a volume's KMS key (if it has one) can be used.  The
+// caller holds e.mu.
+func (e *EC2) usable(v *volume) bool {
+	if !aws.BoolValue(v.vol.Encrypted) {
+		return true
+	}
+	k, ok := e.keys[aws.StringValue(v.vol.KmsKeyId)]
+	return !ok || (k.state == kms.KeyStateEnabled && !k.denied)
+}
+
+// KMS simulates the part of KMS blocker uses, looking keys up, over the same
+// keys as the EC2 it's from.
+type KMS struct {
+	kmsiface.KMSAPI
+
+	e *EC2
+}
+
+// KMS is the simulation's KMS.
+func (e *EC2) KMS() *KMS {
+	return &KMS{e: e}
+}
+
+func (k *KMS) DescribeKeyWithContext(ctx aws.Context, in *kms.DescribeKeyInput,
+	_ ...request.Option) (*kms.DescribeKeyOutput, error) {
+	e := k.e
+	if err := e.call(ctx, "DescribeKey"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := aws.StringValue(in.KeyId)
+	key := e.key(id)
+	if key.denied {
+		return nil, errorf("AccessDeniedException",
+			"User is not authorized to perform: kms:DescribeKey on resource: %v", id)
+	}
+	return &kms.DescribeKeyOutput{KeyMetadata: &kms.KeyMetadata{
+		KeyId:    aws.String(id),
+		KeyState: aws.String(key.state),
+		Enabled:  aws.Bool(key.state == kms.KeyStateEnabled),
+	}}, nil
+}
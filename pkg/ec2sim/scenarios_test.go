@@ -0,0 +1,488 @@
+package ec2sim
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/ewindisch/blocker/pkg/driver"
+)
+
+// A scenario drives the driver, over a simulation of EC2, through a sequence
+// of Docker's requests, checking how each turns out and what's left behind.
+type scenario struct {
+	name        string
+	description string
+	// config adjusts the driver's configuration (see newHarness).
+	config func(c *driver.Config)
+	// setup readies the simulation before the driver starts.
+	setup func(h *harness) error
+	steps []step
+	// check inspects what's left once the steps are done.
+	check func(h *harness) error
+}
+
+// A step is one of Docker's requests.
+type step struct {
+	// op is create, mount, unmount, or remove.
+	op   string
+	name string
+	// opts are create's options; fstype is simFS unless they say
+	// otherwise.
+	opts map[string]string
+	// caller is the container mount the request is for (c1 if empty).
+	caller string
+	// want is the code the request should fail with, or "" if it should
+	// succeed.
+	want driver.ErrorCode
+	// before runs before the request, say to make EC2 misbehave, and
+	// after checks what it did.
+	before func(h *harness)
+	after  func(h *harness) error
+}
+
+// lifecycle is a volume's creation, mount, unmount, and removal.
+func lifecycle(name string, opts map[string]string) []step {
+	return []step{
+		{op: "create", name: name, opts: opts},
+		{op: "mount", name: name},
+		{op: "unmount", name: name},
+		{op: "remove", name: name},
+	}
+}
+
+func TestScenarios(t *testing.T) {
+	for _, s := range scenarios {
+		s := s
+		t.Run(s.name, func(t *testing.T) {
+			newHarness(t, s).run(t, s)
+		})
+	}
+}
+
+// scenarios are the standard scenarios, each a test of its own.
+var scenarios = []scenario{
+	{
+		name:        "lifecycle",
+		description: "A new volume is created, mounted, unmounted, and removed, and left detached.",
+		steps:       lifecycle("data", map[string]string{"size": "1"}),
+		check: func(h *harness) error {
+			return allOf(h.expectDetached("data"), h.expectUnmounted(), h.expectFormats(1))
+		},
+	},
+	{
+		name:        "slow-ebs",
+		description: "Creation, attachment, and detachment each take a while.",
+		setup: func(h *harness) error {
+			h.sim.SetLatency(Create, 300*time.Millisecond)
+			h.sim.SetLatency(Attach, time.Second)
+			h.sim.SetLatency(Detach, time.Second)
+			return nil
+		},
+		steps: lifecycle("data", map[string]string{"size": "1"}),
+		check: func(h *harness) error {
+			return allOf(h.expectDetached("data"), h.expectUnmounted())
+		},
+	},
+	{
+		name:        "slow-api",
+		description: "Every DescribeVolumes call takes a while to answer.",
+		setup: func(h *harness) error {
+			h.sim.SetLatency("DescribeVolumes", 100*time.Millisecond)
+			return nil
+		},
+		steps: lifecycle("data", map[string]string{"size": "1"}),
+		check: func(h *harness) error {
+			return allOf(h.expectDetached("data"), h.expectUnmounted())
+		},
+	},
+	{
+		name:        "remount",
+		description: "A volume mounted a second time keeps its filesystem.",
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1"}},
+			{op: "mount", name: "data"},
+			{op: "unmount", name: "data"},
+			{op: "mount", name: "data"},
+			{op: "unmount", name: "data"},
+		},
+		check: func(h *harness) error {
+			return allOf(h.expectFormats(1), h.expectCalls("AttachVolume", 2), h.expectDetached("data"))
+		},
+	},
+	{
+		name:        "shared-mount",
+		description: "A volume mounted by two containers stays attached until both unmount it.",
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1"}},
+			{op: "mount", name: "data", caller: "c1"},
+			{op: "mount", name: "data", caller: "c2"},
+			{op: "unmount", name: "data", caller: "c1",
+				after: func(h *harness) error { return h.expectAttached("data") }},
+			{op: "unmount", name: "data", caller: "c2"},
+		},
+		check: func(h *harness) error {
+			return allOf(h.expectCalls("AttachVolume", 1), h.expectDetached("data"), h.expectUnmounted())
+		},
+	},
+	{
+		name:        "remove-mounted",
+		description: "Removing a mounted volume unmounts and detaches it first.",
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1"}},
+			{op: "mount", name: "data"},
+			{op: "remove", name: "data"},
+			{op: "unmount", name: "data", want: driver.CodeNotFound},
+		},
+		check: func(h *harness) error {
+			return allOf(h.expectDetached("data"), h.expectUnmounted())
+		},
+	},
+	{
+		name:        "ephemeral",
+		description: "An ephemeral volume is deleted once it's removed.",
+		setup: func(h *harness) error {
+			h.sim.AddVolume(simZone, 1, map[string]string{"Name": "scratch", "blocker:ephemeral": "true"})
+			return nil
+		},
+		steps: lifecycle("scratch", nil),
+		check: func(h *harness) error {
+			return eventually(2*time.Second, func() error {
+				if n := len(h.sim.VolumesNamed("scratch")); n != 0 {
+					return fmt.Errorf("scratch should have been deleted, but %v volume(s) are left", n)
+				}
+				return nil
+			})
+		},
+	},
+	{
+		name:        "pinned",
+		description: "A pinned volume's unmounts and removes are refused until an admin forces them.",
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1", "pinned": "true"}},
+			{op: "mount", name: "data"},
+			{op: "unmount", name: "data", want: driver.CodePinned},
+			{op: "remove", name: "data", want: driver.CodePinned},
+		},
+		check: func(h *harness) error {
+			if err := h.expectAttached("data"); err != nil {
+				return err
+			}
+			v, _ := h.volume("data")
+			if tagValue(v.Tags, "blocker:pinned") != "true" {
+				return fmt.Errorf("%v isn't tagged as pinned", aws.StringValue(v.VolumeId))
+			}
+			if err := h.d.AdminRemove(context.Background(), "data", true); err != nil {
+				return err
+			}
+			return allOf(h.expectDetached("data"), h.expectUnmounted())
+		},
+	},
+	{
+		name:        "replication",
+		description: "A volume with replicate-to keeps a single, fresh copy in the other zone.",
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1", "replicate-to": "us-east-1b"}},
+			{op: "mount", name: "data"},
+		},
+		check: func(h *harness) error {
+			for i := 0; i < 2; i++ {
+				if err := h.d.RefreshCopy(context.Background(), "data"); err != nil {
+					return err
+				}
+			}
+			var copies []string
+			for _, v := range h.sim.VolumesNamed("data") {
+				if tagValue(v.Tags, "blocker:copy-of") != "" {
+					copies = append(copies, aws.StringValue(v.AvailabilityZone))
+				}
+			}
+			if len(copies) != 1 || copies[0] != "us-east-1b" {
+				return fmt.Errorf("expected one copy, in us-east-1b, but found %v", copies)
+			}
+			return h.expectAttached("data")
+		},
+	},
+	{
+		name:        "device-in-use",
+		description: "EC2 says the first device is in use, so the attach moves on to the next.",
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1"}},
+			{op: "mount", name: "data",
+				before: func(h *harness) { h.sim.Fail("AttachVolume", "InvalidParameterValue", 1) },
+				after: func(h *harness) error {
+					return allOf(h.expectCalls("AttachVolume", 2), h.expectAttached("data"))
+				}},
+			{op: "unmount", name: "data"},
+		},
+		check: func(h *harness) error { return h.expectDetached("data") },
+	},
+	{
+		name:        "throttled",
+		description: "A throttled CreateVolume fails the create, and a retry succeeds.",
+		steps: append([]step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1"}, want: driver.CodeAwsThrottled,
+				before: func(h *harness) { h.sim.Fail("CreateVolume", "RequestLimitExceeded", 1) }},
+		}, lifecycle("data", map[string]string{"size": "1"})...),
+		check: func(h *harness) error {
+			if n := len(h.sim.VolumesNamed("data")); n != 1 {
+				return fmt.Errorf("expected one volume named data, got %v", n)
+			}
+			return h.expectDetached("data")
+		},
+	},
+	{
+		name:        "create-stalls",
+		description: "A new volume never becomes available, so its creation times out.",
+		config:      func(c *driver.Config) { c.Timeouts.StateWait = driver.Duration(time.Second) },
+		setup:       func(h *harness) error { h.sim.Stall(Create, true); return nil },
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1"}, want: driver.CodeAttachTimeout},
+			{op: "mount", name: "data", want: driver.CodeNotFound},
+		},
+		check: func(h *harness) error { return h.expectState("data", ec2.VolumeStateCreating) },
+	},
+	{
+		name:        "attach-stalls",
+		description: "An attach never finishes, so the mount times out, and the volume is detached.",
+		config:      func(c *driver.Config) { c.Timeouts.StateWait = driver.Duration(time.Second) },
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1"}},
+			{op: "mount", name: "data", want: driver.CodeAttachTimeout,
+				before: func(h *harness) { h.sim.Stall(Attach, true) }},
+		},
+		check: func(h *harness) error {
+			return allOf(h.expectDetached("data"), h.expectUnmounted(), h.expectFormats(0))
+		},
+	},
+	{
+		name:        "detach-stalls",
+		description: "A detach never finishes, so the unmount succeeds but the next mount times out.",
+		config:      func(c *driver.Config) { c.Timeouts.StateWait = driver.Duration(time.Second) },
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1"}},
+			{op: "mount", name: "data"},
+			{op: "unmount", name: "data",
+				before: func(h *harness) { h.sim.Stall(Detach, true) }},
+			{op: "mount", name: "data", want: driver.CodeAttachTimeout},
+		},
+		check: func(h *harness) error {
+			return allOf(h.expectAttachment("data", ec2.VolumeAttachmentStateDetaching), h.expectUnmounted())
+		},
+	},
+	{
+		name:        "device-missing",
+		description: "An attached volume's device never shows up, so the mount fails and the volume is detached.",
+		config:      func(c *driver.Config) { c.Timeouts.DeviceWait = driver.Duration(time.Second) },
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1"}},
+			{op: "mount", name: "data", want: driver.CodeDeviceMissing,
+				before: func(h *harness) { h.hideDevices(true) }},
+		},
+		check: func(h *harness) error {
+			return allOf(h.expectDetached("data"), h.expectUnmounted())
+		},
+	},
+	{
+		name:        "attached-elsewhere",
+		description: "A volume attached to another instance can't be mounted, and is left where it is.",
+		config:      func(c *driver.Config) { c.Timeouts.StateWait = driver.Duration(time.Second) },
+		setup: func(h *harness) error {
+			id := h.sim.AddVolume(simZone, 1, map[string]string{"Name": "shared"})
+			_, err := h.sim.AttachVolumeWithContext(context.Background(), &ec2.AttachVolumeInput{
+				VolumeId:   aws.String(id),
+				InstanceId: aws.String(otherInstance),
+				Device:     aws.String("/dev/sdf"),
+			})
+			return err
+		},
+		steps: []step{
+			{op: "create", name: "shared"},
+			{op: "mount", name: "shared", want: driver.CodeAttachTimeout},
+		},
+		check: func(h *harness) error {
+			return allOf(h.expectAttachedTo("shared", otherInstance), h.expectUnmounted())
+		},
+	},
+	{
+		name: "key-disabled",
+		description: "An encrypted volume's KMS key is disabled, so its attach falls through and the mount " +
+			"fails naming the key, until the key is enabled again.",
+		config: func(c *driver.Config) { c.Timeouts.StateWait = driver.Duration(time.Second) },
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1", "encrypted": "true", "kms-key": "alias/app"}},
+			{op: "mount", name: "data", want: driver.CodeKeyUnavailable,
+				before: func(h *harness) { h.sim.SetKeyState("alias/app", kms.KeyStateDisabled) },
+				after:  func(h *harness) error { return allOf(h.expectDetached("data"), h.expectUnmounted()) }},
+			{op: "mount", name: "data",
+				before: func(h *harness) { h.sim.SetKeyState("alias/app", kms.KeyStateEnabled) }},
+			{op: "unmount", name: "data"},
+		},
+		check: func(h *harness) error { return h.expectFormats(1) },
+	},
+	{
+		name: "key-denied",
+		description: "A new volume's KMS key policy shuts the instance out, so the volume fails, and " +
+			"its creation names the key.",
+		setup: func(h *harness) error { h.sim.DenyKey("alias/app", true); return nil },
+		steps: []step{
+			{op: "create", name: "data", opts: map[string]string{"size": "1", "encrypted": "true", "kms-key": "alias/app"},
+				want: driver.CodeKeyUnavailable},
+		},
+		check: func(h *harness) error { return h.expectState("data", ec2.VolumeStateError) },
+	},
+	{
+		name: "multi-attach-gated",
+		description: "Multi-Attach volumes are refused while the experimental multi-attach feature is off, " +
+			"and made when a volume turns it on.",
+		steps: []step{
+			{op: "create", name: "shared", opts: multiAttach(), want: driver.CodeInvalidOption},
+			{op: "create", name: "shared", opts: multiAttach("features", "multi-attach"),
+				after: func(h *harness) error {
+					v, err := h.volume("shared")
+					if err == nil && !aws.BoolValue(v.MultiAttachEnabled) {
+						err = fmt.Errorf("%v isn't Multi-Attach", aws.StringValue(v.VolumeId))
+					}
+					return err
+				}},
+			{op: "mount", name: "shared"},
+			{op: "unmount", name: "shared"},
+		},
+		check: func(h *harness) error { return h.expectDetached("shared") },
+	},
+	{
+		name:        "wrong-zone",
+		description: "A volume in another availability zone is refused.",
+		setup: func(h *harness) error {
+			h.sim.AddVolume("us-east-1b", 1, map[string]string{"Name": "far"})
+			return nil
+		},
+		steps: []step{{op: "create", name: "far", want: driver.CodeAZMismatch}},
+	},
+	{
+		name:        "root-volume",
+		description: "The instance's own root volume is refused, whatever it's called.",
+		steps:       []step{{op: "create", name: "root", want: driver.CodeInvalidOption}},
+		check: func(h *harness) error {
+			return allOf(h.expectAttachedTo("root", localInstance), h.expectCalls("AttachVolume", 0))
+		},
+	},
+}
+
+// multiAttach is the options of a Multi-Attach volume, plus any others given
+// as pairs of keys and values.
+func multiAttach(extra ...string) map[string]string {
+	opts := map[string]string{"size": "4", "type": "io2", "iops": "100", "multi-attach": "true"}
+	for i := 0; i+1 < len(extra); i += 2 {
+		opts[extra[i]] = extra[i+1]
+	}
+	return opts
+}
+
+// allOf is the first of the errors, if any.
+func allOf(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// volume describes the one volume with the given name, attached to
+// localInstance if more than one has the name.
+func (h *harness) volume(name string) (*ec2.Volume, error) {
+	vols := h.sim.VolumesNamed(name)
+	for _, v := range vols {
+		if len(v.Attachments) > 0 && aws.StringValue(v.Attachments[0].InstanceId) == localInstance {
+			return v, nil
+		}
+	}
+	if len(vols) != 1 {
+		return nil, fmt.Errorf("expected one volume named %v, got %v", name, len(vols))
+	}
+	return vols[0], nil
+}
+
+// expectState checks a volume's state.
+func (h *harness) expectState(name string, state string) error {
+	v, err := h.volume(name)
+	if err != nil {
+		return err
+	}
+	if got := aws.StringValue(v.State); got != state {
+		return fmt.Errorf("%v is %v, not %v", name, got, state)
+	}
+	return nil
+}
+
+// expectAttachment checks the state of a volume's attachment to localInstance.
+func (h *harness) expectAttachment(name string, state string) error {
+	if err := h.expectAttachedTo(name, localInstance); err != nil {
+		return err
+	}
+	v, _ := h.volume(name)
+	if got := aws.StringValue(v.Attachments[0].State); got != state {
+		return fmt.Errorf("%v is %v, not %v", name, got, state)
+	}
+	return nil
+}
+
+// expectAttachedTo checks that a volume is attached to an instance.
+func (h *harness) expectAttachedTo(name string, instance string) error {
+	v, err := h.volume(name)
+	if err != nil {
+		return err
+	}
+	if len(v.Attachments) != 1 || aws.StringValue(v.Attachments[0].InstanceId) != instance {
+		return fmt.Errorf("%v should be attached to %v, but isn't", name, instance)
+	}
+	return nil
+}
+
+// expectAttached checks that a volume is attached, and mounted.
+func (h *harness) expectAttached(name string) error {
+	if err := h.expectAttachment(name, ec2.VolumeAttachmentStateAttached); err != nil {
+		return err
+	}
+	if len(h.mountpoints()) == 0 {
+		return fmt.Errorf("%v is attached, but nothing's mounted", name)
+	}
+	return nil
+}
+
+// expectDetached checks that a volume ends up detached (which can take a
+// while, since detaches aren't waited for).
+func (h *harness) expectDetached(name string) error {
+	return eventually(3*time.Second, func() error {
+		return h.expectState(name, ec2.VolumeStateAvailable)
+	})
+}
+
+// expectUnmounted checks that nothing's left mounted.
+func (h *harness) expectUnmounted() error {
+	if mounts := h.mountpoints(); len(mounts) > 0 {
+		return fmt.Errorf("still mounted: %v", mounts)
+	}
+	return nil
+}
+
+// expectFormats checks how many devices have been formatted.
+func (h *harness) expectFormats(n int) error {
+	if got := h.formatted(); got != n {
+		return fmt.Errorf("expected %v format(s), got %v", n, got)
+	}
+	return nil
+}
+
+// expectCalls checks how many calls of a kind have been made.
+func (h *harness) expectCalls(call string, n int) error {
+	if got := h.sim.Calls(call); got != n {
+		return fmt.Errorf("expected %v %v call(s), got %v", n, call, got)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package ec2sim
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// snapshotVolume starts a snapshot of a volume.  The caller holds e.mu.
+func (e *EC2) snapshotVolume(v *volume, description *string, tags []*ec2.Tag) *snapshot {
+	now := time.Now()
+	id := e.newId("snap")
+	s := &snapshot{
+		snap: ec2.Snapshot{
+			SnapshotId:  aws.String(id),
+			VolumeId:    v.vol.VolumeId,
+			VolumeSize:  v.vol.Size,
+			Description: description,
+			OwnerId:     aws.String(Owner),
+			Encrypted:   v.vol.Encrypted,
+			KmsKeyId:    v.vol.KmsKeyId,
+			StartTime:   aws.Time(now),
+			State:       aws.String(ec2.SnapshotStatePending),
+			Progress:    aws.String("0%"),
+			Tags:        tags,
+		},
+		done: now.Add(e.latency[Snapshot]),
+	}
+	e.snapshots[id] = s
+	return s
+}
+
+// describe is the snapshot as DescribeSnapshots reports it.
+func (s *snapshot) describe() *ec2.Snapshot {
+	out := s.snap
+	out.Tags = copyTags(s.snap.Tags)
+	return &out
+}
+
+func (e *EC2) CreateSnapshotWithContext(ctx aws.Context, in *ec2.CreateSnapshotInput,
+	_ ...request.Option) (*ec2.Snapshot, error) {
+	if err := e.call(ctx, "CreateSnapshot"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	id := aws.StringValue(in.VolumeId)
+	v, ok := e.volumes[id]
+	if !ok {
+		return nil, errorf("InvalidVolume.NotFound", "The volume '%v' does not exist.", id)
+	}
+	if state := aws.StringValue(v.vol.State); state == ec2.VolumeStateCreating || state == ec2.VolumeStateDeleting {
+		return nil, errorf("IncorrectState", "The volume '%v' is '%v'.", id, state)
+	}
+	s := e.snapshotVolume(v, in.Description, specTags(in.TagSpecifications, ec2.ResourceTypeSnapshot))
+	return s.describe(), nil
+}
+
+func (e *EC2) CreateSnapshotsWithContext(ctx aws.Context, in *ec2.CreateSnapshotsInput,
+	_ ...request.Option) (*ec2.CreateSnapshotsOutput, error) {
+	if err := e.call(ctx, "CreateSnapshots"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	spec := in.InstanceSpecification
+	if spec == nil {
+		return nil, errorf("MissingParameter", "The request must contain the parameter InstanceSpecification")
+	}
+	instanceId := aws.StringValue(spec.InstanceId)
+	inst, ok := e.instances[instanceId]
+	if !ok {
+		return nil, errorf("InvalidInstanceID.NotFound", "The instance ID '%v' does not exist", instanceId)
+	}
+	excluded := map[string]bool{}
+	for _, id := range aws.StringValueSlice(spec.ExcludeDataVolumeIds) {
+		excluded[id] = true
+	}
+	if aws.BoolValue(spec.ExcludeBootVolume) {
+		excluded[inst.root] = true
+	}
+
+	out := &ec2.CreateSnapshotsOutput{Snapshots: []*ec2.SnapshotInfo{}}
+	for _, id := range e.volumeIds() {
+		v := e.volumes[id]
+		if a := v.attachment; a == nil || a.instance != instanceId || excluded[id] {
+			continue
+		}
+		tags := specTags(in.TagSpecifications, ec2.ResourceTypeSnapshot)
+		if aws.StringValue(in.CopyTagsFromSource) == ec2.CopyTagsFromSourceVolume {
+			for _, t := range v.vol.Tags {
+				if !strings.HasPrefix(aws.StringValue(t.Key), "aws:") {
+					tags = setTags(tags, []*ec2.Tag{t})
+				}
+			}
+		}
+		s := e.snapshotVolume(v, in.Description, tags)
+		out.Snapshots = append(out.Snapshots, &ec2.SnapshotInfo{
+			SnapshotId: s.snap.SnapshotId,
+			VolumeId:   s.snap.VolumeId,
+			State:      s.snap.State,
+			StartTime:  s.snap.StartTime,
+		})
+	}
+	return out, nil
+}
+
+// CopySnapshotWithContext copies a snapshot within the simulation, whatever
+// regions it's asked to copy between.
+func (e *EC2) CopySnapshotWithContext(ctx aws.Context, in *ec2.CopySnapshotInput,
+	_ ...request.Option) (*ec2.CopySnapshotOutput, error) {
+	if err := e.call(ctx, "CopySnapshot"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	id := aws.StringValue(in.SourceSnapshotId)
+	source, ok := e.snapshots[id]
+	if !ok {
+		return nil, errorf("InvalidSnapshot.NotFound", "The snapshot '%v' does not exist.", id)
+	}
+	if state := aws.StringValue(source.snap.State); state != ec2.SnapshotStateCompleted {
+		return nil, errorf("IncorrectState", "Snapshot is in invalid state - %v", state)
+	}
+	encrypted := aws.BoolValue(in.Encrypted) || aws.BoolValue(source.snap.Encrypted)
+	key := aws.StringValue(in.KmsKeyId)
+	if key != "" && !encrypted {
+		return nil, errorf("InvalidParameterDependency",
+			"The parameter KmsKeyId requires the parameter Encrypted to be set.")
+	}
+	if encrypted && key == "" {
+		key = aws.StringValue(source.snap.KmsKeyId)
+		if key == "" {
+			key = DefaultKey
+		}
+	}
+
+	now := time.Now()
+	copied := &snapshot{
+		snap: ec2.Snapshot{
+			SnapshotId:  aws.String(e.newId("snap")),
+			VolumeId:    aws.String("vol-ffffffff"),
+			VolumeSize:  source.snap.VolumeSize,
+			Description: in.Description,
+			OwnerId:     aws.String(Owner),
+			Encrypted:   aws.Bool(encrypted),
+			StartTime:   aws.Time(now),
+			State:       aws.String(ec2.SnapshotStatePending),
+			Progress:    aws.String("0%"),
+			Tags:        specTags(in.TagSpecifications, ec2.ResourceTypeSnapshot),
+		},
+		done: now.Add(e.latency[Snapshot]),
+	}
+	if encrypted {
+		copied.snap.KmsKeyId = aws.String(key)
+	}
+	e.snapshots[*copied.snap.SnapshotId] = copied
+	return &ec2.CopySnapshotOutput{SnapshotId: copied.snap.SnapshotId}, nil
+}
+
+func (e *EC2) DeleteSnapshotWithContext(ctx aws.Context, in *ec2.DeleteSnapshotInput,
+	_ ...request.Option) (*ec2.DeleteSnapshotOutput, error) {
+	if err := e.call(ctx, "DeleteSnapshot"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := aws.StringValue(in.SnapshotId)
+	if _, ok := e.snapshots[id]; !ok {
+		return nil, errorf("InvalidSnapshot.NotFound", "The snapshot '%v' does not exist.", id)
+	}
+	delete(e.snapshots, id)
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+// DescribeSnapshotsWithContext lists the simulation's snapshots, all of which
+// are Owner's.
+func (e *EC2) DescribeSnapshotsWithContext(ctx aws.Context, in *ec2.DescribeSnapshotsInput,
+	_ ...request.Option) (*ec2.DescribeSnapshotsOutput, error) {
+	if err := e.call(ctx, "DescribeSnapshots"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	out := &ec2.DescribeSnapshotsOutput{Snapshots: []*ec2.Snapshot{}}
+	if owners := aws.StringValueSlice(in.OwnerIds); len(owners) > 0 {
+		ours := false
+		for _, o := range owners {
+			ours = ours || o == "self" || o == Owner
+		}
+		if !ours {
+			return out, nil
+		}
+	}
+	ids := aws.StringValueSlice(in.SnapshotIds)
+	if len(ids) == 0 {
+		ids = e.snapshotIds()
+	}
+	for _, id := range ids {
+		s, ok := e.snapshots[id]
+		if !ok {
+			return nil, errorf("InvalidSnapshot.NotFound", "The snapshot '%v' does not exist.", id)
+		}
+		match, err := matches(in.Filters, s.fields)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			out.Snapshots = append(out.Snapshots, s.describe())
+		}
+	}
+	return out, nil
+}
+
+// ModifySnapshotAttributeWithContext accepts any change to a snapshot's
+// permissions, but doesn't record it: there are no other accounts.
+func (e *EC2) ModifySnapshotAttributeWithContext(ctx aws.Context, in *ec2.ModifySnapshotAttributeInput,
+	_ ...request.Option) (*ec2.ModifySnapshotAttributeOutput, error) {
+	if err := e.call(ctx, "ModifySnapshotAttribute"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := aws.StringValue(in.SnapshotId)
+	if _, ok := e.snapshots[id]; !ok {
+		return nil, errorf("InvalidSnapshot.NotFound", "The snapshot '%v' does not exist.", id)
+	}
+	return &ec2.ModifySnapshotAttributeOutput{}, nil
+}
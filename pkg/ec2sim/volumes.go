@@ -0,0 +1,332 @@
+package ec2sim
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func (e *EC2) CreateVolumeWithContext(ctx aws.Context, in *ec2.CreateVolumeInput,
+	_ ...request.Option) (*ec2.Volume, error) {
+	if err := e.call(ctx, "CreateVolume"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	// Any zone in the simulation's region will do.
+	zone := aws.StringValue(in.AvailabilityZone)
+	if len(zone) != len(e.zone) || zone[:len(zone)-1] != e.zone[:len(e.zone)-1] {
+		return nil, errorf("InvalidParameterValue", "Invalid availability zone: [%v]", zone)
+	}
+	size := aws.Int64Value(in.Size)
+	encrypted := aws.BoolValue(in.Encrypted)
+	key := aws.StringValue(in.KmsKeyId)
+	if id := aws.StringValue(in.SnapshotId); id != "" {
+		s, ok := e.snapshots[id]
+		if !ok {
+			return nil, errorf("InvalidSnapshot.NotFound", "The snapshot '%v' does not exist.", id)
+		}
+		if state := aws.StringValue(s.snap.State); state != ec2.SnapshotStateCompleted {
+			return nil, errorf("IncorrectState", "Snapshot is in invalid state - %v", state)
+		}
+		switch min := aws.Int64Value(s.snap.VolumeSize); {
+		case size == 0:
+			size = min
+		case size < min:
+			return nil, errorf("InvalidParameterValue",
+				"Volume of %vGiB is too small; minimum is %vGiB.", size, min)
+		}
+		if aws.BoolValue(s.snap.Encrypted) {
+			encrypted = true
+			if key == "" {
+				key = aws.StringValue(s.snap.KmsKeyId)
+			}
+		}
+	} else if size == 0 {
+		return nil, errorf("MissingParameter", "The request must contain the parameter size or snapshotId")
+	}
+	if key != "" && !encrypted {
+		return nil, errorf("InvalidParameterDependency",
+			"The parameter KmsKeyId requires the parameter Encrypted to be set.")
+	}
+	if encrypted && key == "" {
+		key = DefaultKey
+	}
+	volumeType := aws.StringValue(in.VolumeType)
+	if volumeType == "" {
+		volumeType = ec2.VolumeTypeGp2
+	}
+
+	now := time.Now()
+	id := e.newId("vol")
+	v := &volume{
+		vol: ec2.Volume{
+			VolumeId:           aws.String(id),
+			AvailabilityZone:   aws.String(zone),
+			CreateTime:         aws.Time(now),
+			Size:               aws.Int64(size),
+			SnapshotId:         in.SnapshotId,
+			VolumeType:         aws.String(volumeType),
+			Iops:               in.Iops,
+			Throughput:         in.Throughput,
+			MultiAttachEnabled: aws.Bool(aws.BoolValue(in.MultiAttachEnabled)),
+			Encrypted:          aws.Bool(encrypted),
+			State:              aws.String(ec2.VolumeStateCreating),
+			Tags:               specTags(in.TagSpecifications, ec2.ResourceTypeVolume),
+		},
+		done: now.Add(e.latency[Create]),
+	}
+	if encrypted {
+		v.vol.KmsKeyId = aws.String(key)
+	}
+	e.volumes[id] = v
+	return v.describe(), nil
+}
+
+func (e *EC2) DeleteVolumeWithContext(ctx aws.Context, in *ec2.DeleteVolumeInput,
+	_ ...request.Option) (*ec2.DeleteVolumeOutput, error) {
+	if err := e.call(ctx, "DeleteVolume"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	id := aws.StringValue(in.VolumeId)
+	v, ok := e.volumes[id]
+	if !ok {
+		return nil, errorf("InvalidVolume.NotFound", "The volume '%v' does not exist.", id)
+	}
+	if a := v.attachment; a != nil {
+		return nil, errorf("VolumeInUse", "Volume %v is currently attached to %v", id, a.instance)
+	}
+	switch state := aws.StringValue(v.vol.State); state {
+	case ec2.VolumeStateAvailable:
+		v.vol.State = aws.String(ec2.VolumeStateDeleting)
+		v.done = time.Now().Add(e.latency[Delete])
+	case ec2.VolumeStateDeleting:
+	default:
+		return nil, errorf("IncorrectState", "The volume '%v' is '%v'.", id, state)
+	}
+	return &ec2.DeleteVolumeOutput{}, nil
+}
+
+func (e *EC2) AttachVolumeWithContext(ctx aws.Context, in *ec2.AttachVolumeInput,
+	_ ...request.Option) (*ec2.VolumeAttachment, error) {
+	if err := e.call(ctx, "AttachVolume"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	id, instanceId, device := aws.StringValue(in.VolumeId), aws.StringValue(in.InstanceId),
+		aws.StringValue(in.Device)
+	v, ok := e.volumes[id]
+	if !ok {
+		return nil, errorf("InvalidVolume.NotFound", "The volume '%v' does not exist.", id)
+	}
+	if _, ok := e.instances[instanceId]; !ok {
+		return nil, errorf("InvalidInstanceID.NotFound", "The instance ID '%v' does not exist", instanceId)
+	}
+	if aws.StringValue(v.vol.AvailabilityZone) != e.zone {
+		return nil, errorf("InvalidVolume.ZoneMismatch",
+			"The volume '%v' is not in the same availability zone as instance '%v'", id, instanceId)
+	}
+	if v.attachment != nil {
+		return nil, errorf("VolumeInUse", "%v is already attached to an instance", id)
+	}
+	if state := aws.StringValue(v.vol.State); state != ec2.VolumeStateAvailable {
+		return nil, errorf("IncorrectState", "%v is not 'available'.", id)
+	}
+	for _, other := range e.volumes {
+		if a := other.attachment; a != nil && a.instance == instanceId && a.device == device {
+			return nil, errorf("InvalidParameterValue",
+				"Invalid value '%v' for unixDevice. Attachment point %v is already in use", device, device)
+		}
+	}
+
+	now := time.Now()
+	v.attachment = &attachment{instance: instanceId, device: device,
+		state: ec2.VolumeAttachmentStateAttaching, since: now, done: now.Add(e.latency[Attach])}
+	v.vol.State = aws.String(ec2.VolumeStateInUse)
+	return v.describeAttachment(), nil
+}
+
+func (e *EC2) DetachVolumeWithContext(ctx aws.Context, in *ec2.DetachVolumeInput,
+	_ ...request.Option) (*ec2.VolumeAttachment, error) {
+	if err := e.call(ctx, "DetachVolume"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	id := aws.StringValue(in.VolumeId)
+	v, ok := e.volumes[id]
+	if !ok {
+		return nil, errorf("InvalidVolume.NotFound", "The volume '%v' does not exist.", id)
+	}
+	a := v.attachment
+	if a == nil {
+		return nil, errorf("IncorrectState", "Volume '%v' is in the '%v' state.",
+			id, aws.StringValue(v.vol.State))
+	}
+	if instanceId := aws.StringValue(in.InstanceId); instanceId != "" && instanceId != a.instance {
+		return nil, errorf("InvalidAttachment.NotFound",
+			"The volume '%v' is not attached to instance '%v'", id, instanceId)
+	}
+	if inst, ok := e.instances[a.instance]; ok && inst.root == id {
+		return nil, errorf("OperationNotPermitted",
+			"The volume '%v' is the root device of instance '%v' and can't be detached.", id, a.instance)
+	}
+	// Detaching again changes nothing, unless it's forced.
+	if a.state != ec2.VolumeAttachmentStateDetaching {
+		a.state = ec2.VolumeAttachmentStateDetaching
+		a.done = time.Now().Add(e.latency[Detach])
+	}
+	if aws.BoolValue(in.Force) {
+		a.forced = true
+	}
+	return v.describeAttachment(), nil
+}
+
+func (e *EC2) DescribeVolumesWithContext(ctx aws.Context, in *ec2.DescribeVolumesInput,
+	_ ...request.Option) (*ec2.DescribeVolumesOutput, error) {
+	if err := e.call(ctx, "DescribeVolumes"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	ids := aws.StringValueSlice(in.VolumeIds)
+	if len(ids) == 0 {
+		ids = e.volumeIds()
+	}
+	out := &ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{}}
+	for _, id := range ids {
+		v, ok := e.volumes[id]
+		if !ok {
+			return nil, errorf("InvalidVolume.NotFound", "The volume '%v' does not exist.", id)
+		}
+		match, err := matches(in.Filters, v.fields)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			out.Volumes = append(out.Volumes, v.describe())
+		}
+	}
+	return out, nil
+}
+
+// DescribeVolumesPagesWithContext returns every volume in one page.
+func (e *EC2) DescribeVolumesPagesWithContext(ctx aws.Context, in *ec2.DescribeVolumesInput,
+	fn func(*ec2.DescribeVolumesOutput, bool) bool, opts ...request.Option) error {
+	out, err := e.DescribeVolumesWithContext(ctx, in, opts...)
+	if err != nil {
+		return err
+	}
+	fn(out, true)
+	return nil
+}
+
+func (e *EC2) ModifyVolumeWithContext(ctx aws.Context, in *ec2.ModifyVolumeInput,
+	_ ...request.Option) (*ec2.ModifyVolumeOutput, error) {
+	if err := e.call(ctx, "ModifyVolume"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	id := aws.StringValue(in.VolumeId)
+	v, ok := e.volumes[id]
+	if !ok {
+		return nil, errorf("InvalidVolume.NotFound", "The volume '%v' does not exist.", id)
+	}
+	if m := v.mod; m != nil && aws.StringValue(m.ModificationState) != ec2.VolumeModificationStateCompleted {
+		return nil, errorf("IncorrectModificationState",
+			"Volume %v is already being modified (%v).", id, aws.StringValue(m.ModificationState))
+	}
+	size := aws.Int64Value(v.vol.Size)
+	if in.Size != nil {
+		if aws.Int64Value(in.Size) < size {
+			return nil, errorf("InvalidParameterValue", "New size cannot be smaller than existing size")
+		}
+		size = aws.Int64Value(in.Size)
+	}
+	pick := func(asked *int64, have *int64) *int64 {
+		if asked != nil {
+			return asked
+		}
+		return have
+	}
+	volumeType := v.vol.VolumeType
+	if in.VolumeType != nil {
+		volumeType = in.VolumeType
+	}
+
+	now := time.Now()
+	v.mod = &ec2.VolumeModification{
+		VolumeId:          aws.String(id),
+		ModificationState: aws.String(ec2.VolumeModificationStateModifying),
+		OriginalSize:      v.vol.Size,
+		TargetSize:        aws.Int64(size),
+		TargetIops:        pick(in.Iops, v.vol.Iops),
+		TargetThroughput:  pick(in.Throughput, v.vol.Throughput),
+		TargetVolumeType:  volumeType,
+		StartTime:         aws.Time(now),
+		Progress:          aws.Int64(0),
+	}
+	v.modDone = now.Add(e.latency[Modify])
+	m := *v.mod
+	return &ec2.ModifyVolumeOutput{VolumeModification: &m}, nil
+}
+
+func (e *EC2) DescribeVolumesModificationsWithContext(ctx aws.Context,
+	in *ec2.DescribeVolumesModificationsInput, _ ...request.Option) (*ec2.DescribeVolumesModificationsOutput, error) {
+	if err := e.call(ctx, "DescribeVolumesModifications"); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.advance()
+
+	ids := aws.StringValueSlice(in.VolumeIds)
+	if len(ids) == 0 {
+		ids = e.volumeIds()
+	}
+	out := &ec2.DescribeVolumesModificationsOutput{VolumesModifications: []*ec2.VolumeModification{}}
+	for _, id := range ids {
+		v, ok := e.volumes[id]
+		if !ok {
+			return nil, errorf("InvalidVolume.NotFound", "The volume '%v' does not exist.", id)
+		}
+		if v.mod == nil {
+			continue
+		}
+		m := *v.mod
+		match, err := matches(in.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "volume-id":
+				return []string{id}, true
+			case "modification-state":
+				return []string{aws.StringValue(m.ModificationState)}, true
+			}
+			return nil, false
+		})
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			out.VolumesModifications = append(out.VolumesModifications, &m)
+		}
+	}
+	return out, nil
+}
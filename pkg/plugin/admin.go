@@ -0,0 +1,752 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+	"github.com/gorilla/mux"
+)
+
+// AdminSocketFile is where operators (and fleet tooling) talk to the daemon.
+// It is kept separate from the plugin socket, which belongs to Docker.
+const AdminSocketFile = "/var/run/blocker-admin.sock"
+
+// Administrative operations beyond the Docker plugin protocol are optional
+// for drivers.  Each is described by a small interface, and the admin API
+// reports an error if the running driver doesn't support it.
+
+// purger forgets stale, never-mounted volume registrations.
+type purger interface {
+	Purge(olderThan time.Duration) []string
+}
+
+// volumeLister lists volumes a page at a time, filtered.
+type volumeLister interface {
+	Volumes(ctx context.Context, f driver.VolumeFilter) (driver.VolumePage, error)
+}
+
+// snapshotLister lists the snapshots (restore points) of a volume.
+type snapshotLister interface {
+	Snapshots(ctx context.Context, name string) ([]driver.SnapshotInfo, error)
+}
+
+// lineageTracer traces where a volume's data came from and went.
+type lineageTracer interface {
+	Lineage(ctx context.Context, name string) (driver.Lineage, error)
+}
+
+// groupSnapshotter snapshots groups of volumes together.
+type groupSnapshotter interface {
+	SnapshotGroup(ctx context.Context, group string) ([]driver.GroupSnapshot, error)
+}
+
+// fstabExporter renders the mounts as fstab entries, for recovery by hand.
+type fstabExporter interface {
+	Fstab(ctx context.Context, systemd bool) (string, error)
+}
+
+// reporter summarizes the managed volumes for capacity planning.
+type reporter interface {
+	Report(ctx context.Context) (driver.Report, error)
+}
+
+// orphanFinder finds (and deletes) leaked volumes.
+type orphanFinder interface {
+	Orphans(ctx context.Context, olderThan time.Duration, remove bool) ([]driver.Orphan, error)
+}
+
+// batcher runs an operation on many volumes at once.
+type batcher interface {
+	Batch(ctx context.Context, op string, f driver.VolumeFilter, parallelism int) (driver.BatchResult, error)
+}
+
+// historian remembers the recent operations on each volume.
+type historian interface {
+	History(name string) ([]driver.HistoryEntry, error)
+}
+
+// handoffer moves volumes between hosts (see `blocker release`).
+type handoffer interface {
+	Release(ctx context.Context, name string, to string) error
+	Accept(ctx context.Context, name string) (string, error)
+}
+
+// prefetcher attaches volumes ahead of their mounts.
+type prefetcher interface {
+	Prefetch(ctx context.Context, name string) (string, error)
+}
+
+// replicator makes read-only replicas of volumes from fresh snapshots.
+type replicator interface {
+	Replicate(ctx context.Context, name string, count int, prefetch bool) (driver.ReplicaSet, error)
+}
+
+// reconciler reports on (and runs) the reconciliation passes which compare
+// the volumes' state against EC2 and the mount table.
+type reconciler interface {
+	ReconcileReports() []driver.ReconcileReport
+	Reconcile(ctx context.Context) driver.ReconcileReport
+}
+
+// verifier restores a volume's latest backup and checks it.
+type verifier interface {
+	Verify(ctx context.Context, name string) driver.VerifyResult
+}
+
+// exporter exports volumes' snapshots to S3.
+type exporter interface {
+	Export(ctx context.Context, name string, full bool) (driver.ExportResult, error)
+}
+
+// luksRestorer restores encrypted volumes' LUKS headers from their backups.
+type luksRestorer interface {
+	RestoreLUKSHeader(ctx context.Context, name string, version string, confirm string) error
+}
+
+// luksRotator rotates encrypted volumes' LUKS keys.
+type luksRotator interface {
+	RotateLUKSKey(ctx context.Context, name string, kmsKey string, rewrapOnly bool, confirm string) error
+}
+
+// estimator estimates what new volumes would cost.
+type estimator interface {
+	Estimate(ctx context.Context, opts map[string]string) (driver.CostEstimate, error)
+}
+
+// maintainer puts volumes under maintenance, refusing their mounts.
+type maintainer interface {
+	SetMaintenance(ctx context.Context, name string, on bool, reason string, drain bool) error
+}
+
+// resizer grows volumes' filesystems to fill their devices.
+type resizer interface {
+	Resize(ctx context.Context, name string) error
+}
+
+// suspender freezes volumes across instance hibernation.
+type suspender interface {
+	Suspend(ctx context.Context) ([]string, error)
+	Resume(ctx context.Context, force bool) ([]string, error)
+}
+
+// remover unmounts and removes volumes at an admin's request, pinned ones
+// too if forced.
+type remover interface {
+	AdminUnmount(ctx context.Context, name string, force bool) error
+	AdminRemove(ctx context.Context, name string, force bool) error
+}
+
+// copier refreshes volumes' copies in other availability zones or regions.
+type copier interface {
+	RefreshCopy(ctx context.Context, name string) error
+}
+
+func makeAdminRoutes(d VolumeDriver) http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/version", serveAdminVersion).Methods("GET")
+	r.HandleFunc("/metrics", serveMetrics).Methods("GET")
+	r.HandleFunc("/purge", serveAdminPurge(d)).Methods("POST")
+	r.HandleFunc("/drain", serveAdminDrain).Methods("GET", "POST", "DELETE")
+	r.HandleFunc("/events", serveAdminEvents).Methods("GET")
+	r.HandleFunc("/suspend", serveAdminSuspend(d)).Methods("POST")
+	r.HandleFunc("/resume", serveAdminResume(d)).Methods("POST")
+	r.HandleFunc("/fstab", serveAdminFstab(d)).Methods("GET")
+	r.HandleFunc("/report", serveAdminReport(d)).Methods("GET")
+	r.HandleFunc("/orphans", serveAdminOrphans(d)).Methods("GET", "DELETE")
+	r.HandleFunc("/reconcile", serveAdminReconcile(d)).Methods("GET", "POST")
+	r.HandleFunc("/volumes", serveAdminVolumes(d)).Methods("GET")
+	r.HandleFunc("/batch/{op}", serveAdminBatch(d)).Methods("POST")
+	r.HandleFunc("/estimate", serveAdminEstimate(d)).Methods("GET")
+	r.HandleFunc("/volumes/{name}/snapshots", serveAdminSnapshots(d)).Methods("GET")
+	r.HandleFunc("/snapshot-groups/{group}", serveAdminSnapshotGroup(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}/history", serveAdminHistory(d)).Methods("GET")
+	r.HandleFunc("/volumes/{name}/lineage", serveAdminLineage(d)).Methods("GET")
+	r.HandleFunc("/volumes/{name}/verify", serveAdminVerify(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}/export", serveAdminExport(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}/luks-header/restore", serveAdminRestoreLUKSHeader(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}/luks-key/rotate", serveAdminRotateLUKSKey(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}/release", serveAdminRelease(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}/accept", serveAdminAccept(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}/prefetch", serveAdminPrefetch(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}/replicas", serveAdminReplicate(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}/resize", serveAdminResize(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}/maintenance", serveAdminMaintenance(d)).Methods("POST", "DELETE")
+	r.HandleFunc("/volumes/{name}/unmount", serveAdminUnmount(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}/copy", serveAdminRefreshCopy(d)).Methods("POST")
+	r.HandleFunc("/volumes/{name}", serveAdminRemove(d)).Methods("DELETE")
+	return r
+}
+
+type AdminErrorResponse struct {
+	Err  string
+	Code driver.ErrorCode
+}
+
+func serveAdminError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(AdminErrorResponse{Err: err.Error(), Code: driver.ErrorCodeOf(err)})
+}
+
+func serveAdminVersion(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(driver.CurrentBuildInfo())
+}
+
+type AdminPurgeResponse struct {
+	Purged []string
+}
+
+func serveAdminPurge(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := d.(purger)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		// Without an explicit age, purge every never-mounted registration.
+		var olderThan time.Duration
+		if s := r.URL.Query().Get("older-than"); s != "" {
+			var err error
+			if olderThan, err = time.ParseDuration(s); err != nil {
+				serveAdminError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		purged := p.Purge(olderThan)
+		driver.LogCtx(r.Context(), "Admin purge removed %v registration(s): %v\n", len(purged), purged)
+		json.NewEncoder(w).Encode(AdminPurgeResponse{Purged: purged})
+	}
+}
+
+func serveAdminFstab(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := d.(fstabExporter)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		var systemd bool
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "fstab":
+		case "systemd":
+			systemd = true
+		default:
+			serveAdminError(w, http.StatusBadRequest,
+				fmt.Errorf("Unknown format %q; expected fstab or systemd.", format))
+			return
+		}
+		text, err := f.Fstab(r.Context(), systemd)
+		if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, text)
+	}
+}
+
+func serveAdminVolumes(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, ok := d.(volumeLister)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		q := r.URL.Query()
+		f := driver.VolumeFilter{State: q.Get("state"), Tags: q["tag"], After: q.Get("after")}
+		if s := q.Get("limit"); s != "" {
+			var err error
+			if f.Limit, err = strconv.Atoi(s); err != nil {
+				serveAdminError(w, http.StatusBadRequest, fmt.Errorf("Invalid limit %q.", s))
+				return
+			}
+		}
+		page, err := l.Volumes(r.Context(), f)
+		if driver.ErrorCodeOf(err) == driver.CodeInvalidOption {
+			serveAdminError(w, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// serveAdminBatch runs an operation on the volumes matching the same filters
+// as /volumes.
+func serveAdminBatch(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := d.(batcher)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		q := r.URL.Query()
+		f := driver.VolumeFilter{State: q.Get("state"), Tags: q["tag"]}
+		var parallelism int
+		if s := q.Get("parallelism"); s != "" {
+			var err error
+			if parallelism, err = strconv.Atoi(s); err != nil {
+				serveAdminError(w, http.StatusBadRequest, fmt.Errorf("Invalid parallelism %q.", s))
+				return
+			}
+		}
+		result, err := b.Batch(r.Context(), mux.Vars(r)["op"], f, parallelism)
+		if driver.ErrorCodeOf(err) == driver.CodeInvalidOption {
+			serveAdminError(w, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// serveAdminOrphans lists the orphaned volumes, or with DELETE deletes them.
+func serveAdminOrphans(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := d.(orphanFinder)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		var olderThan time.Duration
+		if s := r.URL.Query().Get("older-than"); s != "" {
+			var err error
+			if olderThan, err = time.ParseDuration(s); err != nil {
+				serveAdminError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		orphans, err := f.Orphans(r.Context(), olderThan, r.Method == "DELETE")
+		if driver.ErrorCodeOf(err) == driver.CodeReadOnly {
+			serveAdminError(w, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(orphans)
+	}
+}
+
+// serveAdminReconcile lists the latest reconciliation passes' reports, newest
+// first, or (for POST) runs a pass now and returns its report.
+func serveAdminReconcile(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec, ok := d.(reconciler)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		if r.Method == "POST" {
+			json.NewEncoder(w).Encode(rec.Reconcile(r.Context()))
+			return
+		}
+		json.NewEncoder(w).Encode(rec.ReconcileReports())
+	}
+}
+
+func serveAdminEstimate(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e, ok := d.(estimator)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		// The query holds the volume's options, e.g. ?type=gp3&size=500.
+		opts := map[string]string{}
+		for k, v := range r.URL.Query() {
+			opts[k] = v[0]
+		}
+		estimate, err := e.Estimate(r.Context(), opts)
+		if driver.ErrorCodeOf(err) == driver.CodeInvalidOption {
+			serveAdminError(w, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(estimate)
+	}
+}
+
+func serveAdminSnapshots(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, ok := d.(snapshotLister)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		snapshots, err := l.Snapshots(r.Context(), mux.Vars(r)["name"])
+		if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(snapshots)
+	}
+}
+
+func serveAdminSnapshotGroup(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g, ok := d.(groupSnapshotter)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		snapshots, err := g.SnapshotGroup(r.Context(), mux.Vars(r)["group"])
+		if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(snapshots)
+	}
+}
+
+func serveAdminReport(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep, ok := d.(reporter)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		report, err := rep.Report(r.Context())
+		if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+func serveAdminHistory(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := d.(historian)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		history, err := h.History(mux.Vars(r)["name"])
+		if err != nil {
+			serveAdminError(w, http.StatusNotFound, err)
+			return
+		}
+		json.NewEncoder(w).Encode(history)
+	}
+}
+
+func serveAdminLineage(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, ok := d.(lineageTracer)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		lineage, err := l.Lineage(r.Context(), mux.Vars(r)["name"])
+		if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(lineage)
+	}
+}
+
+type AdminHandoffResponse struct {
+	Mountpoint string
+}
+
+func serveAdminRelease(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := d.(handoffer)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		name, to := mux.Vars(r)["name"], r.URL.Query().Get("to")
+		if err := h.Release(r.Context(), name, to); err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(AdminHandoffResponse{})
+	}
+}
+
+func serveAdminAccept(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := d.(handoffer)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		mountpoint, err := h.Accept(r.Context(), mux.Vars(r)["name"])
+		if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(AdminHandoffResponse{Mountpoint: mountpoint})
+	}
+}
+
+type AdminPrefetchResponse struct {
+	Device string
+}
+
+func serveAdminPrefetch(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := d.(prefetcher)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		dev, err := p.Prefetch(r.Context(), mux.Vars(r)["name"])
+		if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(AdminPrefetchResponse{Device: dev})
+	}
+}
+
+// serveAdminReplicate makes count (default 1) read-only replicas of a volume,
+// attaching them too with prefetch=true.
+func serveAdminReplicate(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep, ok := d.(replicator)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		q := r.URL.Query()
+		count := 1
+		if s := q.Get("count"); s != "" {
+			var err error
+			if count, err = strconv.Atoi(s); err != nil {
+				serveAdminError(w, http.StatusBadRequest, fmt.Errorf("Invalid count %q.", s))
+				return
+			}
+		}
+		set, err := rep.Replicate(r.Context(), mux.Vars(r)["name"], count, q.Get("prefetch") == "true")
+		if driver.ErrorCodeOf(err) == driver.CodeInvalidOption {
+			serveAdminError(w, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(set)
+	}
+}
+
+// serveAdminMaintenance puts a volume under maintenance (POST, with an
+// optional reason, and drain=true to unmount it now) or ends it (DELETE).
+func serveAdminMaintenance(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m, ok := d.(maintainer)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		q := r.URL.Query()
+		if err := m.SetMaintenance(r.Context(), mux.Vars(r)["name"], r.Method == "POST",
+			q.Get("reason"), q.Get("drain") == "true"); err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func serveAdminResize(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs, ok := d.(resizer)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		if err := rs.Resize(r.Context(), mux.Vars(r)["name"]); err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serveAdminUnmount unmounts a volume, whoever is using it; force=true lets
+// go of a pinned one.
+func serveAdminUnmount(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rm, ok := d.(remover)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		force := r.URL.Query().Get("force") == "true"
+		if err := rm.AdminUnmount(r.Context(), mux.Vars(r)["name"], force); err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// serveAdminRemove removes a volume; force=true lets go of a pinned one.
+func serveAdminRemove(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rm, ok := d.(remover)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		force := r.URL.Query().Get("force") == "true"
+		if err := rm.AdminRemove(r.Context(), mux.Vars(r)["name"], force); err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func serveAdminRefreshCopy(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := d.(copier)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		if err := c.RefreshCopy(r.Context(), mux.Vars(r)["name"]); err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func serveAdminVerify(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v, ok := d.(verifier)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+		json.NewEncoder(w).Encode(v.Verify(r.Context(), mux.Vars(r)["name"]))
+	}
+}
+
+func serveAdminExport(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e, ok := d.(exporter)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		full := r.URL.Query().Get("full") == "true"
+		result, err := e.Export(r.Context(), mux.Vars(r)["name"], full)
+		if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func serveAdminRestoreLUKSHeader(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lr, ok := d.(luksRestorer)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		q := r.URL.Query()
+		if err := lr.RestoreLUKSHeader(r.Context(), mux.Vars(r)["name"],
+			q.Get("version"), q.Get("confirm")); err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func serveAdminRotateLUKSKey(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lr, ok := d.(luksRotator)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+
+		q := r.URL.Query()
+		if err := lr.RotateLUKSKey(r.Context(), mux.Vars(r)["name"],
+			q.Get("kms-key"), q.Get("rewrap") == "true", q.Get("confirm")); err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type AdminSuspendResponse struct {
+	Volumes []string
+}
+
+func serveAdminSuspend(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := d.(suspender)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+		frozen, err := s.Suspend(r.Context())
+		if err != nil {
+			serveAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		json.NewEncoder(w).Encode(AdminSuspendResponse{Volumes: frozen})
+	}
+}
+
+func serveAdminResume(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := d.(suspender)
+		if !ok {
+			serveAdminError(w, http.StatusNotImplemented, driver.ErrNotSupported)
+			return
+		}
+		thawed, err := s.Resume(r.Context(), r.URL.Query().Get("force") == "true")
+		if err != nil {
+			serveAdminError(w, http.StatusConflict, err)
+			return
+		}
+		json.NewEncoder(w).Encode(AdminSuspendResponse{Volumes: thawed})
+	}
+}
@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+)
+
+// AuthHeader carries an HMAC signature for admin requests, of the form
+// "<unix-time>:<hex HMAC-SHA256 of the time, method, and request URI>".
+const AuthHeader = "X-Blocker-Auth"
+
+// authMaxSkew bounds how old (or new) a signed request may be.
+const authMaxSkew = 5 * time.Minute
+
+type peerCredKey struct{}
+
+// peerCred is who's at the other end of a unix socket connection.
+type peerCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// newServer makes an HTTP server for one of our unix sockets, recording each
+// connection's peer credentials (via SO_PEERCRED, or LOCAL_PEERCRED on
+// FreeBSD) for later checks.
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler: handler,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if cred, err := peerCredentials(c); err == nil {
+				ctx = context.WithValue(ctx, peerCredKey{}, cred)
+			}
+			return ctx
+		},
+	}
+}
+
+func peerCredentials(c net.Conn) (*peerCred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("Not a unix socket.")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *peerCred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = getPeerCred(int(fd))
+	}); err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// requireAuth rejects requests from peers that aren't permitted by the auth
+// configuration.  With no allowlist and no secret, everyone is permitted, as
+// access to the socket itself is then the only control.  Signed requests
+// are only honored where acceptSigned is set (i.e. on the admin socket),
+// since Docker can't sign its requests.
+func requireAuth(next http.Handler, acceptSigned bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checkAuth(r, acceptSigned); err != nil {
+			driver.LogCtxError(r.Context(), "Rejected %v %v: %v\n", r.Method, r.URL, err)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "{\"Err\":%q}\n", err.Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func checkAuth(r *http.Request, acceptSigned bool) error {
+	auth := driver.GetConfig().Auth
+	restricted := len(auth.AllowedUIDs) > 0 || len(auth.AllowedGIDs) > 0
+	signing := acceptSigned && auth.SecretRef() != ""
+	if !restricted && !signing {
+		return nil
+	}
+
+	if cred, ok := r.Context().Value(peerCredKey{}).(*peerCred); ok {
+		for _, uid := range auth.AllowedUIDs {
+			if cred.Uid == uid {
+				return nil
+			}
+		}
+		for _, gid := range auth.AllowedGIDs {
+			if cred.Gid == gid {
+				return nil
+			}
+		}
+	}
+
+	if signing && r.Header.Get(AuthHeader) != "" {
+		return checkSignature(r, auth.SecretRef())
+	}
+	return errors.New("Peer is not authorized.")
+}
+
+// secretTTL is how long the shared secret is cached, so that one kept in
+// AWS isn't fetched for every request, while a change to it still takes.
+const secretTTL = time.Minute
+
+var secretCache struct {
+	sync.Mutex
+	ref     string
+	secret  []byte
+	fetched time.Time
+}
+
+// readSecret fetches the shared secret the reference names, ignoring
+// surrounding whitespace.
+func readSecret(ref string) ([]byte, error) {
+	secretCache.Lock()
+	defer secretCache.Unlock()
+	if secretCache.ref == ref && time.Since(secretCache.fetched) < secretTTL {
+		return secretCache.secret, nil
+	}
+	secret, err := driver.ReadSecret(context.Background(), ref)
+	if err != nil {
+		return nil, err
+	}
+	secret = []byte(strings.TrimSpace(string(secret)))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Secret %v is empty.", ref)
+	}
+	secretCache.ref, secretCache.secret, secretCache.fetched = ref, secret, time.Now()
+	return secret, nil
+}
+
+func computeSignature(secret []byte, ts int64, method string, uri string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d\n%s\n%s", ts, method, uri)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkSignature(r *http.Request, secretRef string) error {
+	secret, err := readSecret(secretRef)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(r.Header.Get(AuthHeader), ":", 2)
+	if len(parts) != 2 {
+		return errors.New("Malformed signature.")
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return errors.New("Malformed signature timestamp.")
+	}
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > authMaxSkew || skew < -authMaxSkew {
+		return errors.New("Signature has expired.")
+	}
+	expected := computeSignature(secret, ts, r.Method, r.URL.RequestURI())
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return errors.New("Invalid signature.")
+	}
+	return nil
+}
+
+// SignRequest adds a signature to an admin request, if a secret is
+// configured and readable.
+func SignRequest(r *http.Request) error {
+	secretRef := driver.GetConfig().Auth.SecretRef()
+	if secretRef == "" {
+		return nil
+	}
+	secret, err := readSecret(secretRef)
+	if err != nil {
+		return err
+	}
+	ts := time.Now().Unix()
+	r.Header.Set(AuthHeader, fmt.Sprintf("%d:%s",
+		ts, computeSignature(secret, ts, r.Method, r.URL.RequestURI())))
+	return nil
+}
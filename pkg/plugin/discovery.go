@@ -0,0 +1,48 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Docker finds plugins in several ways, depending on its version and how
+// it's set up: by a socket in /run/docker/plugins, or by a .spec or .json
+// file in /etc/docker/plugins or /usr/lib/docker/plugins.  Blocker can be
+// served on several sockets at once, and write any of these files (see
+// driver.DiscoveryConfig), so that one configuration suits a mixed fleet.
+
+// pluginSpec is the content of a .json discovery file.
+type pluginSpec struct {
+	Name string
+	Addr string
+}
+
+// WriteSpecFile writes a discovery file pointing Docker at the given socket:
+// a .spec file holds its URL, and a .json file names the plugin (after the
+// file) and gives its address.  Files already saying as much are left alone.
+func WriteSpecFile(path string, socket string) error {
+	addr := "unix://" + socket
+	data := []byte(addr + "\n")
+	if filepath.Ext(path) == ".json" {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		var err error
+		if data, err = json.Marshal(pluginSpec{Name: name, Addr: addr}); err != nil {
+			return err
+		}
+	}
+	if old, err := ioutil.ReadFile(path); err == nil && string(old) == string(data) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,40 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+)
+
+// refuseWhileDraining wraps a plugin handler for an operation that creates
+// new work, failing it with a retryable error while draining.
+func refuseWhileDraining(op string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if driver.IsDraining() {
+			driver.LogCtxError(r.Context(), "Draining; refusing %v.\n", op)
+			json.NewEncoder(w).Encode(volumeSimpleResponse{
+				Err: fmt.Sprintf("This host is draining; %v refused.  "+
+					"Please retry on another host or later.", op),
+				ErrCode: driver.CodeDraining,
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+type AdminDrainResponse struct {
+	Draining bool
+}
+
+func serveAdminDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		driver.SetDraining(true)
+	case "DELETE":
+		driver.SetDraining(false)
+	}
+	json.NewEncoder(w).Encode(AdminDrainResponse{Draining: driver.IsDraining()})
+}
@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+)
+
+// eventKeepalive is how often an idle stream gets a comment line, which
+// also lets us notice clients that have gone away.
+const eventKeepalive = 15 * time.Second
+
+// serveAdminEvents streams volume events as server-sent events, one JSON
+// object per event.
+func serveAdminEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		driver.LogCtxError(r.Context(), "Streaming events failed: %v\n", err)
+		return
+	}
+
+	ch := driver.Events.Subscribe()
+	defer driver.Events.Unsubscribe(ch)
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(e)
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			// The client went away.
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+)
+
+// Listen listens on a Unix socket.  If another daemon is already serving on
+// it, Listen fails, or with replace stops that daemon first; a socket left
+// behind by a daemon which has exited is removed.
+func Listen(path string, replace bool) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		pid := peerPid(conn)
+		conn.Close()
+		if !replace {
+			return nil, fmt.Errorf("Another blocker daemon (pid %v) is listening on %v; stop it first, or start with -replace to take over from it.",
+				pid, path)
+		}
+		if err := driver.StopDaemon(pid, func() bool { return listening(path) }); err != nil {
+			return nil, err
+		}
+	}
+
+	// Nobody's listening, so any socket there is stale.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+func listening(path string) bool {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// peerPid finds the PID of the process at the other end of a Unix socket
+// connection, or 0 if it can't.
+func peerPid(conn net.Conn) int {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var cred *peerCred
+	raw.Control(func(fd uintptr) {
+		cred, _ = getPeerCred(int(fd))
+	})
+	if cred == nil {
+		return 0
+	}
+	return int(cred.Pid)
+}
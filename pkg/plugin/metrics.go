@@ -0,0 +1,56 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+)
+
+func init() {
+	driver.DescribeMetric("blocker_operations_total",
+		"Docker volume plugin requests, by operation and result (OK, or the error code).")
+	driver.DescribeMetric("blocker_operation_duration_seconds",
+		"How long Docker volume plugin requests took, by operation.")
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	driver.WriteMetrics(w)
+}
+
+// observeOperation records a plugin request for op, begun at start.
+func observeOperation(op string, start time.Time, err error) {
+	result := "OK"
+	if err != nil {
+		result = string(driver.ErrorCodeOf(err))
+	}
+	driver.IncCounter("blocker_operations_total", "op", op, "result", result)
+	driver.ObserveDuration(time.Since(start), "blocker_operation_duration_seconds", "op", op)
+}
+
+// healthChecker reports whether the driver can do its job.
+type healthChecker interface {
+	Healthy() error
+}
+
+type healthResponse struct {
+	Status string
+	Err    string `json:",omitempty"`
+}
+
+// serveHealthz answers 200 while the driver is healthy, and 503 otherwise, for
+// fleet health checks.
+func serveHealthz(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := healthResponse{Status: "ok"}
+		if h, ok := d.(healthChecker); ok {
+			if err := h.Healthy(); err != nil {
+				resp = healthResponse{Status: "unhealthy", Err: err.Error()}
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+)
+
+// RequestIdHeader lets callers supply their own correlation ID; we echo it
+// (or the one we generated) back in the response.
+const RequestIdHeader = "X-Request-Id"
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap exposes the underlying writer (e.g. for flushing event streams).
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// withRequestLogging assigns each request an ID, which is carried in its
+// context (along with its method and path, as log fields) so that every log
+// line (and AWS call) made on its behalf can be traced, and logs a summary of
+// the request and its response.  The context is cancelled if the caller
+// hangs up, ending any waits early; the driver finishes what mustn't be left
+// halfway (like tidying up after a failed attach) regardless.
+func withRequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if id == "" {
+			id = driver.NewRequestId()
+		}
+		ctx := driver.WithRequestId(r.Context(), id)
+		ctx = driver.WithLogFields(ctx, "method", r.Method, "path", r.URL.Path)
+		w.Header().Set(RequestIdHeader, id)
+
+		driver.LogCtx(ctx, "* %s %s\n", r.Method, r.URL.String())
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		elapsed := time.Since(start)
+		driver.LogCtx(driver.WithLogFields(ctx, "status", strconv.Itoa(rec.status),
+			"duration_ms", strconv.FormatInt(elapsed.Milliseconds(), 10)),
+			"* %s %s: %d in %v\n", r.Method, r.URL.String(), rec.status, elapsed)
+	})
+}
+
+func init() {
+	driver.DescribeMetric("blocker_panics_total",
+		"Panics recovered, by handler (\"actor\" for volume operations).")
+}
+
+// withRecovery converts a panic in a handler into an error response, so that
+// one bad request can't take the whole plugin down with it.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				driver.LogCtxError(r.Context(), "Panic serving %v: %v\n%s",
+					r.URL, p, debug.Stack())
+				driver.IncCounter("blocker_panics_total", "handler", r.URL.Path)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(volumeSimpleResponse{
+					Err:     fmt.Sprintf("Internal error: %v", p),
+					ErrCode: driver.CodeInternal,
+				})
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
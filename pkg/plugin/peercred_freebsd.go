@@ -0,0 +1,35 @@
+package plugin
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// From sys/un.h and sys/ucred.h.
+const (
+	solLocal      = 0
+	localPeerCred = 1
+	xucredNGroups = 16
+)
+
+// xucred is struct xucred, whose last member is a union of a pointer and
+// cr_pid.
+type xucred struct {
+	Version uint32
+	Uid     uint32
+	Ngroups int16
+	Groups  [xucredNGroups]uint32
+	Pid     uintptr
+}
+
+// getPeerCred reads the credentials of a unix socket's peer.  Its group is
+// its effective one, the first in its list.
+func getPeerCred(fd int) (*peerCred, error) {
+	var x xucred
+	size := uint32(unsafe.Sizeof(x))
+	if _, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), solLocal, localPeerCred,
+		uintptr(unsafe.Pointer(&x)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+		return nil, errno
+	}
+	return &peerCred{Pid: int32(x.Pid), Uid: x.Uid, Gid: x.Groups[0]}, nil
+}
@@ -0,0 +1,12 @@
+package plugin
+
+import "syscall"
+
+// getPeerCred reads the credentials of a unix socket's peer.
+func getPeerCred(fd int) (*peerCred, error) {
+	cred, err := syscall.GetsockoptUcred(fd, syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return nil, err
+	}
+	return &peerCred{Pid: cred.Pid, Uid: cred.Uid, Gid: cred.Gid}, nil
+}
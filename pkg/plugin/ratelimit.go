@@ -0,0 +1,76 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+)
+
+// tokenBucket is a simple rate limiter: it holds up to burst tokens, refills
+// at rate tokens per second, and each request spends one.
+type tokenBucket struct {
+	limit  driver.RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.PerSecond
+	if max := float64(b.limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+var (
+	bucketsMu sync.Mutex
+	buckets   = make(map[string]*tokenBucket)
+)
+
+// allowRequest reports whether another request for the given operation is
+// permitted under the configured limits.
+func allowRequest(op string) bool {
+	limit, ok := driver.GetConfig().RateLimits[strings.ToLower(op)]
+	if !ok || limit.PerSecond <= 0 {
+		return true
+	}
+
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	now := time.Now()
+	b := buckets[op]
+	if b == nil || b.limit != limit {
+		// New (or reconfigured) limits start out with a full bucket.
+		b = &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		buckets[op] = b
+	}
+	return b.take(now)
+}
+
+// rateLimited wraps a plugin handler, refusing requests over the limit for
+// its operation with a retryable error rather than queuing unbounded work
+// (and AWS calls) behind the ones already running.
+func rateLimited(op string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowRequest(op) {
+			driver.LogCtxError(r.Context(), "Rate limit exceeded for %v; rejecting %v.\n",
+				op, r.URL)
+			json.NewEncoder(w).Encode(volumeSimpleResponse{
+				Err:     fmt.Sprintf("Too many %v requests; please retry shortly.", op),
+				ErrCode: driver.CodeRateLimited,
+			})
+			return
+		}
+		next(w, r)
+	}
+}
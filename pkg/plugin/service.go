@@ -0,0 +1,247 @@
+// Package plugin serves a VolumeDriver over Docker's volume plugin protocol,
+// plus blocker's admin API, on HTTP.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+	"github.com/gorilla/mux"
+)
+
+// shutdownTimeout bounds how long we wait for in-flight requests at exit.
+const shutdownTimeout = 2 * time.Minute
+
+// NewServer makes the HTTP server for Docker's plugin socket.
+func NewServer(d VolumeDriver) *http.Server {
+	return newServer(withRequestLogging(withRecovery(
+		requireAuth(makeRoutes(d), false))))
+}
+
+// NewAdminServer makes the HTTP server for the admin socket.  Which admin
+// operations are available depends on the optional interfaces (see admin.go)
+// that d implements.
+func NewAdminServer(d VolumeDriver) *http.Server {
+	srv := newServer(withRequestLogging(withRecovery(
+		requireAuth(makeAdminRoutes(d), true))))
+	srv.RegisterOnShutdown(driver.Events.CloseAll)
+	return srv
+}
+
+// Shutdown drains the daemon for the configured grace period, so that Docker
+// can still unmount volumes as containers stop, then stops serving once any
+// in-flight requests have finished.
+func Shutdown(servers ...*http.Server) {
+	driver.SetDraining(true)
+	if grace := time.Duration(driver.GetConfig().ShutdownGrace); grace > 0 {
+		driver.Log("Draining for %v before exiting...\n", grace)
+		time.Sleep(grace)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			driver.LogError("Waiting for requests to finish failed: %s.\n", err)
+		}
+	}
+}
+
+func makeRoutes(d VolumeDriver) http.Handler {
+	r := mux.NewRouter()
+	// TODO: permit options in the name string.
+	r.HandleFunc("/Plugin.Activate", servePluginActivate)
+	r.HandleFunc("/VolumeDriver.Create",
+		rateLimited("Create", refuseWhileDraining("Create",
+			serveVolumeCreate(d.Create))))
+	r.HandleFunc("/VolumeDriver.Mount",
+		rateLimited("Mount", refuseWhileDraining("Mount",
+			serveVolumeComplex("Mount", d.Mount))))
+	r.HandleFunc("/VolumeDriver.Path",
+		rateLimited("Path", serveVolumeComplex("Path", d.Path)))
+	r.HandleFunc("/VolumeDriver.Remove",
+		rateLimited("Remove", serveVolumeSimple("Remove", d.Remove)))
+	r.HandleFunc("/VolumeDriver.Unmount",
+		rateLimited("Unmount", serveVolumeSimple("Unmount", d.Unmount)))
+	r.HandleFunc("/VolumeDriver.List", rateLimited("List", serveVolumeList(d)))
+	r.HandleFunc("/VolumeDriver.Get", rateLimited("Get", serveVolumeGet(d)))
+	r.HandleFunc("/VolumeDriver.Capabilities", serveVolumeCapabilities)
+	// For Prometheus and fleet health checks, which may not be able to
+	// reach the admin socket.
+	r.HandleFunc("/metrics", serveMetrics).Methods("GET")
+	r.HandleFunc("/healthz", serveHealthz(d)).Methods("GET")
+	return r
+}
+
+type pluginInfoResponse struct {
+	Implements []string
+}
+
+func servePluginActivate(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(pluginInfoResponse{
+		Implements: []string{"VolumeDriver"},
+	})
+}
+
+type volumeRequest struct {
+	Name string
+	// ID identifies the caller (for Mount and Unmount, one per container
+	// mount) in newer versions of Docker.
+	ID string
+}
+
+type volumeCreateRequest struct {
+	Name string
+	Opts map[string]string
+}
+
+type volumeSimpleResponse struct {
+	Err     string
+	ErrCode driver.ErrorCode `json:",omitempty"`
+}
+
+func serveVolumeSimple(op string, f func(context.Context, string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var vol volumeRequest
+		err := json.NewDecoder(r.Body).Decode(&vol)
+		if err == nil {
+			ctx = driver.WithLogFields(ctx, "volume", vol.Name)
+			start := time.Now()
+			err = f(driver.WithCaller(ctx, vol.ID), vol.Name)
+			observeOperation(op, start, err)
+			driver.LogCtx(ctx, "\tdone: (%s): %v\n", vol.Name, err)
+		}
+		var errs string
+		if err != nil {
+			errs = err.Error()
+		}
+		json.NewEncoder(w).Encode(volumeSimpleResponse{
+			Err:     errs,
+			ErrCode: driver.ErrorCodeOf(err),
+		})
+	}
+}
+
+func serveVolumeCreate(
+	f func(context.Context, string, map[string]string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var vol volumeCreateRequest
+		err := json.NewDecoder(r.Body).Decode(&vol)
+		if err == nil {
+			ctx = driver.WithLogFields(ctx, "volume", vol.Name)
+			start := time.Now()
+			err = f(ctx, vol.Name, vol.Opts)
+			observeOperation("Create", start, err)
+			driver.LogCtx(ctx, "\tdone: (%s, %v): %v\n", vol.Name, vol.Opts, err)
+		}
+		var errs string
+		if err != nil {
+			errs = err.Error()
+		}
+		json.NewEncoder(w).Encode(volumeSimpleResponse{
+			Err:     errs,
+			ErrCode: driver.ErrorCodeOf(err),
+		})
+	}
+}
+
+type volumeComplexResponse struct {
+	Mountpoint string
+	Err        string
+	ErrCode    driver.ErrorCode `json:",omitempty"`
+}
+
+func serveVolumeComplex(
+	op string, f func(context.Context, string) (string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var vol volumeRequest
+		err := json.NewDecoder(r.Body).Decode(&vol)
+		var mountpoint string
+		if err == nil {
+			ctx = driver.WithLogFields(ctx, "volume", vol.Name)
+			start := time.Now()
+			mountpoint, err = f(driver.WithCaller(ctx, vol.ID), vol.Name)
+			observeOperation(op, start, err)
+			driver.LogCtx(ctx, "\tdone: (%s): (%s, %v)\n", vol.Name, mountpoint, err)
+		}
+		var errs string
+		if err != nil {
+			errs = err.Error()
+		}
+		json.NewEncoder(w).Encode(volumeComplexResponse{
+			Mountpoint: mountpoint,
+			Err:        errs,
+			ErrCode:    driver.ErrorCodeOf(err),
+		})
+	}
+}
+
+type volumeListResponse struct {
+	Volumes []driver.VolumeInfo
+	Err     string
+	ErrCode driver.ErrorCode `json:",omitempty"`
+}
+
+func serveVolumeList(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		volumes, err := d.List(r.Context())
+		var errs string
+		if err != nil {
+			errs = err.Error()
+			driver.LogCtxError(r.Context(), "\tList failed: %v\n", err)
+		}
+		json.NewEncoder(w).Encode(volumeListResponse{
+			Volumes: volumes,
+			Err:     errs,
+			ErrCode: driver.ErrorCodeOf(err),
+		})
+	}
+}
+
+type volumeGetResponse struct {
+	Volume  *driver.VolumeInfo `json:",omitempty"`
+	Err     string
+	ErrCode driver.ErrorCode `json:",omitempty"`
+}
+
+func serveVolumeGet(d VolumeDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var vol volumeRequest
+		err := json.NewDecoder(r.Body).Decode(&vol)
+		var resp volumeGetResponse
+		if err == nil {
+			ctx = driver.WithLogFields(ctx, "volume", vol.Name)
+			var info driver.VolumeInfo
+			if info, err = d.Get(ctx, vol.Name); err == nil {
+				resp.Volume = &info
+			}
+			driver.LogCtx(ctx, "\tdone: (%s): %v\n", vol.Name, err)
+		}
+		if err != nil {
+			resp.Err = err.Error()
+			resp.ErrCode = driver.ErrorCodeOf(err)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+type capabilitiesResponse struct {
+	Capabilities struct {
+		Scope string
+	}
+}
+
+// serveVolumeCapabilities tells Docker that volumes are local to this host:
+// an EBS volume can only be attached to one instance at a time.
+func serveVolumeCapabilities(w http.ResponseWriter, r *http.Request) {
+	var resp capabilitiesResponse
+	resp.Capabilities.Scope = "local"
+	json.NewEncoder(w).Encode(resp)
+}
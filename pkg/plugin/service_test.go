@@ -0,0 +1,221 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+)
+
+// fakeDriver is a VolumeDriver which keeps its volumes in memory, recording
+// the calls made of it.
+type fakeDriver struct {
+	mu      sync.Mutex
+	volumes map[string]string // mountpoints, by name
+	calls   []string
+}
+
+func newFakeDriver(names ...string) *fakeDriver {
+	f := &fakeDriver{volumes: map[string]string{}}
+	for _, name := range names {
+		f.volumes[name] = ""
+	}
+	return f
+}
+
+var errFakeNotFound = driver.WithCode(driver.CodeNotFound, errors.New("Name not found."))
+
+func (f *fakeDriver) record(call string, args ...string) {
+	f.calls = append(f.calls, strings.Join(append([]string{call}, args...), " "))
+}
+
+func (f *fakeDriver) Create(ctx context.Context, name string, opts map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k, v := range opts {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	f.record("Create", append([]string{name}, keys...)...)
+	f.volumes[name] = ""
+	return nil
+}
+
+func (f *fakeDriver) Mount(ctx context.Context, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("Mount", name, driver.Caller(ctx))
+	if _, ok := f.volumes[name]; !ok {
+		return "", errFakeNotFound
+	}
+	f.volumes[name] = "/mnt/blocker/" + name
+	return f.volumes[name], nil
+}
+
+func (f *fakeDriver) Path(ctx context.Context, name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mnt, ok := f.volumes[name]
+	if !ok {
+		return "", errFakeNotFound
+	}
+	return mnt, nil
+}
+
+func (f *fakeDriver) Remove(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("Remove", name)
+	if _, ok := f.volumes[name]; !ok {
+		return errFakeNotFound
+	}
+	delete(f.volumes, name)
+	return nil
+}
+
+func (f *fakeDriver) Unmount(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("Unmount", name, driver.Caller(ctx))
+	if _, ok := f.volumes[name]; !ok {
+		return errFakeNotFound
+	}
+	f.volumes[name] = ""
+	return nil
+}
+
+func (f *fakeDriver) List(ctx context.Context) ([]driver.VolumeInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var volumes []driver.VolumeInfo
+	for name, mnt := range f.volumes {
+		volumes = append(volumes, driver.VolumeInfo{Name: name, Mountpoint: mnt})
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+func (f *fakeDriver) Get(ctx context.Context, name string) (driver.VolumeInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mnt, ok := f.volumes[name]
+	if !ok {
+		return driver.VolumeInfo{}, errFakeNotFound
+	}
+	return driver.VolumeInfo{Name: name, Mountpoint: mnt}, nil
+}
+
+// post makes one of Docker's requests of the plugin's routes, decoding the
+// response into resp.
+func post(t *testing.T, h http.Handler, path string, body string, resp interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%v: status %v", path, w.Code)
+	}
+	if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+		t.Fatalf("%v: decoding %q: %v", path, w.Body.String(), err)
+	}
+}
+
+func TestVolumeRequests(t *testing.T) {
+	f := newFakeDriver()
+	routes := makeRoutes(f)
+
+	var simple volumeSimpleResponse
+	post(t, routes, "/VolumeDriver.Create", `{"Name": "data", "Opts": {"size": "10"}}`, &simple)
+	if simple.Err != "" {
+		t.Fatalf("Create: %v", simple.Err)
+	}
+
+	var mounted volumeComplexResponse
+	post(t, routes, "/VolumeDriver.Mount", `{"Name": "data", "ID": "c1"}`, &mounted)
+	if mounted.Err != "" || mounted.Mountpoint != "/mnt/blocker/data" {
+		t.Fatalf("Mount = %+v", mounted)
+	}
+
+	var list volumeListResponse
+	post(t, routes, "/VolumeDriver.List", `{}`, &list)
+	want := []driver.VolumeInfo{{Name: "data", Mountpoint: "/mnt/blocker/data"}}
+	if !reflect.DeepEqual(list.Volumes, want) {
+		t.Errorf("List = %+v, want %+v", list.Volumes, want)
+	}
+
+	var get volumeGetResponse
+	post(t, routes, "/VolumeDriver.Get", `{"Name": "data"}`, &get)
+	if get.Volume == nil || get.Volume.Mountpoint != "/mnt/blocker/data" {
+		t.Errorf("Get = %+v", get)
+	}
+
+	simple = volumeSimpleResponse{}
+	post(t, routes, "/VolumeDriver.Unmount", `{"Name": "data", "ID": "c1"}`, &simple)
+	if simple.Err != "" {
+		t.Fatalf("Unmount: %v", simple.Err)
+	}
+	post(t, routes, "/VolumeDriver.Remove", `{"Name": "data"}`, &simple)
+	if simple.Err != "" {
+		t.Fatalf("Remove: %v", simple.Err)
+	}
+
+	calls := []string{"Create data size=10", "Mount data c1", "Unmount data c1", "Remove data"}
+	if !reflect.DeepEqual(f.calls, calls) {
+		t.Errorf("calls = %q, want %q", f.calls, calls)
+	}
+}
+
+func TestVolumeErrorsCarryCodes(t *testing.T) {
+	routes := makeRoutes(newFakeDriver())
+
+	var mounted volumeComplexResponse
+	post(t, routes, "/VolumeDriver.Mount", `{"Name": "missing"}`, &mounted)
+	if mounted.ErrCode != driver.CodeNotFound || mounted.Err == "" {
+		t.Errorf("Mount = %+v, want a %v error", mounted, driver.CodeNotFound)
+	}
+
+	var get volumeGetResponse
+	post(t, routes, "/VolumeDriver.Get", `{"Name": "missing"}`, &get)
+	if get.Volume != nil || get.ErrCode != driver.CodeNotFound {
+		t.Errorf("Get = %+v, want a %v error", get, driver.CodeNotFound)
+	}
+}
+
+func TestDrainingRefusesNewWork(t *testing.T) {
+	f := newFakeDriver("data")
+	routes := makeRoutes(f)
+	driver.SetDraining(true)
+	t.Cleanup(func() { driver.SetDraining(false) })
+
+	var mounted volumeComplexResponse
+	post(t, routes, "/VolumeDriver.Mount", `{"Name": "data", "ID": "c1"}`, &mounted)
+	if mounted.ErrCode != driver.CodeDraining {
+		t.Errorf("Mount while draining = %+v, want a %v error", mounted, driver.CodeDraining)
+	}
+
+	// Unmounts are still served, so containers can stop.
+	var simple volumeSimpleResponse
+	post(t, routes, "/VolumeDriver.Unmount", `{"Name": "data", "ID": "c1"}`, &simple)
+	if simple.Err != "" {
+		t.Errorf("Unmount while draining: %v", simple.Err)
+	}
+	if want := []string{"Unmount data c1"}; !reflect.DeepEqual(f.calls, want) {
+		t.Errorf("calls = %q, want %q", f.calls, want)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	var resp capabilitiesResponse
+	post(t, makeRoutes(newFakeDriver()), "/VolumeDriver.Capabilities", ``, &resp)
+	if resp.Capabilities.Scope != "local" {
+		t.Errorf("Scope = %q, want local", resp.Capabilities.Scope)
+	}
+}
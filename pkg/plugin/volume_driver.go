@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"context"
+
+	"github.com/ewindisch/blocker/pkg/driver"
+)
+
+// Docker volume plugins enable Docker deployments to be integrated with
+// external storage systems, and enable data volumes to persist beyond the
+// lifetime of a single Docker host.  See the Docker plugin documentation for
+// more information: https://docs.docker.com/extend/plugins_volume/
+//
+// Each call carries the context of the Docker request that caused it.
+type VolumeDriver interface {
+	// Instructs the plugin about a new volume.  The plugin need not actually
+	// manifest the volume on the filesystem yet, until Mount is called.  The
+	// options are those passed via `docker volume create -o key=value`.
+	Create(ctx context.Context, name string, opts map[string]string) error
+
+	// Mounts a volume, returning its mountpoint on the host filesystem.
+	Mount(ctx context.Context, name string) (string, error)
+
+	// Fetches the host mountpoint location for an existing volume.
+	Path(ctx context.Context, name string) (string, error)
+
+	// Removes an existing volume.
+	Remove(ctx context.Context, name string) error
+
+	// Unmounts an existing volume.
+	Unmount(ctx context.Context, name string) error
+
+	// Lists the volumes the plugin knows of.
+	List(ctx context.Context) ([]driver.VolumeInfo, error)
+
+	// Describes one volume, including anything worth showing in its Status.
+	Get(ctx context.Context, name string) (driver.VolumeInfo, error)
+}
@@ -31,9 +31,12 @@ echo "Installing Blocker..."
 $sh_c 'mv blocker /usr/local/bin/blocker'
 $sh_c 'chmod +x /usr/local/bin/blocker'
 $sh_c 'mkdir -p /etc/blocker/.aws'
+$sh_c '[ -f /etc/blocker/blocker.yaml ] || mv blocker.yaml /etc/blocker/blocker.yaml'
 $sh_c 'mkdir -p /etc/docker/plugins'
 $sh_c 'echo "unix:///var/run/blocker.sock" > /etc/docker/plugins/blocker.spec'
 $sh_c 'mv blocker.service /etc/systemd/system/blocker.service'
+$sh_c 'mkdir -p /usr/lib/systemd/system-sleep'
+$sh_c 'mv blocker-sleep /usr/lib/systemd/system-sleep/blocker'
 
 echo "Starting the Blocker service..."
 $sh_c 'systemctl enable /etc/systemd/system/blocker.service'